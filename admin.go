@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// roaOutput is how a ROA is shown on the admin listener.
+type roaOutput struct {
+	Prefix  string `json:"prefix"`
+	MinMask uint8  `json:"minmask"`
+	MaxMask uint8  `json:"maxmask"`
+	ASN     uint32 `json:"asn"`
+	RIR     string `json:"rir"`
+	IsV4    bool   `json:"isv4"`
+}
+
+// clientOutput is how a client session is shown on the admin listener.
+// Version is only set once negotiated, and LastSerial once queried.
+type clientOutput struct {
+	Addr         string    `json:"addr"`
+	Version      *uint8    `json:"version,omitempty"`
+	LastSerial   *uint32   `json:"lastserial,omitempty"`
+	LastActivity time.Time `json:"lastactivity"`
+}
+
+// validation is the result of a /validate query.
+type validation struct {
+	Prefix   string      `json:"prefix"`
+	ASN      uint32      `json:"asn"`
+	State    string      `json:"state"`
+	Covering []roaOutput `json:"covering"`
+}
+
+// diffOutput is the result of a /diff query.
+type diffOutput struct {
+	From    uint32      `json:"from"`
+	To      uint32      `json:"to"`
+	Added   []roaOutput `json:"added"`
+	Deleted []roaOutput `json:"deleted"`
+}
+
+// toOutput converts a ROA to how it is shown on the admin listener.
+func toOutput(v roa) roaOutput {
+	return roaOutput{
+		Prefix:  v.Prefix.String(),
+		MinMask: v.Prefix.Bits(),
+		MaxMask: v.MaxMask,
+		ASN:     v.ASN,
+		RIR:     v.RIR.String(),
+		IsV4:    v.Prefix.IP().Is4(),
+	}
+}
+
+// serveAdmin starts the admin HTTP listener on addr.
+func (s *CacheServer) serveAdmin(addr string, profiling bool) {
+	mux := s.adminMux(profiling)
+
+	log.Printf("Admin listener on %s\n", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("Admin listener stopped: %v\n", err)
+	}
+}
+
+// adminMux has all the admin handlers. The pprof handlers are only added if
+// profiling is enabled.
+func (s *CacheServer) adminMux(profiling bool) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.metricsHandler)
+	mux.HandleFunc("/roas", s.roasHandler)
+	mux.HandleFunc("/healthz", s.healthHandler)
+	mux.HandleFunc("/validate", s.validateHandler)
+	mux.HandleFunc("/csv", s.csvHandler)
+	mux.HandleFunc("/clients", s.clientsHandler)
+	mux.HandleFunc("/diff", s.diffHandler)
+	mux.HandleFunc("/version", versionHandler)
+	mux.HandleFunc("/refresh", s.refreshHandler)
+
+	if profiling {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return mux
+}
+
+// versionHandler returns the version of the running build as json.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(getVersion()); err != nil {
+		log.Printf("Unable to write version to admin client: %v\n", err)
+	}
+}
+
+// clientsHandler returns the connected client sessions as json.
+func (s *CacheServer) clientsHandler(w http.ResponseWriter, r *http.Request) {
+	s.mutex.RLock()
+	out := make([]clientOutput, 0, len(s.clients))
+	for _, c := range s.clients {
+		o := clientOutput{
+			Addr:         c.addr,
+			LastActivity: c.lastActivity,
+		}
+		if c.negotiated {
+			version := c.version
+			o.Version = &version
+		}
+		if c.queried {
+			serial := c.lastSerial
+			o.LastSerial = &serial
+		}
+		out = append(out, o)
+	}
+	s.mutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		log.Printf("Unable to write clients to admin client: %v\n", err)
+	}
+}
+
+// healthHandler returns 200 if there are ROAs to serve and they were fetched
+// recently enough, otherwise 503.
+func (s *CacheServer) healthHandler(w http.ResponseWriter, r *http.Request) {
+	s.mutex.RLock()
+	count := len(s.roas)
+	last := s.updates.lastSuccess
+	s.mutex.RUnlock()
+
+	switch {
+	case count == 0:
+		http.Error(w, "no ROAs", http.StatusServiceUnavailable)
+	case time.Since(last) > s.staleAfter:
+		http.Error(w, fmt.Sprintf("last successful update at %s", last.Format("2006-01-02 15:04:05")), http.StatusServiceUnavailable)
+	default:
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// refreshHandler fetches the ROAs straight away on a POST, rather than at the
+// next scheduled time. The fetch happens in the background, so the response
+// doesn't wait for it.
+func (s *CacheServer) refreshHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "refresh needs a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.refresh() {
+		http.Error(w, "ROAs aren't being fetched", http.StatusServiceUnavailable)
+		return
+	}
+	log.Printf("Refreshing ROAs now, as asked by %s\n", r.RemoteAddr)
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, "refreshing")
+}
+
+// validateHandler returns the validation state of ?prefix= originated by ?asn=
+func (s *CacheServer) validateHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	prefix, err := netaddr.ParseIPPrefix(q.Get("prefix"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	asn, err := asnToUint32(q.Get("asn"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	state, covering := s.Validate(prefix, asn)
+	out := validation{
+		Prefix:   prefix.Masked().String(),
+		ASN:      asn,
+		State:    state.String(),
+		Covering: make([]roaOutput, 0, len(covering)),
+	}
+	for _, v := range covering {
+		out.Covering = append(out.Covering, toOutput(v))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		log.Printf("Unable to write validation to admin client: %v\n", err)
+	}
+}
+
+// diffHandler returns the ROAs added and deleted between two retained serials.
+func (s *CacheServer) diffHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	from, err := strconv.ParseUint(q.Get("from"), 10, 32)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid from serial: %v", err), http.StatusBadRequest)
+		return
+	}
+	to, err := strconv.ParseUint(q.Get("to"), 10, 32)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid to serial: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	s.mutex.RLock()
+	diff, ok := diffBetween(s.history, uint32(from), uint32(to))
+	s.mutex.RUnlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("serials %d to %d are not retained", from, to), http.StatusNotFound)
+		return
+	}
+
+	out := diffOutput{
+		From:    uint32(from),
+		To:      uint32(to),
+		Added:   make([]roaOutput, 0, len(diff.addRoa)),
+		Deleted: make([]roaOutput, 0, len(diff.delRoa)),
+	}
+	for _, v := range diff.addRoa {
+		out.Added = append(out.Added, toOutput(v))
+	}
+	for _, v := range diff.delRoa {
+		out.Deleted = append(out.Deleted, toOutput(v))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		log.Printf("Unable to write diff to admin client: %v\n", err)
+	}
+}
+
+// csvHandler writes the current ROAs in the same CSV format as Routinator.
+func (s *CacheServer) csvHandler(w http.ResponseWriter, r *http.Request) {
+	// ROAs are replaced on update, never changed, so there's no need to hold
+	// the lock while writing.
+	s.mutex.RLock()
+	roas := s.roas
+	s.mutex.RUnlock()
+
+	w.Header().Set("Content-Type", "text/csv")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"ASN", "IP Prefix", "Max Length", "Trust Anchor"})
+	for _, v := range roas {
+		cw.Write([]string{
+			fmt.Sprintf("AS%d", v.ASN),
+			v.Prefix.String(),
+			strconv.Itoa(int(v.MaxMask)),
+			v.RIR.String(),
+		})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		log.Printf("Unable to write CSV to admin client: %v\n", err)
+	}
+}
+
+// roasHandler dumps the current ROAs as json.
+// Can be filtered with ?asn= and ?rir=
+func (s *CacheServer) roasHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var asn uint32
+	if q.Has("asn") {
+		n, err := asnToUint32(q.Get("asn"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		asn = n
+	}
+	ta := q.Get("rir")
+
+	s.mutex.RLock()
+	out := make([]roaOutput, 0, len(s.roas))
+	for _, v := range s.roas {
+		if q.Has("asn") && v.ASN != asn {
+			continue
+		}
+		if ta != "" && v.RIR.String() != ta {
+			continue
+		}
+		out = append(out, toOutput(v))
+	}
+	s.mutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		log.Printf("Unable to write ROAs to admin client: %v\n", err)
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func TestRoasHandler(t *testing.T) {
+	s := &CacheServer{
+		mutex: &sync.RWMutex{},
+		roas: []roa{
+			{
+				Prefix:  netaddr.MustParseIPPrefix("1.0.0.0/24"),
+				MaxMask: 24,
+				ASN:     13335,
+				RIR:     apnic,
+			},
+			{
+				Prefix:  netaddr.MustParseIPPrefix("2001:678:cdc::/48"),
+				MaxMask: 128,
+				ASN:     210660,
+				RIR:     ripe,
+			},
+		},
+	}
+	cloudflare := roaOutput{
+		Prefix:  "1.0.0.0/24",
+		MinMask: 24,
+		MaxMask: 24,
+		ASN:     13335,
+		RIR:     "apnic",
+		IsV4:    true,
+	}
+	ripeROA := roaOutput{
+		Prefix:  "2001:678:cdc::/48",
+		MinMask: 48,
+		MaxMask: 128,
+		ASN:     210660,
+		RIR:     "ripe",
+	}
+
+	tests := []struct {
+		desc   string
+		query  string
+		status int
+		want   []roaOutput
+	}{
+		{
+			desc:   "no filter",
+			query:  "/roas",
+			status: http.StatusOK,
+			want:   []roaOutput{cloudflare, ripeROA},
+		},
+		{
+			desc:   "asn filter",
+			query:  "/roas?asn=13335",
+			status: http.StatusOK,
+			want:   []roaOutput{cloudflare},
+		},
+		{
+			desc:   "asn filter with AS",
+			query:  "/roas?asn=AS210660",
+			status: http.StatusOK,
+			want:   []roaOutput{ripeROA},
+		},
+		{
+			desc:   "rir filter",
+			query:  "/roas?rir=ripe",
+			status: http.StatusOK,
+			want:   []roaOutput{ripeROA},
+		},
+		{
+			desc:   "no matches",
+			query:  "/roas?asn=1&rir=ripe",
+			status: http.StatusOK,
+			want:   []roaOutput{},
+		},
+		{
+			desc:   "invalid asn",
+			query:  "/roas?asn=word",
+			status: http.StatusBadRequest,
+		},
+	}
+	for _, v := range tests {
+		rec := httptest.NewRecorder()
+		s.roasHandler(rec, httptest.NewRequest("GET", v.query, nil))
+		if rec.Code != v.status {
+			t.Errorf("Error on %s. Got status %d, Want %d\n", v.desc, rec.Code, v.status)
+			continue
+		}
+		if v.status != http.StatusOK {
+			continue
+		}
+		var got []roaOutput
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Errorf("Error on %s. Unable to unmarshal: %v", v.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, v.want) {
+			t.Errorf("Error on %s. Got %+v, Want %+v\n", v.desc, got, v.want)
+		}
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	roas := []roa{{Prefix: netaddr.MustParseIPPrefix("1.0.0.0/24"), MaxMask: 24, ASN: 13335}}
+	tests := []struct {
+		desc   string
+		roas   []roa
+		last   time.Time
+		status int
+	}{
+		{
+			desc:   "healthy",
+			roas:   roas,
+			last:   time.Now().Add(-time.Minute),
+			status: http.StatusOK,
+		},
+		{
+			desc:   "no ROAs",
+			last:   time.Now(),
+			status: http.StatusServiceUnavailable,
+		},
+		{
+			desc:   "stale",
+			roas:   roas,
+			last:   time.Now().Add(-2 * time.Hour),
+			status: http.StatusServiceUnavailable,
+		},
+	}
+	for _, v := range tests {
+		s := &CacheServer{
+			mutex:      &sync.RWMutex{},
+			roas:       v.roas,
+			updates:    checkErrorUpdate{lastSuccess: v.last},
+			staleAfter: time.Hour,
+		}
+		rec := httptest.NewRecorder()
+		s.healthHandler(rec, httptest.NewRequest("GET", "/healthz", nil))
+		if rec.Code != v.status {
+			t.Errorf("Error on %s. Got status %d, Want %d\n", v.desc, rec.Code, v.status)
+		}
+	}
+}
+
+func TestValidateHandler(t *testing.T) {
+	roas := []roa{{Prefix: netaddr.MustParseIPPrefix("1.0.0.0/24"), MaxMask: 24, ASN: 13335, RIR: apnic}}
+	s := &CacheServer{
+		mutex: &sync.RWMutex{},
+		roas:  roas,
+		index: newROAIndex(roas),
+	}
+
+	tests := []struct {
+		desc   string
+		query  string
+		status int
+		state  string
+	}{
+		{
+			desc:   "valid",
+			query:  "/validate?prefix=1.0.0.0/24&asn=13335",
+			status: http.StatusOK,
+			state:  "valid",
+		},
+		{
+			desc:   "invalid",
+			query:  "/validate?prefix=1.0.0.0/24&asn=AS64496",
+			status: http.StatusOK,
+			state:  "invalid",
+		},
+		{
+			desc:   "not found",
+			query:  "/validate?prefix=2001:db8::/32&asn=13335",
+			status: http.StatusOK,
+			state:  "notfound",
+		},
+		{
+			desc:   "bad prefix",
+			query:  "/validate?prefix=1.0.0.0&asn=13335",
+			status: http.StatusBadRequest,
+		},
+		{
+			desc:   "bad asn",
+			query:  "/validate?prefix=1.0.0.0/24&asn=cloudflare",
+			status: http.StatusBadRequest,
+		},
+	}
+	for _, v := range tests {
+		rec := httptest.NewRecorder()
+		s.validateHandler(rec, httptest.NewRequest("GET", v.query, nil))
+		if rec.Code != v.status {
+			t.Errorf("Error on %s. Got status %d, Want %d\n", v.desc, rec.Code, v.status)
+			continue
+		}
+		if v.status != http.StatusOK {
+			continue
+		}
+		var got validation
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Errorf("Error on %s. Unable to unmarshal: %v", v.desc, err)
+			continue
+		}
+		if got.State != v.state {
+			t.Errorf("Error on %s. Got state %s, Want %s\n", v.desc, got.State, v.state)
+		}
+	}
+}
+
+func TestCSVHandler(t *testing.T) {
+	s := &CacheServer{
+		mutex: &sync.RWMutex{},
+		roas: []roa{
+			{Prefix: netaddr.MustParseIPPrefix("1.0.0.0/24"), MaxMask: 24, ASN: 13335, RIR: apnic},
+			{Prefix: netaddr.MustParseIPPrefix("2001:678:cdc::/48"), MaxMask: 128, ASN: 210660, RIR: ripe},
+		},
+	}
+	rec := httptest.NewRecorder()
+	s.csvHandler(rec, httptest.NewRequest("GET", "/csv", nil))
+
+	want := "ASN,IP Prefix,Max Length,Trust Anchor\n" +
+		"AS13335,1.0.0.0/24,24,apnic\n" +
+		"AS210660,2001:678:cdc::/48,128,ripe\n"
+	if got := rec.Body.String(); got != want {
+		t.Errorf("Got %q, Want %q", got, want)
+	}
+}
+
+func TestClientsHandler(t *testing.T) {
+	seen := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	s := &CacheServer{
+		mutex: &sync.RWMutex{},
+		clients: []*client{
+			{addr: "192.0.2.1:12345"},
+			{addr: "192.0.2.2:12345", version: version1, negotiated: true, lastActivity: seen},
+			{addr: "192.0.2.3:12345", version: version2, negotiated: true, lastActivity: seen, lastSerial: 7, queried: true},
+		},
+	}
+	rec := httptest.NewRecorder()
+	s.clientsHandler(rec, httptest.NewRequest("GET", "/clients", nil))
+
+	var got []map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Unable to unmarshal %q: %v", rec.Body.String(), err)
+	}
+	want := []map[string]any{
+		{"addr": "192.0.2.1:12345", "lastactivity": "0001-01-01T00:00:00Z"},
+		{"addr": "192.0.2.2:12345", "version": float64(1), "lastactivity": "2026-10-14T12:00:00Z"},
+		{"addr": "192.0.2.3:12345", "version": float64(2), "lastserial": float64(7), "lastactivity": "2026-10-14T12:00:00Z"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, Want %v", got, want)
+	}
+}
+
+func TestVersionHandler(t *testing.T) {
+	defer func(version, commit string) { buildVersion, buildCommit = version, commit }(buildVersion, buildCommit)
+	buildVersion, buildCommit = "v1.2.3", "abc123"
+
+	rec := httptest.NewRecorder()
+	versionHandler(rec, httptest.NewRequest("GET", "/version", nil))
+
+	var got versionInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Unable to unmarshal %q: %v", rec.Body.String(), err)
+	}
+	want := versionInfo{Version: "v1.2.3", Commit: "abc123", GoVersion: runtime.Version()}
+	if got != want {
+		t.Errorf("Got %+v, Want %+v", got, want)
+	}
+}
+
+func TestRefreshHandler(t *testing.T) {
+	s := &CacheServer{refreshNow: make(chan struct{}, 1)}
+	tests := []struct {
+		desc   string
+		s      *CacheServer
+		method string
+		want   int
+	}{
+		{
+			desc:   "get",
+			s:      s,
+			method: "GET",
+			want:   http.StatusMethodNotAllowed,
+		},
+		{
+			desc:   "post",
+			s:      s,
+			method: "POST",
+			want:   http.StatusAccepted,
+		},
+		{
+			desc:   "post with a refresh waiting",
+			s:      s,
+			method: "POST",
+			want:   http.StatusAccepted,
+		},
+		{
+			desc:   "no updates",
+			s:      &CacheServer{},
+			method: "POST",
+			want:   http.StatusServiceUnavailable,
+		},
+	}
+	for _, v := range tests {
+		rec := httptest.NewRecorder()
+		v.s.refreshHandler(rec, httptest.NewRequest(v.method, "/refresh", nil))
+		if rec.Code != v.want {
+			t.Errorf("Error on %s. Got status %d, Want %d", v.desc, rec.Code, v.want)
+		}
+	}
+	if len(s.refreshNow) != 1 {
+		t.Errorf("Got %d refreshes waiting, Want 1", len(s.refreshNow))
+	}
+}
+
+func TestDiffHandler(t *testing.T) {
+	a := roa{Prefix: netaddr.MustParseIPPrefix("192.0.2.0/24"), MaxMask: 24, ASN: 64496, RIR: ripe}
+	s := &CacheServer{
+		mutex: &sync.RWMutex{},
+		history: []serialDiff{
+			{oldSerial: 1, newSerial: 2, addRoa: []roa{a}, diff: true},
+		},
+	}
+	tests := []struct {
+		desc   string
+		query  string
+		status int
+		want   diffOutput
+	}{
+		{
+			desc:   "retained",
+			query:  "from=1&to=2",
+			status: http.StatusOK,
+			want: diffOutput{
+				From:    1,
+				To:      2,
+				Added:   []roaOutput{toOutput(a)},
+				Deleted: []roaOutput{},
+			},
+		},
+		{
+			desc:   "not retained",
+			query:  "from=0&to=2",
+			status: http.StatusNotFound,
+		},
+		{
+			desc:   "bad serial",
+			query:  "from=one&to=2",
+			status: http.StatusBadRequest,
+		},
+	}
+	for _, v := range tests {
+		rec := httptest.NewRecorder()
+		s.diffHandler(rec, httptest.NewRequest("GET", "/diff?"+v.query, nil))
+		if rec.Code != v.status {
+			t.Errorf("Error on %s. Got status %d, Want %d\n", v.desc, rec.Code, v.status)
+			continue
+		}
+		if v.status != http.StatusOK {
+			continue
+		}
+		var got diffOutput
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Errorf("Error on %s. Unable to unmarshal: %v", v.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, v.want) {
+			t.Errorf("Error on %s. Got %+v, Want %+v\n", v.desc, got, v.want)
+		}
+	}
+}
+
+func TestAdminMuxProfiling(t *testing.T) {
+	s := &CacheServer{mutex: &sync.RWMutex{}}
+	for _, v := range []struct {
+		profiling bool
+		status    int
+	}{
+		{profiling: false, status: http.StatusNotFound},
+		{profiling: true, status: http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		s.adminMux(v.profiling).ServeHTTP(rec, httptest.NewRequest("GET", "/debug/pprof/", nil))
+		if rec.Code != v.status {
+			t.Errorf("Error with profiling %t. Got status %d, Want %d\n", v.profiling, rec.Code, v.status)
+		}
+	}
+}
@@ -1,181 +1,581 @@
 package main
 
 import (
-	"log"
-	"math/rand"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"inet.af/netaddr"
 )
 
 // Each client has their own stuff
 type client struct {
-	conn   net.Conn
-	addr   string
-	roas   *[]roa
-	serial *uint32
-	mutex  *sync.RWMutex
-	diff   *serialDiff
+	// bytesSent is updated atomically, so is first to be 64-bit aligned.
+	bytesSent uint64
+	// fullSyncs has how long each full table took to send.
+	fullSyncs *histogram
+	// responses counts the responses sent, by type.
+	responses *responseCounts
+
+	conn net.Conn
+	// writing is held for the whole of anything written to conn, so a notify
+	// from another goroutine can't land in the middle of a response.
+	writing sync.Mutex
+	addr    string
+	session uint16
+	roas    *[]roa
+	keys    *[]bgpsecKey
+	aspas   *[]aspa
+	serial  *uint32
+	mutex   *sync.RWMutex
+	history *[]serialDiff
+	timers  *intervals
+	// overrides are checked against ip for the intervals to advertise. Unix
+	// socket clients have no ip, so always get timers.
+	overrides *[]timerOverride
+	ip        netaddr.IP
+	// timeout is how long to wait for a PDU before the session is dropped.
+	// Zero waits forever, and expireTimeout waits for the expire interval.
+	timeout time.Duration
+	// ends is when the session is closed for the router to reconnect. Zero
+	// never closes it.
+	ends time.Time
+
+	// version is negotiated from the first PDU the client sends.
+	version    uint8
+	negotiated bool
+
+	// lastActivity is when the last PDU was received. lastSerial is from the
+	// last Serial Query, if queried is set.
+	lastActivity time.Time
+	lastSerial   uint32
+	queried      bool
+
+	// sentSerial is the serial of the last response, set once it starts
+	// being sent. Clients which have it don't need a notify for it.
+	sentSerial uint32
+	sent       bool
+}
+
+// status describes the session for the status log. Needs the mutex held.
+func (c *client) status() string {
+	if !c.negotiated {
+		return fmt.Sprintf("%s, no PDU yet", c.addr)
+	}
+	serial := "none"
+	if c.queried {
+		serial = strconv.FormatUint(uint64(c.lastSerial), 10)
+	}
+	return fmt.Sprintf("%s, version %d, last serial %s, last PDU at %s",
+		c.addr, c.version, serial, c.lastActivity.Format("2006-01-02 15:04:05"))
 }
 
-// reset has no data besides the header
-func (c *client) sendReset() {
-	r := cacheResetPDU{}
-	r.serialize(c.conn)
+// sendReset sends a Cache Reset, so the router sends a Reset Query for the
+// full table, as per RFC8210 section 5.9. The reason is only used for logging.
+// A reset has no data besides the header.
+func (c *client) sendReset(reason string) {
+	c.writing.Lock()
+	defer c.writing.Unlock()
+	logWith(levelInfo, logFields{"client": c.addr, "reason": reason}, "sending a cache reset to %s: %s", c.addr, reason)
+	r := cacheResetPDU{
+		version: c.version,
+	}
+	w := c.batchWriter()
+	r.serialize(w)
+	if err := w.Flush(); err != nil {
+		logWith(levelWarn, logFields{"client": c.addr, "error": err.Error()}, "Unable to send a cache reset to %s: %v", c.addr, err)
+		c.conn.Close()
+	}
 }
 
 // updateClient will check to see if there are diffs to send.
 // If so it'll send them, otherwise it'll just send an end of data PDU updating
 // the serial.
-func (c *client) updateClient(session uint16, serial uint32, sendDiff bool) {
+func (c *client) updateClient(session uint16, serial uint32, diff serialDiff) {
+	c.writing.Lock()
+	defer c.writing.Unlock()
+	c.mutex.Lock()
+	c.sentSerial, c.sent = serial, true
+	c.mutex.Unlock()
+
+	w := c.batchWriter()
 	cpdu := cacheResponsePDU{
+		version:   c.version,
 		sessionID: session,
 	}
-	cpdu.serialize(c.conn)
+	cpdu.serialize(w)
 
 	// diff will only be sent if there is an actual update to send
-	if sendDiff && c.diff.diff {
-		c.mutex.RLock()
-		for _, roa := range c.diff.addRoa {
-			writePrefixPDU(&roa, c.conn, announce)
+	if diff.diff {
+		for _, roa := range diff.addRoa {
+			writePrefixPDU(&roa, w, announce, c.version)
 		}
-		for _, roa := range c.diff.delRoa {
-			writePrefixPDU(&roa, c.conn, withdraw)
+		for _, roa := range diff.delRoa {
+			writePrefixPDU(&roa, w, withdraw, c.version)
+		}
+		if c.version >= version1 {
+			for _, key := range diff.addKey {
+				writeRouterKeyPDU(&key, w, announce, c.version)
+			}
+			for _, key := range diff.delKey {
+				writeRouterKeyPDU(&key, w, withdraw, c.version)
+			}
+		}
+		if c.version >= version2 {
+			for _, a := range diff.addASPA {
+				writeASPAPDU(&a, w, announce, c.version)
+			}
+			for _, a := range diff.withdrawnASPAs() {
+				writeASPAPDU(&a, w, withdraw, c.version)
+			}
 		}
-		c.mutex.RUnlock()
-		log.Println("Finished sending all diffs")
 	}
 
-	epdu := getEndOfDataPDU(session, *c.serial)
-	epdu.serialize(c.conn)
+	epdu := c.getEndOfDataPDU(session, serial)
+	epdu.serialize(w)
+	if err := w.Flush(); err != nil {
+		logWith(levelWarn, logFields{"client": c.addr, "error": err.Error()}, "Unable to send an incremental update to %s: %v", c.addr, err)
+		c.conn.Close()
+		return
+	}
+	logWith(levelInfo, logFields{"client": c.addr, "serial": serial, "announced": len(diff.addRoa), "withdrawn": len(diff.delRoa)},
+		"sent an incremental update of %d announced and %d withdrawn ROAs to %s, serial %d", len(diff.addRoa), len(diff.delRoa), c.addr, serial)
+}
+
+// expireTimeout as a read timeout waits as long as the expire interval sent to
+// the client, after which it has to have queried again.
+const expireTimeout time.Duration = -1
+
+// writeTimeout is how long a router has to read each batch of a response.
+var writeTimeout = 30 * time.Second
+
+// batchWriter buffers a response, writing it to the router writeBatch bytes
+// at a time. Each write has writeTimeout to finish, so a router which stops
+// reading can't hold up a send for ever. Once a write fails, the rest of the
+// response is dropped, and Flush returns the error. The session is then
+// closed, as the router has only part of a response. Batches end mid PDU, so
+// writing needs to be held until the response is flushed.
+func (c *client) batchWriter() *bufio.Writer {
+	return bufio.NewWriterSize(deadlineWriter{conn: c.conn, sent: &c.bytesSent}, writeBatch)
+}
+
+// deadlineWriter sets a write deadline for each write, clearing it after.
+// The bytes written are added to sent.
+type deadlineWriter struct {
+	conn net.Conn
+	sent *uint64
+}
+
+func (w deadlineWriter) Write(p []byte) (int, error) {
+	w.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	defer w.conn.SetWriteDeadline(time.Time{})
+	n, err := w.conn.Write(p)
+	atomic.AddUint64(w.sent, uint64(n))
+	return n, err
 }
 
 // writePrefixPDU will directly write the update or withdraw prefix PDU.
-func writePrefixPDU(r *roa, c net.Conn, flag uint8) {
+func writePrefixPDU(r *roa, c io.Writer, flag, version uint8) {
 	switch r.Prefix.IP().Is4() {
 	case true:
 		ppdu := ipv4PrefixPDU{
-			flags:  flag,
-			min:    r.Prefix.Bits(),
-			max:    r.MaxMask,
-			prefix: r.Prefix.IP().As4(),
-			asn:    r.ASN,
+			version: version,
+			flags:   flag,
+			min:     r.Prefix.Bits(),
+			max:     r.MaxMask,
+			prefix:  r.Prefix.IP().As4(),
+			asn:     r.ASN,
 		}
 		ppdu.serialize(c)
 	case false:
 		ppdu := ipv6PrefixPDU{
-			flags:  flag,
-			min:    r.Prefix.Bits(),
-			max:    r.MaxMask,
-			prefix: r.Prefix.IP().As16(),
-			asn:    r.ASN,
+			version: version,
+			flags:   flag,
+			min:     r.Prefix.Bits(),
+			max:     r.MaxMask,
+			prefix:  r.Prefix.IP().As16(),
+			asn:     r.ASN,
 		}
 		ppdu.serialize(c)
 	}
 }
 
-func getEndOfDataPDU(session uint16, serial uint32) endOfDataPDU {
+// writeRouterKeyPDU will directly write the announce or withdraw router key PDU.
+// Router keys only exist from version 1, so this is only called for version 1
+// and later clients, and the PDU has their version.
+func writeRouterKeyPDU(k *bgpsecKey, c io.Writer, flag, version uint8) {
+	rpdu := routerKeyPDU{
+		version: version,
+		flags:   flag,
+		ski:     k.SKI,
+		asn:     k.ASN,
+		spki:    []byte(k.PubKey),
+	}
+	rpdu.serialize(c)
+}
+
+// writeASPAPDU will directly write the announce or withdraw ASPA PDU.
+// Only version 2 has ASPA PDUs.
+func writeASPAPDU(a *aspa, c io.Writer, flag, version uint8) {
+	apdu := aspaPDU{
+		version:  version,
+		flags:    flag,
+		customer: a.Customer,
+	}
+	if flag == announce {
+		apdu.providers = a.Providers
+	}
+	apdu.serialize(c)
+}
+
+// intervals returns the configured intervals, or those overridden for the
+// client's prefix. They can be changed by a reload, so are read under the lock.
+func (c *client) intervals() intervals {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	timers := *c.timers
+	if c.overrides != nil {
+		timers = timersFor(c.ip, timers, *c.overrides)
+	}
+	return timers
+}
+
+// getEndOfDataPDU returns an End of Data PDU with the client's intervals.
+// Version 0 clients don't get the intervals.
+func (c *client) getEndOfDataPDU(session uint16, serial uint32) endOfDataPDU {
+	timers := c.intervals()
 	return endOfDataPDU{
+		version: c.version,
 		session: session,
 		serial:  serial,
-		refresh: DefaultRefreshInterval,
-		retry:   DefaultRetryInterval,
-		expire:  DefaultExpireInterval,
+		refresh: timers.refresh,
+		retry:   timers.retry,
+		expire:  timers.expire,
 	}
 }
 
 // Notify client that an update has taken place
-func (c *client) notify(serial uint32, session uint16) {
+// Clients which haven't sent a query yet have no version, so are not notified.
+// The write has writeTimeout to finish, so a router which stopped reading
+// can't hold up the notify for ever. Needs writing held.
+func (c *client) notify(serial uint32, session uint16) error {
+	c.mutex.RLock()
+	version, negotiated := c.version, c.negotiated
+	c.mutex.RUnlock()
+	if !negotiated {
+		return nil
+	}
+
 	npdu := serialNotifyPDU{
+		version: version,
 		Session: session,
 		Serial:  serial,
 	}
-	npdu.serialize(c.conn)
+	w := c.batchWriter()
+	npdu.serialize(w)
+	return w.Flush()
 }
 
-func (c *client) sendRoa() {
-	session := rand.Intn(100)
+// notifyOrClose sends a notify, closing the session if it can't be sent. The
+// session then ends, and the client is removed. Unless wait is set, a client
+// being sent a response isn't notified, rather than holding up the notifies to
+// everyone else. It's notified after the response if the serial has moved on.
+func (c *client) notifyOrClose(serial uint32, session uint16, wait bool) {
+	if wait {
+		c.writing.Lock()
+	} else if !c.writing.TryLock() {
+		logWith(levelDebug, logFields{"client": c.addr, "serial": serial}, "not notifying %s, which is being sent a response", c.addr)
+		return
+	}
+	defer c.writing.Unlock()
+	if err := c.notify(serial, session); err != nil {
+		logWith(levelWarn, logFields{"client": c.addr, "error": err.Error()}, "Unable to send a notify to %s, closing the session: %v", c.addr, err)
+		c.conn.Close()
+	}
+}
+
+// sendRoa sends the full set of ROAs, returning the serial which was sent.
+// The ROAs, keys, and ASPAs are replaced on update, never changed, so the
+// lock is only held to get them, not while a slow router reads them.
+func (c *client) sendRoa() uint32 {
+	c.mutex.Lock()
+	serial := *c.serial
+	c.sentSerial, c.sent = serial, true
+	roas := *c.roas
+	var keys []bgpsecKey
+	if c.keys != nil {
+		keys = *c.keys
+	}
+	var aspas []aspa
+	if c.aspas != nil {
+		aspas = *c.aspas
+	}
+	c.mutex.Unlock()
+
+	c.writing.Lock()
+	defer c.writing.Unlock()
+	start := time.Now()
+	w := c.batchWriter()
 	cpdu := cacheResponsePDU{
-		sessionID: uint16(session),
+		version:   c.version,
+		sessionID: c.session,
+	}
+	cpdu.serialize(w)
+	for _, roa := range roas {
+		writePrefixPDU(&roa, w, announce, c.version)
+	}
+	if c.version >= version1 {
+		for _, key := range keys {
+			writeRouterKeyPDU(&key, w, announce, c.version)
+		}
+	}
+	if c.version >= version2 {
+		for _, a := range aspas {
+			writeASPAPDU(&a, w, announce, c.version)
+		}
+	}
+	epdu := c.getEndOfDataPDU(c.session, serial)
+	epdu.serialize(w)
+	if err := w.Flush(); err != nil {
+		logWith(levelWarn, logFields{"client": c.addr, "error": err.Error()}, "Unable to send the full table to %s: %v", c.addr, err)
+		c.conn.Close()
+		return serial
 	}
-	cpdu.serialize(c.conn)
+	c.fullSyncs.observe(time.Since(start).Seconds())
+	logWith(levelInfo, logFields{"client": c.addr, "serial": serial, "roas": len(roas)}, "sent the full table of %d ROAs to %s, serial %d", len(roas), c.addr, serial)
+	return serial
+}
 
+// notifyIfChanged sends a Serial Notify if the serial has moved on since the
+// client was sent serial. An update during the response, or before the client
+// negotiated a version, would otherwise leave it waiting for its own timer.
+func (c *client) notifyIfChanged(sent uint32) {
 	c.mutex.RLock()
-	for _, roa := range *c.roas {
-		writePrefixPDU(&roa, c.conn, announce)
-	}
+	serial := *c.serial
 	c.mutex.RUnlock()
-	log.Println("Finished sending all prefixes")
-	// TODO: Why am I sending default timers here? Should I save this per client?
-	epdu := endOfDataPDU{
-		session: uint16(session),
-		serial:  *c.serial,
-		refresh: DefaultRefreshInterval,
-		retry:   DefaultRetryInterval,
-		expire:  DefaultExpireInterval,
+	if serial != sent {
+		logWith(levelDebug, logFields{"client": c.addr, "serial": serial}, "serial is now %d, but %s was sent %d", serial, c.addr, sent)
+		c.notifyOrClose(serial, c.session, true)
 	}
-	epdu.serialize(c.conn)
 }
 
-// TODO: Test this somehow
-func (c *client) error(code int, report string) {
+// error sends an error report, including the PDU which caused it.
+// Before a version is negotiated, this is sent as the highest version we support.
+func (c *client) error(code uint16, pdu []byte, report string) {
+	c.writing.Lock()
+	defer c.writing.Unlock()
+	version := c.version
+	if !c.negotiated {
+		version = version2
+	}
 	epdu := errorReportPDU{
-		code:   uint16(code),
-		report: report,
+		version: version,
+		code:    code,
+		pdu:     pdu,
+		report:  report,
+	}
+	// A router which never reads mustn't hold the write lock forever.
+	epdu.serialize(deadlineWriter{conn: c.conn, sent: &c.bytesSent})
+}
+
+// reportError sends an error report if the error needs to be reported to the client.
+func (c *client) reportError(err error, pdu []byte) {
+	var perr *pduError
+	if errors.As(err, &perr) {
+		c.error(perr.code, pdu, perr.report)
+	}
+}
+
+// diffForQuery returns the diff to answer a Serial Query with. The current or
+// any retained serial can be brought up to date. Otherwise resetRequired is set,
+// along with why: the query is from another session, or the serial is ahead of
+// ours, or no longer in the history, or the changes since are too many.
+func diffForQuery(history []serialDiff, session uint16, serial uint32, sq serialQueryPDU) (serialDiff, string) {
+	switch {
+	case sq.Session != session:
+		return serialDiff{resetRequired: true}, fmt.Sprintf("serial query for session %d, but current session is %d", sq.Session, session)
+	case sq.Serial == serial:
+		return serialDiff{oldSerial: serial, newSerial: serial}, ""
+	case serialLess(serial, sq.Serial):
+		// Likely from before a restart which lost state, so we can't know what they have.
+		return serialDiff{resetRequired: true}, fmt.Sprintf("serial %d is ahead of current serial %d", sq.Serial, serial)
+	}
+	diff, ok := diffSince(history, sq.Serial)
+	if !ok {
+		return serialDiff{resetRequired: true}, fmt.Sprintf("serial %d is no longer in the history, current serial is %d", sq.Serial, serial)
 	}
-	epdu.serialize(c.conn)
+	if diff.resetRequired {
+		return serialDiff{resetRequired: true}, fmt.Sprintf("changes since serial %d are over maxdiffbeforereset", sq.Serial)
+	}
+	return diff, ""
+}
+
+// closedByRouter checks if a read failed because the router closed or reset the
+// connection, which is the usual end of a session rather than an error.
+func closedByRouter(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// readDeadline is when the next PDU has to arrive by, which is the read timeout
+// or the end of the session, whichever is sooner. Zero has no deadline.
+func (c *client) readDeadline(now time.Time) time.Time {
+	timeout := c.timeout
+	if timeout == expireTimeout {
+		timeout = time.Duration(c.intervals().expire) * time.Second
+	}
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = now.Add(timeout)
+	}
+	if !c.ends.IsZero() && (deadline.IsZero() || c.ends.Before(deadline)) {
+		deadline = c.ends
+	}
+	return deadline
+}
+
+// sessionOver checks if a read timed out because the session has lasted
+// maxsessionduration, rather than the router going quiet.
+func (c *client) sessionOver(err error) bool {
+	var nerr net.Error
+	return !c.ends.IsZero() && !time.Now().Before(c.ends) && errors.As(err, &nerr) && nerr.Timeout()
+}
+
+// disconnectReason describes why reading from a client failed.
+func disconnectReason(err error) string {
+	var nerr net.Error
+	var perr *pduError
+	switch {
+	case errors.Is(err, io.EOF):
+		return "closed by router"
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return "closed by router mid PDU"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "reset by router"
+	case errors.Is(err, net.ErrClosed):
+		return "connection closed"
+	case errors.As(err, &nerr) && nerr.Timeout():
+		return "read timeout"
+	case errors.As(err, &perr):
+		return "invalid PDU: " + perr.report
+	}
+	return fmt.Sprintf("read error: %v", err)
 }
 
 // Handle each client.
 func (s *CacheServer) handleClient(c *client) {
-	log.Printf("Serving %s\n", c.conn.RemoteAddr().String())
+	logWith(levelInfo, logFields{"client": c.addr}, "Serving %s", c.conn.RemoteAddr().String())
 
-	// Remove client when exiting
-	defer s.remove(c)
+	// Remove client when exiting, with whatever ended the session.
+	var reason string
+	defer s.sessions.Done()
+	defer func() { s.remove(c, reason) }()
 	defer c.conn.Close()
 
 	for {
+		// A router which silently went away would otherwise stay a client forever.
+		if deadline := c.readDeadline(time.Now()); !deadline.IsZero() {
+			c.conn.SetReadDeadline(deadline)
+		}
+
 		// What is the incoming PDU?
+		// Any error in the PDU itself is reported and ends the session.
 		pdu, err := getPDU(c.conn)
 		if err != nil {
-			log.Printf("error received when getting the pdu: %v", err)
+			// Responses are sent before reading on, so none is cut short.
+			if c.sessionOver(err) {
+				reason = "reached maxsessionduration"
+				logWith(levelInfo, logFields{"client": c.addr}, "closing the session with %s so it reconnects: %s", c.addr, reason)
+				return
+			}
+			reason = disconnectReason(err)
+			// There's no one left to send an error report to.
+			if closedByRouter(err) {
+				logWith(levelInfo, logFields{"client": c.addr}, "%s ended the session: %s", c.addr, reason)
+				return
+			}
+			logWith(levelError, logFields{"client": c.addr, "error": err.Error()}, "error received when getting the pdu: %v", err)
+			c.reportError(err, pdu)
 			return
 		}
+		c.mutex.Lock()
+		c.lastActivity = time.Now()
+		c.mutex.Unlock()
 		header, err := decodePDUHeader(pdu[:2])
 		if err != nil {
-			log.Printf("error received when decoding the header: %v", err)
+			logWith(levelError, logFields{"client": c.addr, "error": err.Error()}, "error received when decoding the header: %v", err)
+			c.reportError(err, pdu)
+			reason = disconnectReason(err)
+			return
+		}
+
+		// The first PDU decides the version for the rest of the session.
+		if !c.negotiated {
+			logWith(levelInfo, logFields{"client": c.addr, "version": header.Version}, "negotiated version %d with %s", header.Version, c.addr)
+			c.mutex.Lock()
+			c.version = header.Version
+			c.negotiated = true
+			c.mutex.Unlock()
+		} else if header.Version != c.version {
+			logWith(levelWarn, logFields{"client": c.addr, "version": header.Version}, "received version %d from %s, but negotiated version %d", header.Version, c.addr, c.version)
+			c.error(unexpectedVersion, pdu, fmt.Sprintf("session is version %d, PDU has version %d", c.version, header.Version))
+			reason = fmt.Sprintf("changed version from %d to %d", c.version, header.Version)
 			return
 		}
 
 		switch {
 		case header.Ptype == resetQuery:
-			log.Printf("received a reset Query PDU from %s\n", c.addr)
-			c.sendRoa()
+			logWith(levelDebug, logFields{"client": c.addr}, "received a reset Query PDU from %s, sending the full table", c.addr)
+			if len(pdu) != 8 {
+				c.error(corruptData, pdu, fmt.Sprintf("reset query PDU has length %d", len(pdu)))
+				reason = "corrupt reset query"
+				return
+			}
+			c.responses.add(fullResponse)
+			c.notifyIfChanged(c.sendRoa())
 
 		case header.Ptype == serialQuery:
-			log.Printf("received a serial Query PDU from %s\n", c.addr)
+			logWith(levelDebug, logFields{"client": c.addr}, "received a serial Query PDU from %s, sending an incremental update or reset", c.addr)
+			if len(pdu) != 12 {
+				c.error(corruptData, pdu, fmt.Sprintf("serial query PDU has length %d", len(pdu)))
+				reason = "corrupt serial query"
+				return
+			}
 			// TODO: Is 2 a magic number?
 			sq := getSerialQueryPDU(pdu[2:])
-			c.mutex.RLock()
-			serial := c.diff.newSerial
-			c.mutex.RUnlock()
-
-			// If the client sends in the current or previous serial, then we can handle it.
-			// If the serial is older or unknown, we need to send a reset.
-			if sq.Serial != serial && sq.Serial != serial-1 {
-				log.Printf("received a serial query PDU, with an unmanagable serial from %s\n", c.addr)
-				log.Printf("Serial received: %d. Current server serial: %d\n", sq.Serial, serial)
-				c.sendReset()
-			}
-			if sq.Serial == serial {
-				log.Printf("received a serial number which currently matches my own from %s\n", c.addr)
-				log.Printf("Serial received: %d. Current server serial: %d\n", sq.Serial, serial)
-				c.updateClient(sq.Session, serial, false)
-			}
-			if sq.Serial == serial-1 {
-				log.Printf("received a serial number one less, so sending diff to %s\n", c.addr)
-				log.Printf("Serial received: %d. Current server serial: %d\n", sq.Serial, serial)
-				c.updateClient(sq.Session, serial, true)
+			c.mutex.Lock()
+			c.lastSerial, c.queried = sq.Serial, true
+			serial := *c.serial
+			diff, why := diffForQuery(*c.history, c.session, serial, sq)
+			c.mutex.Unlock()
+
+			if diff.resetRequired {
+				c.responses.add(cacheResetResponse)
+				c.sendReset(why)
+			} else {
+				c.responses.add(incrementalResponse)
+				logWith(levelDebug, logFields{"client": c.addr, "serial": serial}, "Serial received from %s: %d. Current server serial: %d", c.addr, sq.Serial, serial)
+				c.updateClient(c.session, serial, diff)
+				c.notifyIfChanged(serial)
 			}
+
+		case header.Ptype == errorReport:
+			// Never respond to an error report with another error report.
+			logWith(levelWarn, logFields{"client": c.addr}, "received an error report PDU from %s, closing session: %v", c.addr, pdu)
+			reason = "router sent an error report"
+			return
+
+		default:
+			logWith(levelWarn, logFields{"client": c.addr}, "received an unexpected PDU type %d from %s", header.Ptype, c.addr)
+			c.error(invalidRequest, pdu, fmt.Sprintf("unexpected PDU type %d", header.Ptype))
+			reason = fmt.Sprintf("unexpected PDU type %d", header.Ptype)
+			return
 		}
 	}
 }
@@ -2,7 +2,18 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
+
+	"inet.af/netaddr"
 )
 
 func TestGetPDU(t *testing.T) {
@@ -37,6 +48,12 @@ func TestGetPDU(t *testing.T) {
 			input: []byte{0x01, 0x08, 0x00, 0x01, 0x00, 0x00, 0x00, 0x08},
 			pdu:   []byte{0x01, 0x08, 0x00, 0x01, 0x00, 0x00, 0x00, 0x08},
 		},
+		{
+			desc:    "invalid pdu. Length shorter than a header",
+			input:   []byte{0x01, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x04},
+			pdu:     []byte{0x01, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x04},
+			wantErr: true,
+		},
 		{
 			desc:    "invalid pdu. Length longer than actual pdu",
 			input:   []byte{0x01, 0x08, 0x00, 0x01, 0x00, 0x00, 0x00, 0x0c},
@@ -89,6 +106,16 @@ func TestDecodePDUHeader(t *testing.T) {
 			input: []byte{0x01, 0x08, 0x00, 0x01, 0x00, 0x00, 0x00, 0x08},
 			pdu:   cacheReset,
 		},
+		{
+			desc:  "valid version 0 reset query pdu",
+			input: []byte{0x00, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x08},
+			pdu:   resetQuery,
+		},
+		{
+			desc:    "Unsupported version",
+			input:   []byte{0x03, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x08},
+			wantErr: true,
+		},
 		{
 			desc:    "Invalid pdu number 5",
 			input:   []byte{0x01, 0x05, 0x00, 0x01, 0x00, 0x00, 0x00, 0x08},
@@ -118,3 +145,781 @@ func TestDecodePDUHeader(t *testing.T) {
 		}
 	}
 }
+
+func TestHandleClientErrors(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input []byte
+		code  uint16
+	}{
+		{
+			desc:  "unsupported version",
+			input: []byte{0x03, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x08},
+			code:  unsupportedVersion,
+		},
+		{
+			desc:  "unsupported pdu type",
+			input: []byte{0x01, 0x05, 0x00, 0x00, 0x00, 0x00, 0x00, 0x08},
+			code:  unsupportedPDUType,
+		},
+		{
+			desc:  "invalid length",
+			input: []byte{0x01, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x04},
+			code:  corruptData,
+		},
+		{
+			desc:  "short serial query",
+			input: []byte{0x01, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x08},
+			code:  corruptData,
+		},
+		{
+			desc:  "pdu only a cache sends",
+			input: []byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x08},
+			code:  invalidRequest,
+		},
+	}
+	for _, v := range tests {
+		server, router := net.Pipe()
+		s := &CacheServer{mutex: &sync.RWMutex{}}
+		c := &client{
+			conn:  server,
+			mutex: s.mutex,
+		}
+		s.sessions.Add(1)
+		go s.handleClient(c)
+
+		router.SetDeadline(time.Now().Add(time.Second))
+		router.Write(v.input)
+		pdu, err := getPDU(router)
+		if err != nil {
+			t.Errorf("Error on %s. Unable to read error report: %v", v.desc, err)
+			router.Close()
+			continue
+		}
+		if pdu[1] != errorReport || uint16(pdu[2])<<8|uint16(pdu[3]) != v.code {
+			t.Errorf("Error on %s. Got %v, Want error report with code %d\n", v.desc, pdu, v.code)
+		}
+		// The offending PDU is sent back.
+		if !bytes.Contains(pdu, v.input) {
+			t.Errorf("Error on %s. Error report does not include the PDU: %v", v.desc, pdu)
+		}
+		// and the session is closed.
+		if _, err := router.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("Error on %s. Wanted session to be closed, got %v", v.desc, err)
+		}
+		router.Close()
+	}
+
+	// A router which never reads the report doesn't hold up the session.
+	old := writeTimeout
+	writeTimeout = 50 * time.Millisecond
+	defer func() { writeTimeout = old }()
+	server, router := net.Pipe()
+	defer router.Close()
+	done := make(chan struct{})
+	go func() {
+		(&client{conn: server}).error(corruptData, nil, "no reader")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Sending an error report to a router which isn't reading did not time out")
+	}
+}
+
+func TestVersionNegotiation(t *testing.T) {
+	server, router := net.Pipe()
+	defer router.Close()
+	s := &CacheServer{
+		mutex:   &sync.RWMutex{},
+		session: 1,
+		serial:  2,
+		timers: intervals{
+			refresh: DefaultRefreshInterval,
+			retry:   DefaultRetryInterval,
+			expire:  DefaultExpireInterval,
+		},
+	}
+	c := &client{
+		conn:    server,
+		session: s.session,
+		roas:    &s.roas,
+		serial:  &s.serial,
+		mutex:   s.mutex,
+		history: &s.history,
+		timers:  &s.timers,
+	}
+	s.sessions.Add(1)
+	go s.handleClient(c)
+	router.SetDeadline(time.Now().Add(time.Second))
+
+	// A version 0 reset query gets version 0 responses, with a short end of data.
+	router.Write([]byte{0x00, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x08})
+	for _, want := range [][]byte{
+		{0x00, cacheResponse, 0x00, 0x01, 0x00, 0x00, 0x00, 0x08},
+		{0x00, endOfData, 0x00, 0x01, 0x00, 0x00, 0x00, 0x0c, 0x00, 0x00, 0x00, 0x02},
+	} {
+		got, err := getPDU(router)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("Got %v, Want %v", got, want)
+		}
+	}
+
+	// Changing version mid session is an error.
+	router.Write([]byte{0x01, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x0c, 0x00, 0x00, 0x00, 0x02})
+	got, err := getPDU(router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[0] != version0 || got[1] != errorReport || got[3] != byte(unexpectedVersion) {
+		t.Errorf("Wanted a version 0 unexpected version error report, got %v", got)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	server, router := net.Pipe()
+	defer router.Close()
+	s := &CacheServer{
+		mutex: &sync.RWMutex{},
+	}
+	c := &client{
+		conn:    server,
+		roas:    &s.roas,
+		serial:  &s.serial,
+		mutex:   s.mutex,
+		history: &s.history,
+		timers:  &s.timers,
+		timeout: 50 * time.Millisecond,
+	}
+	s.clients = append(s.clients, c)
+	s.sessions.Add(1)
+	go s.handleClient(c)
+
+	// The router never sends anything, so the session should be dropped.
+	done := make(chan struct{})
+	go func() {
+		s.sessions.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Client was not dropped after the read timeout")
+	}
+	if len(s.clients) != 0 {
+		t.Errorf("Wanted client to be removed, still have %d clients", len(s.clients))
+	}
+}
+
+func TestMaxSession(t *testing.T) {
+	var buf bytes.Buffer
+	setLogging(&buf, textLogs, levelInfo)
+	defer setLogging(os.Stderr, textLogs, levelInfo)
+
+	server, router := net.Pipe()
+	defer router.Close()
+	s := &CacheServer{
+		mutex:   &sync.RWMutex{},
+		session: 1,
+		serial:  2,
+		roas:    []roa{{Prefix: netaddr.MustParseIPPrefix("192.0.2.0/24"), MaxMask: 24, ASN: 64496}},
+	}
+	c := &client{
+		conn:    server,
+		roas:    &s.roas,
+		serial:  &s.serial,
+		mutex:   s.mutex,
+		history: &s.history,
+		timers:  &s.timers,
+		// The read timeout is longer, so only the session ending drops it.
+		timeout: time.Minute,
+		ends:    time.Now().Add(100 * time.Millisecond),
+	}
+	s.clients = append(s.clients, c)
+	s.sessions.Add(1)
+	go s.handleClient(c)
+
+	// A router which keeps querying is still answered until the session ends.
+	rtr := &rtrClient{conn: router, version: version1}
+	if err := rtr.resetQuery(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rtr.readResponse(); err != nil {
+		t.Fatalf("Unable to read the full table: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.sessions.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Session was not closed after maxsessionduration")
+	}
+	if len(s.clients) != 0 {
+		t.Errorf("Wanted client to be removed, still have %d clients", len(s.clients))
+	}
+	if !strings.Contains(buf.String(), "reached maxsessionduration") {
+		t.Errorf("Wanted the reason logged, got %q", buf.String())
+	}
+	if strings.Contains(buf.String(), "error") {
+		t.Errorf("Wanted a clean close, got %q", buf.String())
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		desc    string
+		timeout time.Duration
+		ends    time.Time
+		want    time.Time
+	}{
+		{
+			desc: "neither",
+		},
+		{
+			desc:    "read timeout only",
+			timeout: time.Minute,
+			want:    now.Add(time.Minute),
+		},
+		{
+			desc: "session end only",
+			ends: now.Add(time.Hour),
+			want: now.Add(time.Hour),
+		},
+		{
+			desc:    "read timeout sooner",
+			timeout: time.Minute,
+			ends:    now.Add(time.Hour),
+			want:    now.Add(time.Minute),
+		},
+		{
+			desc:    "session end sooner",
+			timeout: time.Hour,
+			ends:    now.Add(time.Minute),
+			want:    now.Add(time.Minute),
+		},
+	}
+	for _, v := range tests {
+		c := &client{timeout: v.timeout, ends: v.ends}
+		if got := c.readDeadline(now); !got.Equal(v.want) {
+			t.Errorf("Error on %s. Got %v, Want %v", v.desc, got, v.want)
+		}
+	}
+
+	// By default it's the expire interval for the client's prefix, as of now.
+	timers := intervals{refresh: 60, retry: 30, expire: 600}
+	overrides := []timerOverride{{
+		prefix: netaddr.MustParseIPPrefix("192.0.2.0/24"),
+		timers: intervals{refresh: 60, retry: 30, expire: 300},
+	}}
+	c := &client{
+		timeout:   expireTimeout,
+		mutex:     &sync.RWMutex{},
+		timers:    &timers,
+		overrides: &overrides,
+		ip:        netaddr.MustParseIP("198.51.100.1"),
+	}
+	if got, want := c.readDeadline(now), now.Add(600*time.Second); !got.Equal(want) {
+		t.Errorf("Got %v, Want %v from the expire interval", got, want)
+	}
+	c.ip = netaddr.MustParseIP("192.0.2.1")
+	if got, want := c.readDeadline(now), now.Add(300*time.Second); !got.Equal(want) {
+		t.Errorf("Got %v, Want %v from the overridden expire interval", got, want)
+	}
+	// A reload changes it for existing sessions.
+	overrides = nil
+	timers.expire = 900
+	if got, want := c.readDeadline(now), now.Add(900*time.Second); !got.Equal(want) {
+		t.Errorf("Got %v, Want %v from the reloaded expire interval", got, want)
+	}
+}
+
+func TestRouterCloses(t *testing.T) {
+	var buf bytes.Buffer
+	setLogging(&buf, textLogs, levelInfo)
+	defer setLogging(os.Stderr, textLogs, levelInfo)
+
+	tests := []struct {
+		desc string
+		// partial is sent after the full table, before hanging up.
+		partial []byte
+		reason  string
+	}{
+		{
+			desc:   "after a full table",
+			reason: "closed by router",
+		},
+		{
+			desc:    "mid PDU",
+			partial: []byte{version1, serialQuery, 0, 1, 0, 0},
+			reason:  "closed by router mid PDU",
+		},
+	}
+	for _, v := range tests {
+		buf.Reset()
+		server, router := net.Pipe()
+		s := &CacheServer{
+			mutex:   &sync.RWMutex{},
+			session: 1,
+			serial:  2,
+			roas:    []roa{{Prefix: netaddr.MustParseIPPrefix("192.0.2.0/24"), MaxMask: 24, ASN: 64496}},
+		}
+		// No read timeout, so only noticing the close ends the session.
+		c := &client{
+			conn:    server,
+			addr:    "192.0.2.1:40000",
+			session: s.session,
+			roas:    &s.roas,
+			serial:  &s.serial,
+			mutex:   s.mutex,
+			history: &s.history,
+			timers:  &s.timers,
+		}
+		s.clients = append(s.clients, c)
+		s.sessions.Add(1)
+		go s.handleClient(c)
+
+		// Read the full table as it's sent, then hang up.
+		router.SetDeadline(time.Now().Add(time.Second))
+		go router.Write([]byte{version1, resetQuery, 0, 0, 0, 0, 0, 8})
+		for {
+			pdu, err := getPDU(router)
+			if err != nil {
+				t.Fatalf("Error on %s. Unable to read the full table: %v", v.desc, err)
+			}
+			if pdu[1] == endOfData {
+				break
+			}
+		}
+		if v.partial != nil {
+			router.Write(v.partial)
+		}
+		router.Close()
+
+		done := make(chan struct{})
+		go func() {
+			s.sessions.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("Error on %s. Client was not removed after the router closed the session", v.desc)
+		}
+		if len(s.clients) != 0 {
+			t.Errorf("Error on %s. Wanted client to be removed, still have %d clients", v.desc, len(s.clients))
+		}
+		if !strings.Contains(buf.String(), "Removing client") || !strings.Contains(buf.String(), v.reason) {
+			t.Errorf("Error on %s. Wanted the removal logged with %q, got %q", v.desc, v.reason, buf.String())
+		}
+		if strings.Contains(buf.String(), "error received") {
+			t.Errorf("Error on %s. Wanted the close logged as a clean disconnect, got %q", v.desc, buf.String())
+		}
+	}
+}
+
+func TestDisconnectReason(t *testing.T) {
+	tests := []struct {
+		desc string
+		err  error
+		want string
+	}{
+		{
+			desc: "clean close",
+			err:  io.EOF,
+			want: "closed by router",
+		},
+		{
+			desc: "close mid PDU",
+			err:  io.ErrUnexpectedEOF,
+			want: "closed by router mid PDU",
+		},
+		{
+			desc: "timeout",
+			err:  os.ErrDeadlineExceeded,
+			want: "read timeout",
+		},
+		{
+			desc: "bad PDU",
+			err:  &pduError{code: corruptData, report: "invalid PDU length 4"},
+			want: "invalid PDU: invalid PDU length 4",
+		},
+		{
+			desc: "reset",
+			err:  &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)},
+			want: "reset by router",
+		},
+		{
+			desc: "other",
+			err:  errors.New("connection reset by peer"),
+			want: "read error: connection reset by peer",
+		},
+	}
+	for _, v := range tests {
+		if got := disconnectReason(v.err); got != v.want {
+			t.Errorf("Error on %s. Got %q, Want %q", v.desc, got, v.want)
+		}
+	}
+}
+
+func TestDiffForQuery(t *testing.T) {
+	a := roa{Prefix: netaddr.MustParseIPPrefix("192.0.2.0/24"), MaxMask: 24, ASN: 64496}
+	history := []serialDiff{
+		{oldSerial: 2, newSerial: 3, delRoa: []roa{a}, diff: true, resetRequired: true},
+		{oldSerial: 3, newSerial: 4, addRoa: []roa{a}, diff: true},
+		{oldSerial: 4, newSerial: 5},
+	}
+	tests := []struct {
+		desc  string
+		query serialQueryPDU
+		reset bool
+		added int
+	}{
+		{
+			desc:  "current serial",
+			query: serialQueryPDU{Session: 7, Serial: 5},
+		},
+		{
+			desc:  "retained serial",
+			query: serialQueryPDU{Session: 7, Serial: 3},
+			added: 1,
+		},
+		{
+			desc:  "other session",
+			query: serialQueryPDU{Session: 8, Serial: 5},
+			reset: true,
+		},
+		{
+			desc:  "serial ahead",
+			query: serialQueryPDU{Session: 7, Serial: 6},
+			reset: true,
+		},
+		{
+			desc:  "gap in the history",
+			query: serialQueryPDU{Session: 7, Serial: 1},
+			reset: true,
+		},
+		{
+			desc:  "history includes a diff over maxdiffbeforereset",
+			query: serialQueryPDU{Session: 7, Serial: 2},
+			reset: true,
+		},
+	}
+	for _, v := range tests {
+		got, why := diffForQuery(history, 7, 5, v.query)
+		if got.resetRequired != v.reset || (why != "") != v.reset {
+			t.Errorf("Error on %s. Got reset required %t because %q, Want %t", v.desc, got.resetRequired, why, v.reset)
+		}
+		if len(got.addRoa) != v.added {
+			t.Errorf("Error on %s. Got %d added, Want %d", v.desc, len(got.addRoa), v.added)
+		}
+	}
+}
+
+func TestSerialQueryAhead(t *testing.T) {
+	server, router := net.Pipe()
+	defer router.Close()
+	s := &CacheServer{
+		mutex:   &sync.RWMutex{},
+		session: 1,
+		serial:  2,
+	}
+	c := &client{
+		conn:    server,
+		session: s.session,
+		roas:    &s.roas,
+		serial:  &s.serial,
+		mutex:   s.mutex,
+		history: &s.history,
+		timers:  &s.timers,
+	}
+	s.sessions.Add(1)
+	go s.handleClient(c)
+	router.SetDeadline(time.Now().Add(time.Second))
+
+	// Serial 5 is ahead of our serial 2, so the router needs a reset.
+	router.Write([]byte{0x01, serialQuery, 0x00, 0x01, 0x00, 0x00, 0x00, 0x0c, 0x00, 0x00, 0x00, 0x05})
+	got, err := getPDU(router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0x01, cacheReset, 0x00, 0x00, 0x00, 0x00, 0x00, 0x08}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Got %v, Want %v", got, want)
+	}
+}
+
+func TestCacheReset(t *testing.T) {
+	tests := []struct {
+		desc    string
+		session uint16
+		serial  uint32
+	}{
+		{
+			desc:    "other session",
+			session: 2,
+			serial:  9,
+		},
+		{
+			desc:    "no longer in the history",
+			session: 1,
+			serial:  5,
+		},
+	}
+	for _, v := range tests {
+		server, router := net.Pipe()
+		s := &CacheServer{
+			mutex:   &sync.RWMutex{},
+			session: 1,
+			serial:  9,
+			history: []serialDiff{{oldSerial: 8, newSerial: 9}},
+		}
+		c := &client{
+			conn:    server,
+			session: s.session,
+			roas:    &s.roas,
+			serial:  &s.serial,
+			mutex:   s.mutex,
+			history: &s.history,
+			timers:  &s.timers,
+		}
+		s.sessions.Add(1)
+		go s.handleClient(c)
+		router.SetDeadline(time.Now().Add(time.Second))
+
+		query := []byte{0x01, serialQuery, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0c, 0x00, 0x00, 0x00, 0x00}
+		binary.BigEndian.PutUint16(query[2:], v.session)
+		binary.BigEndian.PutUint32(query[8:], v.serial)
+		router.Write(query)
+		got, err := getPDU(router)
+		if err != nil {
+			t.Errorf("Error on %s. Unable to read the response: %v", v.desc, err)
+		}
+		want := []byte{0x01, cacheReset, 0x00, 0x00, 0x00, 0x00, 0x00, 0x08}
+		if !bytes.Equal(got, want) {
+			t.Errorf("Error on %s. Got %v, Want %v", v.desc, got, want)
+		}
+		router.Close()
+	}
+}
+
+func TestNotifyIfChanged(t *testing.T) {
+	tests := []struct {
+		desc   string
+		sent   uint32
+		notify bool
+	}{
+		{
+			desc: "up to date",
+			sent: 7,
+		},
+		{
+			desc:   "updated since",
+			sent:   6,
+			notify: true,
+		},
+	}
+	for _, v := range tests {
+		server, router := net.Pipe()
+		serial := uint32(7)
+		c := &client{
+			conn:       server,
+			version:    version1,
+			negotiated: true,
+			session:    1,
+			serial:     &serial,
+			mutex:      &sync.RWMutex{},
+		}
+		go func() {
+			c.notifyIfChanged(v.sent)
+			server.Close()
+		}()
+
+		got, _ := io.ReadAll(router)
+		var want []byte
+		if v.notify {
+			want = []byte{0x01, serialNotify, 0x00, 0x01, 0x00, 0x00, 0x00, 0x0c, 0x00, 0x00, 0x00, 0x07}
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("Error on %s. Got %v, Want %v", v.desc, got, want)
+		}
+		router.Close()
+	}
+}
+
+func TestSendASPAs(t *testing.T) {
+	keys := []bgpsecKey{{SKI: [20]byte{1}, ASN: 64496, PubKey: "a"}}
+	aspas := []aspa{{Customer: 64496, Providers: []uint32{64497}}}
+	diff := serialDiff{
+		addKey:  keys,
+		addASPA: []aspa{{Customer: 64500, Providers: []uint32{64501}}},
+		delASPA: []aspa{aspas[0]},
+		diff:    true,
+	}
+
+	tests := []struct {
+		desc    string
+		version uint8
+		full    []uint8
+		update  []uint8
+	}{
+		{
+			desc:    "version 1",
+			version: version1,
+			full:    []uint8{cacheResponse, routerKey, endOfData},
+			update:  []uint8{cacheResponse, routerKey, endOfData},
+		},
+		{
+			desc:    "version 2",
+			version: version2,
+			full:    []uint8{cacheResponse, routerKey, aspaPDUType, endOfData},
+			update:  []uint8{cacheResponse, routerKey, aspaPDUType, aspaPDUType, endOfData},
+		},
+	}
+	for _, v := range tests {
+		serial := uint32(1)
+		c := &client{
+			version: v.version,
+			session: 1,
+			roas:    &[]roa{},
+			keys:    &keys,
+			aspas:   &aspas,
+			serial:  &serial,
+			mutex:   &sync.RWMutex{},
+			timers:  &intervals{},
+		}
+		if got := sentTypes(c, func() { c.sendRoa() }); !bytes.Equal(got, v.full) {
+			t.Errorf("Error on %s full response. Got PDU types %v, Want %v", v.desc, got, v.full)
+		}
+		if got := sentTypes(c, func() { c.updateClient(1, 2, diff) }); !bytes.Equal(got, v.update) {
+			t.Errorf("Error on %s diff. Got PDU types %v, Want %v", v.desc, got, v.update)
+		}
+	}
+}
+
+func TestSendLogging(t *testing.T) {
+	var buf bytes.Buffer
+	setLogging(&buf, textLogs, levelInfo)
+	defer setLogging(os.Stderr, textLogs, levelInfo)
+
+	a := roa{Prefix: netaddr.MustParseIPPrefix("192.0.2.0/24"), MaxMask: 24, ASN: 64496}
+	b := roa{Prefix: netaddr.MustParseIPPrefix("198.51.100.0/24"), MaxMask: 24, ASN: 64496}
+	serial := uint32(5)
+	c := &client{
+		addr:    "192.0.2.1:12345",
+		version: version1,
+		session: 1,
+		roas:    &[]roa{a, b},
+		serial:  &serial,
+		mutex:   &sync.RWMutex{},
+		timers:  &intervals{},
+	}
+	sentTypes(c, func() { c.sendRoa() })
+	sentTypes(c, func() { c.updateClient(1, 5, serialDiff{addRoa: []roa{a}, delRoa: []roa{b}, diff: true}) })
+
+	for _, want := range []string{
+		"sent the full table of 2 ROAs to 192.0.2.1:12345, serial 5",
+		"sent an incremental update of 1 announced and 1 withdrawn ROAs to 192.0.2.1:12345, serial 5",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Wanted %q logged, got %q", want, buf.String())
+		}
+	}
+}
+
+// countingConn counts the writes to a connection.
+type countingConn struct {
+	net.Conn
+	writes int
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	c.writes++
+	return c.Conn.Write(p)
+}
+
+func TestBatchWriter(t *testing.T) {
+	roas := make([]roa, 10000)
+	for i := range roas {
+		roas[i] = roa{Prefix: netaddr.IPPrefixFrom(netaddr.IPFrom4([4]byte{10, byte(i >> 8), byte(i), 0}), 24), MaxMask: 24, ASN: 64496}
+	}
+	serial := uint32(1)
+	newClient := func(conn net.Conn) *client {
+		return &client{
+			conn:    conn,
+			version: version1,
+			session: 1,
+			roas:    &roas,
+			serial:  &serial,
+			mutex:   &sync.RWMutex{},
+			timers:  &intervals{},
+		}
+	}
+
+	// 10000 prefix PDUs of 20 bytes are written in batches, not one at a time.
+	server, router := net.Pipe()
+	go io.Copy(io.Discard, router)
+	conn := &countingConn{Conn: server}
+	c := newClient(conn)
+	c.fullSyncs = newHistogram(syncBuckets)
+	c.sendRoa()
+	server.Close()
+	if want := 10000*20/writeBatch + 1; conn.writes != want {
+		t.Errorf("Got %d writes, Want %d", conn.writes, want)
+	}
+	// A Cache Response, the prefixes, and a version 1 End of Data.
+	if want := uint64(8 + 10000*20 + 24); c.bytesSent != want {
+		t.Errorf("Got %d bytes sent, Want %d", c.bytesSent, want)
+	}
+	if c.fullSyncs.count != 1 {
+		t.Errorf("Got %d full syncs timed, Want 1", c.fullSyncs.count)
+	}
+
+	// A router which stops reading times out, rather than blocking the send.
+	old := writeTimeout
+	writeTimeout = 50 * time.Millisecond
+	defer func() { writeTimeout = old }()
+	server, router = net.Pipe()
+	defer router.Close()
+	done := make(chan struct{})
+	go func() {
+		newClient(server).sendRoa()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Sending to a router which isn't reading did not time out")
+	}
+	if _, err := server.Write([]byte{0}); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("Wanted the session closed after the failed send, got %v", err)
+	}
+}
+
+// sentTypes returns the type of each PDU sent to the client by send.
+func sentTypes(c *client, send func()) []uint8 {
+	server, router := net.Pipe()
+	defer router.Close()
+	c.conn = server
+	go func() {
+		send()
+		server.Close()
+	}()
+
+	var types []uint8
+	for {
+		pdu, err := getPDU(router)
+		if err != nil {
+			return types
+		}
+		types = append(types, pdu[1])
+	}
+}
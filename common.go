@@ -1,52 +1,206 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
+	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"inet.af/netaddr"
 )
 
 type jsonroa struct {
 	Prefix string `json:"prefix"`
-	Mask   uint8  `json:"maxLength"`
+	Mask   int    `json:"maxLength"`
 	ASN    any    `json:"asn"`
+	TA     string `json:"ta"`
+}
+
+// roaFields are the keys of each ROA in the json, for validators which don't
+// use the usual ones.
+type roaFields struct {
+	prefix    string
+	maxLength string
+	asn       string
+	ta        string
+}
+
+var defaultROAFields = roaFields{prefix: "prefix", maxLength: "maxLength", asn: "asn", ta: "ta"}
+
+// jsonFields are the keys ROAs are decoded with. Set from config at startup.
+var jsonFields = defaultROAFields
+
+// UnmarshalJSON decodes a ROA with the keys in jsonFields. The usual keys are
+// decoded with the struct tags, as that is quicker for the common case.
+func (r *jsonroa) UnmarshalJSON(b []byte) error {
+	if jsonFields == defaultROAFields {
+		type plain jsonroa
+		return json.Unmarshal(b, (*plain)(r))
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+	for key, v := range map[string]any{
+		jsonFields.prefix:    &r.Prefix,
+		jsonFields.maxLength: &r.Mask,
+		jsonFields.asn:       &r.ASN,
+		jsonFields.ta:        &r.TA,
+	} {
+		raw, ok := fields[key]
+		if !ok {
+			continue
+		}
+		if err := json.Unmarshal(raw, v); err != nil {
+			return fmt.Errorf("unable to decode %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// jsonkey is a BGPsec router key. The SKI is hex encoded and the public
+// key base64 encoded.
+type jsonkey struct {
+	ASN    any    `json:"asn"`
+	SKI    string `json:"ski"`
+	PubKey string `json:"pubkey"`
+}
+
+// jsonaspa is an ASPA as in the rpki-client json.
+type jsonaspa struct {
+	Customer  any   `json:"customer_asid"`
+	Providers []any `json:"providers"`
+}
+
+// roaList is the ROAs array. The RIPE NCC RPKI Validator export wraps it
+// in another object, as {"roas":{"roas":[...]}}, so that is understood too.
+type roaList []jsonroa
+
+func (l *roaList) UnmarshalJSON(b []byte) error {
+	if !bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		return json.Unmarshal(b, (*[]jsonroa)(l))
+	}
+	var nested struct {
+		Roas []jsonroa `json:"roas"`
+	}
+	if err := json.Unmarshal(b, &nested); err != nil {
+		return err
+	}
+	*l = nested.Roas
+	return nil
 }
 
 type roas struct {
-	Roas []jsonroa `json:"roas"`
+	Roas  roaList    `json:"roas"`
+	Keys  []jsonkey  `json:"bgpsec_keys"`
+	ASPAs []jsonaspa `json:"aspas"`
+}
+
+// rpkiData is everything read from the json locations.
+type rpkiData struct {
+	roas  []roa
+	keys  []bgpsecKey
+	aspas []aspa
+
+	// generated and valid come from the json metadata. With more than one
+	// location, these are the oldest of them. Zero if not known.
+	generated time.Time
+	valid     time.Time
+
+	// notModified is set when every location said nothing changed since the
+	// ETag it last sent, so the ROAs are what they were last time.
+	notModified bool
+
+	// size is the bytes of json read, over all locations. Locations which
+	// weren't modified add nothing.
+	size int
+}
+
+// metadata describes when the json was created. Cloudflare and rpki-client
+// each use their own keys, so both are here.
+type metadata struct {
+	// Cloudflare
+	Generated int64 `json:"generated"`
+	Valid     int64 `json:"valid"`
+
+	// rpki-client
+	Buildtime string `json:"buildtime"`
 }
 
 type rpkiResponse struct {
+	Metadata metadata `json:"metadata"`
 	roas
 }
 
+// generated returns the time the json was created, whichever format it's in.
+// Returns the zero time when not present.
+func (m metadata) generated() time.Time {
+	if m.Generated != 0 {
+		return time.Unix(m.Generated, 0).UTC()
+	}
+	t, err := time.Parse(time.RFC3339, m.Buildtime)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// validUntil returns the time the json is valid until. Only Cloudflare has this.
+// Returns the zero time when not present.
+func (m metadata) validUntil() time.Time {
+	if m.Valid == 0 {
+		return time.Time{}
+	}
+	return time.Unix(m.Valid, 0).UTC()
+}
+
+// earliest returns the earlier of two times, ignoring zero times.
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
 // makeDiff will return a list of ROAs that need to be deleted or updated
 // in order for a particular serial version to updated to the latest version.
 func makeDiff(new, old []roa, serial uint32) serialDiff {
 	var addROA, delROA []roa
 
-	newm := roasToMap(new)
-	oldm := roasToMap(old)
+	// Only the keys are kept, as copying whole ROAs into the maps takes
+	// longer than the lookups on a full table.
+	newm := roaKeys(new)
+	oldm := roaKeys(old)
 
-	// If ROA is in newMap but not oldMap, we need to add it
-	for k, v := range newm {
-		_, ok := oldm[k]
-		if !ok {
+	// If ROA is in new but not old, we need to add it. Each key is only added
+	// once, in case new has it more than once.
+	for _, v := range new {
+		k := v.key()
+		if !oldm[k] {
 			addROA = append(addROA, v)
+			oldm[k] = true
 		}
 	}
 
-	// If ROA is in oldMap but not newMap, we need to delete it.
-	for k, v := range oldm {
-		_, ok := newm[k]
-		if !ok {
+	// If ROA is in old but not new, we need to delete it.
+	for _, v := range old {
+		k := v.key()
+		if !newm[k] {
 			delROA = append(delROA, v)
+			newm[k] = true
 		}
 	}
 
@@ -62,102 +216,873 @@ func makeDiff(new, old []roa, serial uint32) serialDiff {
 	}
 }
 
-// roasToMap will convert a slice of ROAs into a map of formatted ROA to a ROA.
-func roasToMap(roas []roa) map[string]roa {
-	rm := make(map[string]roa, len(roas))
+// diffKeys returns the router keys which need to be added or deleted to get
+// from old to new.
+func diffKeys(new, old []bgpsecKey) ([]bgpsecKey, []bgpsecKey) {
+	var addKey, delKey []bgpsecKey
+
+	newm := make(map[bgpsecKey]bool, len(new))
+	for _, k := range new {
+		newm[k] = true
+	}
+	oldm := make(map[bgpsecKey]bool, len(old))
+	for _, k := range old {
+		oldm[k] = true
+	}
+
+	for k := range newm {
+		if !oldm[k] {
+			addKey = append(addKey, k)
+		}
+	}
+	for k := range oldm {
+		if !newm[k] {
+			delKey = append(delKey, k)
+		}
+	}
+	return addKey, delKey
+}
+
+// diffASPAs returns the ASPAs to announce and withdraw to get from old to new.
+// A changed ASPA is announced, and the one it replaces is also withdrawn, so
+// diffs can be merged. Only withdrawnASPAs are sent as withdraws.
+func diffASPAs(new, old []aspa) ([]aspa, []aspa) {
+	var addASPA, delASPA []aspa
+
+	oldm := make(map[uint32]aspa, len(old))
+	for _, a := range old {
+		oldm[a.Customer] = a
+	}
+	newm := make(map[uint32]bool, len(new))
+	for _, a := range new {
+		newm[a.Customer] = true
+		o, ok := oldm[a.Customer]
+		if ok && o.equal(a) {
+			continue
+		}
+		addASPA = append(addASPA, a)
+		if ok {
+			delASPA = append(delASPA, o)
+		}
+	}
+	for _, a := range old {
+		if !newm[a.Customer] {
+			delASPA = append(delASPA, a)
+		}
+	}
+	return addASPA, delASPA
+}
+
+// withdrawnASPAs are the ASPAs removed by the diff, as opposed to replaced.
+func (d serialDiff) withdrawnASPAs() []aspa {
+	added := make(map[uint32]bool, len(d.addASPA))
+	for _, a := range d.addASPA {
+		added[a.Customer] = true
+	}
+	var withdrawn []aspa
+	for _, a := range d.delASPA {
+		if !added[a.Customer] {
+			withdrawn = append(withdrawn, a)
+		}
+	}
+	return withdrawn
+}
+
+// equal checks both ASPAs have the same customer and providers.
+func (a aspa) equal(b aspa) bool {
+	if a.Customer != b.Customer || len(a.Providers) != len(b.Providers) {
+		return false
+	}
+	for i := range a.Providers {
+		if a.Providers[i] != b.Providers[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// serialLess reports whether serial a is before b, using RFC1982 serial number
+// arithmetic so it still works once the serial wraps around. Serials exactly
+// 2^31 apart are undefined, so neither is before the other.
+// https://datatracker.ietf.org/doc/html/rfc1982#section-3.2
+func serialLess(a, b uint32) bool {
+	return int32(b-a) > 0
+}
+
+// appendHistory adds a diff to the history, dropping the oldest diffs once
+// there are more than depth.
+func appendHistory(history []serialDiff, diff serialDiff, depth int) []serialDiff {
+	history = append(history, diff)
+	if len(history) > depth {
+		history = append([]serialDiff(nil), history[len(history)-depth:]...)
+	}
+	return history
+}
+
+// diffSince returns all the changes from serial up to the latest serial in
+// history. Returns false if serial is not retained.
+func diffSince(history []serialDiff, serial uint32) (serialDiff, bool) {
+	for i, d := range history {
+		if d.oldSerial == serial {
+			return mergeDiffs(history[i:]), true
+		}
+	}
+	return serialDiff{}, false
+}
+
+// diffBetween returns the changes from serial from up to serial to. Returns
+// false if the range is not retained in history.
+func diffBetween(history []serialDiff, from, to uint32) (serialDiff, bool) {
+	for i, d := range history {
+		if d.oldSerial != from {
+			continue
+		}
+		for j := i; j < len(history); j++ {
+			if history[j].newSerial == to {
+				return mergeDiffs(history[i : j+1]), true
+			}
+		}
+	}
+	return serialDiff{}, false
+}
+
+// mergeDiffs combines consecutive diffs into a single diff. A ROA or router
+// key which is added and later deleted, or the other way around, cancels out.
+func mergeDiffs(diffs []serialDiff) serialDiff {
+	added := make(map[roaKey]roa)
+	deleted := make(map[roaKey]roa)
+	addedKeys := make(map[bgpsecKey]bool)
+	deletedKeys := make(map[bgpsecKey]bool)
+	// For each customer, the router has the ASPA withdrawn by the first diff
+	// changing it, and should end up with the ASPA announced by the last.
+	aspas := make(map[uint32]*aspaChange)
+	for _, d := range diffs {
+		for _, a := range d.delASPA {
+			a := a
+			if ch, ok := aspas[a.Customer]; ok {
+				ch.new = nil
+			} else {
+				aspas[a.Customer] = &aspaChange{old: &a}
+			}
+		}
+		for _, a := range d.addASPA {
+			a := a
+			ch, ok := aspas[a.Customer]
+			if !ok {
+				ch = &aspaChange{}
+				aspas[a.Customer] = ch
+			}
+			ch.new = &a
+		}
+		for _, k := range d.addKey {
+			if deletedKeys[k] {
+				delete(deletedKeys, k)
+			} else {
+				addedKeys[k] = true
+			}
+		}
+		for _, k := range d.delKey {
+			if addedKeys[k] {
+				delete(addedKeys, k)
+			} else {
+				deletedKeys[k] = true
+			}
+		}
+		for _, r := range d.addRoa {
+			if _, ok := deleted[r.key()]; ok {
+				delete(deleted, r.key())
+			} else {
+				added[r.key()] = r
+			}
+		}
+		for _, r := range d.delRoa {
+			if _, ok := added[r.key()]; ok {
+				delete(added, r.key())
+			} else {
+				deleted[r.key()] = r
+			}
+		}
+	}
+
+	// A router missing any diff needing a reset can't be brought up to date
+	// with the merged diff either.
+	var reset bool
+	for _, d := range diffs {
+		reset = reset || d.resetRequired
+	}
+
+	var addROA, delROA []roa
+	for _, r := range added {
+		addROA = append(addROA, r)
+	}
+	for _, r := range deleted {
+		delROA = append(delROA, r)
+	}
+	var addKey, delKey []bgpsecKey
+	for k := range addedKeys {
+		addKey = append(addKey, k)
+	}
+	for k := range deletedKeys {
+		delKey = append(delKey, k)
+	}
+	var addASPA, delASPA []aspa
+	for _, ch := range aspas {
+		if ch.old != nil && ch.new != nil && ch.old.equal(*ch.new) {
+			continue
+		}
+		if ch.new != nil {
+			addASPA = append(addASPA, *ch.new)
+		}
+		if ch.old != nil {
+			delASPA = append(delASPA, *ch.old)
+		}
+	}
+
+	return serialDiff{
+		oldSerial: diffs[0].oldSerial,
+		newSerial: diffs[len(diffs)-1].newSerial,
+		addRoa:    addROA,
+		delRoa:    delROA,
+		addKey:    addKey,
+		delKey:    delKey,
+		addASPA:   addASPA,
+		delASPA:   delASPA,
+		diff: len(addROA) > 0 || len(delROA) > 0 || len(addKey) > 0 || len(delKey) > 0 ||
+			len(addASPA) > 0 || len(delASPA) > 0,
+		resetRequired: reset,
+	}
+}
+
+// aspaChange is the ASPA for a customer before and after merged diffs.
+// Nil is no ASPA.
+type aspaChange struct {
+	old *aspa
+	new *aspa
+}
+
+// roaKey is what makes a ROA unique. The prefix includes the min mask.
+// The RIR is not part of it, as the same ROA can come from more than one place.
+type roaKey struct {
+	Prefix  netaddr.IPPrefix
+	MaxMask uint8
+	ASN     uint32
+}
+
+func (r roa) key() roaKey {
+	return roaKey{
+		Prefix:  r.Prefix,
+		MaxMask: r.MaxMask,
+		ASN:     r.ASN,
+	}
+}
+
+// roaKeys returns the set of keys of the ROAs.
+func roaKeys(roas []roa) map[roaKey]bool {
+	keys := make(map[roaKey]bool, len(roas))
+	for _, r := range roas {
+		keys[r.key()] = true
+	}
+	return keys
+}
+
+// roasToMap will convert a slice of ROAs into a map of ROA key to a ROA.
+func roasToMap(roas []roa) map[roaKey]roa {
+	rm := make(map[roaKey]roa, len(roas))
 	for _, roa := range roas {
-		rm[fmt.Sprintf("%s%d%d", roa.Prefix.IPNet().String(), roa.MaxMask, roa.ASN)] = roa
+		rm[roa.key()] = roa
 	}
 	return rm
 }
 
-func readROAs(urls []string) ([]roa, error) {
+// readROAs fetches every location and returns the combined ROAs and router keys.
+// Remote locations with an ETag are cached in etags, if not nil, so one which
+// hasn't changed isn't downloaded or parsed again.
+func readROAs(urls []string, filter roaFilter, etags *etagCache) (rpkiData, error) {
 	var roas []roa
+	var keys []bgpsecKey
+	var aspas []aspa
+	var generated, valid time.Time
+	var size int
+	notModified := len(urls) > 0
 
 	// Will this blend?
-	ch := make(chan []roa, len(urls))
+	ch := make(chan rpkiData, len(urls))
+	errs := make(chan error, len(urls))
 	var wg sync.WaitGroup
 	for _, url := range urls {
 		wg.Add(1)
-		go fetchAndDecodeJSON(url, ch, &wg)
+		go fetchAndDecodeJSON(url, filter, etags, ch, errs, &wg)
 	}
 	wg.Wait()
 	close(ch)
+	close(errs)
+
+	// A single failed location means we don't have the full set.
+	if err := <-errs; err != nil {
+		return rpkiData{}, err
+	}
 	for v := range ch {
-		roas = append(roas, v...)
+		roas = append(roas, v.roas...)
+		keys = append(keys, v.keys...)
+		aspas = append(aspas, v.aspas...)
+		generated = earliest(generated, v.generated)
+		valid = earliest(valid, v.valid)
+		notModified = notModified && v.notModified
+		size += v.size
 	}
 
 	validROAs := GetSetOfValidatedROAs(roas)
+	uniqueKeys := uniqueRouterKeys(keys)
+	uniqueASPAs := mergeASPAs(aspas)
+
+	log.Printf("Created a unique set of %d ROAs, %d router keys, and %d ASPAs\n", len(validROAs), len(uniqueKeys), len(uniqueASPAs))
 
-	log.Printf("Created a unique set of %d ROAs\n", len(validROAs))
+	return rpkiData{
+		roas:        validROAs,
+		keys:        uniqueKeys,
+		aspas:       uniqueASPAs,
+		generated:   generated,
+		valid:       valid,
+		notModified: notModified,
+		size:        size,
+	}, nil
+}
+
+// Categories of failed ROA updates, used to label the error counter.
+const (
+	fetchError  = "fetch"
+	parseError  = "parse"
+	slurmError  = "slurm"
+	shrinkError = "shrink"
+	otherError  = "other"
+)
+
+var errorCategories = []string{fetchError, parseError, slurmError, shrinkError, otherError}
+
+// updateError is why a ROA update failed, with the category of failure.
+type updateError struct {
+	category string
+	err      error
+}
+
+func (e *updateError) Error() string {
+	return e.err.Error()
+}
+
+func (e *updateError) Unwrap() error {
+	return e.err
+}
+
+// errorCategory returns the category of a failed update, or other if unknown.
+func errorCategory(err error) string {
+	var ue *updateError
+	if errors.As(err, &ue) {
+		return ue.category
+	}
+	return otherError
+}
+
+// readROAsWithFallback reads the ROAs from urls. If that fails, or there are no
+// ROAs, each fallback is tried in turn until one returns some ROAs.
+// The last attempt is returned if none of them do.
+// Local overrides from the SLURM file, if any, are applied to whatever is used.
+func readROAsWithFallback(urls, fallbacks []string, filter roaFilter, slurmPath string, etags *etagCache) (rpkiData, error) {
+	data, err := readROAs(urls, filter, etags)
+	source := strings.Join(urls, ",")
+	for _, fb := range fallbacks {
+		if err == nil && len(data.roas) > 0 {
+			break
+		}
+		if err == nil {
+			err = errors.New("no ROAs")
+		}
+		logWith(levelWarn, logFields{"url": source, "error": err.Error()}, "Unable to use ROAs from %s, trying %s: %v", source, fb, err)
+		data, err = readROAs([]string{fb}, filter, etags)
+		source = fb
+	}
+	if err != nil {
+		return data, err
+	}
+	if len(fallbacks) > 0 {
+		log.Printf("Using %d ROAs from %s\n", len(data.roas), source)
+	}
 
-	return validROAs, nil
+	// The SLURM file is re-read every time, so changes are picked up, and the
+	// result may have changed even if the locations haven't.
+	if slurmPath != "" {
+		data.notModified = false
+		sl, err := readSLURM(slurmPath)
+		if err != nil {
+			return rpkiData{}, &updateError{category: slurmError, err: err}
+		}
+		data = sl.apply(data)
+	}
+	return data, nil
 }
 
 // fetchAndDecodeJSON will fetch the latest set of ROAs and add to a local struct
+// The Cloudflare, rpki-client, and RIPE NCC RPKI Validator formats are understood.
+// https://rpki.cloudflare.com/rpki.json
 // https://console.rpki-client.org/vrps.json
-func fetchAndDecodeJSON(url string, ch chan []roa, wg *sync.WaitGroup) {
+// The location may also be a local file, which is re-read on every update.
+// ROAs for prefixes more specific than the filter allows, or from other RIRs, are dropped.
+func fetchAndDecodeJSON(url string, filter roaFilter, etags *etagCache, ch chan rpkiData, errs chan error, wg *sync.WaitGroup) {
 	defer wg.Done()
-	log.Printf("Downloading from %s\n", url)
-	resp, err := http.Get(url)
-	if err != nil {
-		log.Printf("unable to retrieve ROAs from url: %v", err)
+	cached, _ := etags.get(url)
+	f, etag, err := fetchJSONIfChanged(url, cached.etag)
+	if errors.Is(err, errNotModified) {
+		log.Printf("%s is not modified since ETag %s, using the %d ROAs from before\n", url, cached.etag, len(cached.data.roas))
+		data := cached.data
+		data.notModified = true
+		data.size = 0
+		ch <- data
 		return
 	}
-	defer resp.Body.Close()
-
-	f, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Printf("unable to read body of response: %v", err)
+		logWith(levelWarn, logFields{"url": url, "error": err.Error()}, "%v", err)
+		errs <- &updateError{category: fetchError, err: err}
 		return
 	}
 
 	var r rpkiResponse
 	if err = json.Unmarshal(f, &r); err != nil {
-		log.Printf("unable to unmarshal: %v", err)
+		logWith(levelWarn, logFields{"url": url, "error": err.Error()}, "unable to unmarshal %s: %v", url, err)
+		errs <- &updateError{category: parseError, err: fmt.Errorf("unable to unmarshal %s: %w", url, err)}
 		return
 	}
 
 	// We know how many ROAs we have, so we can add that capacity directly
 	newROAs := make([]roa, 0, len(r.roas.Roas))
 
+	var skipped, filtered, otherRIR, tooLong, clamped, blocked int
 	for _, r := range r.roas.Roas {
-		prefix, err := netaddr.ParseIPPrefix(r.Prefix)
+		roa, err := convertROA(r)
+		if err != nil {
+			logWith(levelDebug, logFields{"url": url}, "Skipping ROA from %s: %v", url, err)
+			skipped++
+			continue
+		}
+		if !filter.allows(roa) {
+			filtered++
+			continue
+		}
+		if !filter.fromRIR(roa) {
+			otherRIR++
+			continue
+		}
+		if filter.blocked(roa) {
+			blocked++
+			continue
+		}
+		roa, kept, changed := filter.clamp(roa)
+		if !kept {
+			tooLong++
+			continue
+		}
+		if changed {
+			clamped++
+		}
+		newROAs = append(newROAs, roa)
+	}
+	if skipped > 0 {
+		log.Printf("Skipped %d invalid ROAs from %s\n", skipped, url)
+	}
+	if filtered > 0 {
+		log.Printf("Filtered %d ROAs more specific than /%d or /%d from %s\n", filtered, filter.v4, filter.v6, url)
+	}
+	if otherRIR > 0 {
+		log.Printf("Filtered %d ROAs from other RIRs from %s\n", otherRIR, url)
+	}
+	if blocked > 0 {
+		log.Printf("Blocklist removed %d ROAs from %s\n", blocked, url)
+	}
+	if tooLong > 0 {
+		log.Printf("Filtered %d ROAs more specific than the maxLength cap of /%d or /%d from %s\n", tooLong, filter.maxV4, filter.maxV6, url)
+	}
+	if clamped > 0 {
+		log.Printf("Clamped the maxLength of %d ROAs to /%d or /%d from %s\n", clamped, filter.maxV4, filter.maxV6, url)
+	}
+
+	newKeys := make([]bgpsecKey, 0, len(r.roas.Keys))
+	for _, k := range r.roas.Keys {
+		key, err := convertRouterKey(k)
+		if err != nil {
+			logWith(levelDebug, logFields{"url": url}, "Skipping router key from %s: %v", url, err)
+			continue
+		}
+		newKeys = append(newKeys, key)
+	}
+
+	newASPAs := make([]aspa, 0, len(r.roas.ASPAs))
+	for _, a := range r.roas.ASPAs {
+		as, err := convertASPA(a)
+		if err != nil {
+			logWith(levelDebug, logFields{"url": url}, "Skipping ASPA from %s: %v", url, err)
+			continue
+		}
+		newASPAs = append(newASPAs, as)
+	}
+
+	data := rpkiData{
+		roas:      newROAs,
+		keys:      newKeys,
+		aspas:     newASPAs,
+		generated: r.Metadata.generated(),
+		valid:     r.Metadata.validUntil(),
+		size:      len(f),
+	}
+	etags.set(url, etag, data)
+	ch <- data
+
+	log.Printf("Read %d bytes of json from %s\n", len(f), url)
+	log.Printf("Returning %d ROAs, %d router keys, and %d ASPAs from %s\n", len(newROAs), len(newKeys), len(newASPAs), url)
+	if generated := r.Metadata.generated(); !generated.IsZero() {
+		log.Printf("ROAs from %s were generated at %s\n", url, generated.Format("2006-01-02 15:04:05"))
+	}
+	if valid := r.Metadata.validUntil(); !valid.IsZero() {
+		log.Printf("ROAs from %s are valid until %s\n", url, valid.Format("2006-01-02 15:04:05"))
+	}
+}
+
+// httpClient fetches the ROAs. The timeout is set from config at startup, so a
+// hung upstream fails the update instead of blocking it.
+var httpClient = &http.Client{Timeout: defaultFetchTimeout * time.Second}
+
+// fetchJSON returns the raw JSON from either a remote URL or a local file.
+// Local files are given as a file:// URL or a plain filesystem path.
+// Either may be gzip compressed.
+func fetchJSON(url string) ([]byte, error) {
+	f, _, err := fetchJSONIfChanged(url, "")
+	return f, err
+}
+
+// errNotModified is returned when a url hasn't changed since the ETag sent.
+var errNotModified = errors.New("not modified")
+
+// fetchJSONIfChanged is fetchJSON, but sends etag as If-None-Match when set,
+// returning errNotModified if the url hasn't changed since. The ETag of the
+// response is returned, which is always empty for local files.
+func fetchJSONIfChanged(url, etag string) ([]byte, string, error) {
+	if path, ok := localPath(url); ok {
+		log.Printf("Reading from %s\n", path)
+		f, err := os.ReadFile(path)
+		if err != nil {
+			return nil, "", fmt.Errorf("unable to read ROAs from file: %w", err)
+		}
+		f, err = gunzip(f, false)
+		return f, "", err
+	}
+
+	log.Printf("Downloading from %s\n", url)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to retrieve ROAs from url: %w", err)
+	}
+	// Asking for gzip ourselves means the body is left compressed, so it's
+	// handled the same as a compressed file.
+	req.Header.Set("Accept-Encoding", "gzip")
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to retrieve ROAs from url: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && etag != "" {
+		return nil, etag, errNotModified
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("unexpected response from %s: %s", url, resp.Status)
+	}
+
+	f, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to read body of response: %w", err)
+	}
+	f, err = gunzip(f, resp.Header.Get("Content-Encoding") == "gzip")
+	return f, resp.Header.Get("ETag"), err
+}
+
+// etagCache keeps the ETag and ROAs last read from each url, so a url which
+// hasn't changed doesn't need downloading and parsing again. The ROAs are
+// kept as filtered, so the filter must not change. A nil cache is empty.
+type etagCache struct {
+	mu      sync.Mutex
+	entries map[string]etagEntry
+}
+
+type etagEntry struct {
+	etag string
+	data rpkiData
+}
+
+func newETagCache() *etagCache {
+	return &etagCache{entries: make(map[string]etagEntry)}
+}
+
+func (c *etagCache) get(url string) (etagEntry, bool) {
+	if c == nil {
+		return etagEntry{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[url]
+	return e, ok
+}
+
+// set caches the data from url, or forgets it if there's no ETag.
+func (c *etagCache) set(url, etag string, data rpkiData) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if etag == "" {
+		delete(c.entries, url)
+		return
+	}
+	c.entries[url] = etagEntry{etag: etag, data: data}
+}
+
+// gunzip decompresses the json if it's compressed, or starts with the gzip
+// magic header. Anything else is returned as is.
+func gunzip(f []byte, compressed bool) ([]byte, error) {
+	if !compressed && !bytes.HasPrefix(f, []byte{0x1f, 0x8b}) {
+		return f, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(f))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress ROAs: %w", err)
+	}
+	defer zr.Close()
+	d, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress ROAs: %w", err)
+	}
+	return d, nil
+}
+
+// localPath returns the filesystem path if the location refers to a local file.
+func localPath(url string) (string, bool) {
+	if strings.HasPrefix(url, "file://") {
+		return strings.TrimPrefix(url, "file://"), true
+	}
+	if !strings.Contains(url, "://") {
+		return url, true
+	}
+	return "", false
+}
+
+// convertROA converts a json ROA, ensuring each field is valid.
+func convertROA(r jsonroa) (roa, error) {
+	prefix, err := netaddr.ParseIPPrefix(r.Prefix)
+	if err != nil {
+		return roa{}, err
+	}
+	if prefix != prefix.Masked() {
+		return roa{}, fmt.Errorf("prefix %s has host bits set", r.Prefix)
+	}
+	asn, err := decodeASN(r.ASN)
+	if err != nil {
+		return roa{}, fmt.Errorf("invalid ASN for %s: %w", r.Prefix, err)
+	}
+	if r.Mask < 0 || r.Mask > 128 {
+		return roa{}, fmt.Errorf("invalid maxLength %d for %s", r.Mask, r.Prefix)
+	}
+	converted := roa{
+		Prefix:  prefix,
+		MaxMask: uint8(r.Mask),
+		ASN:     asn,
+		RIR:     parseRIR(r.TA),
+	}
+	if !converted.isValid() {
+		return roa{}, fmt.Errorf("invalid maxLength %d for %s", r.Mask, r.Prefix)
+	}
+	return converted, nil
+}
+
+// convertRouterKey converts a json router key, decoding the SKI and public key.
+func convertRouterKey(k jsonkey) (bgpsecKey, error) {
+	asn, err := decodeASN(k.ASN)
+	if err != nil {
+		return bgpsecKey{}, fmt.Errorf("invalid ASN for router key %s: %w", k.SKI, err)
+	}
+	ski, err := hex.DecodeString(k.SKI)
+	if err != nil {
+		return bgpsecKey{}, fmt.Errorf("invalid SKI %s: %w", k.SKI, err)
+	}
+	if len(ski) != 20 {
+		return bgpsecKey{}, fmt.Errorf("SKI %s is %d bytes, not 20", k.SKI, len(ski))
+	}
+	pub, err := base64.StdEncoding.DecodeString(k.PubKey)
+	if err != nil {
+		return bgpsecKey{}, fmt.Errorf("invalid public key for router key %s: %w", k.SKI, err)
+	}
+	if len(pub) == 0 {
+		return bgpsecKey{}, fmt.Errorf("empty public key for router key %s", k.SKI)
+	}
+
+	key := bgpsecKey{
+		ASN:    asn,
+		PubKey: string(pub),
+	}
+	copy(key.SKI[:], ski)
+	return key, nil
+}
+
+// roaFilter drops ROAs which shouldn't be served. The prefix length is capped
+// per address family. The MinMask sent to routers is the prefix length, so
+// it's never longer than the cap. MaxMask is left as is, unless maxV4 or maxV6
+// is set for its family, which it's then clamped to.
+// If rirs is set, only ROAs from those RIRs are kept.
+type roaFilter struct {
+	v4   uint8
+	v6   uint8
+	rirs map[rir]bool
+
+	// maxV4 and maxV6 cap MaxMask, so routers don't accept anything more
+	// specific. Zero doesn't cap it.
+	maxV4 uint8
+	maxV6 uint8
+
+	// blockedASNs and blockedPrefixes drop ROAs for those ASNs, or for those
+	// prefixes or anything more specific.
+	blockedASNs     map[uint32]bool
+	blockedPrefixes []netaddr.IPPrefix
+}
+
+// allows checks the ROA prefix is no more specific than the cap for its family.
+func (f roaFilter) allows(r roa) bool {
+	if r.Prefix.IP().Is4() {
+		return r.Prefix.Bits() <= f.v4
+	}
+	return r.Prefix.Bits() <= f.v6
+}
+
+// clamp caps the ROA's MaxMask for its family, if there is a cap. A prefix more
+// specific than the cap can't be clamped, so isn't kept. Returns the ROA, and
+// whether it's kept and was changed.
+func (f roaFilter) clamp(r roa) (roa, bool, bool) {
+	max := f.maxV6
+	if r.Prefix.IP().Is4() {
+		max = f.maxV4
+	}
+	if max == 0 || r.MaxMask <= max {
+		return r, true, false
+	}
+	if r.Prefix.Bits() > max {
+		return r, false, false
+	}
+	r.MaxMask = max
+	return r, true, true
+}
+
+// blocked checks if the ROA is for an ASN, or within a prefix, on the blocklist.
+func (f roaFilter) blocked(r roa) bool {
+	if f.blockedASNs[r.ASN] {
+		return true
+	}
+	for _, p := range f.blockedPrefixes {
+		if p.Contains(r.Prefix.IP()) && r.Prefix.Bits() >= p.Bits() {
+			return true
+		}
+	}
+	return false
+}
+
+// fromRIR checks the ROA is from one of the RIRs kept, if any are set.
+func (f roaFilter) fromRIR(r roa) bool {
+	return len(f.rirs) == 0 || f.rirs[r.RIR]
+}
+
+// parseRIR returns the RIR for the trust anchor name used in the json.
+func parseRIR(ta string) rir {
+	ta = strings.ToLower(ta)
+	for r, name := range rirNames {
+		if r != unknownRIR && strings.Contains(ta, name) {
+			return r
+		}
+	}
+	return unknownRIR
+}
+
+// convertASPA converts an ASPA from the json, sorting the providers.
+func convertASPA(a jsonaspa) (aspa, error) {
+	customer, err := decodeASN(a.Customer)
+	if err != nil {
+		return aspa{}, fmt.Errorf("invalid customer ASN for ASPA: %w", err)
+	}
+	if len(a.Providers) == 0 {
+		return aspa{}, fmt.Errorf("ASPA for AS%d has no providers", customer)
+	}
+	providers := make([]uint32, 0, len(a.Providers))
+	for _, p := range a.Providers {
+		asn, err := decodeASN(p)
 		if err != nil {
-			log.Printf("%v", err)
-			ch <- newROAs
+			return aspa{}, fmt.Errorf("invalid provider ASN for ASPA for AS%d: %w", customer, err)
 		}
-		asn := decodeASN(r)
-		newROAs = append(newROAs, roa{
-			Prefix:  prefix,
-			MaxMask: r.Mask,
-			ASN:     asn,
-		})
+		providers = append(providers, asn)
 	}
+	return aspa{
+		Customer:  customer,
+		Providers: sortProviders(providers),
+	}, nil
+}
 
-	ch <- newROAs
+// mergeASPAs combines ASPAs for the same customer, as more than one location
+// can have an ASPA for it. The providers of all of them are kept.
+func mergeASPAs(aspas []aspa) []aspa {
+	merged := make([]aspa, 0, len(aspas))
+	index := make(map[uint32]int, len(aspas))
+	for _, a := range aspas {
+		i, ok := index[a.Customer]
+		if !ok {
+			index[a.Customer] = len(merged)
+			merged = append(merged, a)
+			continue
+		}
+		providers := append(append([]uint32(nil), merged[i].Providers...), a.Providers...)
+		merged[i].Providers = sortProviders(providers)
+	}
+	return merged
+}
 
-	log.Printf("Returning %d ROAs from %s\n", len(newROAs), url)
+// sortProviders sorts the providers and removes duplicates.
+func sortProviders(providers []uint32) []uint32 {
+	sort.Slice(providers, func(i, j int) bool { return providers[i] < providers[j] })
+	unique := providers[:0]
+	for i, p := range providers {
+		if i == 0 || p != providers[i-1] {
+			unique = append(unique, p)
+		}
+	}
+	return unique
 }
 
-func decodeASN(data jsonroa) uint32 {
-	switch atype := data.ASN.(type) {
+// decodeASN accepts both the string and the number form of an ASN.
+func decodeASN(asn any) (uint32, error) {
+	switch atype := asn.(type) {
 	case string:
 		return asnToUint32(atype)
 	case float64:
-		return uint32(atype)
+		if atype < 0 || atype > math.MaxUint32 || atype != math.Trunc(atype) {
+			return 0, fmt.Errorf("ASN %v out of range", atype)
+		}
+		return uint32(atype), nil
 	}
-	return 0
+	return 0, fmt.Errorf("ASN %v is not a string or number", asn)
 }
 
 // GetSetOfValidatedROAs returns a slice of ROAs with no duplicates.
 // It only appends if the ROA is valid
+// Duplicates are by prefix, max mask, and ASN, so the first one seen is kept.
 func GetSetOfValidatedROAs(roas []roa) []roa {
 	u := make([]roa, 0, len(roas))
-	m := make(map[roa]bool)
+	m := make(map[roaKey]bool)
 	for _, roa := range roas {
-		if _, ok := m[roa]; !ok {
-			m[roa] = true
+		if _, ok := m[roa.key()]; !ok {
+			m[roa.key()] = true
 			if roa.isValid() {
 				u = append(u, roa)
 			}
@@ -166,27 +1091,40 @@ func GetSetOfValidatedROAs(roas []roa) []roa {
 	return u
 }
 
+// uniqueRouterKeys returns a slice of router keys with no duplicates.
+func uniqueRouterKeys(keys []bgpsecKey) []bgpsecKey {
+	u := make([]bgpsecKey, 0, len(keys))
+	m := make(map[bgpsecKey]bool)
+	for _, k := range keys {
+		if !m[k] {
+			m[k] = true
+			u = append(u, k)
+		}
+	}
+	return u
+}
+
 // https://datatracker.ietf.org/doc/html/rfc6482#section-3.3
 func (roa *roa) isValid() bool {
 	// MaxLength cannot be zero or negative
 	// MaxMask is a uint8 so cannot be negative
 	if roa.MaxMask == 0 {
-		log.Printf("maxmask <= 0: %#v\n", roa)
+		logWith(levelDebug, nil, "maxmask <= 0: %#v", roa)
 		return false
 	}
 
 	// MaxLength cannot be smaller than prefix length
 	if roa.MaxMask < roa.Prefix.Bits() {
-		log.Printf("maxmask < mask: %#v\n", roa)
+		logWith(levelDebug, nil, "maxmask < mask: %#v", roa)
 		return false
 	}
 
 	// MaxLength cannot be larger than the max allowed for that address family
 	if roa.Prefix.IP().Is4() && roa.MaxMask > 32 {
-		log.Printf("maxmask > max: %#v\n", roa)
+		logWith(levelDebug, nil, "maxmask > max: %#v", roa)
 		return false
 	} else if roa.MaxMask > 128 {
-		log.Printf("maxmask > max: %#v\n", roa)
+		logWith(levelDebug, nil, "maxmask > max: %#v", roa)
 		return false
 	}
 
@@ -204,13 +1142,26 @@ func stringToInt(s string) int {
 	return n
 }
 
-// Some json VRPs contain ASXXX instead of just XXX as the ASN
-func asnToUint32(a string) uint32 {
-	n, err := strconv.Atoi(a[2:])
+// Some json VRPs contain ASXXX instead of just XXX as the ASN.
+// 4-byte ASNs may also be in asdot notation, as high.low (RFC5396).
+// Anything which doesn't fit in 32 bits is an error rather than truncated.
+func asnToUint32(a string) (uint32, error) {
+	s := strings.TrimPrefix(strings.ToUpper(a), "AS")
+	if high, low, ok := strings.Cut(s, "."); ok {
+		h, err := strconv.ParseUint(high, 10, 16)
+		if err != nil {
+			return 0, fmt.Errorf("unable to convert asdot ASN %s to int: %w", a, err)
+		}
+		l, err := strconv.ParseUint(low, 10, 16)
+		if err != nil {
+			return 0, fmt.Errorf("unable to convert asdot ASN %s to int: %w", a, err)
+		}
+		return uint32(h<<16 | l), nil
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
 	if err != nil {
-		log.Printf("Unable to convert ASN %s to int", a)
-		return 0
+		return 0, fmt.Errorf("unable to convert ASN %s to int: %w", a, err)
 	}
 
-	return uint32(n)
+	return uint32(n), nil
 }
@@ -1,8 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
@@ -40,6 +48,7 @@ func TestAsnToInt(t *testing.T) {
 		desc    string
 		asnText string
 		want    uint32
+		wantErr bool
 	}{
 		{
 			desc:    "test 1",
@@ -49,18 +58,454 @@ func TestAsnToInt(t *testing.T) {
 		{
 			desc:    "test 2",
 			asnText: "word",
+			wantErr: true,
+		},
+		{
+			desc:    "lower case",
+			asnText: "as64496",
+			want:    64496,
+		},
+		{
+			desc:    "no prefix",
+			asnText: "64496",
+			want:    64496,
+		},
+		{
+			desc:    "AS0",
+			asnText: "AS0",
 			want:    0,
 		},
+		{
+			desc:    "largest 4-byte ASN",
+			asnText: "AS4294967295",
+			want:    4294967295,
+		},
+		{
+			desc:    "too big for 4 bytes",
+			asnText: "AS4294967296",
+			wantErr: true,
+		},
+		{
+			desc:    "negative",
+			asnText: "AS-1",
+			wantErr: true,
+		},
+		{
+			desc:    "only the prefix",
+			asnText: "AS",
+			wantErr: true,
+		},
+		{
+			desc:    "trailing garbage",
+			asnText: "AS123abc",
+			wantErr: true,
+		},
+		{
+			desc:    "asdot",
+			asnText: "AS1.10",
+			want:    65546,
+		},
+		{
+			desc:    "largest asdot",
+			asnText: "65535.65535",
+			want:    4294967295,
+		},
+		{
+			desc:    "asdot out of range",
+			asnText: "AS1.65536",
+			wantErr: true,
+		},
+		{
+			desc:    "asdot missing low",
+			asnText: "AS1.",
+			wantErr: true,
+		},
 	}
 	for _, v := range tests {
-		got := asnToUint32(v.asnText)
+		got, err := asnToUint32(v.asnText)
+		if err == nil && v.wantErr {
+			t.Errorf("Error on %s. Wanted an error, but none received", v.desc)
+		}
+		if err != nil && !v.wantErr {
+			t.Errorf("Error on %s. No error expected, but error received: %v", v.desc, err)
+		}
 		if got != v.want {
 			t.Errorf("Error on %s. Got %d, Want %d\n", v.desc, got, v.want)
 		}
 	}
 }
 
+func TestConvertROA(t *testing.T) {
+	tests := []struct {
+		desc    string
+		input   jsonroa
+		want    roa
+		wantErr bool
+	}{
+		{
+			desc:  "valid v4 string ASN",
+			input: jsonroa{Prefix: "1.0.0.0/24", Mask: 24, ASN: "AS13335", TA: "apnic"},
+			want: roa{
+				Prefix:  netaddr.MustParseIPPrefix("1.0.0.0/24"),
+				MaxMask: 24,
+				ASN:     13335,
+				RIR:     apnic,
+			},
+		},
+		{
+			desc:  "valid v6 number ASN",
+			input: jsonroa{Prefix: "2001:db8::/32", Mask: 48, ASN: float64(123)},
+			want: roa{
+				Prefix:  netaddr.MustParseIPPrefix("2001:db8::/32"),
+				MaxMask: 48,
+				ASN:     123,
+			},
+		},
+		{
+			desc:    "prefix not a prefix",
+			input:   jsonroa{Prefix: "1.0.0.0", Mask: 24, ASN: "AS13335"},
+			wantErr: true,
+		},
+		{
+			desc:    "prefix with host bits",
+			input:   jsonroa{Prefix: "1.0.4.0/21", Mask: 24, ASN: "AS13335"},
+			wantErr: true,
+		},
+		{
+			desc:    "invalid ASN",
+			input:   jsonroa{Prefix: "1.0.0.0/24", Mask: 24, ASN: "ASword"},
+			wantErr: true,
+		},
+		{
+			desc:    "negative ASN",
+			input:   jsonroa{Prefix: "1.0.0.0/24", Mask: 24, ASN: float64(-1)},
+			wantErr: true,
+		},
+		{
+			desc:  "4-byte number ASN",
+			input: jsonroa{Prefix: "1.0.0.0/24", Mask: 24, ASN: float64(4200000000)},
+			want: roa{
+				Prefix:  netaddr.MustParseIPPrefix("1.0.0.0/24"),
+				MaxMask: 24,
+				ASN:     4200000000,
+			},
+		},
+		{
+			desc:    "number ASN too big",
+			input:   jsonroa{Prefix: "1.0.0.0/24", Mask: 24, ASN: float64(4294967296)},
+			wantErr: true,
+		},
+		{
+			desc:    "string ASN too big",
+			input:   jsonroa{Prefix: "1.0.0.0/24", Mask: 24, ASN: "AS4294967296"},
+			wantErr: true,
+		},
+		{
+			desc:    "missing ASN",
+			input:   jsonroa{Prefix: "1.0.0.0/24", Mask: 24},
+			wantErr: true,
+		},
+		{
+			desc:    "maxLength smaller than prefix",
+			input:   jsonroa{Prefix: "1.0.0.0/24", Mask: 23, ASN: "AS13335"},
+			wantErr: true,
+		},
+		{
+			desc:    "maxLength too long for v4",
+			input:   jsonroa{Prefix: "1.0.0.0/24", Mask: 33, ASN: "AS13335"},
+			wantErr: true,
+		},
+		{
+			desc:    "maxLength too long for v6",
+			input:   jsonroa{Prefix: "2001:db8::/32", Mask: 129, ASN: "AS13335"},
+			wantErr: true,
+		},
+		{
+			desc:    "maxLength does not fit",
+			input:   jsonroa{Prefix: "2001:db8::/32", Mask: 300, ASN: "AS13335"},
+			wantErr: true,
+		},
+	}
+	for _, v := range tests {
+		got, err := convertROA(v.input)
+		if err == nil && v.wantErr {
+			t.Errorf("Error on %s. Wanted an error, but none received", v.desc)
+		}
+		if err != nil && !v.wantErr {
+			t.Errorf("Error on %s. No error expected, but error received: %v", v.desc, err)
+		}
+		if got != v.want {
+			t.Errorf("Error on %s. Got %v, Want %v\n", v.desc, got, v.want)
+		}
+	}
+}
+
+func TestLocalPath(t *testing.T) {
+	tests := []struct {
+		desc  string
+		url   string
+		path  string
+		local bool
+	}{
+		{
+			desc:  "file scheme",
+			url:   "file:///var/lib/rpki/rpki.json",
+			path:  "/var/lib/rpki/rpki.json",
+			local: true,
+		},
+		{
+			desc:  "plain path",
+			url:   "/var/lib/rpki/rpki.json",
+			path:  "/var/lib/rpki/rpki.json",
+			local: true,
+		},
+		{
+			desc:  "relative path",
+			url:   "data/int.json",
+			path:  "data/int.json",
+			local: true,
+		},
+		{
+			desc: "https url",
+			url:  "https://rpki.cloudflare.com/rpki.json",
+		},
+	}
+	for _, v := range tests {
+		path, local := localPath(v.url)
+		if path != v.path || local != v.local {
+			t.Errorf("Error on %s. Got %s %t, Want %s %t\n", v.desc, path, local, v.path, v.local)
+		}
+	}
+}
+
+func TestFetchJSONFromFile(t *testing.T) {
+	want, err := os.ReadFile("data/string.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	abs, err := filepath.Abs("data/string.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, url := range []string{"data/string.json", "file://" + abs} {
+		got, err := fetchJSON(url)
+		if err != nil {
+			t.Errorf("Error on %s. No error expected, but error received: %v", url, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("Error on %s. File contents do not match", url)
+		}
+	}
+	if _, err := fetchJSON("data/missing.json"); err == nil {
+		t.Errorf("Wanted an error reading a missing file, but none received")
+	}
+}
+
+func TestFetchGzipJSON(t *testing.T) {
+	want, err := os.ReadFile("data/string.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var zipped bytes.Buffer
+	zw := gzip.NewWriter(&zipped)
+	zw.Write(want)
+	zw.Close()
+
+	// A compressed file is recognised by its magic header.
+	file := filepath.Join(t.TempDir(), "rpki.json.gz")
+	if err := os.WriteFile(file, zipped.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			w.Write(want)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(zipped.Bytes())
+	}))
+	defer ts.Close()
+
+	for _, url := range []string{file, ts.URL} {
+		got, err := fetchJSON(url)
+		if err != nil {
+			t.Errorf("Error on %s. No error expected, but error received: %v", url, err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("Error on %s. Decompressed contents do not match", url)
+		}
+	}
+
+	// Claiming gzip but sending something else is an error.
+	if _, err := gunzip(want, true); err == nil {
+		t.Errorf("Wanted an error decompressing plain json, but none received")
+	}
+}
+
+func TestReadROAsError(t *testing.T) {
+	// One good and one bad location should not return a partial set.
+	got, err := readROAs([]string{"data/string.json", "data/missing.json"}, roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6}, nil)
+	if err == nil {
+		t.Errorf("Wanted an error, but none received. Got %v", got)
+	}
+}
+
+func TestReadROAsWithFallback(t *testing.T) {
+	filter := roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6}
+	empty := filepath.Join(t.TempDir(), "empty.json")
+	if err := os.WriteFile(empty, []byte(`{"roas":[]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc      string
+		urls      []string
+		fallbacks []string
+		roas      int
+		wantErr   bool
+	}{
+		{
+			desc:      "primary works",
+			urls:      []string{"data/int.json"},
+			fallbacks: []string{"data/string.json"},
+			roas:      7,
+		},
+		{
+			desc:      "primary fails",
+			urls:      []string{"data/missing.json"},
+			fallbacks: []string{"data/string.json", "data/int.json"},
+			roas:      6,
+		},
+		{
+			desc:      "primary and first fallback empty or failing",
+			urls:      []string{empty},
+			fallbacks: []string{"data/missing.json", "data/int.json"},
+			roas:      7,
+		},
+		{
+			desc:      "everything fails",
+			urls:      []string{"data/missing.json"},
+			fallbacks: []string{"data/missing.json"},
+			wantErr:   true,
+		},
+		{
+			desc: "empty without fallbacks is left to the caller",
+			urls: []string{empty},
+		},
+	}
+	for _, v := range tests {
+		got, err := readROAsWithFallback(v.urls, v.fallbacks, filter, "", nil)
+		if (err != nil) != v.wantErr {
+			t.Errorf("Error on %s. Got error %v, Want error %t", v.desc, err, v.wantErr)
+			continue
+		}
+		if len(got.roas) != v.roas {
+			t.Errorf("Error on %s. Got %d ROAs, Want %d\n", v.desc, len(got.roas), v.roas)
+		}
+	}
+}
+
+func TestDecodeFormats(t *testing.T) {
+	tests := []struct {
+		desc      string
+		file      string
+		roas      int
+		keys      int
+		aspas     int
+		generated time.Time
+		valid     time.Time
+	}{
+		{
+			desc:      "rpki-client",
+			file:      "data/int.json",
+			roas:      7,
+			keys:      1,
+			aspas:     1,
+			generated: time.Date(2021, 10, 21, 23, 33, 14, 0, time.UTC),
+		},
+		{
+			desc:      "cloudflare",
+			file:      "data/string.json",
+			roas:      10,
+			generated: time.Date(2021, 10, 22, 1, 19, 3, 0, time.UTC),
+		},
+		{
+			desc: "ripe validator",
+			file: "data/ripe.json",
+			roas: 3,
+		},
+	}
+	for _, v := range tests {
+		data, err := os.ReadFile(v.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r rpkiResponse
+		if err := json.Unmarshal(data, &r); err != nil {
+			t.Errorf("Error on %s. Unable to unmarshal: %v", v.desc, err)
+			continue
+		}
+		if len(r.Roas) != v.roas {
+			t.Errorf("Error on %s. Got %d ROAs, Want %d\n", v.desc, len(r.Roas), v.roas)
+		}
+		if len(r.Keys) != v.keys {
+			t.Errorf("Error on %s. Got %d router keys, Want %d\n", v.desc, len(r.Keys), v.keys)
+		}
+		if len(r.ASPAs) != v.aspas {
+			t.Errorf("Error on %s. Got %d ASPAs, Want %d\n", v.desc, len(r.ASPAs), v.aspas)
+		}
+		if got := r.Metadata.generated(); !got.Equal(v.generated) {
+			t.Errorf("Error on %s. Got generated %v, Want %v\n", v.desc, got, v.generated)
+		}
+		if got := r.Metadata.validUntil(); !got.Equal(v.valid) {
+			t.Errorf("Error on %s. Got valid %v, Want %v\n", v.desc, got, v.valid)
+		}
+		for _, roa := range r.Roas {
+			if _, err := decodeASN(roa.ASN); err != nil {
+				t.Errorf("Error on %s. Unable to decode ASN: %v", v.desc, err)
+			}
+		}
+		for _, key := range r.Keys {
+			if _, err := convertRouterKey(key); err != nil {
+				t.Errorf("Error on %s. Unable to convert router key: %v", v.desc, err)
+			}
+		}
+	}
+}
+
+func TestCustomFields(t *testing.T) {
+	defer func(fields roaFields) { jsonFields = fields }(jsonFields)
+	jsonFields = roaFields{prefix: "ip_prefix", maxLength: "max_len", asn: "origin", ta: "tal"}
+
+	input := `{"roas": [{"ip_prefix": "192.0.2.0/24", "max_len": 24, "origin": "AS64496", "tal": "ripe", "prefix": "ignored"}]}`
+	var r rpkiResponse
+	if err := json.Unmarshal([]byte(input), &r); err != nil {
+		t.Fatalf("Unable to unmarshal: %v", err)
+	}
+	want := jsonroa{Prefix: "192.0.2.0/24", Mask: 24, ASN: "AS64496", TA: "ripe"}
+	if len(r.Roas) != 1 || !reflect.DeepEqual(r.Roas[0], want) {
+		t.Errorf("Got %+v, Want %+v", r.Roas, want)
+	}
+
+	if err := json.Unmarshal([]byte(`{"roas": [{"max_len": "24"}]}`), &r); err == nil {
+		t.Errorf("Wanted an error for a maxLength which isn't a number")
+	}
+}
+
 func TestMakeDiff(t *testing.T) {
+	a := roa{Prefix: netaddr.MustParseIPPrefix("192.0.2.0/24"), MaxMask: 24, ASN: 64496}
+	b := roa{Prefix: netaddr.MustParseIPPrefix("198.51.100.0/22"), MaxMask: 24, ASN: 64497}
+	c := roa{Prefix: netaddr.MustParseIPPrefix("2001:db8::/32"), MaxMask: 48, ASN: 64498}
+	shorterB := b
+	shorterB.MaxMask = 23
+	// The same prefixes, now authorized for other ASNs.
+	movedA := a
+	movedA.ASN = 64499
+	movedC := c
+	movedC.ASN = 64499
+
 	tests := []struct {
 		desc   string
 		new    []roa
@@ -283,6 +728,67 @@ func TestMakeDiff(t *testing.T) {
 				diff: true,
 			},
 		},
+		{
+			desc:   "identical sets in another order",
+			new:    []roa{c, a, b},
+			old:    []roa{a, b, c},
+			serial: 3,
+			want:   serialDiff{oldSerial: 3, newSerial: 4},
+		},
+		{
+			desc:   "all new",
+			new:    []roa{a, b, c},
+			serial: 3,
+			want:   serialDiff{oldSerial: 3, newSerial: 4, addRoa: []roa{a, b, c}, diff: true},
+		},
+		{
+			desc:   "all removed",
+			old:    []roa{a, b, c},
+			serial: 3,
+			want:   serialDiff{oldSerial: 3, newSerial: 4, delRoa: []roa{a, b, c}, diff: true},
+		},
+		{
+			desc:   "only maxLength changed, among unchanged ROAs",
+			new:    []roa{a, shorterB, c},
+			old:    []roa{a, b, c},
+			serial: 3,
+			want:   serialDiff{oldSerial: 3, newSerial: 4, addRoa: []roa{shorterB}, delRoa: []roa{b}, diff: true},
+		},
+		{
+			desc:   "only ASN changed, among unchanged ROAs",
+			new:    []roa{movedA, b, movedC},
+			old:    []roa{a, b, c},
+			serial: 3,
+			want:   serialDiff{oldSerial: 3, newSerial: 4, addRoa: []roa{movedA, movedC}, delRoa: []roa{a, c}, diff: true},
+		},
+		{
+			// Both ASNs are valid origins, so nothing is withdrawn.
+			desc:   "second ASN for a prefix",
+			new:    []roa{a, movedA},
+			old:    []roa{a},
+			serial: 3,
+			want:   serialDiff{oldSerial: 3, newSerial: 4, addRoa: []roa{movedA}, diff: true},
+		},
+		{
+			desc:   "one of two ASNs for a prefix removed",
+			new:    []roa{movedA},
+			old:    []roa{a, movedA},
+			serial: 3,
+			want:   serialDiff{oldSerial: 3, newSerial: 4, delRoa: []roa{a}, diff: true},
+		},
+		{
+			desc:   "everything replaced",
+			new:    []roa{b, c},
+			old:    []roa{a},
+			serial: 3,
+			want:   serialDiff{oldSerial: 3, newSerial: 4, addRoa: []roa{b, c}, delRoa: []roa{a}, diff: true},
+		},
+		{
+			desc:   "serial wraps",
+			new:    []roa{a},
+			serial: math.MaxUint32,
+			want:   serialDiff{oldSerial: math.MaxUint32, newSerial: 0, addRoa: []roa{a}, diff: true},
+		},
 	}
 	for _, v := range tests {
 		got := makeDiff(v.new, v.old, v.serial)
@@ -292,51 +798,421 @@ func TestMakeDiff(t *testing.T) {
 	}
 }
 
-// diffIsEqual will ensure two serialDiffs are equal.
-func diffIsEqual(first, second serialDiff) bool {
-	if first.oldSerial != second.oldSerial {
-		return false
+// BenchmarkMakeDiff diffs tables up to the size of the global table, with a
+// hundredth of the ROAs replaced. The time per op should grow linearly.
+func BenchmarkMakeDiff(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000, 400000} {
+		old := make([]roa, n)
+		for i := range old {
+			old[i] = roa{
+				Prefix:  netaddr.IPPrefixFrom(netaddr.IPFrom4([4]byte{byte(i >> 16), byte(i >> 8), byte(i), 0}), 24),
+				MaxMask: 24,
+				ASN:     uint32(i),
+			}
+		}
+		new := make([]roa, n)
+		copy(new, old)
+		for i := 0; i < n; i += 100 {
+			new[i].ASN++
+		}
+		b.Run(fmt.Sprintf("%d roas", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				makeDiff(new, old, 1)
+			}
+		})
 	}
-	if first.newSerial != second.newSerial {
-		return false
+}
+
+func TestDiffSince(t *testing.T) {
+	a := roa{Prefix: netaddr.MustParseIPPrefix("192.168.1.0/24"), MaxMask: 24, ASN: 123}
+	b := roa{Prefix: netaddr.MustParseIPPrefix("192.168.2.0/24"), MaxMask: 24, ASN: 123}
+	c := roa{Prefix: netaddr.MustParseIPPrefix("2001:db8::/32"), MaxMask: 48, ASN: 123}
+
+	// serial 1 -> 2 adds a and b, 2 -> 3 does nothing, 3 -> 4 deletes b and adds c.
+	var history []serialDiff
+	history = appendHistory(history, serialDiff{oldSerial: 1, newSerial: 2, addRoa: []roa{a, b}, diff: true}, 3)
+	history = appendHistory(history, serialDiff{oldSerial: 2, newSerial: 3}, 3)
+	history = appendHistory(history, serialDiff{oldSerial: 3, newSerial: 4, addRoa: []roa{c}, delRoa: []roa{b}, diff: true}, 3)
+
+	tests := []struct {
+		desc   string
+		serial uint32
+		ok     bool
+		add    []roa
+		del    []roa
+	}{
+		{
+			desc:   "from the oldest serial",
+			serial: 1,
+			ok:     true,
+			add:    []roa{a, c},
+		},
+		{
+			desc:   "from the middle",
+			serial: 2,
+			ok:     true,
+			add:    []roa{c},
+			del:    []roa{b},
+		},
+		{
+			desc:   "from the previous serial",
+			serial: 3,
+			ok:     true,
+			add:    []roa{c},
+			del:    []roa{b},
+		},
+		{
+			desc:   "unknown serial",
+			serial: 0,
+		},
 	}
-	if len(first.delRoa) != len(second.delRoa) {
-		return false
+	for _, v := range tests {
+		got, ok := diffSince(history, v.serial)
+		if ok != v.ok {
+			t.Errorf("Error on %s. Got %t, Want %t\n", v.desc, ok, v.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if got.oldSerial != v.serial || got.newSerial != 4 {
+			t.Errorf("Error on %s. Got serials %d to %d, Want %d to 4\n", v.desc, got.oldSerial, got.newSerial, v.serial)
+		}
+		if !sameROAs(got.addRoa, v.add) || !sameROAs(got.delRoa, v.del) {
+			t.Errorf("Error on %s. Got %v %v, Want %v %v\n", v.desc, got.addRoa, got.delRoa, v.add, v.del)
+		}
 	}
-	if len(first.addRoa) != len(second.addRoa) {
-		return false
+
+	// A fourth diff pushes out the oldest.
+	history = appendHistory(history, serialDiff{oldSerial: 4, newSerial: 5}, 3)
+	if _, ok := diffSince(history, 1); ok {
+		t.Errorf("Wanted serial 1 to be dropped from history, but it was found")
 	}
-	if len(first.addRoa) > 0 {
-		for i := 0; i < len(first.addRoa); i++ {
-			if first.addRoa[i].MaxMask != second.addRoa[i].MaxMask {
-				return false
-			}
-			if first.addRoa[i].ASN != second.addRoa[i].ASN {
-				return false
-			}
-			// TODO: Add rir if I ever get around to doing that.
-			if first.addRoa[i].Prefix != second.addRoa[i].Prefix {
-				return false
-			}
+	if len(history) != 3 {
+		t.Errorf("Wanted history of 3, got %d", len(history))
+	}
+}
+
+func TestDiffBetween(t *testing.T) {
+	a := roa{Prefix: netaddr.MustParseIPPrefix("192.168.1.0/24"), MaxMask: 24, ASN: 123}
+	b := roa{Prefix: netaddr.MustParseIPPrefix("192.168.2.0/24"), MaxMask: 24, ASN: 123}
+	c := roa{Prefix: netaddr.MustParseIPPrefix("2001:db8::/32"), MaxMask: 48, ASN: 123}
+
+	history := []serialDiff{
+		{oldSerial: 1, newSerial: 2, addRoa: []roa{a, b}, diff: true},
+		{oldSerial: 2, newSerial: 3, delRoa: []roa{b}, diff: true},
+		{oldSerial: 3, newSerial: 4, addRoa: []roa{c}, diff: true},
+	}
+
+	tests := []struct {
+		desc string
+		from uint32
+		to   uint32
+		ok   bool
+		add  []roa
+		del  []roa
+	}{
+		{
+			desc: "whole history",
+			from: 1,
+			to:   4,
+			ok:   true,
+			add:  []roa{a, c},
+		},
+		{
+			desc: "single diff",
+			from: 2,
+			to:   3,
+			ok:   true,
+			del:  []roa{b},
+		},
+		{
+			desc: "start of history",
+			from: 1,
+			to:   3,
+			ok:   true,
+			add:  []roa{a},
+		},
+		{
+			desc: "backwards",
+			from: 3,
+			to:   2,
+		},
+		{
+			desc: "past the latest serial",
+			from: 2,
+			to:   5,
+		},
+		{
+			desc: "before history",
+			from: 0,
+			to:   2,
+		},
+	}
+	for _, v := range tests {
+		got, ok := diffBetween(history, v.from, v.to)
+		if ok != v.ok {
+			t.Errorf("Error on %s. Got %t, Want %t\n", v.desc, ok, v.ok)
+			continue
+		}
+		if !sameROAs(got.addRoa, v.add) || !sameROAs(got.delRoa, v.del) {
+			t.Errorf("Error on %s. Got %v %v, Want %v %v\n", v.desc, got.addRoa, got.delRoa, v.add, v.del)
 		}
 	}
-	if len(first.delRoa) > 0 {
-		for i := 0; i < len(first.delRoa); i++ {
-			if first.delRoa[i].MaxMask != second.delRoa[i].MaxMask {
-				return false
-			}
-			if first.delRoa[i].ASN != second.delRoa[i].ASN {
-				return false
-			}
-			// TODO: Add rir if I ever get around to doing that.
-			if first.delRoa[i].Prefix != second.delRoa[i].Prefix {
-				return false
-			}
+}
+
+func TestConvertRouterKey(t *testing.T) {
+	tests := []struct {
+		desc    string
+		key     jsonkey
+		wantErr bool
+	}{
+		{
+			desc: "valid",
+			key:  jsonkey{ASN: float64(64496), SKI: "0ECB1FD1021E071A6D355FC3DCA5FDB4D3BE06CC", PubKey: "qrvM"},
+		},
+		{
+			desc:    "short SKI",
+			key:     jsonkey{ASN: float64(64496), SKI: "0ECB", PubKey: "qrvM"},
+			wantErr: true,
+		},
+		{
+			desc:    "SKI not hex",
+			key:     jsonkey{ASN: float64(64496), SKI: "ZZCB1FD1021E071A6D355FC3DCA5FDB4D3BE06CC", PubKey: "qrvM"},
+			wantErr: true,
+		},
+		{
+			desc:    "public key not base64",
+			key:     jsonkey{ASN: float64(64496), SKI: "0ECB1FD1021E071A6D355FC3DCA5FDB4D3BE06CC", PubKey: "!!"},
+			wantErr: true,
+		},
+		{
+			desc:    "missing public key",
+			key:     jsonkey{ASN: float64(64496), SKI: "0ECB1FD1021E071A6D355FC3DCA5FDB4D3BE06CC"},
+			wantErr: true,
+		},
+		{
+			desc:    "bad ASN",
+			key:     jsonkey{ASN: "ASxyz", SKI: "0ECB1FD1021E071A6D355FC3DCA5FDB4D3BE06CC", PubKey: "qrvM"},
+			wantErr: true,
+		},
+	}
+	for _, v := range tests {
+		got, err := convertRouterKey(v.key)
+		if (err != nil) != v.wantErr {
+			t.Errorf("Error on %s. Got error %v, Want error %t\n", v.desc, err, v.wantErr)
+			continue
+		}
+		if err == nil && (got.ASN != 64496 || got.SKI[0] != 0x0e || got.PubKey != "\xaa\xbb\xcc") {
+			t.Errorf("Error on %s. Got %+v\n", v.desc, got)
+		}
+	}
+}
+
+func TestDiffKeys(t *testing.T) {
+	a := bgpsecKey{SKI: [20]byte{1}, ASN: 64496, PubKey: "a"}
+	b := bgpsecKey{SKI: [20]byte{2}, ASN: 64496, PubKey: "b"}
+	c := bgpsecKey{SKI: [20]byte{3}, ASN: 64497, PubKey: "c"}
+
+	add, del := diffKeys([]bgpsecKey{a, c}, []bgpsecKey{a, b})
+	if len(add) != 1 || add[0] != c {
+		t.Errorf("Got added %v, Want %v\n", add, c)
+	}
+	if len(del) != 1 || del[0] != b {
+		t.Errorf("Got deleted %v, Want %v\n", del, b)
+	}
+
+	// A key added and then deleted again cancels out when merged.
+	merged := mergeDiffs([]serialDiff{
+		{oldSerial: 1, newSerial: 2, addKey: []bgpsecKey{c}, diff: true},
+		{oldSerial: 2, newSerial: 3, delKey: []bgpsecKey{c, b}, diff: true},
+	})
+	if len(merged.addKey) != 0 || len(merged.delKey) != 1 || merged.delKey[0] != b || !merged.diff {
+		t.Errorf("Got merged %+v, Want only %v deleted\n", merged, b)
+	}
+}
+
+func TestMaskFilter(t *testing.T) {
+	capped := roaFilter{v4: 24, v6: 48}
+	// By default nothing is filtered.
+	defaults := roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6}
+	tests := []struct {
+		filter roaFilter
+		prefix string
+		want   bool
+	}{
+		{filter: capped, prefix: "192.0.2.0/24", want: true},
+		{filter: capped, prefix: "192.0.2.0/25", want: false},
+		{filter: capped, prefix: "10.0.0.0/8", want: true},
+		{filter: capped, prefix: "2001:db8::/48", want: true},
+		{filter: capped, prefix: "2001:db8::/49", want: false},
+		{filter: defaults, prefix: "192.0.2.0/25", want: true},
+		{filter: defaults, prefix: "192.0.2.1/32", want: true},
+		{filter: defaults, prefix: "2001:db8::/49", want: true},
+		{filter: defaults, prefix: "2001:db8::1/128", want: true},
+	}
+	for _, v := range tests {
+		r := roa{Prefix: netaddr.MustParseIPPrefix(v.prefix), MaxMask: 128, ASN: 123}
+		if got := v.filter.allows(r); got != v.want {
+			t.Errorf("Error on %s with /%d and /%d. Got %t, Want %t\n", v.prefix, v.filter.v4, v.filter.v6, got, v.want)
+		}
+	}
+}
+
+func TestClamp(t *testing.T) {
+	f := roaFilter{maxV4: 24, maxV6: 48}
+	tests := []struct {
+		prefix      string
+		maxMask     uint8
+		wantMask    uint8
+		wantKept    bool
+		wantChanged bool
+	}{
+		{prefix: "192.0.2.0/24", maxMask: 24, wantMask: 24, wantKept: true},
+		{prefix: "198.51.100.0/22", maxMask: 32, wantMask: 24, wantKept: true, wantChanged: true},
+		{prefix: "192.0.2.0/25", maxMask: 25, wantMask: 25},
+		{prefix: "2001:db8::/32", maxMask: 64, wantMask: 48, wantKept: true, wantChanged: true},
+		{prefix: "2001:db8::/56", maxMask: 56, wantMask: 56},
+	}
+	for _, v := range tests {
+		r := roa{Prefix: netaddr.MustParseIPPrefix(v.prefix), MaxMask: v.maxMask, ASN: 123}
+		got, kept, changed := f.clamp(r)
+		if got.MaxMask != v.wantMask || kept != v.wantKept || changed != v.wantChanged {
+			t.Errorf("Error on %s. Got maxLength %d, kept %t, changed %t, Want %d, %t, %t\n",
+				v.prefix, got.MaxMask, kept, changed, v.wantMask, v.wantKept, v.wantChanged)
+		}
+	}
+
+	// Without a cap, nothing changes.
+	r := roa{Prefix: netaddr.MustParseIPPrefix("192.0.2.0/24"), MaxMask: 32, ASN: 123}
+	if got, kept, changed := (roaFilter{}).clamp(r); got != r || !kept || changed {
+		t.Errorf("Got %+v, kept %t, changed %t without a cap, Want %+v unchanged", got, kept, changed, r)
+	}
+}
+
+func TestBlocklist(t *testing.T) {
+	f := roaFilter{
+		blockedASNs:     map[uint32]bool{64496: true},
+		blockedPrefixes: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("198.51.100.0/22")},
+	}
+	tests := []struct {
+		prefix string
+		asn    uint32
+		want   bool
+	}{
+		{prefix: "192.0.2.0/24", asn: 64496, want: true},
+		{prefix: "192.0.2.0/24", asn: 64497, want: false},
+		{prefix: "198.51.100.0/22", asn: 64497, want: true},
+		{prefix: "198.51.101.0/24", asn: 64497, want: true},
+		{prefix: "198.51.100.0/21", asn: 64497, want: false},
+		{prefix: "2001:db8::/32", asn: 64497, want: false},
+	}
+	for _, v := range tests {
+		r := roa{Prefix: netaddr.MustParseIPPrefix(v.prefix), MaxMask: 24, ASN: v.asn}
+		if got := f.blocked(r); got != v.want {
+			t.Errorf("Error on %s AS%d. Got %t, Want %t\n", v.prefix, v.asn, got, v.want)
+		}
+	}
+}
+
+func TestDuplicateROAs(t *testing.T) {
+	a := roa{Prefix: netaddr.MustParseIPPrefix("192.0.2.0/24"), MaxMask: 24, ASN: 64496, RIR: arin}
+	b := roa{Prefix: netaddr.MustParseIPPrefix("2001:db8::/32"), MaxMask: 48, ASN: 64497, RIR: ripe}
+
+	// The same ROA from another trust anchor is still a duplicate.
+	input := []roa{a, b, a, {Prefix: a.Prefix, MaxMask: a.MaxMask, ASN: a.ASN, RIR: apnic}}
+	first := GetSetOfValidatedROAs(input)
+	if len(first) != 2 {
+		t.Errorf("Wanted 2 unique ROAs, got %d: %v", len(first), first)
+	}
+
+	// Feeding identical input twice, in any order, is not a diff.
+	second := GetSetOfValidatedROAs([]roa{input[3], b, a, b})
+	if d := makeDiff(second, first, 1); d.diff {
+		t.Errorf("Wanted no diff for identical input, got %+v", d)
+	}
+
+	// ROAs which only looked the same when formatted are different.
+	old := []roa{{Prefix: netaddr.MustParseIPPrefix("2000::/8"), MaxMask: 11, ASN: 23}}
+	new := []roa{{Prefix: netaddr.MustParseIPPrefix("2000::/8"), MaxMask: 112, ASN: 3}}
+	if d := makeDiff(new, old, 1); !d.diff || len(d.addRoa) != 1 || len(d.delRoa) != 1 {
+		t.Errorf("Wanted one add and one delete, got %+v", d)
+	}
+}
+
+func TestSerialLess(t *testing.T) {
+	tests := []struct {
+		a, b uint32
+		want bool
+	}{
+		{a: 1, b: 2, want: true},
+		{a: 2, b: 1},
+		{a: 5, b: 5},
+		{a: math.MaxUint32, b: 0, want: true},
+		{a: 0, b: math.MaxUint32},
+		{a: math.MaxUint32 - 10, b: 10, want: true},
+		{a: 0, b: 1<<31 - 1, want: true},
+		// Exactly half way round is undefined either way.
+		{a: 0, b: 1 << 31},
+		{a: 1 << 31, b: 0},
+	}
+	for _, v := range tests {
+		if got := serialLess(v.a, v.b); got != v.want {
+			t.Errorf("serialLess(%d, %d) = %t, Want %t\n", v.a, v.b, got, v.want)
+		}
+	}
+}
+
+func TestDiffSinceWraparound(t *testing.T) {
+	a := roa{Prefix: netaddr.MustParseIPPrefix("192.168.1.0/24"), MaxMask: 24, ASN: 123}
+	b := roa{Prefix: netaddr.MustParseIPPrefix("192.168.2.0/24"), MaxMask: 24, ASN: 123}
+
+	// The serial wraps from the maximum back to 0.
+	var history []serialDiff
+	history = appendHistory(history, makeDiff([]roa{a}, nil, math.MaxUint32-1), 3)
+	history = appendHistory(history, makeDiff([]roa{a, b}, []roa{a}, math.MaxUint32), 3)
+	history = appendHistory(history, makeDiff([]roa{b}, []roa{a, b}, 0), 3)
+
+	got, ok := diffSince(history, math.MaxUint32-1)
+	if !ok {
+		t.Fatalf("Wanted serial %d to be in history", uint32(math.MaxUint32-1))
+	}
+	if got.newSerial != 1 || !sameROAs(got.addRoa, []roa{b}) || len(got.delRoa) != 0 {
+		t.Errorf("Got %+v, Want b added up to serial 1", got)
+	}
+	if !serialLess(math.MaxUint32-1, got.newSerial) {
+		t.Errorf("Wanted serial %d to be before %d", uint32(math.MaxUint32-1), got.newSerial)
+	}
+}
+
+// sameROAs checks two slices contain the same ROAs, in any order.
+func sameROAs(first, second []roa) bool {
+	if len(first) != len(second) {
+		return false
+	}
+	m := make(map[roa]bool, len(first))
+	for _, r := range first {
+		m[r] = true
+	}
+	for _, r := range second {
+		if !m[r] {
+			return false
 		}
 	}
 	return true
 }
 
+// diffIsEqual compares the serials, ROAs, and whether there's a diff. makeDiff
+// returns ROAs in map order, so their order doesn't matter.
+func diffIsEqual(first, second serialDiff) bool {
+	return first.oldSerial == second.oldSerial &&
+		first.newSerial == second.newSerial &&
+		first.diff == second.diff &&
+		sameROAs(first.addRoa, second.addRoa) &&
+		sameROAs(first.delRoa, second.delRoa)
+}
+
 func stringHandler(w http.ResponseWriter, r *http.Request) {
 	data, err := os.ReadFile("data/string.json")
 	if err != nil {
@@ -376,69 +1252,381 @@ func TestReadROAs(t *testing.T) {
 					Prefix:  netaddr.MustParseIPPrefix("1.0.0.0/24"),
 					MaxMask: 24,
 					ASN:     13335,
+					RIR:     apnic,
 				},
 				{
-					Prefix:  netaddr.MustParseIPPrefix("1.0.0.0/24"),
+					Prefix:  netaddr.MustParseIPPrefix("1.0.4.0/24"),
 					MaxMask: 24,
 					ASN:     38803,
+					RIR:     apnic,
 				},
 				{
-					Prefix:  netaddr.MustParseIPPrefix("1.0.0.0/22"),
+					Prefix:  netaddr.MustParseIPPrefix("1.0.4.0/22"),
 					MaxMask: 22,
 					ASN:     38803,
+					RIR:     apnic,
 				},
 				{
 					Prefix:  netaddr.MustParseIPPrefix("1.0.5.0/24"),
 					MaxMask: 24,
 					ASN:     38803,
+					RIR:     apnic,
 				},
 				{
 					Prefix:  netaddr.MustParseIPPrefix("2c0f:ffb8::/32"),
 					MaxMask: 32,
-					ASN:     3721,
+					ASN:     37211,
+					RIR:     afrinic,
 				},
 				{
 					Prefix:  netaddr.MustParseIPPrefix("2c0f:ffe8::/32"),
 					MaxMask: 32,
 					ASN:     37443,
+					RIR:     afrinic,
 				},
 				{
 					Prefix:  netaddr.MustParseIPPrefix("2001:678:cdc::/48"),
 					MaxMask: 128,
 					ASN:     333333,
+					RIR:     ripe,
 				},
 				{
-					Prefix:  netaddr.MustParseIPPrefix("1.0.0.0/22"),
+					Prefix:  netaddr.MustParseIPPrefix("1.0.4.0/22"),
 					MaxMask: 23,
 					ASN:     38803,
+					RIR:     apnic,
 				},
 				{
 					Prefix:  netaddr.MustParseIPPrefix("2001:678:cdc::/48"),
 					MaxMask: 128,
 					ASN:     210660,
+					RIR:     ripe,
 				},
 				{
 					Prefix:  netaddr.MustParseIPPrefix("50.128.0.0/9"),
 					MaxMask: 9,
 					ASN:     7922,
+					RIR:     arin,
 				},
 				{
 					Prefix:  netaddr.MustParseIPPrefix("73.0.0.0/8"),
 					MaxMask: 8,
 					ASN:     7922,
+					RIR:     arin,
 				},
 			},
 		},
 	}
 	for _, tc := range tests {
 		t.Run(tc.desc, func(t *testing.T) {
-			got, err := readROAs([]string{"http://127.0.0.1:8181/int", "http://127.0.0.1:8181/string"})
+			got, err := readROAs([]string{"http://127.0.0.1:8181/int", "http://127.0.0.1:8181/string"}, roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6}, nil)
 			if err != nil {
 				panic(err)
 			}
-			if !reflect.DeepEqual(got, tc.want) {
-				t.Errorf("Got (%v), Wanted (%v)", got, tc.want)
+			// Each location is fetched concurrently, so order isn't fixed.
+			if !sameROAs(got.roas, tc.want) {
+				t.Errorf("Got (%v), Wanted (%v)", got.roas, tc.want)
+			}
+			if len(got.keys) != 1 {
+				t.Errorf("Got %d router keys, Wanted 1", len(got.keys))
+			}
+			// The oldest of the two locations.
+			if want := time.Date(2021, 10, 21, 23, 33, 14, 0, time.UTC); !got.generated.Equal(want) {
+				t.Errorf("Got generated %v, Wanted %v", got.generated, want)
 			}
 		})
 	}
 }
+
+func TestRIRFilter(t *testing.T) {
+	tests := []struct {
+		desc string
+		rirs map[rir]bool
+		rir  rir
+		want bool
+	}{
+		{
+			desc: "no filter",
+			rir:  apnic,
+			want: true,
+		},
+		{
+			desc: "kept RIR",
+			rirs: map[rir]bool{ripe: true, arin: true},
+			rir:  ripe,
+			want: true,
+		},
+		{
+			desc: "other RIR",
+			rirs: map[rir]bool{ripe: true, arin: true},
+			rir:  apnic,
+		},
+		{
+			desc: "unknown trust anchor",
+			rirs: map[rir]bool{ripe: true},
+			rir:  unknownRIR,
+		},
+	}
+	for _, v := range tests {
+		f := roaFilter{rirs: v.rirs}
+		r := roa{Prefix: netaddr.MustParseIPPrefix("192.0.2.0/24"), MaxMask: 24, ASN: 123, RIR: v.rir}
+		if got := f.fromRIR(r); got != v.want {
+			t.Errorf("Error on %s. Got %t, Want %t\n", v.desc, got, v.want)
+		}
+	}
+}
+
+func TestErrorCategory(t *testing.T) {
+	dir := t.TempDir()
+	broken := filepath.Join(dir, "broken.json")
+	if err := os.WriteFile(broken, []byte(`{"roas": [`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	filter := roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6}
+
+	_, fetchErr := readROAs([]string{filepath.Join(dir, "missing.json")}, filter, nil)
+	_, parseErr := readROAs([]string{broken}, filter, nil)
+	_, slurmErr := readROAsWithFallback([]string{"data/int.json"}, nil, filter, filepath.Join(dir, "missing-slurm.json"), nil)
+
+	tests := []struct {
+		desc string
+		err  error
+		want string
+	}{
+		{desc: "missing file", err: fetchErr, want: fetchError},
+		{desc: "broken json", err: parseErr, want: parseError},
+		{desc: "missing SLURM file", err: slurmErr, want: slurmError},
+		{desc: "too much shrink", err: checkShrink(100, 10, 50), want: shrinkError},
+		{desc: "uncategorised", err: errors.New("boom"), want: otherError},
+	}
+	for _, v := range tests {
+		if v.err == nil {
+			t.Errorf("Error on %s. Wanted an error", v.desc)
+			continue
+		}
+		if got := errorCategory(v.err); got != v.want {
+			t.Errorf("Error on %s. Got %s, Want %s", v.desc, got, v.want)
+		}
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	timeout := httpClient.Timeout
+	httpClient.Timeout = 50 * time.Millisecond
+	defer func() { httpClient.Timeout = timeout }()
+
+	start := time.Now()
+	if _, err := fetchJSON(ts.URL); err == nil {
+		t.Errorf("Wanted an error from a hung upstream")
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("Fetch took %v, Wanted it to give up after %v", took, httpClient.Timeout)
+	}
+}
+
+func TestETagCache(t *testing.T) {
+	body, err := os.ReadFile("data/int.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag := `"v1"`
+	var downloads int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		downloads++
+		w.Write(body)
+	}))
+	defer ts.Close()
+
+	filter := roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6}
+	etags := newETagCache()
+	tests := []struct {
+		desc        string
+		etag        string
+		notModified bool
+		downloads   int
+	}{
+		{
+			desc:      "first fetch",
+			etag:      `"v1"`,
+			downloads: 1,
+		},
+		{
+			desc:        "unchanged",
+			etag:        `"v1"`,
+			notModified: true,
+			downloads:   1,
+		},
+		{
+			desc:      "changed",
+			etag:      `"v2"`,
+			downloads: 2,
+		},
+	}
+	for _, v := range tests {
+		etag = v.etag
+		got, err := readROAs([]string{ts.URL}, filter, etags)
+		if err != nil {
+			t.Errorf("Error on %s. Unable to read ROAs: %v", v.desc, err)
+			continue
+		}
+		if got.notModified != v.notModified || downloads != v.downloads {
+			t.Errorf("Error on %s. Got not modified %t after %d downloads, Want %t after %d", v.desc, got.notModified, downloads, v.notModified, v.downloads)
+		}
+		if len(got.roas) != 7 {
+			t.Errorf("Error on %s. Got %d ROAs, Want 7", v.desc, len(got.roas))
+		}
+		size := len(body)
+		if v.notModified {
+			size = 0
+		}
+		if got.size != size {
+			t.Errorf("Error on %s. Got size %d, Want %d", v.desc, got.size, size)
+		}
+	}
+
+	// Local files have no ETag, so are always read.
+	got, err := readROAs([]string{"data/int.json"}, filter, etags)
+	if err != nil || got.notModified {
+		t.Errorf("Got not modified %t, %v from a local file. Wanted it read", got.notModified, err)
+	}
+}
+
+func TestConvertASPA(t *testing.T) {
+	tests := []struct {
+		desc    string
+		aspa    jsonaspa
+		want    aspa
+		wantErr bool
+	}{
+		{
+			desc: "valid",
+			aspa: jsonaspa{Customer: float64(64496), Providers: []any{float64(64498), "AS64497", float64(64498)}},
+			want: aspa{Customer: 64496, Providers: []uint32{64497, 64498}},
+		},
+		{
+			desc:    "no providers",
+			aspa:    jsonaspa{Customer: float64(64496)},
+			wantErr: true,
+		},
+		{
+			desc:    "bad customer",
+			aspa:    jsonaspa{Customer: "ASxyz", Providers: []any{float64(64497)}},
+			wantErr: true,
+		},
+		{
+			desc:    "bad provider",
+			aspa:    jsonaspa{Customer: float64(64496), Providers: []any{float64(-1)}},
+			wantErr: true,
+		},
+	}
+	for _, v := range tests {
+		got, err := convertASPA(v.aspa)
+		if (err != nil) != v.wantErr {
+			t.Errorf("Error on %s. Got error %v, Want error %t\n", v.desc, err, v.wantErr)
+			continue
+		}
+		if !v.wantErr && !got.equal(v.want) {
+			t.Errorf("Error on %s. Got %v, Want %v\n", v.desc, got, v.want)
+		}
+	}
+}
+
+func TestMergeASPAs(t *testing.T) {
+	got := mergeASPAs([]aspa{
+		{Customer: 64496, Providers: []uint32{64497}},
+		{Customer: 64500, Providers: []uint32{64501}},
+		{Customer: 64496, Providers: []uint32{64499, 64497}},
+	})
+	want := map[uint32][]uint32{64496: {64497, 64499}, 64500: {64501}}
+	if !reflect.DeepEqual(aspaSet(got), want) {
+		t.Errorf("Got %v, Want %v", got, want)
+	}
+}
+
+func TestDiffASPAs(t *testing.T) {
+	a := aspa{Customer: 64496, Providers: []uint32{64497}}
+	a2 := aspa{Customer: 64496, Providers: []uint32{64497, 64498}}
+	b := aspa{Customer: 64500, Providers: []uint32{64501}}
+	c := aspa{Customer: 64510, Providers: []uint32{64511}}
+
+	// What goes on the wire is an announce for each new or changed ASPA, and
+	// a withdraw for each removed one.
+	tests := []struct {
+		desc      string
+		diffs     [][2][]aspa
+		announced map[uint32][]uint32
+		withdrawn map[uint32][]uint32
+	}{
+		{
+			desc:      "single update",
+			diffs:     [][2][]aspa{{{a, b}, {a2, c}}},
+			announced: map[uint32][]uint32{64496: a2.Providers, 64510: c.Providers},
+			withdrawn: map[uint32][]uint32{64500: b.Providers},
+		},
+		{
+			desc:  "changed and changed back",
+			diffs: [][2][]aspa{{{a}, {a2}}, {{a2}, {a}}},
+		},
+		{
+			desc:      "added then changed",
+			diffs:     [][2][]aspa{{{}, {a}}, {{a}, {a2}}},
+			announced: map[uint32][]uint32{64496: a2.Providers},
+		},
+		{
+			desc:      "changed then withdrawn",
+			diffs:     [][2][]aspa{{{a}, {a2}}, {{a2}, {}}},
+			withdrawn: map[uint32][]uint32{64496: a.Providers},
+		},
+		{
+			desc:  "added then withdrawn",
+			diffs: [][2][]aspa{{{a}, {a, c}}, {{a, c}, {a}}},
+		},
+	}
+	for _, v := range tests {
+		var diffs []serialDiff
+		for i, d := range v.diffs {
+			add, del := diffASPAs(d[1], d[0])
+			diffs = append(diffs, serialDiff{
+				oldSerial: uint32(i),
+				newSerial: uint32(i + 1),
+				addASPA:   add,
+				delASPA:   del,
+				diff:      len(add) > 0 || len(del) > 0,
+			})
+		}
+		merged := mergeDiffs(diffs)
+		if got := aspaSet(merged.addASPA); !reflect.DeepEqual(got, v.announced) {
+			t.Errorf("Error on %s. Got announced %v, Want %v\n", v.desc, got, v.announced)
+		}
+		if got := aspaSet(merged.withdrawnASPAs()); !reflect.DeepEqual(got, v.withdrawn) {
+			t.Errorf("Error on %s. Got withdrawn %v, Want %v\n", v.desc, got, v.withdrawn)
+		}
+		if want := v.announced != nil || v.withdrawn != nil; merged.diff != want {
+			t.Errorf("Error on %s. Got diff %t, Want %t\n", v.desc, merged.diff, want)
+		}
+	}
+}
+
+// aspaSet returns the providers by customer, or nil if there are no ASPAs.
+func aspaSet(aspas []aspa) map[uint32][]uint32 {
+	if len(aspas) == 0 {
+		return nil
+	}
+	m := make(map[uint32][]uint32, len(aspas))
+	for _, a := range aspas {
+		m[a.Customer] = a.Providers
+	}
+	return m
+}
@@ -0,0 +1,902 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/ini.v1"
+	"inet.af/netaddr"
+)
+
+const (
+	// defaultTLSPort is the IANA assigned port for rpki-rtr-tls.
+	defaultTLSPort = 324
+
+	// defaultHistory is how many serials of diffs are kept by default.
+	defaultHistory = 10
+
+	// defaultMaxShrink is the percentage the ROA set may shrink by in one update.
+	defaultMaxShrink = 50
+
+	// defaultStaleAfter is how many seconds since the last successful fetch
+	// before the health check fails.
+	defaultStaleAfter = 3600
+
+	// defaultFetchTimeout is how many seconds fetching the ROAs can take.
+	defaultFetchTimeout = 60
+
+	// defaultFirstRefresh is how many seconds after startup the ROAs are
+	// fetched again, before settling into the usual refresh.
+	defaultFirstRefresh = 60
+
+	// defaultNotifyInterval is the least number of seconds between Serial Notifies.
+	defaultNotifyInterval = 60
+
+	// defaultConnectBurst is how many connections an IP can make in a row.
+	defaultConnectBurst = 5
+
+	// maxMD5KeyLen is TCP_MD5SIG_MAXKEYLEN on Linux.
+	maxMD5KeyLen = 80
+)
+
+// config holds all the settings needed to start the server.
+type config struct {
+	port   int64
+	admin  int64
+	grpc   int64
+	log    string
+	urls   []string
+	timers intervals
+	state  string
+	depth  int
+
+	// allowed are the prefixes clients may connect from. Empty allows all.
+	allowed []netaddr.IPPrefix
+
+	// TLS is only served if both a certificate and key are configured.
+	tlsCert string
+	tlsKey  string
+	tlsPort int64
+
+	// logFormat is either text or json.
+	logFormat string
+
+	// logLevel is the least level logged, debug, info, warn, or error.
+	logLevel string
+
+	// logMaxSize is the size in bytes the log file is rotated at. Zero never rotates.
+	logMaxSize int64
+
+	// statusInterval is how often the status is logged.
+	statusInterval time.Duration
+
+	// filter drops ROAs more specific than these prefix lengths, and caps MaxMask.
+	filter roaFilter
+
+	// maxShrink is the percentage the ROA set may shrink by before an update is refused.
+	maxShrink int
+
+	// maxDiff is the most ROAs an update can add and delete before routers are
+	// sent a Cache Reset instead of the diff. Zero is unlimited.
+	maxDiff int
+
+	// readTimeout drops clients which have sent nothing for this long. Zero
+	// disables it, and expireTimeout follows each client's expire interval.
+	readTimeout time.Duration
+
+	// maxSession closes sessions once they've lasted this long, so routers
+	// reconnect, perhaps to another instance. Zero never closes them.
+	maxSession time.Duration
+
+	// tcpKeepalive is the period of TCP keepalives on client connections. Zero
+	// uses Go's default, and negative disables them.
+	tcpKeepalive time.Duration
+
+	// keepalive sends a Serial Notify every refresh interval, even without changes.
+	keepalive bool
+
+	// notifyInterval is the least time between Serial Notifies. Zero doesn't limit them.
+	notifyInterval time.Duration
+
+	// staleAfter is how old the last successful fetch can be while still healthy.
+	staleAfter time.Duration
+
+	// maxClients caps the number of sessions. Zero is unlimited.
+	maxClients int
+
+	// fallbacks are tried in order when urls fail or have no ROAs.
+	fallbacks []string
+
+	// bind is the address to listen on. Empty is all interfaces.
+	bind string
+
+	// slurm is a file of local filters and assertions, as per RFC8416.
+	slurm string
+
+	// pprof adds the profiling handlers to the admin listener.
+	pprof bool
+
+	// md5Key is a TCP-MD5 (RFC2385) key shared with routers. Linux only.
+	md5Key string
+
+	// fetchTimeout is how long fetching the ROAs from a url can take.
+	fetchTimeout time.Duration
+
+	// firstRefresh is how soon after startup the ROAs are fetched again, if
+	// sooner than the usual refresh. Zero waits for the usual refresh.
+	firstRefresh time.Duration
+
+	// check fetches the ROAs once and exits, without serving anything.
+	check bool
+
+	// showVersion prints the version and exits, without reading the config.
+	showVersion bool
+
+	// empty serves no ROAs at serial 0, without fetching any, so routers can
+	// be tested against a known table.
+	empty bool
+
+	// adaptiveRefresh fetches just after the upstream data stops being valid,
+	// instead of every refreshROA.
+	adaptiveRefresh bool
+
+	// network is tcp for both IPv4 and IPv6, or tcp4 or tcp6 for only one.
+	network string
+
+	// instance names this server in logs and metrics. Empty if not named.
+	instance string
+
+	// proxyProtocol reads a PROXY protocol header on each TCP connection,
+	// for the router's address behind a load balancer.
+	proxyProtocol bool
+
+	// connectRate is how many connections a minute each IP can make, after
+	// connectBurst in a row. Zero is unlimited.
+	connectRate  int
+	connectBurst int
+
+	// timerOverrides are the intervals advertised to clients from particular
+	// prefixes, instead of timers.
+	timerOverrides []timerOverride
+
+	// views are subsets of the ROAs served on ports of their own.
+	views []roaView
+
+	// fields are the keys of each ROA in the json.
+	fields roaFields
+
+	// snapshot is where the ROAs are saved after each update, to be served if
+	// none can be fetched at startup. Empty disables it.
+	snapshot string
+}
+
+// requiredSetting is a setting with no default, and the flag it can be given
+// as instead.
+type requiredSetting struct {
+	key, flag string
+}
+
+var requiredSettings = []requiredSetting{
+	{"port", "port"},
+	{"log", "log"},
+	{"cacheurl", "cache-url"},
+}
+
+// missingSettings returns the required settings which aren't set. cacheurl
+// isn't needed to serve an empty table.
+func missingSettings(c config) []requiredSetting {
+	var missing []requiredSetting
+	for _, r := range requiredSettings {
+		switch {
+		case r.key == "port" && c.port != 0:
+		case r.key == "log" && c.log != "":
+		case r.key == "cacheurl" && (c.empty || strings.Join(c.urls, "") != ""):
+		default:
+			missing = append(missing, r)
+		}
+	}
+	return missing
+}
+
+// envPrefix starts the environment variables which set config, as in
+// RPKIRTR_CACHE_URL for cacheurl.
+const envPrefix = "RPKIRTR_"
+
+// applyEnv sets config from environment variables, replacing the config file.
+// The name after envPrefix is the setting, ignoring case and underscores.
+func applyEnv(sec *ini.Section, environ []string) {
+	for _, e := range environ {
+		name, value, ok := strings.Cut(e, "=")
+		if !ok || !strings.HasPrefix(name, envPrefix) {
+			continue
+		}
+		key := strings.ToLower(strings.ReplaceAll(strings.TrimPrefix(name, envPrefix), "_", ""))
+		sec.Key(key).SetValue(value)
+	}
+}
+
+// envName is the environment variable for a flag.
+func envName(flag string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// loadConfig reads the config file, then environment variables, with any flags
+// taking precedence over both. The config file is optional as long as all
+// required settings are passed as environment variables or flags.
+func loadConfig(args []string) (config, error) {
+	var c config
+	fs := flag.NewFlagSet("rpkirtr", flag.ContinueOnError)
+	file := fs.String("config", defaultConfigPath, "location of the config file")
+	port := fs.Int64("port", 0, "port to listen on")
+	logf := fs.String("log", "", "location of the log file, or - for standard output")
+	jsons := fs.String("cache-url", "", "comma separated json locations of VRPs. These can also be local files, either file:// or a plain path")
+	fs.StringVar(jsons, "urls", "", "alias of -cache-url")
+	check := fs.Bool("check", false, "load the config and ROAs once, print what was found, and exit")
+	showVersion := fs.Bool("version", false, "print the version and exit")
+	empty := fs.Bool("empty", false, "serve an empty table at serial 0, without fetching any ROAs")
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+	if *showVersion {
+		c.showVersion = true
+		return c, nil
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	set["cache-url"] = set["cache-url"] || set["urls"]
+
+	cf, err := ini.Load(*file)
+	noFile := errors.Is(err, os.ErrNotExist)
+	if err != nil {
+		if !noFile {
+			return c, fmt.Errorf("failed to read config file: %w", err)
+		}
+		// Every required setting then needs a flag, which is checked below.
+		cf = ini.Empty()
+	}
+	sec := cf.Section("rpkirtr")
+	applyEnv(sec, os.Environ())
+	c.check = *check
+	c.empty = *empty
+	if !set["empty"] {
+		if c.empty, err = readBool(sec, "empty", false); err != nil {
+			return c, err
+		}
+	}
+
+	c.port = *port
+	if !set["port"] && sec.HasKey("port") {
+		if c.port, err = sec.Key("port").Int64(); err != nil {
+			return c, fmt.Errorf("port set needs to be a number: %v", err)
+		}
+	}
+	if c.admin, err = readInt(sec, "adminport", 0); err != nil {
+		return c, err
+	}
+	if c.grpc, err = readInt(sec, "grpcport", 0); err != nil {
+		return c, err
+	}
+	c.bind = sec.Key("bind").String()
+	if path, ok := unixPath(c.bind); ok && path == "" {
+		return c, fmt.Errorf("bind on a Unix socket needs a path, as %s/path", unixPrefix)
+	}
+	c.log = *logf
+	if !set["log"] {
+		c.log = sec.Key("log").String()
+	}
+	c.instance = sec.Key("instance").String()
+	c.logFormat = sec.Key("logformat").MustString(textLogs)
+	if c.logFormat != textLogs && c.logFormat != jsonLogs {
+		return c, fmt.Errorf("logformat needs to be %s or %s, got %s", textLogs, jsonLogs, c.logFormat)
+	}
+	c.logLevel = sec.Key("loglevel").MustString(levelInfo)
+	if _, ok := logLevels[c.logLevel]; !ok {
+		return c, fmt.Errorf("loglevel needs to be %s, %s, %s, or %s, got %s", levelDebug, levelInfo, levelWarn, levelError, c.logLevel)
+	}
+	size, err := readInt(sec, "logmaxsize", 0)
+	if err != nil {
+		return c, err
+	}
+	if size < 0 {
+		return c, fmt.Errorf("logmaxsize can't be negative, got %d", size)
+	}
+	c.logMaxSize = size << 20
+	if !set["cache-url"] {
+		*jsons = sec.Key("cacheurl").String()
+	}
+	// Spaces around each location are dropped, as for fallbackurls.
+	for _, u := range strings.Split(*jsons, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			c.urls = append(c.urls, u)
+		}
+	}
+	if missing := missingSettings(c); len(missing) > 0 {
+		var keys, flags []string
+		for _, m := range missing {
+			keys = append(keys, m.key)
+			flags = append(flags, fmt.Sprintf("-%s (or %s)", m.flag, envName(m.flag)))
+		}
+		if noFile {
+			return c, fmt.Errorf("no config file at %s, so these flags are needed: %s. Create the file, or run rpkirtr -h for all flags", *file, strings.Join(flags, ", "))
+		}
+		return c, fmt.Errorf("%s is missing these settings: %s. They can also be given as flags: %s", *file, strings.Join(keys, ", "), strings.Join(flags, ", "))
+	}
+	if sec.Key("fallbackurls").String() != "" {
+		c.fallbacks = sec.Key("fallbackurls").Strings(",")
+	}
+	c.state = sec.Key("state").String()
+	c.snapshot = sec.Key("snapshot").String()
+	c.slurm = sec.Key("slurm").String()
+
+	depth, err := readInt(sec, "history", defaultHistory)
+	if err != nil {
+		return c, err
+	}
+	if depth < 1 {
+		return c, fmt.Errorf("history needs to be at least 1, got %d", depth)
+	}
+	c.depth = int(depth)
+
+	if c.allowed, err = readPrefixes(sec, "allowed"); err != nil {
+		return c, err
+	}
+
+	c.tlsCert = sec.Key("tlscert").String()
+	c.tlsKey = sec.Key("tlskey").String()
+	if (c.tlsCert == "") != (c.tlsKey == "") {
+		return c, fmt.Errorf("tlscert and tlskey need to be set together")
+	}
+	if c.tlsPort, err = readInt(sec, "tlsport", defaultTLSPort); err != nil {
+		return c, err
+	}
+
+	status, err := readInt(sec, "statusinterval", int64(refreshROA/time.Second))
+	if err != nil {
+		return c, err
+	}
+	if status < 1 {
+		return c, fmt.Errorf("statusinterval needs to be at least 1, got %d", status)
+	}
+	c.statusInterval = time.Duration(status) * time.Second
+
+	if c.filter.v4, err = readMask(sec, "maxminmaskv4", maxMinMaskv4, 32); err != nil {
+		return c, err
+	}
+	if c.filter.v6, err = readMask(sec, "maxminmaskv6", maxMinMaskv6, 128); err != nil {
+		return c, err
+	}
+	if c.filter.rirs, err = readRIRs(sec, "rirs"); err != nil {
+		return c, err
+	}
+	if c.filter.blockedASNs, c.filter.blockedPrefixes, err = readBlocklist(sec, "blocklist"); err != nil {
+		return c, err
+	}
+	if c.filter.maxV4, err = readMask(sec, "maxacceptv4", 0, 32); err != nil {
+		return c, err
+	}
+	if c.filter.maxV6, err = readMask(sec, "maxacceptv6", 0, 128); err != nil {
+		return c, err
+	}
+
+	shrink, err := readInt(sec, "maxshrink", defaultMaxShrink)
+	if err != nil {
+		return c, err
+	}
+	if shrink < 0 || shrink > 100 {
+		return c, fmt.Errorf("maxshrink needs to be between 0 and 100, got %d", shrink)
+	}
+	c.maxShrink = int(shrink)
+	maxDiff, err := readInt(sec, "maxdiffbeforereset", 0)
+	if err != nil {
+		return c, err
+	}
+	if maxDiff < 0 {
+		return c, fmt.Errorf("maxdiffbeforereset can't be negative, got %d", maxDiff)
+	}
+	c.maxDiff = int(maxDiff)
+
+	def := intervals{
+		refresh: DefaultRefreshInterval,
+		retry:   DefaultRetryInterval,
+		expire:  DefaultExpireInterval,
+	}
+	if c.timers, err = readIntervals(sec, def); err != nil {
+		return c, err
+	}
+	if c.timerOverrides, err = readTimerOverrides(cf, c.timers); err != nil {
+		return c, err
+	}
+	if c.views, err = readViews(cf, c); err != nil {
+		return c, err
+	}
+
+	// Routers need to check in before their data expires, so by default
+	// anything quiet for longer than that has gone away. The expire interval
+	// can be overridden per prefix and reloaded, so is looked up on each read.
+	c.readTimeout = expireTimeout
+	if sec.Key("readtimeout").String() != "" {
+		timeout, err := readInt(sec, "readtimeout", 0)
+		if err != nil {
+			return c, err
+		}
+		if timeout < 0 {
+			return c, fmt.Errorf("readtimeout can't be negative, got %d", timeout)
+		}
+		c.readTimeout = time.Duration(timeout) * time.Second
+	}
+
+	maxSession, err := readInt(sec, "maxsessionduration", 0)
+	if err != nil {
+		return c, err
+	}
+	if maxSession < 0 {
+		return c, fmt.Errorf("maxsessionduration can't be negative, got %d", maxSession)
+	}
+	c.maxSession = time.Duration(maxSession) * time.Second
+
+	keepalive, err := readInt(sec, "tcpkeepalive", 0)
+	if err != nil {
+		return c, err
+	}
+	if keepalive < -1 {
+		return c, fmt.Errorf("tcpkeepalive needs to be -1 or more, got %d", keepalive)
+	}
+	c.tcpKeepalive = time.Duration(keepalive) * time.Second
+
+	if c.keepalive, err = readBool(sec, "keepalive", false); err != nil {
+		return c, err
+	}
+
+	notify, err := readInt(sec, "notifyinterval", defaultNotifyInterval)
+	if err != nil {
+		return c, err
+	}
+	if notify < 0 {
+		return c, fmt.Errorf("notifyinterval can't be negative, got %d", notify)
+	}
+	c.notifyInterval = time.Duration(notify) * time.Second
+	if c.pprof, err = readBool(sec, "pprof", false); err != nil {
+		return c, err
+	}
+
+	stale, err := readInt(sec, "staleafter", defaultStaleAfter)
+	if err != nil {
+		return c, err
+	}
+	if stale < 1 {
+		return c, fmt.Errorf("staleafter needs to be at least 1, got %d", stale)
+	}
+	c.staleAfter = time.Duration(stale) * time.Second
+
+	clients, err := readInt(sec, "maxclients", 0)
+	if err != nil {
+		return c, err
+	}
+	if clients < 0 {
+		return c, fmt.Errorf("maxclients can't be negative, got %d", clients)
+	}
+	c.maxClients = int(clients)
+
+	rate, err := readInt(sec, "connectrate", 0)
+	if err != nil {
+		return c, err
+	}
+	if rate < 0 {
+		return c, fmt.Errorf("connectrate can't be negative, got %d", rate)
+	}
+	c.connectRate = int(rate)
+	burst, err := readInt(sec, "connectburst", defaultConnectBurst)
+	if err != nil {
+		return c, err
+	}
+	if burst < 1 {
+		return c, fmt.Errorf("connectburst needs to be at least 1, got %d", burst)
+	}
+	c.connectBurst = int(burst)
+
+	fetch, err := readInt(sec, "fetchtimeout", defaultFetchTimeout)
+	if err != nil {
+		return c, err
+	}
+	if fetch < 1 {
+		return c, fmt.Errorf("fetchtimeout needs to be at least 1, got %d", fetch)
+	}
+	c.fetchTimeout = time.Duration(fetch) * time.Second
+
+	first, err := readInt(sec, "firstrefresh", defaultFirstRefresh)
+	if err != nil {
+		return c, err
+	}
+	if first < 0 {
+		return c, fmt.Errorf("firstrefresh can't be negative, got %d", first)
+	}
+	c.firstRefresh = time.Duration(first) * time.Second
+
+	if c.adaptiveRefresh, err = readBool(sec, "adaptiverefresh", false); err != nil {
+		return c, err
+	}
+
+	if c.fields, err = readROAFields(sec); err != nil {
+		return c, err
+	}
+
+	c.network = sec.Key("network").MustString("tcp")
+	switch c.network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return c, fmt.Errorf("network needs to be tcp, tcp4, or tcp6, got %s", c.network)
+	}
+	if ip, err := netaddr.ParseIP(c.bind); err == nil &&
+		(c.network == "tcp4" && !ip.Is4() || c.network == "tcp6" && !ip.Is6()) {
+		return c, fmt.Errorf("bind %s can't be used with network %s", c.bind, c.network)
+	}
+	if c.proxyProtocol, err = readBool(sec, "proxyprotocol", false); err != nil {
+		return c, err
+	}
+
+	c.md5Key = sec.Key("md5key").String()
+	if len(c.md5Key) > maxMD5KeyLen {
+		return c, fmt.Errorf("md5key can be at most %d characters, got %d", maxMD5KeyLen, len(c.md5Key))
+	}
+
+	// TLS, TCP-MD5, and PROXY headers only make sense over TCP.
+	if _, ok := unixPath(c.bind); ok && (c.tlsCert != "" || c.md5Key != "" || c.proxyProtocol) {
+		return c, fmt.Errorf("tlscert, md5key, and proxyprotocol can't be used when binding to a Unix socket")
+	}
+
+	return c, nil
+}
+
+// restartNeeded returns the settings which differ between the configs, but
+// can't be applied by a reload.
+func restartNeeded(old, new config) []string {
+	settings := []struct {
+		name    string
+		changed bool
+	}{
+		{"port", old.port != new.port},
+		{"adminport", old.admin != new.admin},
+		{"grpcport", old.grpc != new.grpc},
+		{"bind", old.bind != new.bind},
+		{"network", old.network != new.network},
+		{"proxyprotocol", old.proxyProtocol != new.proxyProtocol},
+		{"log", old.log != new.log},
+		{"logformat", old.logFormat != new.logFormat},
+		{"instance", old.instance != new.instance},
+		{"logmaxsize", old.logMaxSize != new.logMaxSize},
+		{"fallbackurls", !reflect.DeepEqual(old.fallbacks, new.fallbacks)},
+		{"slurm", old.slurm != new.slurm},
+		{"state", old.state != new.state},
+		{"empty", old.empty != new.empty},
+		{"snapshot", old.snapshot != new.snapshot},
+		{"history", old.depth != new.depth},
+		{"tlscert", old.tlsCert != new.tlsCert},
+		{"tlskey", old.tlsKey != new.tlsKey},
+		{"tlsport", old.tlsPort != new.tlsPort},
+		{"statusinterval", old.statusInterval != new.statusInterval},
+		{"maxminmask, maxaccept, rirs, or blocklist", !reflect.DeepEqual(old.filter, new.filter)},
+		{"maxshrink", old.maxShrink != new.maxShrink},
+		{"maxdiffbeforereset", old.maxDiff != new.maxDiff},
+		{"view sections", !reflect.DeepEqual(old.views, new.views)},
+		{"readtimeout", old.readTimeout != new.readTimeout},
+		{"maxsessionduration", old.maxSession != new.maxSession},
+		{"tcpkeepalive", old.tcpKeepalive != new.tcpKeepalive},
+		{"keepalive", old.keepalive != new.keepalive},
+		{"notifyinterval", old.notifyInterval != new.notifyInterval},
+		{"staleafter", old.staleAfter != new.staleAfter},
+		{"maxclients", old.maxClients != new.maxClients},
+		{"connectrate or connectburst", old.connectRate != new.connectRate || old.connectBurst != new.connectBurst},
+		{"md5key", old.md5Key != new.md5Key},
+		{"fetchtimeout", old.fetchTimeout != new.fetchTimeout},
+		{"adaptiverefresh", old.adaptiveRefresh != new.adaptiveRefresh},
+		{"firstrefresh", old.firstRefresh != new.firstRefresh},
+		{"prefixfield, maxlengthfield, asnfield, or tafield", old.fields != new.fields},
+		{"pprof", old.pprof != new.pprof},
+	}
+	var names []string
+	for _, v := range settings {
+		if v.changed {
+			names = append(names, v.name)
+		}
+	}
+	return names
+}
+
+// readInt returns an optional number from config, or the default if not set.
+func readInt(sec *ini.Section, name string, def int64) (int64, error) {
+	if sec.Key(name).String() == "" {
+		return def, nil
+	}
+	v, err := sec.Key(name).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("%s set needs to be a number: %v", name, err)
+	}
+	return v, nil
+}
+
+// readBool returns an optional true or false from config, or the default if not set.
+func readBool(sec *ini.Section, name string, def bool) (bool, error) {
+	if sec.Key(name).String() == "" {
+		return def, nil
+	}
+	v, err := sec.Key(name).Bool()
+	if err != nil {
+		return false, fmt.Errorf("%s set needs to be true or false: %v", name, err)
+	}
+	return v, nil
+}
+
+// readMask returns a prefix length, or the default if not set.
+func readMask(sec *ini.Section, name string, def, max uint8) (uint8, error) {
+	if sec.Key(name).String() == "" {
+		return def, nil
+	}
+	v, err := sec.Key(name).Uint()
+	if err != nil {
+		return 0, fmt.Errorf("%s set needs to be a number: %v", name, err)
+	}
+	if v > uint(max) {
+		return 0, fmt.Errorf("%s needs to be between 0 and %d, got %d", name, max, v)
+	}
+	return uint8(v), nil
+}
+
+// readPrefixes returns a comma separated list of prefixes from config.
+func readPrefixes(sec *ini.Section, name string) ([]netaddr.IPPrefix, error) {
+	var prefixes []netaddr.IPPrefix
+	for _, v := range sec.Key(name).Strings(",") {
+		p, err := netaddr.ParseIPPrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s contains an invalid prefix: %v", name, err)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// readBlocklist returns the ASNs and prefixes in a comma separated list, where
+// each entry is either. Both are nil if not set.
+func readBlocklist(sec *ini.Section, name string) (map[uint32]bool, []netaddr.IPPrefix, error) {
+	var asns map[uint32]bool
+	var prefixes []netaddr.IPPrefix
+	for _, v := range sec.Key(name).Strings(",") {
+		if strings.Contains(v, "/") {
+			p, err := netaddr.ParseIPPrefix(v)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s contains an invalid prefix: %v", name, err)
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+		asn, err := asnToUint32(v)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s contains an invalid ASN: %v", name, err)
+		}
+		if asns == nil {
+			asns = make(map[uint32]bool)
+		}
+		asns[asn] = true
+	}
+	return asns, prefixes, nil
+}
+
+// readRIRs returns the set of RIRs in a comma separated list, or nil if not set.
+func readRIRs(sec *ini.Section, name string) (map[rir]bool, error) {
+	names := sec.Key(name).Strings(",")
+	if len(names) == 0 {
+		return nil, nil
+	}
+	rirs := make(map[rir]bool, len(names))
+	for _, v := range names {
+		r := parseRIR(v)
+		if r == unknownRIR || rirNames[r] != strings.ToLower(v) {
+			return nil, fmt.Errorf("%s contains an unknown RIR: %s", name, v)
+		}
+		rirs[r] = true
+	}
+	return rirs, nil
+}
+
+// readROAFields returns the keys of each ROA in the json, with the usual ones
+// for any not set. Each needs to be different, or one would hide another.
+func readROAFields(sec *ini.Section) (roaFields, error) {
+	f := roaFields{
+		prefix:    sec.Key("prefixfield").MustString(defaultROAFields.prefix),
+		maxLength: sec.Key("maxlengthfield").MustString(defaultROAFields.maxLength),
+		asn:       sec.Key("asnfield").MustString(defaultROAFields.asn),
+		ta:        sec.Key("tafield").MustString(defaultROAFields.ta),
+	}
+	seen := make(map[string]bool)
+	for _, v := range []string{f.prefix, f.maxLength, f.asn, f.ta} {
+		if seen[v] {
+			return f, fmt.Errorf("prefixfield, maxlengthfield, asnfield, and tafield need to be different, got %s twice", v)
+		}
+		seen[v] = true
+	}
+	return f, nil
+}
+
+// defaultConfigPath is where the config file is read from, unless -config says
+// otherwise. It doesn't depend on where the executable is, or how it's linked.
+const defaultConfigPath = "/etc/rpkirtr/config.ini"
+
+// intervals are the timers advertised to clients in the End of Data PDU.
+type intervals struct {
+	refresh uint32
+	retry   uint32
+	expire  uint32
+}
+
+// readIntervals loads the refresh, retry, and expire intervals from config.
+// Unset values fall back to def.
+// https://datatracker.ietf.org/doc/html/rfc8210#section-6
+func readIntervals(sec *ini.Section, def intervals) (intervals, error) {
+	var i intervals
+	var err error
+	if i.refresh, err = readInterval(sec, "refresh", def.refresh, 1, 86400); err != nil {
+		return i, err
+	}
+	if i.retry, err = readInterval(sec, "retry", def.retry, 1, 7200); err != nil {
+		return i, err
+	}
+	if i.expire, err = readInterval(sec, "expire", def.expire, 600, 172800); err != nil {
+		return i, err
+	}
+
+	// Expire must be larger than both refresh and retry.
+	if i.expire <= i.refresh || i.expire <= i.retry {
+		return i, fmt.Errorf("expire (%d) needs to be larger than refresh (%d) and retry (%d)", i.expire, i.refresh, i.retry)
+	}
+
+	return i, nil
+}
+
+// readInterval returns a single interval, or the default if not set.
+func readInterval(sec *ini.Section, name string, def, min, max uint32) (uint32, error) {
+	if sec.Key(name).String() == "" {
+		return def, nil
+	}
+	v, err := sec.Key(name).Uint()
+	if err != nil {
+		return 0, fmt.Errorf("%s set needs to be a number: %v", name, err)
+	}
+	if v < uint(min) || v > uint(max) {
+		return 0, fmt.Errorf("%s needs to be between %d and %d, got %d", name, min, max, v)
+	}
+	return uint32(v), nil
+}
+
+// timerOverride is the intervals advertised to clients connecting from prefix.
+type timerOverride struct {
+	prefix netaddr.IPPrefix
+	timers intervals
+}
+
+// timersSection starts the name of a config section overriding the intervals
+// for a prefix, as in [timers 192.0.2.0/24].
+const timersSection = "timers "
+
+// readTimerOverrides loads the intervals from each timers section. Anything
+// unset in a section is taken from def.
+func readTimerOverrides(cf *ini.File, def intervals) ([]timerOverride, error) {
+	var overrides []timerOverride
+	for _, sec := range cf.Sections() {
+		if !strings.HasPrefix(sec.Name(), timersSection) {
+			continue
+		}
+		p, err := netaddr.ParseIPPrefix(strings.TrimSpace(strings.TrimPrefix(sec.Name(), timersSection)))
+		if err != nil {
+			return nil, fmt.Errorf("section [%s] needs a valid prefix: %v", sec.Name(), err)
+		}
+		i, err := readIntervals(sec, def)
+		if err != nil {
+			return nil, fmt.Errorf("section [%s]: %w", sec.Name(), err)
+		}
+		overrides = append(overrides, timerOverride{prefix: p.Masked(), timers: i})
+	}
+	return overrides, nil
+}
+
+// roaView is a subset of the ROAs served on a port of its own, as in
+// [view ripe]. Empty rirs or prefixes don't filter on them.
+type roaView struct {
+	name     string
+	port     int64
+	rirs     map[rir]bool
+	prefixes []netaddr.IPPrefix
+}
+
+// viewSection starts the name of a config section for a view.
+const viewSection = "view "
+
+// readViews loads the view sections. Each needs a port of its own, other than
+// those the server already listens on.
+func readViews(cf *ini.File, c config) ([]roaView, error) {
+	var views []roaView
+	ports := map[int64]string{c.port: "port", c.admin: "adminport", c.grpc: "grpcport"}
+	if c.tlsCert != "" {
+		ports[c.tlsPort] = "tlsport"
+	}
+	for _, sec := range cf.Sections() {
+		if !strings.HasPrefix(sec.Name(), viewSection) {
+			continue
+		}
+		v := roaView{name: strings.TrimSpace(strings.TrimPrefix(sec.Name(), viewSection))}
+		if v.name == "" {
+			return nil, fmt.Errorf("section [%s] needs a name", sec.Name())
+		}
+		if _, ok := unixPath(c.bind); ok {
+			return nil, fmt.Errorf("section [%s] can't be used with bind on a Unix socket", sec.Name())
+		}
+		var err error
+		if v.port, err = readInt(sec, "port", 0); err != nil {
+			return nil, fmt.Errorf("section [%s]: %w", sec.Name(), err)
+		}
+		if v.port <= 0 {
+			return nil, fmt.Errorf("section [%s] needs a port", sec.Name())
+		}
+		if used, ok := ports[v.port]; ok {
+			return nil, fmt.Errorf("section [%s] port %d is already used by %s", sec.Name(), v.port, used)
+		}
+		ports[v.port] = "[" + sec.Name() + "]"
+		if v.rirs, err = readRIRs(sec, "rirs"); err != nil {
+			return nil, fmt.Errorf("section [%s]: %w", sec.Name(), err)
+		}
+		if v.prefixes, err = readPrefixes(sec, "prefixes"); err != nil {
+			return nil, fmt.Errorf("section [%s]: %w", sec.Name(), err)
+		}
+		views = append(views, v)
+	}
+	return views, nil
+}
+
+// keeps checks the ROA is from one of the view's RIRs, and for one of its
+// prefixes or anything more specific.
+func (v roaView) keeps(r roa) bool {
+	if len(v.rirs) > 0 && !v.rirs[r.RIR] {
+		return false
+	}
+	if len(v.prefixes) == 0 {
+		return true
+	}
+	for _, p := range v.prefixes {
+		if p.Contains(r.Prefix.IP()) && r.Prefix.Bits() >= p.Bits() {
+			return true
+		}
+	}
+	return false
+}
+
+// filter returns the ROAs the view keeps, in the same order.
+func (v roaView) filter(roas []roa) []roa {
+	var kept []roa
+	for _, r := range roas {
+		if v.keeps(r) {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
+
+// timersFor returns the intervals from the most specific override covering ip,
+// or def if none do.
+func timersFor(ip netaddr.IP, def intervals, overrides []timerOverride) intervals {
+	best := -1
+	for i, o := range overrides {
+		if o.prefix.Contains(ip.Unmap()) && (best < 0 || o.prefix.Bits() > overrides[best].prefix.Bits()) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return def
+	}
+	return overrides[best].timers
+}
@@ -0,0 +1,1420 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/ini.v1"
+	"inet.af/netaddr"
+)
+
+func TestReadIntervals(t *testing.T) {
+	tests := []struct {
+		desc    string
+		config  string
+		want    intervals
+		wantErr bool
+	}{
+		{
+			desc: "unset uses defaults",
+			want: intervals{
+				refresh: DefaultRefreshInterval,
+				retry:   DefaultRetryInterval,
+				expire:  DefaultExpireInterval,
+			},
+		},
+		{
+			desc:   "all set",
+			config: "refresh = 300\nretry = 60\nexpire = 900",
+			want: intervals{
+				refresh: 300,
+				retry:   60,
+				expire:  900,
+			},
+		},
+		{
+			desc:    "refresh too large",
+			config:  "refresh = 86401",
+			wantErr: true,
+		},
+		{
+			desc:    "retry zero",
+			config:  "retry = 0",
+			wantErr: true,
+		},
+		{
+			desc:    "expire too small",
+			config:  "expire = 599",
+			wantErr: true,
+		},
+		{
+			desc:    "expire smaller than refresh",
+			config:  "refresh = 7200\nexpire = 3600",
+			wantErr: true,
+		},
+		{
+			desc:    "not a number",
+			config:  "refresh = soon",
+			wantErr: true,
+		},
+	}
+	for _, v := range tests {
+		cf, err := ini.Load([]byte("[rpkirtr]\n" + v.config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := readIntervals(cf.Section("rpkirtr"), intervals{
+			refresh: DefaultRefreshInterval,
+			retry:   DefaultRetryInterval,
+			expire:  DefaultExpireInterval,
+		})
+		if err == nil && v.wantErr {
+			t.Errorf("Error on %s. Wanted an error, but none received", v.desc)
+			continue
+		}
+		if err != nil && !v.wantErr {
+			t.Errorf("Error on %s. No error expected, but error received: %v", v.desc, err)
+			continue
+		}
+		if !v.wantErr && got != v.want {
+			t.Errorf("Error on %s. Got %+v, Want %+v\n", v.desc, got, v.want)
+		}
+	}
+}
+
+func TestReadTimerOverrides(t *testing.T) {
+	def := intervals{refresh: 3600, retry: 600, expire: 7200}
+	tests := []struct {
+		desc    string
+		config  string
+		want    []timerOverride
+		wantErr bool
+	}{
+		{
+			desc: "none",
+		},
+		{
+			desc:   "unset are from the defaults",
+			config: "[timers 192.0.2.0/24]\nrefresh = 60",
+			want: []timerOverride{
+				{prefix: netaddr.MustParseIPPrefix("192.0.2.0/24"), timers: intervals{refresh: 60, retry: 600, expire: 7200}},
+			},
+		},
+		{
+			desc:   "prefixes are masked",
+			config: "[timers 2001:db8::1/32]\nrefresh = 60\nretry = 30\nexpire = 600",
+			want: []timerOverride{
+				{prefix: netaddr.MustParseIPPrefix("2001:db8::/32"), timers: intervals{refresh: 60, retry: 30, expire: 600}},
+			},
+		},
+		{
+			desc:    "invalid prefix",
+			config:  "[timers lab]\nrefresh = 60",
+			wantErr: true,
+		},
+		{
+			desc:    "invalid interval",
+			config:  "[timers 192.0.2.0/24]\nexpire = 60",
+			wantErr: true,
+		},
+	}
+	for _, v := range tests {
+		cf, err := ini.Load([]byte("[rpkirtr]\n" + v.config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := readTimerOverrides(cf, def)
+		if err == nil && v.wantErr {
+			t.Errorf("Error on %s. Wanted an error, but none received", v.desc)
+			continue
+		}
+		if err != nil && !v.wantErr {
+			t.Errorf("Error on %s. No error expected, but error received: %v", v.desc, err)
+			continue
+		}
+		if !v.wantErr && !reflect.DeepEqual(got, v.want) {
+			t.Errorf("Error on %s. Got %+v, Want %+v\n", v.desc, got, v.want)
+		}
+	}
+}
+
+func TestTimersFor(t *testing.T) {
+	def := intervals{refresh: 3600, retry: 600, expire: 7200}
+	lab := intervals{refresh: 60, retry: 30, expire: 600}
+	bench := intervals{refresh: 10, retry: 10, expire: 600}
+	overrides := []timerOverride{
+		{prefix: netaddr.MustParseIPPrefix("192.0.2.0/24"), timers: lab},
+		{prefix: netaddr.MustParseIPPrefix("192.0.2.128/25"), timers: bench},
+	}
+	tests := []struct {
+		ip   string
+		want intervals
+	}{
+		{ip: "198.51.100.1", want: def},
+		{ip: "192.0.2.1", want: lab},
+		{ip: "192.0.2.129", want: bench},
+		{ip: "::ffff:192.0.2.1", want: lab},
+	}
+	for _, v := range tests {
+		if got := timersFor(netaddr.MustParseIP(v.ip), def, overrides); got != v.want {
+			t.Errorf("Error on %s. Got %+v, Want %+v", v.ip, got, v.want)
+		}
+	}
+	if got := timersFor(netaddr.IP{}, def, overrides); got != def {
+		t.Errorf("Got %+v for no IP, Want %+v", got, def)
+	}
+}
+
+func TestViewKeeps(t *testing.T) {
+	view := roaView{
+		rirs:     map[rir]bool{ripe: true},
+		prefixes: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("192.0.2.0/24")},
+	}
+	tests := []struct {
+		prefix string
+		rir    rir
+		want   bool
+	}{
+		{prefix: "192.0.2.0/24", rir: ripe, want: true},
+		{prefix: "192.0.2.128/25", rir: ripe, want: true},
+		{prefix: "192.0.2.0/24", rir: arin},
+		{prefix: "192.0.0.0/16", rir: ripe},
+		{prefix: "198.51.100.0/24", rir: ripe},
+	}
+	for _, v := range tests {
+		r := roa{Prefix: netaddr.MustParseIPPrefix(v.prefix), MaxMask: 24, RIR: v.rir}
+		if got := view.keeps(r); got != v.want {
+			t.Errorf("Error on %s from %s. Got %t, Want %t", v.prefix, v.rir, got, v.want)
+		}
+	}
+	if !(roaView{}).keeps(roa{Prefix: netaddr.MustParseIPPrefix("198.51.100.0/24")}) {
+		t.Error("Got a ROA dropped by a view without filters, Want it kept")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	base := "[rpkirtr]\nport = 8282\nlog = /var/log/rpkirtr.log\ncacheurl = https://rpki.cloudflare.com/rpki.json\n"
+	defaults := intervals{
+		refresh: DefaultRefreshInterval,
+		retry:   DefaultRetryInterval,
+		expire:  DefaultExpireInterval,
+	}
+
+	tests := []struct {
+		desc    string
+		args    []string
+		env     map[string]string
+		config  string
+		want    config
+		wantErr bool
+	}{
+		{
+			desc: "config file only",
+			want: config{
+				port:           8282,
+				log:            "/var/log/rpkirtr.log",
+				urls:           []string{"https://rpki.cloudflare.com/rpki.json"},
+				timers:         defaults,
+				depth:          defaultHistory,
+				tlsPort:        defaultTLSPort,
+				logFormat:      textLogs,
+				logLevel:       levelInfo,
+				statusInterval: refreshROA,
+				filter:         roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6},
+				maxShrink:      defaultMaxShrink,
+				readTimeout:    expireTimeout,
+				staleAfter:     defaultStaleAfter * time.Second,
+				fetchTimeout:   defaultFetchTimeout * time.Second,
+				firstRefresh:   defaultFirstRefresh * time.Second,
+				notifyInterval: defaultNotifyInterval * time.Second,
+				network:        "tcp",
+				connectBurst:   defaultConnectBurst,
+				fields:         defaultROAFields,
+			},
+		},
+		{
+			desc: "flags override config file",
+			args: []string{"-port", "8383", "-cache-url", "file:///data/rpki.json"},
+			want: config{
+				port:           8383,
+				log:            "/var/log/rpkirtr.log",
+				urls:           []string{"file:///data/rpki.json"},
+				timers:         defaults,
+				depth:          defaultHistory,
+				tlsPort:        defaultTLSPort,
+				logFormat:      textLogs,
+				logLevel:       levelInfo,
+				statusInterval: refreshROA,
+				filter:         roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6},
+				maxShrink:      defaultMaxShrink,
+				readTimeout:    expireTimeout,
+				staleAfter:     defaultStaleAfter * time.Second,
+				fetchTimeout:   defaultFetchTimeout * time.Second,
+				firstRefresh:   defaultFirstRefresh * time.Second,
+				notifyInterval: defaultNotifyInterval * time.Second,
+				network:        "tcp",
+				connectBurst:   defaultConnectBurst,
+				fields:         defaultROAFields,
+			},
+		},
+		{
+			desc: "check flag",
+			args: []string{"-check"},
+			want: config{
+				port:           8282,
+				log:            "/var/log/rpkirtr.log",
+				urls:           []string{"https://rpki.cloudflare.com/rpki.json"},
+				timers:         defaults,
+				depth:          defaultHistory,
+				tlsPort:        defaultTLSPort,
+				logFormat:      textLogs,
+				logLevel:       levelInfo,
+				statusInterval: refreshROA,
+				filter:         roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6},
+				maxShrink:      defaultMaxShrink,
+				readTimeout:    expireTimeout,
+				staleAfter:     defaultStaleAfter * time.Second,
+				fetchTimeout:   defaultFetchTimeout * time.Second,
+				firstRefresh:   defaultFirstRefresh * time.Second,
+				notifyInterval: defaultNotifyInterval * time.Second,
+				network:        "tcp",
+				connectBurst:   defaultConnectBurst,
+				fields:         defaultROAFields,
+				check:          true,
+			},
+		},
+		{
+			desc: "version flag skips the config",
+			args: []string{"-version", "-config", "/nonexistent/config.ini"},
+			want: config{showVersion: true},
+		},
+		{
+			desc: "urls alias",
+			args: []string{"-urls", "a.json,b.json"},
+			want: config{
+				port:           8282,
+				log:            "/var/log/rpkirtr.log",
+				urls:           []string{"a.json", "b.json"},
+				timers:         defaults,
+				depth:          defaultHistory,
+				tlsPort:        defaultTLSPort,
+				logFormat:      textLogs,
+				logLevel:       levelInfo,
+				statusInterval: refreshROA,
+				filter:         roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6},
+				maxShrink:      defaultMaxShrink,
+				readTimeout:    expireTimeout,
+				staleAfter:     defaultStaleAfter * time.Second,
+				fetchTimeout:   defaultFetchTimeout * time.Second,
+				firstRefresh:   defaultFirstRefresh * time.Second,
+				notifyInterval: defaultNotifyInterval * time.Second,
+				network:        "tcp",
+				connectBurst:   defaultConnectBurst,
+				fields:         defaultROAFields,
+			},
+		},
+		{
+			desc: "cache urls with spaces",
+			args: []string{"-cache-url", " a.json, b.json ,"},
+			want: config{
+				port:           8282,
+				log:            "/var/log/rpkirtr.log",
+				urls:           []string{"a.json", "b.json"},
+				timers:         defaults,
+				depth:          defaultHistory,
+				tlsPort:        defaultTLSPort,
+				logFormat:      textLogs,
+				logLevel:       levelInfo,
+				statusInterval: refreshROA,
+				filter:         roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6},
+				maxShrink:      defaultMaxShrink,
+				readTimeout:    expireTimeout,
+				staleAfter:     defaultStaleAfter * time.Second,
+				fetchTimeout:   defaultFetchTimeout * time.Second,
+				firstRefresh:   defaultFirstRefresh * time.Second,
+				notifyInterval: defaultNotifyInterval * time.Second,
+				network:        "tcp",
+				connectBurst:   defaultConnectBurst,
+				fields:         defaultROAFields,
+			},
+		},
+		{
+			desc: "no config file with all flags",
+			args: []string{"-config", "/nonexistent/config.ini", "-port", "8282", "-log", "/tmp/rpkirtr.log", "-cache-url", "file:///data/rpki.json"},
+			want: config{
+				port:           8282,
+				log:            "/tmp/rpkirtr.log",
+				urls:           []string{"file:///data/rpki.json"},
+				timers:         defaults,
+				depth:          defaultHistory,
+				tlsPort:        defaultTLSPort,
+				logFormat:      textLogs,
+				logLevel:       levelInfo,
+				statusInterval: refreshROA,
+				filter:         roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6},
+				maxShrink:      defaultMaxShrink,
+				readTimeout:    expireTimeout,
+				staleAfter:     defaultStaleAfter * time.Second,
+				fetchTimeout:   defaultFetchTimeout * time.Second,
+				firstRefresh:   defaultFirstRefresh * time.Second,
+				notifyInterval: defaultNotifyInterval * time.Second,
+				network:        "tcp",
+				connectBurst:   defaultConnectBurst,
+				fields:         defaultROAFields,
+			},
+		},
+		{
+			desc: "environment overrides config file",
+			env:  map[string]string{"RPKIRTR_PORT": "8383", "RPKIRTR_CACHE_URL": "file:///data/rpki.json", "RPKIRTR_MAX_SHRINK": "10"},
+			want: config{
+				port:           8383,
+				log:            "/var/log/rpkirtr.log",
+				urls:           []string{"file:///data/rpki.json"},
+				timers:         defaults,
+				depth:          defaultHistory,
+				tlsPort:        defaultTLSPort,
+				logFormat:      textLogs,
+				logLevel:       levelInfo,
+				statusInterval: refreshROA,
+				filter:         roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6},
+				maxShrink:      10,
+				readTimeout:    expireTimeout,
+				staleAfter:     defaultStaleAfter * time.Second,
+				fetchTimeout:   defaultFetchTimeout * time.Second,
+				firstRefresh:   defaultFirstRefresh * time.Second,
+				notifyInterval: defaultNotifyInterval * time.Second,
+				network:        "tcp",
+				connectBurst:   defaultConnectBurst,
+				fields:         defaultROAFields,
+			},
+		},
+		{
+			desc: "flags override environment",
+			args: []string{"-port", "8484"},
+			env:  map[string]string{"RPKIRTR_PORT": "8383"},
+			want: config{
+				port:           8484,
+				log:            "/var/log/rpkirtr.log",
+				urls:           []string{"https://rpki.cloudflare.com/rpki.json"},
+				timers:         defaults,
+				depth:          defaultHistory,
+				tlsPort:        defaultTLSPort,
+				logFormat:      textLogs,
+				logLevel:       levelInfo,
+				statusInterval: refreshROA,
+				filter:         roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6},
+				maxShrink:      defaultMaxShrink,
+				readTimeout:    expireTimeout,
+				staleAfter:     defaultStaleAfter * time.Second,
+				fetchTimeout:   defaultFetchTimeout * time.Second,
+				firstRefresh:   defaultFirstRefresh * time.Second,
+				notifyInterval: defaultNotifyInterval * time.Second,
+				network:        "tcp",
+				connectBurst:   defaultConnectBurst,
+				fields:         defaultROAFields,
+			},
+		},
+		{
+			desc: "environment without a config file",
+			args: []string{"-config", "/nonexistent/config.ini"},
+			env:  map[string]string{"RPKIRTR_PORT": "8383", "RPKIRTR_LOG": "-", "RPKIRTR_CACHE_URL": "file:///data/rpki.json"},
+			want: config{
+				port:           8383,
+				log:            "-",
+				urls:           []string{"file:///data/rpki.json"},
+				timers:         defaults,
+				depth:          defaultHistory,
+				tlsPort:        defaultTLSPort,
+				logFormat:      textLogs,
+				logLevel:       levelInfo,
+				statusInterval: refreshROA,
+				filter:         roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6},
+				maxShrink:      defaultMaxShrink,
+				readTimeout:    expireTimeout,
+				staleAfter:     defaultStaleAfter * time.Second,
+				fetchTimeout:   defaultFetchTimeout * time.Second,
+				firstRefresh:   defaultFirstRefresh * time.Second,
+				notifyInterval: defaultNotifyInterval * time.Second,
+				network:        "tcp",
+				connectBurst:   defaultConnectBurst,
+				fields:         defaultROAFields,
+			},
+		},
+		{
+			desc:    "invalid setting from the environment",
+			env:     map[string]string{"RPKIRTR_MAXSHRINK": "lots"},
+			wantErr: true,
+		},
+		{
+			desc:    "no config file and missing flags",
+			args:    []string{"-config", "/nonexistent/config.ini", "-port", "8282"},
+			wantErr: true,
+		},
+		{
+			desc: "empty table needs no cache url",
+			args: []string{"-config", "/nonexistent/config.ini", "-port", "8282", "-log", "-", "-empty"},
+			want: config{
+				port:           8282,
+				log:            "-",
+				timers:         defaults,
+				depth:          defaultHistory,
+				tlsPort:        defaultTLSPort,
+				logFormat:      textLogs,
+				logLevel:       levelInfo,
+				statusInterval: refreshROA,
+				filter:         roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6},
+				maxShrink:      defaultMaxShrink,
+				readTimeout:    expireTimeout,
+				staleAfter:     defaultStaleAfter * time.Second,
+				fetchTimeout:   defaultFetchTimeout * time.Second,
+				firstRefresh:   defaultFirstRefresh * time.Second,
+				notifyInterval: defaultNotifyInterval * time.Second,
+				network:        "tcp",
+				connectBurst:   defaultConnectBurst,
+				fields:         defaultROAFields,
+				empty:          true,
+			},
+		},
+		{
+			desc:   "empty table from config",
+			config: "empty = true\n",
+			want: config{
+				port:           8282,
+				log:            "/var/log/rpkirtr.log",
+				urls:           []string{"https://rpki.cloudflare.com/rpki.json"},
+				timers:         defaults,
+				depth:          defaultHistory,
+				tlsPort:        defaultTLSPort,
+				logFormat:      textLogs,
+				logLevel:       levelInfo,
+				statusInterval: refreshROA,
+				filter:         roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6},
+				maxShrink:      defaultMaxShrink,
+				readTimeout:    expireTimeout,
+				staleAfter:     defaultStaleAfter * time.Second,
+				fetchTimeout:   defaultFetchTimeout * time.Second,
+				firstRefresh:   defaultFirstRefresh * time.Second,
+				notifyInterval: defaultNotifyInterval * time.Second,
+				network:        "tcp",
+				connectBurst:   defaultConnectBurst,
+				fields:         defaultROAFields,
+				empty:          true,
+			},
+		},
+		{
+			desc:   "allowed prefixes",
+			config: "allowed = 192.0.2.1/24, 2001:db8::/32\n",
+			want: config{
+				port:   8282,
+				log:    "/var/log/rpkirtr.log",
+				urls:   []string{"https://rpki.cloudflare.com/rpki.json"},
+				timers: defaults,
+				depth:  defaultHistory,
+				allowed: []netaddr.IPPrefix{
+					netaddr.MustParseIPPrefix("192.0.2.0/24"),
+					netaddr.MustParseIPPrefix("2001:db8::/32"),
+				},
+				tlsPort:        defaultTLSPort,
+				logFormat:      textLogs,
+				logLevel:       levelInfo,
+				statusInterval: refreshROA,
+				filter:         roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6},
+				maxShrink:      defaultMaxShrink,
+				readTimeout:    expireTimeout,
+				staleAfter:     defaultStaleAfter * time.Second,
+				fetchTimeout:   defaultFetchTimeout * time.Second,
+				firstRefresh:   defaultFirstRefresh * time.Second,
+				notifyInterval: defaultNotifyInterval * time.Second,
+				network:        "tcp",
+				connectBurst:   defaultConnectBurst,
+				fields:         defaultROAFields,
+			},
+		},
+		{
+			desc:    "invalid allowed prefix",
+			config:  "allowed = 192.0.2.0\n",
+			wantErr: true,
+		},
+		{
+			desc:    "history too small",
+			config:  "history = 0\n",
+			wantErr: true,
+		},
+		{
+			desc:    "tls cert without key",
+			args:    []string{"-port", "8282"},
+			config:  "tlscert = /etc/rpkirtr/cert.pem\n",
+			wantErr: true,
+		},
+		{
+			desc:   "json logs",
+			config: "logformat = json\n",
+			want: config{
+				port:           8282,
+				log:            "/var/log/rpkirtr.log",
+				urls:           []string{"https://rpki.cloudflare.com/rpki.json"},
+				timers:         defaults,
+				depth:          defaultHistory,
+				tlsPort:        defaultTLSPort,
+				logFormat:      jsonLogs,
+				logLevel:       levelInfo,
+				statusInterval: refreshROA,
+				filter:         roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6},
+				maxShrink:      defaultMaxShrink,
+				readTimeout:    expireTimeout,
+				staleAfter:     defaultStaleAfter * time.Second,
+				fetchTimeout:   defaultFetchTimeout * time.Second,
+				firstRefresh:   defaultFirstRefresh * time.Second,
+				notifyInterval: defaultNotifyInterval * time.Second,
+				network:        "tcp",
+				connectBurst:   defaultConnectBurst,
+				fields:         defaultROAFields,
+			},
+		},
+		{
+			desc:    "unknown log format",
+			config:  "logformat = xml\n",
+			wantErr: true,
+		},
+		{
+			desc:   "status interval",
+			config: "statusinterval = 60\n",
+			want: config{
+				port:           8282,
+				log:            "/var/log/rpkirtr.log",
+				urls:           []string{"https://rpki.cloudflare.com/rpki.json"},
+				timers:         defaults,
+				depth:          defaultHistory,
+				tlsPort:        defaultTLSPort,
+				logFormat:      textLogs,
+				logLevel:       levelInfo,
+				statusInterval: time.Minute,
+				filter:         roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6},
+				maxShrink:      defaultMaxShrink,
+				readTimeout:    expireTimeout,
+				staleAfter:     defaultStaleAfter * time.Second,
+				fetchTimeout:   defaultFetchTimeout * time.Second,
+				firstRefresh:   defaultFirstRefresh * time.Second,
+				notifyInterval: defaultNotifyInterval * time.Second,
+				network:        "tcp",
+				connectBurst:   defaultConnectBurst,
+				fields:         defaultROAFields,
+			},
+		},
+		{
+			desc:    "status interval too small",
+			config:  "statusinterval = 0\n",
+			wantErr: true,
+		},
+		{
+			desc:   "mask filter",
+			config: "maxminmaskv4 = 28\nmaxminmaskv6 = 64\n",
+			want: config{
+				port:           8282,
+				log:            "/var/log/rpkirtr.log",
+				urls:           []string{"https://rpki.cloudflare.com/rpki.json"},
+				timers:         defaults,
+				depth:          defaultHistory,
+				tlsPort:        defaultTLSPort,
+				logFormat:      textLogs,
+				logLevel:       levelInfo,
+				statusInterval: refreshROA,
+				filter:         roaFilter{v4: 28, v6: 64},
+				maxShrink:      defaultMaxShrink,
+				readTimeout:    expireTimeout,
+				staleAfter:     defaultStaleAfter * time.Second,
+				fetchTimeout:   defaultFetchTimeout * time.Second,
+				firstRefresh:   defaultFirstRefresh * time.Second,
+				notifyInterval: defaultNotifyInterval * time.Second,
+				network:        "tcp",
+				connectBurst:   defaultConnectBurst,
+				fields:         defaultROAFields,
+			},
+		},
+		{
+			desc:    "mask filter too long",
+			config:  "maxminmaskv4 = 33\n",
+			wantErr: true,
+		},
+		{
+			desc:   "max accept",
+			config: "maxacceptv4 = 24\nmaxacceptv6 = 48\n",
+			want: config{
+				port:           8282,
+				log:            "/var/log/rpkirtr.log",
+				urls:           []string{"https://rpki.cloudflare.com/rpki.json"},
+				timers:         defaults,
+				depth:          defaultHistory,
+				tlsPort:        defaultTLSPort,
+				logFormat:      textLogs,
+				logLevel:       levelInfo,
+				statusInterval: refreshROA,
+				filter:         roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6, maxV4: 24, maxV6: 48},
+				maxShrink:      defaultMaxShrink,
+				readTimeout:    expireTimeout,
+				staleAfter:     defaultStaleAfter * time.Second,
+				fetchTimeout:   defaultFetchTimeout * time.Second,
+				firstRefresh:   defaultFirstRefresh * time.Second,
+				notifyInterval: defaultNotifyInterval * time.Second,
+				network:        "tcp",
+				connectBurst:   defaultConnectBurst,
+				fields:         defaultROAFields,
+			},
+		},
+		{
+			desc:   "blocklist",
+			config: "blocklist = AS64496, 192.0.2.1/24, 64497, 2001:db8::/32\n",
+			want: config{
+				port:           8282,
+				log:            "/var/log/rpkirtr.log",
+				urls:           []string{"https://rpki.cloudflare.com/rpki.json"},
+				timers:         defaults,
+				depth:          defaultHistory,
+				tlsPort:        defaultTLSPort,
+				logFormat:      textLogs,
+				logLevel:       levelInfo,
+				statusInterval: refreshROA,
+				filter: roaFilter{
+					v4:          maxMinMaskv4,
+					v6:          maxMinMaskv6,
+					blockedASNs: map[uint32]bool{64496: true, 64497: true},
+					blockedPrefixes: []netaddr.IPPrefix{
+						netaddr.MustParseIPPrefix("192.0.2.0/24"),
+						netaddr.MustParseIPPrefix("2001:db8::/32"),
+					},
+				},
+				maxShrink:      defaultMaxShrink,
+				readTimeout:    expireTimeout,
+				staleAfter:     defaultStaleAfter * time.Second,
+				fetchTimeout:   defaultFetchTimeout * time.Second,
+				firstRefresh:   defaultFirstRefresh * time.Second,
+				notifyInterval: defaultNotifyInterval * time.Second,
+				network:        "tcp",
+				connectBurst:   defaultConnectBurst,
+				fields:         defaultROAFields,
+			},
+		},
+		{
+			desc:    "blocklist with an invalid entry",
+			config:  "blocklist = AS64496, bad\n",
+			wantErr: true,
+		},
+		{
+			desc:    "max accept too long",
+			config:  "maxacceptv6 = 129\n",
+			wantErr: true,
+		},
+		{
+			desc:   "custom fields",
+			config: "prefixfield = ip_prefix\nasnfield = origin\n",
+			want: config{
+				port:           8282,
+				log:            "/var/log/rpkirtr.log",
+				urls:           []string{"https://rpki.cloudflare.com/rpki.json"},
+				timers:         defaults,
+				depth:          defaultHistory,
+				tlsPort:        defaultTLSPort,
+				logFormat:      textLogs,
+				logLevel:       levelInfo,
+				statusInterval: refreshROA,
+				filter:         roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6},
+				maxShrink:      defaultMaxShrink,
+				readTimeout:    expireTimeout,
+				staleAfter:     defaultStaleAfter * time.Second,
+				fetchTimeout:   defaultFetchTimeout * time.Second,
+				firstRefresh:   defaultFirstRefresh * time.Second,
+				notifyInterval: defaultNotifyInterval * time.Second,
+				network:        "tcp",
+				connectBurst:   defaultConnectBurst,
+				fields:         roaFields{prefix: "ip_prefix", maxLength: "maxLength", asn: "origin", ta: "ta"},
+			},
+		},
+		{
+			desc:   "tcp keepalive",
+			config: "tcpkeepalive = 30\n",
+			want: config{
+				port:           8282,
+				log:            "/var/log/rpkirtr.log",
+				urls:           []string{"https://rpki.cloudflare.com/rpki.json"},
+				timers:         defaults,
+				depth:          defaultHistory,
+				tlsPort:        defaultTLSPort,
+				logFormat:      textLogs,
+				logLevel:       levelInfo,
+				statusInterval: refreshROA,
+				filter:         roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6},
+				maxShrink:      defaultMaxShrink,
+				readTimeout:    expireTimeout,
+				tcpKeepalive:   30 * time.Second,
+				staleAfter:     defaultStaleAfter * time.Second,
+				fetchTimeout:   defaultFetchTimeout * time.Second,
+				firstRefresh:   defaultFirstRefresh * time.Second,
+				notifyInterval: defaultNotifyInterval * time.Second,
+				network:        "tcp",
+				connectBurst:   defaultConnectBurst,
+				fields:         defaultROAFields,
+			},
+		},
+		{
+			desc:    "tcp keepalive too small",
+			config:  "tcpkeepalive = -2\n",
+			wantErr: true,
+		},
+		{
+			desc:    "same field twice",
+			config:  "asnfield = origin\ntafield = origin\n",
+			wantErr: true,
+		},
+		{
+			desc:   "view",
+			config: "\n[view ripe]\nport = 8284\nrirs = ripe\nprefixes = 192.0.2.0/24, 2001:db8::/32\n",
+			want: config{
+				port:           8282,
+				log:            "/var/log/rpkirtr.log",
+				urls:           []string{"https://rpki.cloudflare.com/rpki.json"},
+				timers:         defaults,
+				depth:          defaultHistory,
+				tlsPort:        defaultTLSPort,
+				logFormat:      textLogs,
+				logLevel:       levelInfo,
+				statusInterval: refreshROA,
+				filter:         roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6},
+				maxShrink:      defaultMaxShrink,
+				readTimeout:    expireTimeout,
+				staleAfter:     defaultStaleAfter * time.Second,
+				fetchTimeout:   defaultFetchTimeout * time.Second,
+				firstRefresh:   defaultFirstRefresh * time.Second,
+				notifyInterval: defaultNotifyInterval * time.Second,
+				network:        "tcp",
+				connectBurst:   defaultConnectBurst,
+				fields:         defaultROAFields,
+				views: []roaView{{
+					name: "ripe",
+					port: 8284,
+					rirs: map[rir]bool{ripe: true},
+					prefixes: []netaddr.IPPrefix{
+						netaddr.MustParseIPPrefix("192.0.2.0/24"),
+						netaddr.MustParseIPPrefix("2001:db8::/32"),
+					},
+				}},
+			},
+		},
+		{
+			desc:    "view without a port",
+			config:  "\n[view ripe]\nrirs = ripe\n",
+			wantErr: true,
+		},
+		{
+			desc:    "view on the RTR port",
+			config:  "\n[view ripe]\nport = 8282\n",
+			wantErr: true,
+		},
+		{
+			desc:    "view on the gRPC port",
+			config:  "grpcport = 8285\n\n[view ripe]\nport = 8285\n",
+			wantErr: true,
+		},
+		{
+			desc:   "gRPC port",
+			config: "grpcport = 8285\n",
+			want: config{
+				port:           8282,
+				grpc:           8285,
+				log:            "/var/log/rpkirtr.log",
+				urls:           []string{"https://rpki.cloudflare.com/rpki.json"},
+				timers:         defaults,
+				depth:          defaultHistory,
+				tlsPort:        defaultTLSPort,
+				logFormat:      textLogs,
+				logLevel:       levelInfo,
+				statusInterval: refreshROA,
+				filter:         roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6},
+				maxShrink:      defaultMaxShrink,
+				readTimeout:    expireTimeout,
+				staleAfter:     defaultStaleAfter * time.Second,
+				fetchTimeout:   defaultFetchTimeout * time.Second,
+				firstRefresh:   defaultFirstRefresh * time.Second,
+				notifyInterval: defaultNotifyInterval * time.Second,
+				network:        "tcp",
+				connectBurst:   defaultConnectBurst,
+				fields:         defaultROAFields,
+			},
+		},
+		{
+			desc:    "views on the same port",
+			config:  "\n[view ripe]\nport = 8284\n[view arin]\nport = 8284\n",
+			wantErr: true,
+		},
+		{
+			desc:    "view with an unknown RIR",
+			config:  "\n[view lab]\nport = 8284\nrirs = iana\n",
+			wantErr: true,
+		},
+		{
+			desc:   "max diff before reset",
+			config: "maxdiffbeforereset = 10000\n",
+			want: config{
+				port:           8282,
+				log:            "/var/log/rpkirtr.log",
+				urls:           []string{"https://rpki.cloudflare.com/rpki.json"},
+				timers:         defaults,
+				depth:          defaultHistory,
+				tlsPort:        defaultTLSPort,
+				logFormat:      textLogs,
+				logLevel:       levelInfo,
+				statusInterval: refreshROA,
+				filter:         roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6},
+				maxShrink:      defaultMaxShrink,
+				maxDiff:        10000,
+				readTimeout:    expireTimeout,
+				staleAfter:     defaultStaleAfter * time.Second,
+				fetchTimeout:   defaultFetchTimeout * time.Second,
+				firstRefresh:   defaultFirstRefresh * time.Second,
+				notifyInterval: defaultNotifyInterval * time.Second,
+				network:        "tcp",
+				connectBurst:   defaultConnectBurst,
+				fields:         defaultROAFields,
+			},
+		},
+		{
+			desc:    "negative max diff before reset",
+			config:  "maxdiffbeforereset = -1\n",
+			wantErr: true,
+		},
+		{
+			desc:    "max shrink over 100",
+			config:  "maxshrink = 101\n",
+			wantErr: true,
+		},
+		{
+			desc:   "read timeout disabled",
+			config: "readtimeout = 0\n",
+			want: config{
+				port:           8282,
+				log:            "/var/log/rpkirtr.log",
+				urls:           []string{"https://rpki.cloudflare.com/rpki.json"},
+				timers:         defaults,
+				depth:          defaultHistory,
+				tlsPort:        defaultTLSPort,
+				logFormat:      textLogs,
+				logLevel:       levelInfo,
+				statusInterval: refreshROA,
+				filter:         roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6},
+				maxShrink:      defaultMaxShrink,
+				staleAfter:     defaultStaleAfter * time.Second,
+				fetchTimeout:   defaultFetchTimeout * time.Second,
+				firstRefresh:   defaultFirstRefresh * time.Second,
+				notifyInterval: defaultNotifyInterval * time.Second,
+				network:        "tcp",
+				connectBurst:   defaultConnectBurst,
+				fields:         defaultROAFields,
+			},
+		},
+		{
+			desc:    "negative read timeout",
+			config:  "readtimeout = -1\n",
+			wantErr: true,
+		},
+		{
+			desc:   "max session duration",
+			config: "maxsessionduration = 86400\n",
+			want: config{
+				port:           8282,
+				log:            "/var/log/rpkirtr.log",
+				urls:           []string{"https://rpki.cloudflare.com/rpki.json"},
+				timers:         defaults,
+				depth:          defaultHistory,
+				tlsPort:        defaultTLSPort,
+				logFormat:      textLogs,
+				logLevel:       levelInfo,
+				statusInterval: refreshROA,
+				filter:         roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6},
+				maxShrink:      defaultMaxShrink,
+				readTimeout:    expireTimeout,
+				maxSession:     86400 * time.Second,
+				staleAfter:     defaultStaleAfter * time.Second,
+				fetchTimeout:   defaultFetchTimeout * time.Second,
+				firstRefresh:   defaultFirstRefresh * time.Second,
+				notifyInterval: defaultNotifyInterval * time.Second,
+				network:        "tcp",
+				connectBurst:   defaultConnectBurst,
+				fields:         defaultROAFields,
+			},
+		},
+		{
+			desc:    "negative max session duration",
+			config:  "maxsessionduration = -1\n",
+			wantErr: true,
+		},
+		{
+			desc:    "keepalive not a bool",
+			config:  "keepalive = maybe\n",
+			wantErr: true,
+		},
+		{
+			desc:    "negative max clients",
+			config:  "maxclients = -1\n",
+			wantErr: true,
+		},
+		{
+			desc:   "log rotation",
+			config: "logmaxsize = 10\n",
+			want: config{
+				port:           8282,
+				log:            "/var/log/rpkirtr.log",
+				urls:           []string{"https://rpki.cloudflare.com/rpki.json"},
+				timers:         defaults,
+				depth:          defaultHistory,
+				tlsPort:        defaultTLSPort,
+				logFormat:      textLogs,
+				logLevel:       levelInfo,
+				logMaxSize:     10 << 20,
+				statusInterval: refreshROA,
+				filter:         roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6},
+				maxShrink:      defaultMaxShrink,
+				readTimeout:    expireTimeout,
+				staleAfter:     defaultStaleAfter * time.Second,
+				fetchTimeout:   defaultFetchTimeout * time.Second,
+				firstRefresh:   defaultFirstRefresh * time.Second,
+				notifyInterval: defaultNotifyInterval * time.Second,
+				network:        "tcp",
+				connectBurst:   defaultConnectBurst,
+				fields:         defaultROAFields,
+			},
+		},
+		{
+			desc:   "first refresh at the usual time",
+			config: "firstrefresh = 0\n",
+			want: config{
+				port:           8282,
+				log:            "/var/log/rpkirtr.log",
+				urls:           []string{"https://rpki.cloudflare.com/rpki.json"},
+				timers:         defaults,
+				depth:          defaultHistory,
+				tlsPort:        defaultTLSPort,
+				logFormat:      textLogs,
+				logLevel:       levelInfo,
+				statusInterval: refreshROA,
+				filter:         roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6},
+				maxShrink:      defaultMaxShrink,
+				readTimeout:    expireTimeout,
+				staleAfter:     defaultStaleAfter * time.Second,
+				fetchTimeout:   defaultFetchTimeout * time.Second,
+				notifyInterval: defaultNotifyInterval * time.Second,
+				network:        "tcp",
+				connectBurst:   defaultConnectBurst,
+				fields:         defaultROAFields,
+			},
+		},
+		{
+			desc:    "negative first refresh",
+			config:  "firstrefresh = -1\n",
+			wantErr: true,
+		},
+		{
+			desc:    "negative log size",
+			config:  "logmaxsize = -1\n",
+			wantErr: true,
+		},
+		{
+			desc:   "md5 key",
+			config: "md5key = secret\n",
+			want: config{
+				port:           8282,
+				log:            "/var/log/rpkirtr.log",
+				urls:           []string{"https://rpki.cloudflare.com/rpki.json"},
+				timers:         defaults,
+				depth:          defaultHistory,
+				tlsPort:        defaultTLSPort,
+				logFormat:      textLogs,
+				logLevel:       levelInfo,
+				statusInterval: refreshROA,
+				filter:         roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6},
+				maxShrink:      defaultMaxShrink,
+				readTimeout:    expireTimeout,
+				staleAfter:     defaultStaleAfter * time.Second,
+				fetchTimeout:   defaultFetchTimeout * time.Second,
+				firstRefresh:   defaultFirstRefresh * time.Second,
+				notifyInterval: defaultNotifyInterval * time.Second,
+				network:        "tcp",
+				connectBurst:   defaultConnectBurst,
+				fields:         defaultROAFields,
+				md5Key:         "secret",
+			},
+		},
+		{
+			desc:   "rir filter",
+			config: "rirs = RIPE, arin\n",
+			want: config{
+				port:           8282,
+				log:            "/var/log/rpkirtr.log",
+				urls:           []string{"https://rpki.cloudflare.com/rpki.json"},
+				timers:         defaults,
+				depth:          defaultHistory,
+				tlsPort:        defaultTLSPort,
+				logFormat:      textLogs,
+				logLevel:       levelInfo,
+				statusInterval: refreshROA,
+				filter:         roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6, rirs: map[rir]bool{ripe: true, arin: true}},
+				maxShrink:      defaultMaxShrink,
+				readTimeout:    expireTimeout,
+				staleAfter:     defaultStaleAfter * time.Second,
+				fetchTimeout:   defaultFetchTimeout * time.Second,
+				firstRefresh:   defaultFirstRefresh * time.Second,
+				notifyInterval: defaultNotifyInterval * time.Second,
+				network:        "tcp",
+				connectBurst:   defaultConnectBurst,
+				fields:         defaultROAFields,
+			},
+		},
+		{
+			desc:    "unknown rir",
+			config:  "rirs = ripe, iana\n",
+			wantErr: true,
+		},
+		{
+			desc:    "negative notify interval",
+			config:  "notifyinterval = -1\n",
+			wantErr: true,
+		},
+		{
+			desc:   "adaptive refresh",
+			config: "adaptiverefresh = true\n",
+			want: config{
+				port:            8282,
+				log:             "/var/log/rpkirtr.log",
+				urls:            []string{"https://rpki.cloudflare.com/rpki.json"},
+				timers:          defaults,
+				depth:           defaultHistory,
+				tlsPort:         defaultTLSPort,
+				logFormat:       textLogs,
+				logLevel:        levelInfo,
+				statusInterval:  refreshROA,
+				filter:          roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6},
+				maxShrink:       defaultMaxShrink,
+				readTimeout:     expireTimeout,
+				staleAfter:      defaultStaleAfter * time.Second,
+				fetchTimeout:    defaultFetchTimeout * time.Second,
+				firstRefresh:    defaultFirstRefresh * time.Second,
+				notifyInterval:  defaultNotifyInterval * time.Second,
+				network:         "tcp",
+				connectBurst:    defaultConnectBurst,
+				fields:          defaultROAFields,
+				adaptiveRefresh: true,
+			},
+		},
+		{
+			desc:   "ipv6 only",
+			config: "network = tcp6\nbind = 2001:db8::1\n",
+			want: config{
+				port:           8282,
+				log:            "/var/log/rpkirtr.log",
+				urls:           []string{"https://rpki.cloudflare.com/rpki.json"},
+				timers:         defaults,
+				depth:          defaultHistory,
+				tlsPort:        defaultTLSPort,
+				logFormat:      textLogs,
+				logLevel:       levelInfo,
+				statusInterval: refreshROA,
+				filter:         roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6},
+				maxShrink:      defaultMaxShrink,
+				readTimeout:    expireTimeout,
+				staleAfter:     defaultStaleAfter * time.Second,
+				fetchTimeout:   defaultFetchTimeout * time.Second,
+				firstRefresh:   defaultFirstRefresh * time.Second,
+				notifyInterval: defaultNotifyInterval * time.Second,
+				network:        "tcp6",
+				connectBurst:   defaultConnectBurst,
+				fields:         defaultROAFields,
+				bind:           "2001:db8::1",
+			},
+		},
+		{
+			desc:    "negative connect rate",
+			config:  "connectrate = -1\n",
+			wantErr: true,
+		},
+		{
+			desc:    "connect burst too small",
+			config:  "connectrate = 6\nconnectburst = 0\n",
+			wantErr: true,
+		},
+		{
+			desc:    "unknown network",
+			config:  "network = udp\n",
+			wantErr: true,
+		},
+		{
+			desc:    "ipv4 bind on ipv6 only",
+			config:  "network = tcp6\nbind = 192.0.2.1\n",
+			wantErr: true,
+		},
+		{
+			desc:   "proxy protocol",
+			config: "proxyprotocol = true\n",
+			want: config{
+				port:           8282,
+				log:            "/var/log/rpkirtr.log",
+				urls:           []string{"https://rpki.cloudflare.com/rpki.json"},
+				timers:         defaults,
+				depth:          defaultHistory,
+				tlsPort:        defaultTLSPort,
+				logFormat:      textLogs,
+				logLevel:       levelInfo,
+				statusInterval: refreshROA,
+				filter:         roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6},
+				maxShrink:      defaultMaxShrink,
+				readTimeout:    expireTimeout,
+				staleAfter:     defaultStaleAfter * time.Second,
+				fetchTimeout:   defaultFetchTimeout * time.Second,
+				firstRefresh:   defaultFirstRefresh * time.Second,
+				notifyInterval: defaultNotifyInterval * time.Second,
+				network:        "tcp",
+				proxyProtocol:  true,
+				connectBurst:   defaultConnectBurst,
+				fields:         defaultROAFields,
+			},
+		},
+		{
+			desc:   "instance name",
+			config: "instance = edge1\n",
+			want: config{
+				port:           8282,
+				log:            "/var/log/rpkirtr.log",
+				urls:           []string{"https://rpki.cloudflare.com/rpki.json"},
+				timers:         defaults,
+				depth:          defaultHistory,
+				tlsPort:        defaultTLSPort,
+				logFormat:      textLogs,
+				logLevel:       levelInfo,
+				statusInterval: refreshROA,
+				filter:         roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6},
+				maxShrink:      defaultMaxShrink,
+				readTimeout:    expireTimeout,
+				staleAfter:     defaultStaleAfter * time.Second,
+				fetchTimeout:   defaultFetchTimeout * time.Second,
+				firstRefresh:   defaultFirstRefresh * time.Second,
+				notifyInterval: defaultNotifyInterval * time.Second,
+				network:        "tcp",
+				instance:       "edge1",
+				connectBurst:   defaultConnectBurst,
+				fields:         defaultROAFields,
+			},
+		},
+		{
+			desc:    "unknown log level",
+			config:  "loglevel = verbose\n",
+			wantErr: true,
+		},
+		{
+			desc:    "adaptive refresh not a bool",
+			config:  "adaptiverefresh = sometimes\n",
+			wantErr: true,
+		},
+		{
+			desc:    "fetch timeout too short",
+			config:  "fetchtimeout = 0\n",
+			wantErr: true,
+		},
+		{
+			desc:    "unix socket without a path",
+			config:  "bind = unix:\n",
+			wantErr: true,
+		},
+		{
+			desc:    "unix socket with md5 key",
+			config:  "bind = unix:/run/rpkirtr.sock\nmd5key = secret\n",
+			wantErr: true,
+		},
+		{
+			desc:    "unix socket with proxy protocol",
+			config:  "bind = unix:/run/rpkirtr.sock\nproxyprotocol = true\n",
+			wantErr: true,
+		},
+		{
+			desc:    "md5 key too long",
+			config:  "md5key = " + strings.Repeat("a", maxMD5KeyLen+1) + "\n",
+			wantErr: true,
+		},
+		{
+			desc:   "fallback urls",
+			config: "fallbackurls = https://routinator.example.net/json, mirror.json\n",
+			want: config{
+				port:           8282,
+				log:            "/var/log/rpkirtr.log",
+				urls:           []string{"https://rpki.cloudflare.com/rpki.json"},
+				timers:         defaults,
+				depth:          defaultHistory,
+				tlsPort:        defaultTLSPort,
+				logFormat:      textLogs,
+				logLevel:       levelInfo,
+				statusInterval: refreshROA,
+				filter:         roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6},
+				maxShrink:      defaultMaxShrink,
+				readTimeout:    expireTimeout,
+				staleAfter:     defaultStaleAfter * time.Second,
+				fetchTimeout:   defaultFetchTimeout * time.Second,
+				firstRefresh:   defaultFirstRefresh * time.Second,
+				notifyInterval: defaultNotifyInterval * time.Second,
+				network:        "tcp",
+				connectBurst:   defaultConnectBurst,
+				fields:         defaultROAFields,
+				fallbacks:      []string{"https://routinator.example.net/json", "mirror.json"},
+			},
+		},
+		{
+			desc:   "bind address",
+			config: "bind = 192.0.2.1\n",
+			want: config{
+				port:           8282,
+				log:            "/var/log/rpkirtr.log",
+				urls:           []string{"https://rpki.cloudflare.com/rpki.json"},
+				timers:         defaults,
+				depth:          defaultHistory,
+				tlsPort:        defaultTLSPort,
+				logFormat:      textLogs,
+				logLevel:       levelInfo,
+				statusInterval: refreshROA,
+				filter:         roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6},
+				maxShrink:      defaultMaxShrink,
+				readTimeout:    expireTimeout,
+				staleAfter:     defaultStaleAfter * time.Second,
+				fetchTimeout:   defaultFetchTimeout * time.Second,
+				firstRefresh:   defaultFirstRefresh * time.Second,
+				notifyInterval: defaultNotifyInterval * time.Second,
+				network:        "tcp",
+				connectBurst:   defaultConnectBurst,
+				fields:         defaultROAFields,
+				bind:           "192.0.2.1",
+			},
+		},
+		{
+			desc:    "port not a number",
+			args:    []string{"-port", "abc"},
+			wantErr: true,
+		},
+	}
+	for _, v := range tests {
+		// Each test gets the base config file, plus any extra config.
+		file := filepath.Join(t.TempDir(), "config.ini")
+		if err := os.WriteFile(file, []byte(base+v.config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		for name, value := range v.env {
+			os.Setenv(name, value)
+		}
+		got, err := loadConfig(append([]string{"-config", file}, v.args...))
+		for name := range v.env {
+			os.Unsetenv(name)
+		}
+		if err == nil && v.wantErr {
+			t.Errorf("Error on %s. Wanted an error, but none received", v.desc)
+			continue
+		}
+		if err != nil && !v.wantErr {
+			t.Errorf("Error on %s. No error expected, but error received: %v", v.desc, err)
+			continue
+		}
+		if !v.wantErr && !reflect.DeepEqual(got, v.want) {
+			t.Errorf("Error on %s. Got %+v, Want %+v\n", v.desc, got, v.want)
+		}
+	}
+}
+
+func TestMissingSettings(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		desc   string
+		args   []string
+		config string
+		want   string
+	}{
+		{
+			desc: "no config file and no flags",
+			want: "no config file at " + filepath.Join(dir, "config.ini") + ", so these flags are needed: -port (or RPKIRTR_PORT), -log (or RPKIRTR_LOG), -cache-url (or RPKIRTR_CACHE_URL)",
+		},
+		{
+			desc: "no config file and some flags",
+			args: []string{"-port", "8282"},
+			want: "these flags are needed: -log (or RPKIRTR_LOG), -cache-url (or RPKIRTR_CACHE_URL).",
+		},
+		{
+			desc: "no config file, empty table without a log",
+			args: []string{"-port", "8282", "-empty"},
+			want: "these flags are needed: -log (or RPKIRTR_LOG).",
+		},
+		{
+			desc:   "config file without a cache url",
+			config: "[rpkirtr]\nport = 8282\nlog = -\n",
+			want:   "config.ini is missing these settings: cacheurl. They can also be given as flags: -cache-url (or RPKIRTR_CACHE_URL)",
+		},
+		{
+			desc:   "config file without a port or log",
+			config: "[rpkirtr]\ncacheurl = file:///data/rpki.json\n",
+			want:   "config.ini is missing these settings: port, log. They can also be given as flags: -port (or RPKIRTR_PORT), -log (or RPKIRTR_LOG)",
+		},
+	}
+	for _, v := range tests {
+		file := filepath.Join(dir, "config.ini")
+		os.Remove(file)
+		if v.config != "" {
+			if err := os.WriteFile(file, []byte(v.config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err := loadConfig(append([]string{"-config", file}, v.args...))
+		if err == nil || !strings.Contains(err.Error(), v.want) {
+			t.Errorf("Error on %s. Got error %v, Want one containing %q", v.desc, err, v.want)
+		}
+	}
+}
+
+func TestRestartNeeded(t *testing.T) {
+	old := config{
+		port:    8282,
+		urls:    []string{"a.json"},
+		timers:  intervals{refresh: 3600, retry: 600, expire: 7200},
+		allowed: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("192.0.2.0/24")},
+		filter:  roaFilter{v4: 24, v6: 48},
+	}
+	tests := []struct {
+		desc   string
+		change func(c *config)
+		want   []string
+	}{
+		{
+			desc:   "nothing",
+			change: func(c *config) {},
+		},
+		{
+			desc: "reloadable only",
+			change: func(c *config) {
+				c.timers.refresh = 60
+				c.allowed = nil
+				c.urls = []string{"b.json"}
+				c.logLevel = levelDebug
+			},
+		},
+		{
+			desc: "needs restart",
+			change: func(c *config) {
+				c.port = 8383
+				c.filter.rirs = map[rir]bool{ripe: true}
+				c.timers.retry = 60
+			},
+			want: []string{"port", "maxminmask, maxaccept, rirs, or blocklist"},
+		},
+	}
+	for _, v := range tests {
+		new := old
+		new.urls = append([]string(nil), old.urls...)
+		v.change(&new)
+		if got := restartNeeded(old, new); !reflect.DeepEqual(got, v.want) {
+			t.Errorf("Error on %s. Got %v, Want %v", v.desc, got, v.want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+
+	pb "github.com/mellowdrifter/rpkirtr/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"inet.af/netaddr"
+)
+
+// validationServer answers the gRPC Validation service from the same ROAs
+// served to routers.
+type validationServer struct {
+	pb.UnimplementedValidationServer
+	s *CacheServer
+}
+
+// protoStates maps validation states to the ones in the service definition.
+var protoStates = map[validationState]pb.ValidateResponse_State{
+	notFound: pb.ValidateResponse_NOT_FOUND,
+	valid:    pb.ValidateResponse_VALID,
+	invalid:  pb.ValidateResponse_INVALID,
+}
+
+// serveGRPC starts the gRPC listener on addr.
+func (s *CacheServer) serveGRPC(addr string) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Printf("Unable to start the gRPC listener: %v\n", err)
+		return
+	}
+	log.Printf("gRPC listener on %s\n", addr)
+	if err := s.grpcServer().Serve(l); err != nil {
+		log.Printf("gRPC listener stopped: %v\n", err)
+	}
+}
+
+// grpcServer has the Validation service registered.
+func (s *CacheServer) grpcServer() *grpc.Server {
+	g := grpc.NewServer()
+	pb.RegisterValidationServer(g, &validationServer{s: s})
+	return g
+}
+
+// toProto converts a ROA to how it is sent over gRPC.
+func toProto(v roa) *pb.ROA {
+	return &pb.ROA{
+		Prefix:  v.Prefix.String(),
+		MaxMask: uint32(v.MaxMask),
+		Asn:     v.ASN,
+		Rir:     v.RIR.String(),
+	}
+}
+
+// Validate returns the validation state of a route, as /validate does.
+func (v *validationServer) Validate(ctx context.Context, req *pb.ValidateRequest) (*pb.ValidateResponse, error) {
+	prefix, err := netaddr.ParseIPPrefix(req.GetPrefix())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	state, covering := v.s.Validate(prefix, req.GetAsn())
+	resp := &pb.ValidateResponse{State: protoStates[state]}
+	for _, r := range covering {
+		resp.Covering = append(resp.Covering, toProto(r))
+	}
+	return resp, nil
+}
+
+// ListROAs streams the current ROAs, filtered as /roas is. The ROAs are
+// replaced on update, never changed, so the lock is only held to get them.
+func (v *validationServer) ListROAs(req *pb.ListROAsRequest, stream pb.Validation_ListROAsServer) error {
+	v.s.mutex.RLock()
+	roas := v.s.roas
+	v.s.mutex.RUnlock()
+
+	for _, r := range roas {
+		if req.Asn != nil && r.ASN != req.GetAsn() {
+			continue
+		}
+		if req.GetRir() != "" && r.RIR.String() != req.GetRir() {
+			continue
+		}
+		if err := stream.Send(toProto(r)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	pb "github.com/mellowdrifter/rpkirtr/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"inet.af/netaddr"
+)
+
+// dialGRPC serves the Validation service for s in memory, returning a client for it.
+func dialGRPC(t *testing.T, s *CacheServer) pb.ValidationClient {
+	t.Helper()
+	l := bufconn.Listen(1 << 20)
+	g := s.grpcServer()
+	go g.Serve(l)
+	t.Cleanup(g.Stop)
+
+	conn, err := grpc.DialContext(context.Background(), "bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return l.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewValidationClient(conn)
+}
+
+func TestGRPCValidate(t *testing.T) {
+	roas := []roa{
+		{Prefix: netaddr.MustParseIPPrefix("192.0.2.0/24"), MaxMask: 24, ASN: 64496, RIR: ripe},
+		{Prefix: netaddr.MustParseIPPrefix("2001:db8::/32"), MaxMask: 48, ASN: 64497, RIR: arin},
+	}
+	s := &CacheServer{mutex: &sync.RWMutex{}, roas: roas, index: newROAIndex(roas)}
+	client := dialGRPC(t, s)
+
+	tests := []struct {
+		desc     string
+		req      *pb.ValidateRequest
+		want     *pb.ValidateResponse
+		wantCode codes.Code
+	}{
+		{
+			desc: "valid",
+			req:  &pb.ValidateRequest{Prefix: "192.0.2.0/24", Asn: 64496},
+			want: &pb.ValidateResponse{
+				State:    pb.ValidateResponse_VALID,
+				Covering: []*pb.ROA{{Prefix: "192.0.2.0/24", MaxMask: 24, Asn: 64496, Rir: "ripe"}},
+			},
+		},
+		{
+			desc: "invalid",
+			req:  &pb.ValidateRequest{Prefix: "2001:db8:1::/48", Asn: 64496},
+			want: &pb.ValidateResponse{
+				State:    pb.ValidateResponse_INVALID,
+				Covering: []*pb.ROA{{Prefix: "2001:db8::/32", MaxMask: 48, Asn: 64497, Rir: "arin"}},
+			},
+		},
+		{
+			desc: "not found",
+			req:  &pb.ValidateRequest{Prefix: "198.51.100.0/24", Asn: 64496},
+			want: &pb.ValidateResponse{State: pb.ValidateResponse_NOT_FOUND},
+		},
+		{
+			desc:     "bad prefix",
+			req:      &pb.ValidateRequest{Prefix: "192.0.2.0", Asn: 64496},
+			wantCode: codes.InvalidArgument,
+		},
+	}
+	for _, v := range tests {
+		got, err := client.Validate(context.Background(), v.req)
+		if code := status.Code(err); code != v.wantCode {
+			t.Errorf("Error on %s. Got code %v, Want %v", v.desc, code, v.wantCode)
+			continue
+		}
+		if v.wantCode != codes.OK {
+			continue
+		}
+		if !proto.Equal(got, v.want) {
+			t.Errorf("Error on %s. Got %v, Want %v", v.desc, got, v.want)
+		}
+	}
+}
+
+func TestGRPCListROAs(t *testing.T) {
+	roas := []roa{
+		{Prefix: netaddr.MustParseIPPrefix("192.0.2.0/24"), MaxMask: 24, ASN: 64496, RIR: ripe},
+		{Prefix: netaddr.MustParseIPPrefix("198.51.100.0/24"), MaxMask: 24, ASN: 0, RIR: ripe},
+		{Prefix: netaddr.MustParseIPPrefix("2001:db8::/32"), MaxMask: 48, ASN: 64496, RIR: arin},
+	}
+	s := &CacheServer{mutex: &sync.RWMutex{}, roas: roas, index: newROAIndex(roas)}
+	client := dialGRPC(t, s)
+
+	tests := []struct {
+		desc string
+		req  *pb.ListROAsRequest
+		want []string
+	}{
+		{
+			desc: "everything",
+			req:  &pb.ListROAsRequest{},
+			want: []string{"192.0.2.0/24", "198.51.100.0/24", "2001:db8::/32"},
+		},
+		{
+			desc: "by ASN",
+			req:  &pb.ListROAsRequest{Asn: proto.Uint32(64496)},
+			want: []string{"192.0.2.0/24", "2001:db8::/32"},
+		},
+		{
+			desc: "AS0",
+			req:  &pb.ListROAsRequest{Asn: proto.Uint32(0)},
+			want: []string{"198.51.100.0/24"},
+		},
+		{
+			desc: "by RIR",
+			req:  &pb.ListROAsRequest{Rir: "arin"},
+			want: []string{"2001:db8::/32"},
+		},
+		{
+			desc: "by ASN and RIR",
+			req:  &pb.ListROAsRequest{Asn: proto.Uint32(64496), Rir: "ripe"},
+			want: []string{"192.0.2.0/24"},
+		},
+	}
+	for _, v := range tests {
+		stream, err := client.ListROAs(context.Background(), v.req)
+		if err != nil {
+			t.Fatalf("Error on %s. Got %v", v.desc, err)
+		}
+		var got []string
+		for {
+			r, err := stream.Recv()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Error on %s. Got %v", v.desc, err)
+			}
+			got = append(got, r.GetPrefix())
+		}
+		if len(got) != len(v.want) {
+			t.Errorf("Error on %s. Got %v, Want %v", v.desc, got, v.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != v.want[i] {
+				t.Errorf("Error on %s. Got %v, Want %v", v.desc, got, v.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// log formats
+	textLogs = "text"
+	jsonLogs = "json"
+
+	// log levels
+	levelDebug = "debug"
+	levelInfo  = "info"
+	levelWarn  = "warn"
+	levelError = "error"
+)
+
+// logLevels orders the levels, so anything below the log level is dropped.
+var logLevels = map[string]int{
+	levelDebug: 0,
+	levelInfo:  1,
+	levelWarn:  2,
+	levelError: 3,
+}
+
+// logLevel is the order in logLevels of the least level logged. Anything
+// logged through the log package is info. It's changed on reload, so is only
+// read and set atomically.
+var logLevel = int32(logLevels[levelInfo])
+
+// textLog writes plain text events from logWith. The log package's own output
+// is discarded when info isn't logged, but these still need writing.
+var textLog = log.New(os.Stderr, "", log.LstdFlags|log.Lshortfile)
+
+// logFile is the flags the log file is opened with.
+const logFile = os.O_APPEND | os.O_CREATE | os.O_WRONLY
+
+// logFields are extra values attached to a log event, such as serial or client address.
+type logFields map[string]any
+
+// jsonLog is set when logging as json. Plain text logging leaves it nil.
+var jsonLog *jsonLogger
+
+// instanceName tells servers apart in logs and metrics when more than one is
+// run. Set from config at startup, and empty if not named.
+var instanceName string
+
+// jsonLogger writes each log event as a single json object per line.
+// Anything logged through the log package is written as an info event.
+type jsonLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// openLog opens where logs go. A location of - or stdout logs to standard
+// output, leaving rotation to whatever collects it. Anything else is a file,
+// which is rotated once it reaches maxSize bytes, unless maxSize is zero.
+func openLog(location string, maxSize int64) (io.WriteCloser, error) {
+	if location == "-" || location == "stdout" {
+		return nopCloser{os.Stdout}, nil
+	}
+	f, err := os.OpenFile(location, logFile, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open logfile: %w", err)
+	}
+	if maxSize == 0 {
+		return f, nil
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to stat logfile: %w", err)
+	}
+	return &rotatingFile{
+		path:    location,
+		maxSize: maxSize,
+		f:       f,
+		size:    info.Size(),
+	}, nil
+}
+
+// nopCloser stops standard output being closed along with the log.
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// rotatingFile is a log file which is moved to path.1 once it gets too big.
+// Only the one previous file is kept.
+type rotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	f       *os.File
+	size    int64
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		// Keep writing to the current file if it can't be rotated.
+		if err := r.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "unable to rotate logfile %s: %v\n", r.path, err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(r.path, logFile, 0o600)
+	if err != nil {
+		return err
+	}
+	r.f.Close()
+	r.f, r.size = f, 0
+	return nil
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+// setLogging sends all logging at level or above to w in the given format.
+// Plain text lines start with the instance name, if there is one.
+func setLogging(w io.Writer, format, level string) {
+	setLogLevel(level)
+	if format == jsonLogs {
+		jsonLog = &jsonLogger{w: w}
+		log.SetFlags(0)
+		log.SetPrefix("")
+		log.SetOutput(jsonLog)
+		return
+	}
+	jsonLog = nil
+	var prefix string
+	if instanceName != "" {
+		prefix = instanceName + " "
+	}
+	// Enable line numbers in logging
+	textLog = log.New(w, prefix, log.LstdFlags|log.Lshortfile)
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	log.SetPrefix(prefix)
+	log.SetOutput(infoWriter{w})
+}
+
+// setLogLevel changes the least level logged, without changing where to.
+func setLogLevel(level string) {
+	atomic.StoreInt32(&logLevel, int32(logLevels[level]))
+}
+
+// infoWriter drops the log package's plain text output when info isn't
+// logged. The level is checked on each write, as it can change on reload.
+type infoWriter struct {
+	w io.Writer
+}
+
+func (i infoWriter) Write(p []byte) (int, error) {
+	if !logged(levelInfo) {
+		return len(p), nil
+	}
+	return i.w.Write(p)
+}
+
+// logged returns whether events at level are logged.
+func logged(level string) bool {
+	return int32(logLevels[level]) >= atomic.LoadInt32(&logLevel)
+}
+
+// Write is used by the log package, so every line becomes an info event.
+func (l *jsonLogger) Write(p []byte) (int, error) {
+	if !logged(levelInfo) {
+		return len(p), nil
+	}
+	if err := l.write(levelInfo, strings.TrimSpace(string(p)), "", nil); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (l *jsonLogger) write(level, msg, caller string, fields logFields) error {
+	event := make(map[string]any, len(fields)+4)
+	for k, v := range fields {
+		event[k] = v
+	}
+	event["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	event["level"] = level
+	event["msg"] = msg
+	if instanceName != "" {
+		event["instance"] = instanceName
+	}
+	if caller != "" {
+		event["caller"] = caller
+	}
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.w.Write(append(b, '\n'))
+	return err
+}
+
+// logWith logs an event with a level and fields. Plain text logs only have the
+// message, so anything important in fields should also be in the message.
+// Nothing is logged below the log level.
+func logWith(level string, fields logFields, format string, v ...any) {
+	if !logged(level) {
+		return
+	}
+	msg := fmt.Sprintf(format, v...)
+	if jsonLog == nil {
+		textLog.Output(2, msg)
+		return
+	}
+	var caller string
+	if _, file, line, ok := runtime.Caller(1); ok {
+		caller = fmt.Sprintf("%s:%d", path.Base(file), line)
+	}
+	jsonLog.write(level, msg, caller, fields)
+}
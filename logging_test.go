@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJSONLogging(t *testing.T) {
+	var buf bytes.Buffer
+	setLogging(&buf, jsonLogs, levelInfo)
+	defer setLogging(os.Stderr, textLogs, levelInfo)
+
+	log.Printf("plain message %d\n", 1)
+	logWith(levelError, logFields{"serial": 5, "client": "192.0.2.1"}, "update for %s", "192.0.2.1")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Wanted 2 log lines, got %d: %q", len(lines), buf.String())
+	}
+
+	tests := []struct {
+		desc   string
+		line   string
+		want   map[string]any
+		caller bool
+	}{
+		{
+			desc: "log package",
+			line: lines[0],
+			want: map[string]any{"level": levelInfo, "msg": "plain message 1"},
+		},
+		{
+			desc:   "with fields",
+			line:   lines[1],
+			want:   map[string]any{"level": levelError, "msg": "update for 192.0.2.1", "serial": float64(5), "client": "192.0.2.1"},
+			caller: true,
+		},
+	}
+	for _, v := range tests {
+		var got map[string]any
+		if err := json.Unmarshal([]byte(v.line), &got); err != nil {
+			t.Errorf("Error on %s. Unable to unmarshal %q: %v", v.desc, v.line, err)
+			continue
+		}
+		for k, want := range v.want {
+			if got[k] != want {
+				t.Errorf("Error on %s. Got %s=%v, Want %v\n", v.desc, k, got[k], want)
+			}
+		}
+		if _, ok := got["time"]; !ok {
+			t.Errorf("Error on %s. No time in %v", v.desc, got)
+		}
+		if _, ok := got["caller"]; ok != v.caller {
+			t.Errorf("Error on %s. Got caller %v, Want caller %t", v.desc, got["caller"], v.caller)
+		}
+	}
+}
+
+func TestTextLogging(t *testing.T) {
+	var buf bytes.Buffer
+	setLogging(&buf, textLogs, levelInfo)
+	defer setLogging(os.Stderr, textLogs, levelInfo)
+
+	logWith(levelInfo, logFields{"serial": 5}, "roas updated, serial is now %d", 5)
+	if got := buf.String(); !strings.HasSuffix(got, "roas updated, serial is now 5\n") || strings.Contains(got, "{") {
+		t.Errorf("Got %q, Wanted a plain text line", got)
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	defer setLogging(os.Stderr, textLogs, levelInfo)
+	tests := []struct {
+		desc   string
+		format string
+		level  string
+		want   []string
+	}{
+		{
+			desc:   "warn drops info and debug",
+			format: textLogs,
+			level:  levelWarn,
+			want:   []string{"warn message", "error message"},
+		},
+		{
+			desc:   "info drops debug",
+			format: textLogs,
+			level:  levelInfo,
+			want:   []string{"plain message", "info message", "warn message", "error message"},
+		},
+		{
+			desc:   "debug logs everything",
+			format: jsonLogs,
+			level:  levelDebug,
+			want:   []string{"plain message", "debug message", "info message", "warn message", "error message"},
+		},
+		{
+			desc:   "error as json",
+			format: jsonLogs,
+			level:  levelError,
+			want:   []string{"error message"},
+		},
+	}
+	for _, v := range tests {
+		var buf bytes.Buffer
+		setLogging(&buf, v.format, v.level)
+		log.Println("plain message")
+		for _, level := range []string{levelDebug, levelInfo, levelWarn, levelError} {
+			logWith(level, nil, "%s message", level)
+		}
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		if len(lines) != len(v.want) {
+			t.Errorf("Error on %s. Got %d lines, Want %d: %q", v.desc, len(lines), len(v.want), buf.String())
+			continue
+		}
+		for i, want := range v.want {
+			if !strings.Contains(lines[i], want) {
+				t.Errorf("Error on %s. Got %q, Want %q", v.desc, lines[i], want)
+			}
+		}
+	}
+}
+
+func TestInstanceLogging(t *testing.T) {
+	instanceName = "edge1"
+	defer func() {
+		instanceName = ""
+		setLogging(os.Stderr, textLogs, levelInfo)
+	}()
+
+	var buf bytes.Buffer
+	setLogging(&buf, jsonLogs, levelInfo)
+	logWith(levelInfo, logFields{"serial": 5}, "roas updated, serial is now %d", 5)
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("Unable to unmarshal %q: %v", buf.String(), err)
+	}
+	if got["instance"] != "edge1" {
+		t.Errorf("Got instance %v, Want edge1", got["instance"])
+	}
+
+	buf.Reset()
+	setLogging(&buf, textLogs, levelInfo)
+	log.Println("plain message")
+	if got := buf.String(); !strings.HasPrefix(got, "edge1 ") {
+		t.Errorf("Got %q, Wanted a line starting with the instance", got)
+	}
+}
+
+func TestOpenLog(t *testing.T) {
+	if w, err := openLog("-", 0); err != nil || w.(nopCloser).Writer != os.Stdout {
+		t.Errorf("Got %v, %v. Wanted standard output", w, err)
+	}
+
+	p := filepath.Join(t.TempDir(), "rpkirtr.log")
+	w, err := openLog(p, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	tests := []struct {
+		write   string
+		current string
+		old     string
+	}{
+		{
+			write:   "12345",
+			current: "12345",
+		},
+		{
+			write:   "678",
+			current: "12345678",
+		},
+		{
+			write:   "abc",
+			current: "abc",
+			old:     "12345678",
+		},
+		{
+			write:   "0123456789012",
+			current: "0123456789012",
+			old:     "abc",
+		},
+	}
+	for _, v := range tests {
+		if _, err := w.Write([]byte(v.write)); err != nil {
+			t.Fatal(err)
+		}
+		current, _ := os.ReadFile(p)
+		old, _ := os.ReadFile(p + ".1")
+		if string(current) != v.current || string(old) != v.old {
+			t.Errorf("Error after writing %s. Got %q and %q, Want %q and %q", v.write, current, old, v.current, v.old)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"inet.af/netaddr"
+)
+
+// From linux/tcp.h
+const (
+	tcpMD5SigExt     = 32
+	tcpMD5FlagPrefix = 1
+)
+
+// tcpMD5Sig is struct tcp_md5sig from linux/tcp.h. The address is a
+// sockaddr_storage, split into the family and the rest.
+type tcpMD5Sig struct {
+	family    uint16
+	addr      [126]byte
+	flags     uint8
+	prefixLen uint8
+	keyLen    uint16
+	ifindex   int32
+	key       [maxMD5KeyLen]byte
+}
+
+// md5Control returns a listener control function setting the TCP-MD5
+// (RFC2385) key for each of the peer prefixes. Routers connecting from these
+// without the key can't complete the TCP handshake.
+func md5Control(key string, peers []netaddr.IPPrefix) func(string, string, syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = setMD5(int(fd), key, peers)
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
+
+func setMD5(fd int, key string, peers []netaddr.IPPrefix) error {
+	domain, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_DOMAIN)
+	if err != nil {
+		return fmt.Errorf("unable to get socket domain: %w", err)
+	}
+	for _, p := range peers {
+		sig, ok := md5Sig(domain, key, p)
+		if !ok {
+			continue
+		}
+		b := (*[unsafe.Sizeof(sig)]byte)(unsafe.Pointer(&sig))
+		if err := syscall.SetsockoptString(fd, syscall.IPPROTO_TCP, tcpMD5SigExt, string(b[:])); err != nil {
+			return fmt.Errorf("unable to set TCP-MD5 key for %s: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// md5Sig builds the key for the peer prefix on a socket of the domain. An IPv6
+// prefix can't be used on an IPv4 socket, so isn't ok.
+func md5Sig(domain int, key string, p netaddr.IPPrefix) (tcpMD5Sig, bool) {
+	sig := tcpMD5Sig{
+		flags:     tcpMD5FlagPrefix,
+		prefixLen: p.Bits(),
+		keyLen:    uint16(len(key)),
+	}
+	copy(sig.key[:], key)
+
+	// The address goes after the port, and for IPv6 the flow info.
+	switch ip := p.IP(); {
+	case domain == syscall.AF_INET && ip.Is4():
+		sig.family = syscall.AF_INET
+		a := ip.As4()
+		copy(sig.addr[2:], a[:])
+	case domain == syscall.AF_INET6:
+		// IPv4 peers of an IPv6 socket are IPv4 mapped addresses. The kernel
+		// keeps the key for one as an IPv4 key, so its length stays the IPv4
+		// one, and anything over 32 is refused. See tcp_v6_parse_md5_keys.
+		sig.family = syscall.AF_INET6
+		a := ip.As16()
+		copy(sig.addr[6:], a[:])
+	default:
+		return sig, false
+	}
+	return sig, true
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func TestMD5Sig(t *testing.T) {
+	tests := []struct {
+		desc      string
+		domain    int
+		prefix    string
+		family    uint16
+		addr      string
+		prefixLen uint8
+		skipped   bool
+	}{
+		{
+			desc:      "IPv4 prefix on an IPv4 socket",
+			domain:    syscall.AF_INET,
+			prefix:    "192.0.2.0/24",
+			family:    syscall.AF_INET,
+			addr:      "192.0.2.0",
+			prefixLen: 24,
+		},
+		{
+			desc:      "IPv4 prefix on an IPv6 socket",
+			domain:    syscall.AF_INET6,
+			prefix:    "192.0.2.0/24",
+			family:    syscall.AF_INET6,
+			addr:      "::ffff:192.0.2.0",
+			prefixLen: 24,
+		},
+		{
+			desc:      "all of IPv4 on an IPv6 socket",
+			domain:    syscall.AF_INET6,
+			prefix:    "0.0.0.0/0",
+			family:    syscall.AF_INET6,
+			addr:      "::ffff:0.0.0.0",
+			prefixLen: 0,
+		},
+		{
+			desc:      "IPv6 prefix on an IPv6 socket",
+			domain:    syscall.AF_INET6,
+			prefix:    "2001:db8::/32",
+			family:    syscall.AF_INET6,
+			addr:      "2001:db8::",
+			prefixLen: 32,
+		},
+		{
+			desc:    "IPv6 prefix on an IPv4 socket",
+			domain:  syscall.AF_INET,
+			prefix:  "2001:db8::/32",
+			skipped: true,
+		},
+	}
+	for _, v := range tests {
+		sig, ok := md5Sig(v.domain, "secret", netaddr.MustParseIPPrefix(v.prefix))
+		if ok == v.skipped {
+			t.Errorf("Error on %s. Got ok %t, Want %t", v.desc, ok, !v.skipped)
+			continue
+		}
+		if v.skipped {
+			continue
+		}
+		// Decode the address from where the kernel reads it in the sockaddr.
+		var addr net.IP
+		if sig.family == syscall.AF_INET {
+			addr = net.IP(sig.addr[2:6])
+		} else {
+			addr = net.IP(sig.addr[6:22])
+		}
+		if sig.family != v.family || !addr.Equal(net.ParseIP(v.addr)) || sig.prefixLen != v.prefixLen {
+			t.Errorf("Error on %s. Got family %d, %s/%d, Want %d, %s/%d", v.desc, sig.family, addr, sig.prefixLen, v.family, v.addr, v.prefixLen)
+		}
+		if got := string(sig.key[:sig.keyLen]); got != "secret" || sig.flags != tcpMD5FlagPrefix {
+			t.Errorf("Error on %s. Got key %q with flags %d, Want secret with the prefix flag", v.desc, got, sig.flags)
+		}
+	}
+}
+
+// TestMD5Scope checks a key for an IPv4 prefix on a dual stack listener only
+// covers that prefix, by connecting from 127.0.0.1 without a key.
+func TestMD5Scope(t *testing.T) {
+	tests := []struct {
+		desc    string
+		peer    string
+		refused bool
+	}{
+		{
+			desc: "key for another IPv4 prefix",
+			peer: "192.0.2.0/24",
+		},
+		{
+			desc:    "key for the connecting prefix",
+			peer:    "127.0.0.0/8",
+			refused: true,
+		},
+	}
+	for _, v := range tests {
+		lc := &net.ListenConfig{Control: md5Control("secret", []netaddr.IPPrefix{netaddr.MustParseIPPrefix(v.peer)})}
+		l, err := lc.Listen(context.Background(), "tcp", ":0")
+		if errors.Is(err, syscall.ENOPROTOOPT) {
+			t.Skip("kernel has no TCP-MD5 support")
+		}
+		if err != nil {
+			t.Fatalf("Error on %s. Unable to listen: %v", v.desc, err)
+		}
+		_, port, _ := net.SplitHostPort(l.Addr().String())
+		conn, err := net.DialTimeout("tcp4", net.JoinHostPort("127.0.0.1", port), 500*time.Millisecond)
+		if err == nil {
+			conn.Close()
+		}
+		if (err != nil) != v.refused {
+			t.Errorf("Error on %s. Got error %v, Want refused %t", v.desc, err, v.refused)
+		}
+		l.Close()
+	}
+}
+
+func TestMD5Control(t *testing.T) {
+	tests := []struct {
+		desc    string
+		network string
+		addr    string
+		peers   []netaddr.IPPrefix
+	}{
+		{
+			desc:    "IPv4 listener",
+			network: "tcp4",
+			addr:    "127.0.0.1:0",
+			peers:   []netaddr.IPPrefix{netaddr.MustParseIPPrefix("127.0.0.0/8"), netaddr.MustParseIPPrefix("::1/128")},
+		},
+		{
+			desc:    "dual stack listener",
+			network: "tcp",
+			addr:    ":0",
+			peers:   []netaddr.IPPrefix{netaddr.MustParseIPPrefix("0.0.0.0/0"), netaddr.MustParseIPPrefix("::/0")},
+		},
+	}
+	for _, v := range tests {
+		lc := &net.ListenConfig{Control: md5Control("secret", v.peers)}
+		l, err := lc.Listen(context.Background(), v.network, v.addr)
+		if errors.Is(err, syscall.ENOPROTOOPT) {
+			t.Skip("kernel has no TCP-MD5 support")
+		}
+		if err != nil {
+			t.Errorf("Error on %s. Unable to listen: %v", v.desc, err)
+			continue
+		}
+		l.Close()
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+
+	"inet.af/netaddr"
+)
+
+// md5Control fails, as TCP-MD5 is only set up on Linux.
+func md5Control(key string, peers []netaddr.IPPrefix) func(string, string, syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return errors.New("TCP-MD5 is only supported on Linux")
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// counters only ever go up over the life of the server.
+type counters struct {
+	updates uint64
+	added   uint64
+	deleted uint64
+
+	// errors are failed updates by category.
+	errors map[string]uint64
+}
+
+// failed counts a failed update in the category.
+func (c *counters) failed(category string) {
+	if c.errors == nil {
+		c.errors = make(map[string]uint64)
+	}
+	c.errors[category]++
+}
+
+// The responses to router queries, counted in responseCounts.
+const (
+	incrementalResponse = iota
+	fullResponse
+	cacheResetResponse
+)
+
+// responseTypes are the label values of each response.
+var responseTypes = []string{"incremental", "full", "cache_reset"}
+
+// responseCounts counts the responses sent to router queries. Clients add to it
+// without the server lock, so it's updated atomically.
+type responseCounts [3]uint64
+
+// add counts a response. Nothing is done for nil counts.
+func (r *responseCounts) add(response int) {
+	if r == nil {
+		return
+	}
+	atomic.AddUint64(&r[response], 1)
+}
+
+// get returns the count of a response, which is 0 for nil counts.
+func (r *responseCounts) get(response int) uint64 {
+	if r == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&r[response])
+}
+
+// syncBuckets are the upper bounds, in seconds, of the full sync histogram.
+var syncBuckets = []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// histogram counts observations into buckets, as a Prometheus histogram.
+// It has its own lock, as it's added to while sending, without the server lock.
+type histogram struct {
+	mutex   sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+// observe adds a value. Nothing is done for a nil histogram.
+func (h *histogram) observe(v float64) {
+	if h == nil {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// sample is a single value of a metric, with optional labels.
+type sample struct {
+	labels string
+	value  float64
+}
+
+// metricsHandler exposes the current state in the Prometheus text format.
+// The metrics are rendered under the lock, then written once it's released, so
+// a slow scraper can't hold up updates.
+func (s *CacheServer) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var b bytes.Buffer
+	s.writeMetrics(&b)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(b.Bytes())
+}
+
+// writeMetrics writes every metric to w in the Prometheus text format.
+func (s *CacheServer) writeMetrics(w io.Writer) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	v4, v6 := len(s.roasV4), len(s.roasV6)
+
+	writeMetric(w, "rpkirtr_roas", "Number of ROAs currently served.", "gauge",
+		sample{value: float64(len(s.roas))})
+	writeMetric(w, "rpkirtr_roas_by_family", "Number of ROAs currently served per address family.", "gauge",
+		sample{labels: `family="ipv4"`, value: float64(v4)},
+		sample{labels: `family="ipv6"`, value: float64(v6)})
+	writeMetric(w, "rpkirtr_router_keys", "Number of BGPsec router keys currently served.", "gauge",
+		sample{value: float64(len(s.keys))})
+	writeMetric(w, "rpkirtr_aspas", "Number of ASPAs currently served.", "gauge",
+		sample{value: float64(len(s.aspas))})
+	writeMetric(w, "rpkirtr_serial", "Current serial number.", "gauge",
+		sample{value: float64(s.serial)})
+	writeMetric(w, "rpkirtr_clients", "Number of connected clients.", "gauge",
+		sample{value: float64(len(s.clients))})
+	writeMetric(w, "rpkirtr_client_info", "Connected client sessions, by address and port, with the version negotiated.", "gauge",
+		clientSamples(s.clients)...)
+	writeMetric(w, "rpkirtr_last_check_timestamp_seconds", "Time of the last ROA update check.", "gauge",
+		sample{value: timestamp(s.updates.lastCheck)})
+	writeMetric(w, "rpkirtr_last_error_timestamp_seconds", "Time of the last failed ROA update.", "gauge",
+		sample{value: timestamp(s.updates.lastError)})
+	writeMetric(w, "rpkirtr_last_update_timestamp_seconds", "Time of the last ROA change.", "gauge",
+		sample{value: timestamp(s.updates.lastUpdate)})
+	writeMetric(w, "rpkirtr_upstream_generated_timestamp_seconds", "Time the upstream json was generated, from its metadata.", "gauge",
+		sample{value: timestamp(s.updates.generated)})
+	writeMetric(w, "rpkirtr_upstream_valid_timestamp_seconds", "Time the upstream json is valid until, from its metadata.", "gauge",
+		sample{value: timestamp(s.updates.valid)})
+	writeMetric(w, "rpkirtr_last_fetch_bytes", "Size of the json in the last successful fetch, excluding locations which weren't modified.", "gauge",
+		sample{value: float64(s.updates.fetchBytes)})
+	writeMetric(w, "rpkirtr_last_fetch_duration_seconds", "Time the last successful fetch took to fetch and parse the json.", "gauge",
+		sample{value: s.updates.fetchTime.Seconds()})
+	changed := 0.0
+	if s.updates.changed {
+		changed = 1
+	}
+	writeMetric(w, "rpkirtr_last_update_changed", "Whether the last successful update changed the ROAs, router keys, or ASPAs.", "gauge",
+		sample{value: changed})
+	writeMetric(w, "rpkirtr_unchanged_updates", "Number of successful updates in a row which changed nothing.", "gauge",
+		sample{value: float64(s.updates.unchanged)})
+	writeMetric(w, "rpkirtr_updates_total", "Number of successful ROA update cycles.", "counter",
+		sample{value: float64(s.counters.updates)})
+	writeMetric(w, "rpkirtr_diff_roas_total", "Number of ROAs added or deleted by updates.", "counter",
+		sample{labels: `action="add"`, value: float64(s.counters.added)},
+		sample{labels: `action="delete"`, value: float64(s.counters.deleted)})
+	errs := make([]sample, 0, len(errorCategories))
+	for _, v := range errorCategories {
+		errs = append(errs, sample{labels: fmt.Sprintf(`category=%q`, v), value: float64(s.counters.errors[v])})
+	}
+	writeMetric(w, "rpkirtr_update_errors_total", "Number of failed ROA updates, by category.", "counter", errs...)
+	responses := make([]sample, 0, len(responseTypes))
+	for i, v := range responseTypes {
+		responses = append(responses, sample{labels: fmt.Sprintf(`type=%q`, v), value: float64(s.responses.get(i))})
+	}
+	writeMetric(w, "rpkirtr_responses_total", "Number of responses to client queries, by type: incremental for a Serial Query, full for a Reset Query, and cache_reset for a Serial Query which needed a Cache Reset.", "counter",
+		responses...)
+	writeMetric(w, "rpkirtr_client_sent_bytes_total", "Bytes sent to each connected client session, by address and port.", "counter",
+		sentSamples(s.clients)...)
+	writeHistogram(w, "rpkirtr_full_sync_duration_seconds", "Time taken to send the full table to a client.", s.fullSyncs)
+}
+
+// sentSamples has the bytes sent for each client session.
+func sentSamples(clients []*client) []sample {
+	samples := make([]sample, 0, len(clients))
+	for _, c := range clients {
+		samples = append(samples, sample{labels: fmt.Sprintf(`client=%q`, c.addr), value: float64(atomic.LoadUint64(&c.bytesSent))})
+	}
+	return samples
+}
+
+// clientSamples has a sample per client session. The version is none until negotiated.
+func clientSamples(clients []*client) []sample {
+	samples := make([]sample, 0, len(clients))
+	for _, c := range clients {
+		version := "none"
+		if c.negotiated {
+			version = strconv.Itoa(int(c.version))
+		}
+		samples = append(samples, sample{labels: fmt.Sprintf(`client=%q,version=%q`, c.addr, version), value: 1})
+	}
+	return samples
+}
+
+// writeMetric writes a single metric family.
+func writeMetric(w io.Writer, name, help, kind string, samples ...sample) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(&b, "# TYPE %s %s\n", name, kind)
+	for _, v := range samples {
+		if labels := withInstance(v.labels); labels != "" {
+			fmt.Fprintf(&b, "%s{%s} %s\n", name, labels, strconv.FormatFloat(v.value, 'f', -1, 64))
+		} else {
+			fmt.Fprintf(&b, "%s %s\n", name, strconv.FormatFloat(v.value, 'f', -1, 64))
+		}
+	}
+	io.WriteString(w, b.String())
+}
+
+// writeHistogram writes a histogram, with cumulative buckets, the sum, and
+// the count. A nil histogram is written as empty.
+func writeHistogram(w io.Writer, name, help string, h *histogram) {
+	if h == nil {
+		h = newHistogram(syncBuckets)
+	}
+	var b strings.Builder
+	h.mutex.Lock()
+	fmt.Fprintf(&b, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(&b, "# TYPE %s histogram\n", name)
+	for i, le := range h.buckets {
+		fmt.Fprintf(&b, "%s_bucket{%s} %d\n", name, withInstance(fmt.Sprintf("le=%q", strconv.FormatFloat(le, 'f', -1, 64))), h.counts[i])
+	}
+	fmt.Fprintf(&b, "%s_bucket{%s} %d\n", name, withInstance(`le="+Inf"`), h.count)
+	var labels string
+	if l := withInstance(""); l != "" {
+		labels = "{" + l + "}"
+	}
+	fmt.Fprintf(&b, "%s_sum%s %s\n", name, labels, strconv.FormatFloat(h.sum, 'f', -1, 64))
+	fmt.Fprintf(&b, "%s_count%s %d\n", name, labels, h.count)
+	h.mutex.Unlock()
+	io.WriteString(w, b.String())
+}
+
+// withInstance adds the rpkirtr_instance label to labels, if the instance is
+// named. Prometheus sets its own instance label to the scraped address, so
+// this has a name of its own.
+func withInstance(labels string) string {
+	if instanceName == "" {
+		return labels
+	}
+	l := fmt.Sprintf("rpkirtr_instance=%q", instanceName)
+	if labels == "" {
+		return l
+	}
+	return l + "," + labels
+}
+
+// timestamp returns unix time in seconds, or zero if the time was never set.
+func timestamp(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.Unix())
+}
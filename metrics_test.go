@@ -0,0 +1,214 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	s := &CacheServer{
+		mutex:  &sync.RWMutex{},
+		serial: 5,
+		roas: []roa{
+			{
+				Prefix:  netaddr.MustParseIPPrefix("192.168.1.0/24"),
+				MaxMask: 24,
+				ASN:     123,
+			},
+			{
+				Prefix:  netaddr.MustParseIPPrefix("2001:db8::/32"),
+				MaxMask: 48,
+				ASN:     123,
+			},
+			{
+				Prefix:  netaddr.MustParseIPPrefix("2001:db8::/48"),
+				MaxMask: 48,
+				ASN:     123,
+			},
+		},
+		updates: checkErrorUpdate{
+			lastCheck:  time.Unix(1634865543, 0),
+			generated:  time.Unix(1634865000, 0),
+			fetchBytes: 52000000,
+			fetchTime:  2500 * time.Millisecond,
+			unchanged:  12,
+		},
+		counters: counters{
+			updates: 2,
+			added:   10,
+			deleted: 3,
+			errors:  map[string]uint64{parseError: 4},
+		},
+		clients: []*client{
+			{addr: "192.0.2.1:40000", version: version1, negotiated: true, bytesSent: 1234},
+			{addr: "192.0.2.1:40001"},
+		},
+		fullSyncs: newHistogram(syncBuckets),
+		responses: &responseCounts{40, 3, 2},
+	}
+	s.roas, s.roasV4, s.roasV6 = splitFamilies(s.roas)
+	s.fullSyncs.observe(0.3)
+	s.fullSyncs.observe(45)
+
+	rec := httptest.NewRecorder()
+	s.metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, want := range []string{
+		"# TYPE rpkirtr_roas gauge\n",
+		"rpkirtr_roas 3\n",
+		"rpkirtr_roas_by_family{family=\"ipv4\"} 1\n",
+		"rpkirtr_roas_by_family{family=\"ipv6\"} 2\n",
+		"rpkirtr_router_keys 0\n",
+		"rpkirtr_aspas 0\n",
+		"rpkirtr_serial 5\n",
+		"# TYPE rpkirtr_responses_total counter\n",
+		"rpkirtr_responses_total{type=\"incremental\"} 40\n",
+		"rpkirtr_responses_total{type=\"full\"} 3\n",
+		"rpkirtr_responses_total{type=\"cache_reset\"} 2\n",
+		"rpkirtr_clients 2\n",
+		"rpkirtr_client_info{client=\"192.0.2.1:40000\",version=\"1\"} 1\n",
+		"rpkirtr_client_info{client=\"192.0.2.1:40001\",version=\"none\"} 1\n",
+		"rpkirtr_last_check_timestamp_seconds 1634865543\n",
+		"rpkirtr_last_error_timestamp_seconds 0\n",
+		"rpkirtr_upstream_generated_timestamp_seconds 1634865000\n",
+		"rpkirtr_upstream_valid_timestamp_seconds 0\n",
+		"rpkirtr_last_fetch_bytes 52000000\n",
+		"rpkirtr_last_fetch_duration_seconds 2.5\n",
+		"rpkirtr_last_update_changed 0\n",
+		"rpkirtr_unchanged_updates 12\n",
+		"# TYPE rpkirtr_updates_total counter\n",
+		"rpkirtr_updates_total 2\n",
+		"rpkirtr_diff_roas_total{action=\"add\"} 10\n",
+		"rpkirtr_diff_roas_total{action=\"delete\"} 3\n",
+		"# TYPE rpkirtr_update_errors_total counter\n",
+		"rpkirtr_update_errors_total{category=\"parse\"} 4\n",
+		"rpkirtr_update_errors_total{category=\"fetch\"} 0\n",
+		"rpkirtr_client_sent_bytes_total{client=\"192.0.2.1:40000\"} 1234\n",
+		"rpkirtr_client_sent_bytes_total{client=\"192.0.2.1:40001\"} 0\n",
+		"# TYPE rpkirtr_full_sync_duration_seconds histogram\n",
+		"rpkirtr_full_sync_duration_seconds_bucket{le=\"0.1\"} 0\n",
+		"rpkirtr_full_sync_duration_seconds_bucket{le=\"0.5\"} 1\n",
+		"rpkirtr_full_sync_duration_seconds_bucket{le=\"30\"} 1\n",
+		"rpkirtr_full_sync_duration_seconds_bucket{le=\"60\"} 2\n",
+		"rpkirtr_full_sync_duration_seconds_bucket{le=\"+Inf\"} 2\n",
+		"rpkirtr_full_sync_duration_seconds_sum 45.3\n",
+		"rpkirtr_full_sync_duration_seconds_count 2\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics output missing %q. Got:\n%s", want, body)
+		}
+	}
+}
+
+func TestLastUpdateChanged(t *testing.T) {
+	s := &CacheServer{
+		mutex:     &sync.RWMutex{},
+		depth:     defaultHistory,
+		fullSyncs: newHistogram(syncBuckets),
+		responses: &responseCounts{},
+	}
+	metric := func() string {
+		rec := httptest.NewRecorder()
+		s.metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+		return rec.Body.String()
+	}
+
+	// Nothing has been updated at startup.
+	if body := metric(); !strings.Contains(body, "rpkirtr_last_update_changed 0\n") {
+		t.Errorf("Got before any update:\n%s\nWant rpkirtr_last_update_changed 0", body)
+	}
+	s.apply(rpkiData{roas: []roa{{Prefix: netaddr.MustParseIPPrefix("192.0.2.0/24"), MaxMask: 24, ASN: 64496}}}, time.Now())
+	if body := metric(); !strings.Contains(body, "rpkirtr_last_update_changed 1\n") {
+		t.Errorf("Got after a change:\n%s\nWant rpkirtr_last_update_changed 1", body)
+	}
+}
+
+// stuckWriter is a response writer whose scraper never reads.
+type stuckWriter struct {
+	*httptest.ResponseRecorder
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (w stuckWriter) Write(p []byte) (int, error) {
+	select {
+	case w.writing <- struct{}{}:
+	default:
+	}
+	<-w.release
+	return w.ResponseRecorder.Write(p)
+}
+
+func (w stuckWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func TestMetricsSlowScraper(t *testing.T) {
+	s := &CacheServer{
+		mutex:     &sync.RWMutex{},
+		fullSyncs: newHistogram(syncBuckets),
+	}
+	w := stuckWriter{
+		ResponseRecorder: httptest.NewRecorder(),
+		writing:          make(chan struct{}, 1),
+		release:          make(chan struct{}),
+	}
+	done := make(chan struct{})
+	go func() {
+		s.metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+		close(done)
+	}()
+	<-w.writing
+
+	// Neither an update nor a full sync waits for the scraper.
+	locked := make(chan struct{})
+	go func() {
+		s.mutex.Lock()
+		s.mutex.Unlock()
+		s.fullSyncs.observe(1)
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Error("The server lock was held while writing to a scraper")
+	}
+	close(w.release)
+	<-done
+	if !strings.Contains(w.Body.String(), "rpkirtr_serial 0\n") {
+		t.Errorf("Got:\n%s\nWant the metrics written once released", w.Body.String())
+	}
+}
+
+func TestMetricsInstance(t *testing.T) {
+	instanceName = "edge1"
+	defer func() { instanceName = "" }()
+
+	var b strings.Builder
+	writeMetric(&b, "rpkirtr_roas", "Number of ROAs currently served.", "gauge", sample{value: 3})
+	writeMetric(&b, "rpkirtr_roas_by_family", "Number of ROAs currently served per address family.", "gauge",
+		sample{labels: `family="ipv4"`, value: 1})
+	h := newHistogram([]float64{1})
+	h.observe(0.5)
+	writeHistogram(&b, "rpkirtr_full_sync_duration_seconds", "Time taken to send the full table to a client.", h)
+	body := b.String()
+
+	for _, want := range []string{
+		"rpkirtr_roas{rpkirtr_instance=\"edge1\"} 3\n",
+		"rpkirtr_roas_by_family{rpkirtr_instance=\"edge1\",family=\"ipv4\"} 1\n",
+		"rpkirtr_full_sync_duration_seconds_bucket{rpkirtr_instance=\"edge1\",le=\"1\"} 1\n",
+		"rpkirtr_full_sync_duration_seconds_bucket{rpkirtr_instance=\"edge1\",le=\"+Inf\"} 1\n",
+		"rpkirtr_full_sync_duration_seconds_sum{rpkirtr_instance=\"edge1\"} 0.5\n",
+		"rpkirtr_full_sync_duration_seconds_count{rpkirtr_instance=\"edge1\"} 1\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics output missing %q. Got:\n%s", want, body)
+		}
+	}
+}
@@ -1,10 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
-	"log"
 )
 
 const (
@@ -19,13 +19,28 @@ const (
 	cacheReset    uint8 = 8
 	routerKey     uint8 = 9
 	errorReport   uint8 = 10
+	aspaPDUType   uint8 = 11
 
 	// protocol versions
 	version0 uint8 = 0
 	version1 uint8 = 1
+	version2 uint8 = 2
 
 	minPDULength  = 8
 	headPDULength = 2
+	// maxPDULength is far larger than anything a router should send us.
+	maxPDULength = 65536
+
+	// error codes
+	corruptData           uint16 = 0
+	internalError         uint16 = 1
+	noDataAvailable       uint16 = 2
+	invalidRequest        uint16 = 3
+	unsupportedVersion    uint16 = 4
+	unsupportedPDUType    uint16 = 5
+	unknownWithdrawal     uint16 = 6
+	duplicateAnnouncement uint16 = 7
+	unexpectedVersion     uint16 = 8
 
 	// flags
 	withdraw uint8 = 0
@@ -55,12 +70,13 @@ type serialNotifyPDU struct {
 		|                                           |
 		`-------------------------------------------'
 	*/
+	version uint8
 	Session uint16
 	Serial  uint32
 }
 
 func (p *serialNotifyPDU) serialize(wr io.Writer) {
-	log.Printf("Sending a serial notify PDU: %+v\n", *p)
+	logWith(levelDebug, nil, "Sending a serial notify PDU: %+v", *p)
 	pdu := struct {
 		version uint8
 		ptype   uint8
@@ -68,7 +84,7 @@ func (p *serialNotifyPDU) serialize(wr io.Writer) {
 		length  uint32
 		serial  uint32
 	}{
-		version1,
+		p.version,
 		serialNotify,
 		p.Session,
 		uint32(12),
@@ -129,18 +145,19 @@ type cacheResponsePDU struct {
 		|                                           |
 		`-------------------------------------------'
 	*/
+	version   uint8
 	sessionID uint16
 }
 
 func (p *cacheResponsePDU) serialize(wr io.Writer) {
-	log.Printf("Sending a cache Response PDU: %v\n", *p)
+	logWith(levelDebug, nil, "Sending a cache Response PDU: %v", *p)
 	pdu := struct {
 		version uint8
 		ptype   uint8
 		session uint16
 		length  uint32
 	}{
-		version1,
+		p.version,
 		cacheResponse,
 		p.sessionID,
 		uint32(8),
@@ -173,11 +190,12 @@ type ipv4PrefixPDU struct {
 		|                                           |
 		`-------------------------------------------'
 	*/
-	flags  uint8
-	min    uint8
-	max    uint8
-	prefix [4]byte
-	asn    uint32
+	version uint8
+	flags   uint8
+	min     uint8
+	max     uint8
+	prefix  [4]byte
+	asn     uint32
 }
 
 func (p *ipv4PrefixPDU) serialize(wr io.Writer) {
@@ -193,7 +211,7 @@ func (p *ipv4PrefixPDU) serialize(wr io.Writer) {
 		prefix  [4]byte
 		asn     uint32
 	}{
-		version1,
+		p.version,
 		ipv4Prefix,
 		uint16(0),
 		uint32(20),
@@ -236,11 +254,12 @@ type ipv6PrefixPDU struct {
 		|                                           |
 		`-------------------------------------------'
 	*/
-	flags  uint8
-	min    uint8
-	max    uint8
-	prefix [16]byte
-	asn    uint32
+	version uint8
+	flags   uint8
+	min     uint8
+	max     uint8
+	prefix  [16]byte
+	asn     uint32
 }
 
 func (p *ipv6PrefixPDU) serialize(wr io.Writer) {
@@ -256,7 +275,7 @@ func (p *ipv6PrefixPDU) serialize(wr io.Writer) {
 		prefix  [16]byte
 		asn     uint32
 	}{
-		version1,
+		p.version,
 		ipv6Prefix,
 		uint16(0),
 		uint32(32),
@@ -270,6 +289,99 @@ func (p *ipv6PrefixPDU) serialize(wr io.Writer) {
 	binary.Write(wr, binary.BigEndian, pdu)
 }
 
+// routerKeyPDU is only part of version 1 of the protocol.
+type routerKeyPDU struct {
+	/*
+		0          8          16         24        31
+		.-------------------------------------------.
+		| Protocol |   PDU    |          |          |
+		| Version  |   Type   |  Flags   |   zero   |
+		|    1     |    9     |          |          |
+		+-------------------------------------------+
+		|                                           |
+		|                  Length                   |
+		|                                           |
+		+-------------------------------------------+
+		|                                           |
+		+---                                     ---+
+		|          Subject Key Identifier           |
+		+---                                     ---+
+		|                                           |
+		+---                                     ---+
+		|                (20 octets)                |
+		+---                                     ---+
+		|                                           |
+		+-------------------------------------------+
+		|                                           |
+		|                 AS Number                 |
+		|                                           |
+		+-------------------------------------------+
+		|                                           |
+		~          Subject Public Key Info          ~
+		|                                           |
+		`-------------------------------------------'
+	*/
+	version uint8
+	flags   uint8
+	ski     [20]byte
+	asn     uint32
+	spki    []byte
+}
+
+func (p *routerKeyPDU) serialize(wr io.Writer) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, p.version)
+	binary.Write(&buf, binary.BigEndian, routerKey)
+	binary.Write(&buf, binary.BigEndian, p.flags)
+	binary.Write(&buf, binary.BigEndian, uint8(0))
+	binary.Write(&buf, binary.BigEndian, uint32(32+len(p.spki)))
+	buf.Write(p.ski[:])
+	binary.Write(&buf, binary.BigEndian, p.asn)
+	buf.Write(p.spki)
+	wr.Write(buf.Bytes())
+}
+
+// aspaPDU is from draft-ietf-sidrops-8210bis, only sent in version 2.
+// A withdraw has no providers.
+type aspaPDU struct {
+	/*
+		0          8          16         24        31
+		.-------------------------------------------.
+		| Protocol |   PDU    |          |          |
+		| Version  |   Type   |  Flags   |   zero   |
+		|    2     |    11    |          |          |
+		+-------------------------------------------+
+		|                                           |
+		|                  Length                   |
+		|                                           |
+		+-------------------------------------------+
+		|                                           |
+		|    Customer Autonomous System Number      |
+		|                                           |
+		+-------------------------------------------+
+		|                                           |
+		~    Provider Autonomous System Numbers     ~
+		|                                           |
+		`-------------------------------------------'
+	*/
+	version   uint8
+	flags     uint8
+	customer  uint32
+	providers []uint32
+}
+
+func (p *aspaPDU) serialize(wr io.Writer) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, p.version)
+	binary.Write(&buf, binary.BigEndian, aspaPDUType)
+	binary.Write(&buf, binary.BigEndian, p.flags)
+	binary.Write(&buf, binary.BigEndian, uint8(0))
+	binary.Write(&buf, binary.BigEndian, uint32(12+4*len(p.providers)))
+	binary.Write(&buf, binary.BigEndian, p.customer)
+	binary.Write(&buf, binary.BigEndian, p.providers)
+	wr.Write(buf.Bytes())
+}
+
 type endOfDataPDU struct {
 	/*
 		0          8          16         24        31
@@ -299,6 +411,7 @@ type endOfDataPDU struct {
 		|                                           |
 		`-------------------------------------------'
 	*/
+	version uint8
 	session uint16
 	serial  uint32
 	refresh uint32
@@ -307,7 +420,28 @@ type endOfDataPDU struct {
 }
 
 func (p *endOfDataPDU) serialize(wr io.Writer) {
-	log.Printf("Sending end of data PDU: %v\n", *p)
+	logWith(levelDebug, nil, "Sending end of data PDU: %v", *p)
+
+	// Version 0 has no timing parameters.
+	// https://datatracker.ietf.org/doc/html/rfc6810#section-5.8
+	if p.version == version0 {
+		pdu := struct {
+			version uint8
+			ptype   uint8
+			session uint16
+			length  uint32
+			serial  uint32
+		}{
+			p.version,
+			endOfData,
+			p.session,
+			uint32(12),
+			p.serial,
+		}
+		binary.Write(wr, binary.BigEndian, pdu)
+		return
+	}
+
 	pdu := struct {
 		version uint8
 		ptype   uint8
@@ -318,7 +452,7 @@ func (p *endOfDataPDU) serialize(wr io.Writer) {
 		retry   uint32
 		expire  uint32
 	}{
-		version1,
+		p.version,
 		endOfData,
 		p.session,
 		uint32(24),
@@ -330,7 +464,8 @@ func (p *endOfDataPDU) serialize(wr io.Writer) {
 	binary.Write(wr, binary.BigEndian, pdu)
 }
 
-type cacheResetPDU struct { /*
+type cacheResetPDU struct {
+	/*
 		0          8          16         24        31
 		.-------------------------------------------.
 		| Protocol |   PDU    |                     |
@@ -342,17 +477,18 @@ type cacheResetPDU struct { /*
 		|                                           |
 		`-------------------------------------------'
 	*/
+	version uint8
 }
 
 func (p *cacheResetPDU) serialize(wr io.Writer) {
-	log.Printf("Sending a cache reset PDU: %v\n", *p)
+	logWith(levelDebug, nil, "Sending a cache reset PDU: %v", *p)
 	pdu := struct {
 		version uint8
 		ptype   uint8
 		zero    uint16
 		length  uint32
 	}{
-		version1,
+		p.version,
 		cacheReset,
 		uint16(0),
 		uint32(8),
@@ -391,24 +527,38 @@ type errorReportPDU struct {
 		|                                           |
 		`-------------------------------------------'
 	*/
+	version uint8
+	code    uint16
+	pdu     []byte
+	report  string
+}
+
+func (p *errorReportPDU) serialize(wr io.Writer) {
+	logWith(levelDebug, nil, "Sending an error report PDU: %d %s", p.code, p.report)
+	report := []byte(p.report)
+
+	// Built up first so the whole PDU goes out in a single write.
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, p.version)
+	binary.Write(&buf, binary.BigEndian, errorReport)
+	binary.Write(&buf, binary.BigEndian, p.code)
+	binary.Write(&buf, binary.BigEndian, uint32(16+len(p.pdu)+len(report)))
+	binary.Write(&buf, binary.BigEndian, uint32(len(p.pdu)))
+	buf.Write(p.pdu)
+	binary.Write(&buf, binary.BigEndian, uint32(len(report)))
+	buf.Write(report)
+	wr.Write(buf.Bytes())
+}
+
+// pduError is an error which needs to be reported back to the client
+// with an error report PDU.
+type pduError struct {
 	code   uint16
 	report string
 }
 
-func (p *errorReportPDU) serialize(wr io.Writer) {
-	log.Printf("Sending an error report PDU: %v\n", *p)
-	// length of encapped PDU 0 for now
-	// not encapping PDU, so empty field there
-	reportLength := len([]byte(p.report))
-	totalLength := 128 + reportLength
-
-	binary.Write(wr, binary.BigEndian, version1)
-	binary.Write(wr, binary.BigEndian, errorReport)
-	binary.Write(wr, binary.BigEndian, p.code)
-	binary.Write(wr, binary.BigEndian, totalLength)
-	binary.Write(wr, binary.BigEndian, uint32(0))
-	binary.Write(wr, binary.BigEndian, reportLength)
-	binary.Write(wr, binary.BigEndian, p.report)
+func (e *pduError) Error() string {
+	return e.report
 }
 
 func getSerialQueryPDU(pdu []byte) serialQueryPDU {
@@ -439,7 +589,14 @@ func getPDU(r io.Reader) ([]byte, error) {
 	}
 
 	// Read the rest of the PDU, minus the header.
-	length := binary.BigEndian.Uint32(buf[4:8]) - 8
+	length := binary.BigEndian.Uint32(buf[4:8])
+	if length < minPDULength || length > maxPDULength {
+		return buf, &pduError{
+			code:   corruptData,
+			report: fmt.Sprintf("invalid PDU length %d", length),
+		}
+	}
+	length -= minPDULength
 	if length > 0 {
 		lr := io.LimitReader(r, int64(length))
 		data := make([]byte, length)
@@ -452,20 +609,28 @@ func getPDU(r io.Reader) ([]byte, error) {
 }
 
 // decodePDUHeader does a size and version check. Otherwise it returns just the header.
+// Versions 0 (RFC6810), 1 (RFC8210), and 2 (draft-ietf-sidrops-8210bis) are supported.
 func decodePDUHeader(pdu []byte) (headerPDU, error) {
 	var header headerPDU
 	if len(pdu) < headPDULength {
 		return header, fmt.Errorf("PDU headers have a minimin size of 2. PDU passed has length %d", len(pdu))
 	}
-	if int(pdu[0]) != 1 {
-		return header, fmt.Errorf("only version 1 is supported. PDU has version %d", int(pdu[0]))
+	if pdu[0] > version2 {
+		return header, &pduError{
+			code:   unsupportedVersion,
+			report: fmt.Sprintf("only versions 0, 1, and 2 are supported. PDU has version %d", int(pdu[0])),
+		}
 	}
 	header.Version = uint8(pdu[0])
 	header.Ptype = uint8(pdu[1])
 
 	// PDU types currently number from 0 to 10, excluding 5. Anything else is invalid.
+	// ASPA PDUs are only sent by caches, so are not expected from a router.
 	if header.Ptype > 10 || header.Ptype == 5 {
-		return header, fmt.Errorf("unsupported pdu version received: %d", header.Ptype)
+		return header, &pduError{
+			code:   unsupportedPDUType,
+			report: fmt.Sprintf("unsupported pdu type received: %d", header.Ptype),
+		}
 	}
 
 	return header, nil
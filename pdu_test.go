@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"inet.af/netaddr"
 )
 
 func TestSerialNotifyPDU(t *testing.T) {
@@ -36,6 +37,7 @@ func TestSerialNotifyPDU(t *testing.T) {
 		// Send data to be encoded
 		var buffer bytes.Buffer
 		pdu := &serialNotifyPDU{
+			version: version1,
 			Session: p.session,
 			Serial:  p.serial,
 		}
@@ -87,6 +89,7 @@ func TestCacheResponsePDU(t *testing.T) {
 		// Send data to be encoded
 		var buffer bytes.Buffer
 		pdu := &cacheResponsePDU{
+			version:   version1,
 			sessionID: p.session,
 		}
 		pdu.serialize(&buffer)
@@ -153,11 +156,12 @@ func TestIpv4PrefixPDU(t *testing.T) {
 		// Send data to be encoded
 		var buffer bytes.Buffer
 		pdu := &ipv4PrefixPDU{
-			prefix: p.prefix,
-			flags:  p.flag,
-			min:    p.min,
-			max:    p.max,
-			asn:    p.asn,
+			version: version1,
+			prefix:  p.prefix,
+			flags:   p.flag,
+			min:     p.min,
+			max:     p.max,
+			asn:     p.asn,
 		}
 		pdu.serialize(&buffer)
 
@@ -243,11 +247,12 @@ func TestIpv6PrefixPDU(t *testing.T) {
 		// Send data to be encoded
 		var buffer bytes.Buffer
 		pdu := &ipv6PrefixPDU{
-			prefix: p.prefix,
-			flags:  p.flag,
-			min:    p.min,
-			max:    p.max,
-			asn:    p.asn,
+			version: version1,
+			prefix:  p.prefix,
+			flags:   p.flag,
+			min:     p.min,
+			max:     p.max,
+			asn:     p.asn,
 		}
 		pdu.serialize(&buffer)
 
@@ -275,6 +280,97 @@ func TestIpv6PrefixPDU(t *testing.T) {
 	}
 }
 
+// TestPrefixPDUBytes checks the bytes written for a ROA field by field against
+// the layout in RFC8210 5.6 and 5.7.
+func TestPrefixPDUBytes(t *testing.T) {
+	tests := []struct {
+		desc    string
+		roa     roa
+		flag    uint8
+		version uint8
+		want    []byte
+	}{
+		{
+			desc:    "192.0.2.0/24-/25 AS64496 announce",
+			roa:     roa{Prefix: netaddr.MustParseIPPrefix("192.0.2.0/24"), MaxMask: 25, ASN: 64496},
+			flag:    announce,
+			version: version1,
+			want: []byte{
+				0x01, 0x04, 0x00, 0x00, // version, type, zero
+				0x00, 0x00, 0x00, 0x14, // length
+				0x01, 0x18, 0x19, 0x00, // flags, prefix length, max length, zero
+				0xc0, 0x00, 0x02, 0x00, // prefix
+				0x00, 0x00, 0xfb, 0xf0, // ASN
+			},
+		},
+		{
+			desc:    "192.0.2.0/24-/25 AS64496 withdraw version 0",
+			roa:     roa{Prefix: netaddr.MustParseIPPrefix("192.0.2.0/24"), MaxMask: 25, ASN: 64496},
+			flag:    withdraw,
+			version: version0,
+			want: []byte{
+				0x00, 0x04, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x14,
+				0x00, 0x18, 0x19, 0x00,
+				0xc0, 0x00, 0x02, 0x00,
+				0x00, 0x00, 0xfb, 0xf0,
+			},
+		},
+		{
+			desc:    "10.0.0.0/8-/24 AS4200000000 announce",
+			roa:     roa{Prefix: netaddr.MustParseIPPrefix("10.0.0.0/8"), MaxMask: 24, ASN: 4200000000},
+			flag:    announce,
+			version: version1,
+			want: []byte{
+				0x01, 0x04, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x14,
+				0x01, 0x08, 0x18, 0x00,
+				0x0a, 0x00, 0x00, 0x00,
+				0xfa, 0x56, 0xea, 0x00,
+			},
+		},
+		{
+			desc:    "2001:db8::/32-/48 AS64496 announce",
+			roa:     roa{Prefix: netaddr.MustParseIPPrefix("2001:db8::/32"), MaxMask: 48, ASN: 64496},
+			flag:    announce,
+			version: version1,
+			want: []byte{
+				0x01, 0x06, 0x00, 0x00, // version, type, zero
+				0x00, 0x00, 0x00, 0x20, // length
+				0x01, 0x20, 0x30, 0x00, // flags, prefix length, max length, zero
+				0x20, 0x01, 0x0d, 0xb8, // prefix
+				0x00, 0x00, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x00,
+				0x00, 0x00, 0xfb, 0xf0, // ASN
+			},
+		},
+		{
+			desc:    "2001:db8::1/128-/128 AS4200000000 withdraw version 2",
+			roa:     roa{Prefix: netaddr.MustParseIPPrefix("2001:db8::1/128"), MaxMask: 128, ASN: 4200000000},
+			flag:    withdraw,
+			version: version2,
+			want: []byte{
+				0x02, 0x06, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x20,
+				0x00, 0x80, 0x80, 0x00,
+				0x20, 0x01, 0x0d, 0xb8,
+				0x00, 0x00, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x01,
+				0xfa, 0x56, 0xea, 0x00,
+			},
+		},
+	}
+	for _, v := range tests {
+		var buffer bytes.Buffer
+		writePrefixPDU(&v.roa, &buffer, v.flag, v.version)
+		if !bytes.Equal(buffer.Bytes(), v.want) {
+			t.Errorf("Error on %s. Got % x, Wanted % x\n", v.desc, buffer.Bytes(), v.want)
+		}
+	}
+}
+
 func TestEndOfDataPDU(t *testing.T) {
 	type eodPDU struct {
 		Version uint8
@@ -310,6 +406,7 @@ func TestEndOfDataPDU(t *testing.T) {
 		// Send data to be encoded
 		var buffer bytes.Buffer
 		pdu := &endOfDataPDU{
+			version: version1,
 			session: v.session,
 			serial:  v.serial,
 			refresh: v.refresh,
@@ -342,6 +439,25 @@ func TestEndOfDataPDU(t *testing.T) {
 	}
 }
 
+func TestEndOfDataPDUVersion0(t *testing.T) {
+	var buffer bytes.Buffer
+	pdu := &endOfDataPDU{
+		version: version0,
+		session: 1,
+		serial:  2,
+		refresh: 3,
+		retry:   4,
+		expire:  5,
+	}
+	pdu.serialize(&buffer)
+
+	// No timing parameters in version 0.
+	want := []byte{0x00, 0x07, 0x00, 0x01, 0x00, 0x00, 0x00, 0x0c, 0x00, 0x00, 0x00, 0x02}
+	if !bytes.Equal(buffer.Bytes(), want) {
+		t.Errorf("PDU encoded is not what was expected. Got %v, Wanted %v\n", buffer.Bytes(), want)
+	}
+}
+
 func TestCacheResetPDU(t *testing.T) {
 	type cachePDU struct {
 		Version uint8
@@ -352,7 +468,9 @@ func TestCacheResetPDU(t *testing.T) {
 
 	// Send data to be encoded
 	var buffer bytes.Buffer
-	pdu := &cacheResetPDU{}
+	pdu := &cacheResetPDU{
+		version: version1,
+	}
 	pdu.serialize(&buffer)
 
 	// Read data back that was written
@@ -372,3 +490,109 @@ func TestCacheResetPDU(t *testing.T) {
 		t.Errorf("PDU encoded is not what was expected. Got %+v, Wanted %+v\n", got, want)
 	}
 }
+
+func TestErrorReportPDU(t *testing.T) {
+	tests := []struct {
+		desc   string
+		code   uint16
+		pdu    []byte
+		report string
+		want   []byte
+	}{
+		{
+			desc: "no pdu or text",
+			code: internalError,
+			want: []byte{0x01, 0x0a, 0x00, 0x01, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+		},
+		{
+			desc:   "pdu and text",
+			code:   unsupportedVersion,
+			pdu:    []byte{0x02, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x08},
+			report: "v2",
+			want: []byte{
+				0x01, 0x0a, 0x00, 0x04, 0x00, 0x00, 0x00, 0x1a,
+				0x00, 0x00, 0x00, 0x08, 0x02, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x08,
+				0x00, 0x00, 0x00, 0x02, 0x76, 0x32,
+			},
+		},
+	}
+	for _, v := range tests {
+		var buffer bytes.Buffer
+		pdu := &errorReportPDU{
+			version: version1,
+			code:    v.code,
+			pdu:     v.pdu,
+			report:  v.report,
+		}
+		pdu.serialize(&buffer)
+		if !bytes.Equal(buffer.Bytes(), v.want) {
+			t.Errorf("Error on %s. Got %v, Want %v\n", v.desc, buffer.Bytes(), v.want)
+		}
+	}
+}
+
+func TestRouterKeyPDU(t *testing.T) {
+	var buffer bytes.Buffer
+	pdu := &routerKeyPDU{
+		version: version1,
+		flags:   announce,
+		ski:     [20]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10, 0x11, 0x12, 0x13, 0x14},
+		asn:     64496,
+		spki:    []byte{0xaa, 0xbb, 0xcc},
+	}
+	pdu.serialize(&buffer)
+
+	want := []byte{
+		0x01, 0x09, 0x01, 0x00, 0x00, 0x00, 0x00, 0x23,
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a,
+		0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10, 0x11, 0x12, 0x13, 0x14,
+		0x00, 0x00, 0xfb, 0xf0,
+		0xaa, 0xbb, 0xcc,
+	}
+	if !bytes.Equal(buffer.Bytes(), want) {
+		t.Errorf("PDU encoded is not what was expected. Got %v, Wanted %v\n", buffer.Bytes(), want)
+	}
+}
+
+func TestASPAPDU(t *testing.T) {
+	tests := []struct {
+		desc string
+		pdu  aspaPDU
+		want []byte
+	}{
+		{
+			desc: "announce",
+			pdu: aspaPDU{
+				version:   version2,
+				flags:     announce,
+				customer:  64496,
+				providers: []uint32{64497, 64498},
+			},
+			want: []byte{
+				0x02, 0x0b, 0x01, 0x00, 0x00, 0x00, 0x00, 0x14,
+				0x00, 0x00, 0xfb, 0xf0,
+				0x00, 0x00, 0xfb, 0xf1,
+				0x00, 0x00, 0xfb, 0xf2,
+			},
+		},
+		{
+			desc: "withdraw",
+			pdu: aspaPDU{
+				version:  version2,
+				flags:    withdraw,
+				customer: 64496,
+			},
+			want: []byte{
+				0x02, 0x0b, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0c,
+				0x00, 0x00, 0xfb, 0xf0,
+			},
+		},
+	}
+	for _, v := range tests {
+		var buffer bytes.Buffer
+		v.pdu.serialize(&buffer)
+		if !bytes.Equal(buffer.Bytes(), v.want) {
+			t.Errorf("Error on %s. Got %v, Wanted %v\n", v.desc, buffer.Bytes(), v.want)
+		}
+	}
+}
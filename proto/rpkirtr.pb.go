@@ -0,0 +1,467 @@
+// Service definition for querying the cache's validation state without
+// speaking RTR. Answers come from the same ROAs served to routers.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.30.0
+// 	protoc        (unknown)
+// source: proto/rpkirtr.proto
+
+package proto
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type ValidateResponse_State int32
+
+const (
+	ValidateResponse_NOT_FOUND ValidateResponse_State = 0
+	ValidateResponse_VALID     ValidateResponse_State = 1
+	ValidateResponse_INVALID   ValidateResponse_State = 2
+)
+
+// Enum value maps for ValidateResponse_State.
+var (
+	ValidateResponse_State_name = map[int32]string{
+		0: "NOT_FOUND",
+		1: "VALID",
+		2: "INVALID",
+	}
+	ValidateResponse_State_value = map[string]int32{
+		"NOT_FOUND": 0,
+		"VALID":     1,
+		"INVALID":   2,
+	}
+)
+
+func (x ValidateResponse_State) Enum() *ValidateResponse_State {
+	p := new(ValidateResponse_State)
+	*p = x
+	return p
+}
+
+func (x ValidateResponse_State) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (ValidateResponse_State) Descriptor() protoreflect.EnumDescriptor {
+	return file_proto_rpkirtr_proto_enumTypes[0].Descriptor()
+}
+
+func (ValidateResponse_State) Type() protoreflect.EnumType {
+	return &file_proto_rpkirtr_proto_enumTypes[0]
+}
+
+func (x ValidateResponse_State) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use ValidateResponse_State.Descriptor instead.
+func (ValidateResponse_State) EnumDescriptor() ([]byte, []int) {
+	return file_proto_rpkirtr_proto_rawDescGZIP(), []int{1, 0}
+}
+
+type ValidateRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// prefix is in CIDR notation, such as 192.0.2.0/24.
+	Prefix string `protobuf:"bytes,1,opt,name=prefix,proto3" json:"prefix,omitempty"`
+	Asn    uint32 `protobuf:"varint,2,opt,name=asn,proto3" json:"asn,omitempty"`
+}
+
+func (x *ValidateRequest) Reset() {
+	*x = ValidateRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_proto_rpkirtr_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ValidateRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ValidateRequest) ProtoMessage() {}
+
+func (x *ValidateRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_rpkirtr_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ValidateRequest.ProtoReflect.Descriptor instead.
+func (*ValidateRequest) Descriptor() ([]byte, []int) {
+	return file_proto_rpkirtr_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *ValidateRequest) GetPrefix() string {
+	if x != nil {
+		return x.Prefix
+	}
+	return ""
+}
+
+func (x *ValidateRequest) GetAsn() uint32 {
+	if x != nil {
+		return x.Asn
+	}
+	return 0
+}
+
+type ValidateResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	State    ValidateResponse_State `protobuf:"varint,1,opt,name=state,proto3,enum=rpkirtr.ValidateResponse_State" json:"state,omitempty"`
+	Covering []*ROA                 `protobuf:"bytes,2,rep,name=covering,proto3" json:"covering,omitempty"`
+}
+
+func (x *ValidateResponse) Reset() {
+	*x = ValidateResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_proto_rpkirtr_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ValidateResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ValidateResponse) ProtoMessage() {}
+
+func (x *ValidateResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_rpkirtr_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ValidateResponse.ProtoReflect.Descriptor instead.
+func (*ValidateResponse) Descriptor() ([]byte, []int) {
+	return file_proto_rpkirtr_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *ValidateResponse) GetState() ValidateResponse_State {
+	if x != nil {
+		return x.State
+	}
+	return ValidateResponse_NOT_FOUND
+}
+
+func (x *ValidateResponse) GetCovering() []*ROA {
+	if x != nil {
+		return x.Covering
+	}
+	return nil
+}
+
+type ListROAsRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// asn and rir filter the ROAs when set, as ?asn= and ?rir= do on /roas. asn
+	// is optional, so AS0 can be asked for.
+	Asn *uint32 `protobuf:"varint,1,opt,name=asn,proto3,oneof" json:"asn,omitempty"`
+	Rir string  `protobuf:"bytes,2,opt,name=rir,proto3" json:"rir,omitempty"`
+}
+
+func (x *ListROAsRequest) Reset() {
+	*x = ListROAsRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_proto_rpkirtr_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ListROAsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListROAsRequest) ProtoMessage() {}
+
+func (x *ListROAsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_rpkirtr_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListROAsRequest.ProtoReflect.Descriptor instead.
+func (*ListROAsRequest) Descriptor() ([]byte, []int) {
+	return file_proto_rpkirtr_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *ListROAsRequest) GetAsn() uint32 {
+	if x != nil && x.Asn != nil {
+		return *x.Asn
+	}
+	return 0
+}
+
+func (x *ListROAsRequest) GetRir() string {
+	if x != nil {
+		return x.Rir
+	}
+	return ""
+}
+
+type ROA struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Prefix  string `protobuf:"bytes,1,opt,name=prefix,proto3" json:"prefix,omitempty"`
+	MaxMask uint32 `protobuf:"varint,2,opt,name=max_mask,json=maxMask,proto3" json:"max_mask,omitempty"`
+	Asn     uint32 `protobuf:"varint,3,opt,name=asn,proto3" json:"asn,omitempty"`
+	Rir     string `protobuf:"bytes,4,opt,name=rir,proto3" json:"rir,omitempty"`
+}
+
+func (x *ROA) Reset() {
+	*x = ROA{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_proto_rpkirtr_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ROA) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ROA) ProtoMessage() {}
+
+func (x *ROA) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_rpkirtr_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ROA.ProtoReflect.Descriptor instead.
+func (*ROA) Descriptor() ([]byte, []int) {
+	return file_proto_rpkirtr_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *ROA) GetPrefix() string {
+	if x != nil {
+		return x.Prefix
+	}
+	return ""
+}
+
+func (x *ROA) GetMaxMask() uint32 {
+	if x != nil {
+		return x.MaxMask
+	}
+	return 0
+}
+
+func (x *ROA) GetAsn() uint32 {
+	if x != nil {
+		return x.Asn
+	}
+	return 0
+}
+
+func (x *ROA) GetRir() string {
+	if x != nil {
+		return x.Rir
+	}
+	return ""
+}
+
+var File_proto_rpkirtr_proto protoreflect.FileDescriptor
+
+var file_proto_rpkirtr_proto_rawDesc = []byte{
+	0x0a, 0x13, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x2f, 0x72, 0x70, 0x6b, 0x69, 0x72, 0x74, 0x72, 0x2e,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x07, 0x72, 0x70, 0x6b, 0x69, 0x72, 0x74, 0x72, 0x22, 0x3b,
+	0x0a, 0x0f, 0x56, 0x61, 0x6c, 0x69, 0x64, 0x61, 0x74, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
+	0x74, 0x12, 0x16, 0x0a, 0x06, 0x70, 0x72, 0x65, 0x66, 0x69, 0x78, 0x18, 0x01, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x06, 0x70, 0x72, 0x65, 0x66, 0x69, 0x78, 0x12, 0x10, 0x0a, 0x03, 0x61, 0x73, 0x6e,
+	0x18, 0x02, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x03, 0x61, 0x73, 0x6e, 0x22, 0xa3, 0x01, 0x0a, 0x10,
+	0x56, 0x61, 0x6c, 0x69, 0x64, 0x61, 0x74, 0x65, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65,
+	0x12, 0x35, 0x0a, 0x05, 0x73, 0x74, 0x61, 0x74, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0e, 0x32,
+	0x1f, 0x2e, 0x72, 0x70, 0x6b, 0x69, 0x72, 0x74, 0x72, 0x2e, 0x56, 0x61, 0x6c, 0x69, 0x64, 0x61,
+	0x74, 0x65, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x2e, 0x53, 0x74, 0x61, 0x74, 0x65,
+	0x52, 0x05, 0x73, 0x74, 0x61, 0x74, 0x65, 0x12, 0x28, 0x0a, 0x08, 0x63, 0x6f, 0x76, 0x65, 0x72,
+	0x69, 0x6e, 0x67, 0x18, 0x02, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x0c, 0x2e, 0x72, 0x70, 0x6b, 0x69,
+	0x72, 0x74, 0x72, 0x2e, 0x52, 0x4f, 0x41, 0x52, 0x08, 0x63, 0x6f, 0x76, 0x65, 0x72, 0x69, 0x6e,
+	0x67, 0x22, 0x2e, 0x0a, 0x05, 0x53, 0x74, 0x61, 0x74, 0x65, 0x12, 0x0d, 0x0a, 0x09, 0x4e, 0x4f,
+	0x54, 0x5f, 0x46, 0x4f, 0x55, 0x4e, 0x44, 0x10, 0x00, 0x12, 0x09, 0x0a, 0x05, 0x56, 0x41, 0x4c,
+	0x49, 0x44, 0x10, 0x01, 0x12, 0x0b, 0x0a, 0x07, 0x49, 0x4e, 0x56, 0x41, 0x4c, 0x49, 0x44, 0x10,
+	0x02, 0x22, 0x42, 0x0a, 0x0f, 0x4c, 0x69, 0x73, 0x74, 0x52, 0x4f, 0x41, 0x73, 0x52, 0x65, 0x71,
+	0x75, 0x65, 0x73, 0x74, 0x12, 0x15, 0x0a, 0x03, 0x61, 0x73, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28,
+	0x0d, 0x48, 0x00, 0x52, 0x03, 0x61, 0x73, 0x6e, 0x88, 0x01, 0x01, 0x12, 0x10, 0x0a, 0x03, 0x72,
+	0x69, 0x72, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x72, 0x69, 0x72, 0x42, 0x06, 0x0a,
+	0x04, 0x5f, 0x61, 0x73, 0x6e, 0x22, 0x5c, 0x0a, 0x03, 0x52, 0x4f, 0x41, 0x12, 0x16, 0x0a, 0x06,
+	0x70, 0x72, 0x65, 0x66, 0x69, 0x78, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x70, 0x72,
+	0x65, 0x66, 0x69, 0x78, 0x12, 0x19, 0x0a, 0x08, 0x6d, 0x61, 0x78, 0x5f, 0x6d, 0x61, 0x73, 0x6b,
+	0x18, 0x02, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x07, 0x6d, 0x61, 0x78, 0x4d, 0x61, 0x73, 0x6b, 0x12,
+	0x10, 0x0a, 0x03, 0x61, 0x73, 0x6e, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x03, 0x61, 0x73,
+	0x6e, 0x12, 0x10, 0x0a, 0x03, 0x72, 0x69, 0x72, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03,
+	0x72, 0x69, 0x72, 0x32, 0x83, 0x01, 0x0a, 0x0a, 0x56, 0x61, 0x6c, 0x69, 0x64, 0x61, 0x74, 0x69,
+	0x6f, 0x6e, 0x12, 0x3f, 0x0a, 0x08, 0x56, 0x61, 0x6c, 0x69, 0x64, 0x61, 0x74, 0x65, 0x12, 0x18,
+	0x2e, 0x72, 0x70, 0x6b, 0x69, 0x72, 0x74, 0x72, 0x2e, 0x56, 0x61, 0x6c, 0x69, 0x64, 0x61, 0x74,
+	0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x19, 0x2e, 0x72, 0x70, 0x6b, 0x69, 0x72,
+	0x74, 0x72, 0x2e, 0x56, 0x61, 0x6c, 0x69, 0x64, 0x61, 0x74, 0x65, 0x52, 0x65, 0x73, 0x70, 0x6f,
+	0x6e, 0x73, 0x65, 0x12, 0x34, 0x0a, 0x08, 0x4c, 0x69, 0x73, 0x74, 0x52, 0x4f, 0x41, 0x73, 0x12,
+	0x18, 0x2e, 0x72, 0x70, 0x6b, 0x69, 0x72, 0x74, 0x72, 0x2e, 0x4c, 0x69, 0x73, 0x74, 0x52, 0x4f,
+	0x41, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x0c, 0x2e, 0x72, 0x70, 0x6b, 0x69,
+	0x72, 0x74, 0x72, 0x2e, 0x52, 0x4f, 0x41, 0x30, 0x01, 0x42, 0x28, 0x5a, 0x26, 0x67, 0x69, 0x74,
+	0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x6d, 0x65, 0x6c, 0x6c, 0x6f, 0x77, 0x64, 0x72,
+	0x69, 0x66, 0x74, 0x65, 0x72, 0x2f, 0x72, 0x70, 0x6b, 0x69, 0x72, 0x74, 0x72, 0x2f, 0x70, 0x72,
+	0x6f, 0x74, 0x6f, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_proto_rpkirtr_proto_rawDescOnce sync.Once
+	file_proto_rpkirtr_proto_rawDescData = file_proto_rpkirtr_proto_rawDesc
+)
+
+func file_proto_rpkirtr_proto_rawDescGZIP() []byte {
+	file_proto_rpkirtr_proto_rawDescOnce.Do(func() {
+		file_proto_rpkirtr_proto_rawDescData = protoimpl.X.CompressGZIP(file_proto_rpkirtr_proto_rawDescData)
+	})
+	return file_proto_rpkirtr_proto_rawDescData
+}
+
+var file_proto_rpkirtr_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_proto_rpkirtr_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_proto_rpkirtr_proto_goTypes = []interface{}{
+	(ValidateResponse_State)(0), // 0: rpkirtr.ValidateResponse.State
+	(*ValidateRequest)(nil),     // 1: rpkirtr.ValidateRequest
+	(*ValidateResponse)(nil),    // 2: rpkirtr.ValidateResponse
+	(*ListROAsRequest)(nil),     // 3: rpkirtr.ListROAsRequest
+	(*ROA)(nil),                 // 4: rpkirtr.ROA
+}
+var file_proto_rpkirtr_proto_depIdxs = []int32{
+	0, // 0: rpkirtr.ValidateResponse.state:type_name -> rpkirtr.ValidateResponse.State
+	4, // 1: rpkirtr.ValidateResponse.covering:type_name -> rpkirtr.ROA
+	1, // 2: rpkirtr.Validation.Validate:input_type -> rpkirtr.ValidateRequest
+	3, // 3: rpkirtr.Validation.ListROAs:input_type -> rpkirtr.ListROAsRequest
+	2, // 4: rpkirtr.Validation.Validate:output_type -> rpkirtr.ValidateResponse
+	4, // 5: rpkirtr.Validation.ListROAs:output_type -> rpkirtr.ROA
+	4, // [4:6] is the sub-list for method output_type
+	2, // [2:4] is the sub-list for method input_type
+	2, // [2:2] is the sub-list for extension type_name
+	2, // [2:2] is the sub-list for extension extendee
+	0, // [0:2] is the sub-list for field type_name
+}
+
+func init() { file_proto_rpkirtr_proto_init() }
+func file_proto_rpkirtr_proto_init() {
+	if File_proto_rpkirtr_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_proto_rpkirtr_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ValidateRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_proto_rpkirtr_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ValidateResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_proto_rpkirtr_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ListROAsRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_proto_rpkirtr_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ROA); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	file_proto_rpkirtr_proto_msgTypes[2].OneofWrappers = []interface{}{}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_proto_rpkirtr_proto_rawDesc,
+			NumEnums:      1,
+			NumMessages:   4,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_proto_rpkirtr_proto_goTypes,
+		DependencyIndexes: file_proto_rpkirtr_proto_depIdxs,
+		EnumInfos:         file_proto_rpkirtr_proto_enumTypes,
+		MessageInfos:      file_proto_rpkirtr_proto_msgTypes,
+	}.Build()
+	File_proto_rpkirtr_proto = out.File
+	file_proto_rpkirtr_proto_rawDesc = nil
+	file_proto_rpkirtr_proto_goTypes = nil
+	file_proto_rpkirtr_proto_depIdxs = nil
+}
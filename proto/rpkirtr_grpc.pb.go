@@ -0,0 +1,183 @@
+// Service definition for querying the cache's validation state without
+// speaking RTR. Answers come from the same ROAs served to routers.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: proto/rpkirtr.proto
+
+package proto
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Validation_Validate_FullMethodName = "/rpkirtr.Validation/Validate"
+	Validation_ListROAs_FullMethodName = "/rpkirtr.Validation/ListROAs"
+)
+
+// ValidationClient is the client API for Validation service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ValidationClient interface {
+	// Validate returns the RFC6811 origin validation state of a route, along
+	// with the ROAs covering its prefix.
+	Validate(ctx context.Context, in *ValidateRequest, opts ...grpc.CallOption) (*ValidateResponse, error)
+	// ListROAs streams every ROA currently served, optionally filtered.
+	ListROAs(ctx context.Context, in *ListROAsRequest, opts ...grpc.CallOption) (Validation_ListROAsClient, error)
+}
+
+type validationClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewValidationClient(cc grpc.ClientConnInterface) ValidationClient {
+	return &validationClient{cc}
+}
+
+func (c *validationClient) Validate(ctx context.Context, in *ValidateRequest, opts ...grpc.CallOption) (*ValidateResponse, error) {
+	out := new(ValidateResponse)
+	err := c.cc.Invoke(ctx, Validation_Validate_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *validationClient) ListROAs(ctx context.Context, in *ListROAsRequest, opts ...grpc.CallOption) (Validation_ListROAsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Validation_ServiceDesc.Streams[0], Validation_ListROAs_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &validationListROAsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Validation_ListROAsClient interface {
+	Recv() (*ROA, error)
+	grpc.ClientStream
+}
+
+type validationListROAsClient struct {
+	grpc.ClientStream
+}
+
+func (x *validationListROAsClient) Recv() (*ROA, error) {
+	m := new(ROA)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ValidationServer is the server API for Validation service.
+// All implementations must embed UnimplementedValidationServer
+// for forward compatibility
+type ValidationServer interface {
+	// Validate returns the RFC6811 origin validation state of a route, along
+	// with the ROAs covering its prefix.
+	Validate(context.Context, *ValidateRequest) (*ValidateResponse, error)
+	// ListROAs streams every ROA currently served, optionally filtered.
+	ListROAs(*ListROAsRequest, Validation_ListROAsServer) error
+	mustEmbedUnimplementedValidationServer()
+}
+
+// UnimplementedValidationServer must be embedded to have forward compatible implementations.
+type UnimplementedValidationServer struct {
+}
+
+func (UnimplementedValidationServer) Validate(context.Context, *ValidateRequest) (*ValidateResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Validate not implemented")
+}
+func (UnimplementedValidationServer) ListROAs(*ListROAsRequest, Validation_ListROAsServer) error {
+	return status.Errorf(codes.Unimplemented, "method ListROAs not implemented")
+}
+func (UnimplementedValidationServer) mustEmbedUnimplementedValidationServer() {}
+
+// UnsafeValidationServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ValidationServer will
+// result in compilation errors.
+type UnsafeValidationServer interface {
+	mustEmbedUnimplementedValidationServer()
+}
+
+func RegisterValidationServer(s grpc.ServiceRegistrar, srv ValidationServer) {
+	s.RegisterService(&Validation_ServiceDesc, srv)
+}
+
+func _Validation_Validate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ValidateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ValidationServer).Validate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Validation_Validate_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ValidationServer).Validate(ctx, req.(*ValidateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Validation_ListROAs_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ListROAsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ValidationServer).ListROAs(m, &validationListROAsServer{stream})
+}
+
+type Validation_ListROAsServer interface {
+	Send(*ROA) error
+	grpc.ServerStream
+}
+
+type validationListROAsServer struct {
+	grpc.ServerStream
+}
+
+func (x *validationListROAsServer) Send(m *ROA) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Validation_ServiceDesc is the grpc.ServiceDesc for Validation service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Validation_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "rpkirtr.Validation",
+	HandlerType: (*ValidationServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Validate",
+			Handler:    _Validation_Validate_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ListROAs",
+			Handler:       _Validation_ListROAs_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "proto/rpkirtr.proto",
+}
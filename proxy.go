@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout is how long a load balancer has to send the PROXY header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV2Signature starts every version 2 PROXY header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyListener wraps accepted connections to read a PROXY protocol header
+// from a load balancer, which has the router's real address.
+type proxyListener struct {
+	net.Listener
+}
+
+func (l proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// proxyConn reads the PROXY header the first time it's read from, or its
+// remote address is asked for. The remote address is then the one from the
+// header. A connection without a valid header fails every read, so it can't
+// be mistaken for RTR.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remote, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.err = fmt.Errorf("invalid PROXY header: %w", c.err)
+		}
+		// A health check from the load balancer itself has no address.
+		if c.remote == nil {
+			c.remote = c.Conn.RemoteAddr()
+		}
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+// readProxy reads the PROXY header of a connection from a proxyListener,
+// directly or under TLS, returning why it's invalid. Other connections have no
+// header, so are always fine.
+func readProxy(conn net.Conn) error {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	pc, ok := conn.(*proxyConn)
+	if !ok {
+		return nil
+	}
+	pc.init()
+	return pc.err
+}
+
+// readProxyHeader reads a version 1 or 2 PROXY header, returning the source
+// address in it. The address is nil when the header has none, such as for
+// UNKNOWN or LOCAL connections.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	// The shortest header of either version is longer than the signature.
+	start, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		return readProxyV1(r)
+	case bytes.Equal(start, proxyV2Signature):
+		return readProxyV2(r)
+	}
+	return nil, errors.New("no PROXY signature")
+}
+
+// readProxyV1 reads the text header, such as
+// PROXY TCP4 192.0.2.1 198.51.100.1 40000 323\r\n
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// The line is at most 107 bytes, including the CRLF.
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("version 1 header is too long")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed version 1 header %q", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid %s source address %q", fields[1], fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source port %q", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads the binary header. Only the source address is used, and
+// any TLVs after the addresses are skipped.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", header[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch header[12] & 0x0f {
+	case 0x0:
+		// LOCAL, such as a health check.
+		return nil, nil
+	case 0x1:
+		// PROXY
+	default:
+		return nil, fmt.Errorf("unsupported command %d", header[12]&0x0f)
+	}
+	switch header[13] {
+	case 0x11:
+		// TCP over IPv4
+		if len(body) < 12 {
+			return nil, fmt.Errorf("IPv4 addresses need 12 bytes, got %d", len(body))
+		}
+		return &net.TCPAddr{IP: net.IP(body[:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 0x21:
+		// TCP over IPv6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("IPv6 addresses need 36 bytes, got %d", len(body))
+		}
+		return &net.TCPAddr{IP: net.IP(body[:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	case 0x00:
+		// UNSPEC, so no address.
+		return nil, nil
+	}
+	// Anything else, such as UDP or a Unix socket, can't be a router.
+	return nil, fmt.Errorf("unsupported address family and protocol %#x", header[13])
+}
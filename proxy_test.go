@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// proxyV2 builds a version 2 header with the command, address family and
+// protocol, and addresses given.
+func proxyV2(command, family byte, addrs []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0x9c, 0x40, 0x01, 0x43}
+	v6 := make([]byte, 36)
+	copy(v6, net.ParseIP("2001:db8::1"))
+	copy(v6[16:], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(v6[32:], 40000)
+	binary.BigEndian.PutUint16(v6[34:], 323)
+	// A TLV, which is skipped.
+	v6 = append(v6, 0x04, 0x00, 0x01, 0xff)
+
+	tests := []struct {
+		desc    string
+		header  []byte
+		want    string
+		wantErr bool
+	}{
+		{
+			desc:   "version 1 IPv4",
+			header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 40000 323\r\n"),
+			want:   "192.0.2.1:40000",
+		},
+		{
+			desc:   "version 1 IPv6",
+			header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 40000 323\r\n"),
+			want:   "[2001:db8::1]:40000",
+		},
+		{
+			desc:   "version 1 unknown",
+			header: []byte("PROXY UNKNOWN\r\n"),
+		},
+		{
+			desc:    "version 1 IPv6 address as TCP4",
+			header:  []byte("PROXY TCP4 2001:db8::1 2001:db8::2 40000 323\r\n"),
+			wantErr: true,
+		},
+		{
+			desc:    "version 1 bad port",
+			header:  []byte("PROXY TCP4 192.0.2.1 198.51.100.1 70000 323\r\n"),
+			wantErr: true,
+		},
+		{
+			desc:    "version 1 too long",
+			header:  []byte("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n"),
+			wantErr: true,
+		},
+		{
+			desc:   "version 2 IPv4",
+			header: proxyV2(1, 0x11, v4),
+			want:   "192.0.2.1:40000",
+		},
+		{
+			desc:   "version 2 IPv6 with TLV",
+			header: proxyV2(1, 0x21, v6),
+			want:   "[2001:db8::1]:40000",
+		},
+		{
+			desc:   "version 2 local",
+			header: proxyV2(0, 0x00, nil),
+		},
+		{
+			desc:    "version 2 short addresses",
+			header:  proxyV2(1, 0x11, v4[:8]),
+			wantErr: true,
+		},
+		{
+			desc:    "version 2 UDP",
+			header:  proxyV2(1, 0x12, v4),
+			wantErr: true,
+		},
+		{
+			desc:    "RTR without a header",
+			header:  []byte{version1, serialQuery, 0, 7, 0, 0, 0, 12, 0, 0, 0, 1},
+			wantErr: true,
+		},
+	}
+	for _, v := range tests {
+		// What follows the header must be left to read.
+		r := bufio.NewReader(bytes.NewReader(append(v.header, version1, resetQuery)))
+		addr, err := readProxyHeader(r)
+		if (err != nil) != v.wantErr {
+			t.Errorf("Error on %s. Got error %v, Want error %t", v.desc, err, v.wantErr)
+			continue
+		}
+		if v.wantErr {
+			continue
+		}
+		var got string
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != v.want {
+			t.Errorf("Error on %s. Got address %q, Want %q", v.desc, got, v.want)
+		}
+		if rest, _ := r.Peek(2); !bytes.Equal(rest, []byte{version1, resetQuery}) {
+			t.Errorf("Error on %s. Got %v after the header, Want the reset query", v.desc, rest)
+		}
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	s := &CacheServer{
+		mutex:         &sync.RWMutex{},
+		session:       7,
+		serial:        1,
+		roas:          []roa{{Prefix: netaddr.MustParseIPPrefix("192.0.2.0/24"), MaxMask: 24, ASN: 64496}},
+		depth:         defaultHistory,
+		timers:        intervals{refresh: 3600, retry: 600, expire: 7200},
+		network:       "tcp",
+		proxyProtocol: true,
+		// Only the address in the header is allowed, not the load balancer's.
+		allowed: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("192.0.2.0/24")},
+	}
+	s.listen("127.0.0.1", 0)
+	go s.start()
+	defer s.shutdown()
+	defer s.close()
+	addr := s.listeners[0].Addr().String()
+
+	router := dialRTR(t, addr, version1)
+	defer router.conn.Close()
+	if _, err := router.conn.Write([]byte("PROXY TCP4 192.0.2.1 127.0.0.1 40000 323\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := router.resetQuery(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := router.readResponse()
+	if err != nil {
+		t.Fatalf("Unable to read the full table: %v", err)
+	}
+	if got.serial != 1 || len(got.announced) != 1 {
+		t.Errorf("Got %+v, Want serial 1 with 1 ROA", got)
+	}
+	s.mutex.RLock()
+	clientAddr := s.clients[0].addr
+	s.mutex.RUnlock()
+	if clientAddr != "192.0.2.1:40000" {
+		t.Errorf("Got client address %s, Want 192.0.2.1:40000 from the header", clientAddr)
+	}
+
+	// A connection which hasn't sent its header yet doesn't hold up others.
+	idle := dialRTR(t, addr, version1)
+	defer idle.conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	next := dialRTR(t, addr, version1)
+	defer next.conn.Close()
+	if _, err := next.conn.Write([]byte("PROXY TCP4 192.0.2.2 127.0.0.1 40000 323\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := next.resetQuery(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := next.readResponse(); err != nil {
+		t.Fatalf("Unable to read the full table: %v", err)
+	}
+	if took := time.Since(start); took >= proxyHeaderTimeout/2 {
+		t.Errorf("Full table took %v, Want it sent without waiting for the idle connection's header", took)
+	}
+
+	// Without a header, the load balancer's own address isn't allowed.
+	other := dialRTR(t, addr, version1)
+	defer other.conn.Close()
+	if err := other.serialQuery(7, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.readResponse(); err == nil {
+		t.Error("Got a response without a PROXY header, Want the connection closed")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// limiterCleanup is how often source IPs which are back to a full bucket are forgotten.
+const limiterCleanup = 10 * time.Minute
+
+// rateLimiter is a token bucket per source IP. Each IP can connect burst
+// times in a row, after which it gets another connection every interval.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	burst    int
+	buckets  map[string]*bucket
+}
+
+// bucket is the connections an IP has left as of last.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter allows perMinute connections a minute from each IP, with up
+// to burst at once.
+func newRateLimiter(perMinute, burst int) *rateLimiter {
+	return &rateLimiter{
+		interval: time.Minute / time.Duration(perMinute),
+		burst:    burst,
+		buckets:  make(map[string]*bucket),
+	}
+}
+
+// allow takes a connection from the bucket for ip, returning false if there
+// are none left.
+func (l *rateLimiter) allow(ip string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: float64(l.burst)}
+		l.buckets[ip] = b
+	} else {
+		b.tokens = l.refill(b, now)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// refill returns how many connections b has at now, up to the burst.
+func (l *rateLimiter) refill(b *bucket, now time.Time) float64 {
+	tokens := b.tokens + float64(now.Sub(b.last))/float64(l.interval)
+	if tokens > float64(l.burst) {
+		return float64(l.burst)
+	}
+	return tokens
+}
+
+// cleanup forgets IPs with a full bucket, as they're the same as new ones.
+func (l *rateLimiter) cleanup(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ip, b := range l.buckets {
+		if l.refill(b, now) >= float64(l.burst) {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// clean runs cleanup every interval, until ctx is done.
+func (l *rateLimiter) clean(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.cleanup(now)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	start := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	l := newRateLimiter(6, 2)
+
+	tests := []struct {
+		desc  string
+		ip    string
+		after time.Duration
+		want  bool
+	}{
+		{
+			desc: "first",
+			ip:   "192.0.2.1",
+			want: true,
+		},
+		{
+			desc: "within burst",
+			ip:   "192.0.2.1",
+			want: true,
+		},
+		{
+			desc: "burst used up",
+			ip:   "192.0.2.1",
+			want: false,
+		},
+		{
+			desc: "other ip has its own bucket",
+			ip:   "192.0.2.2",
+			want: true,
+		},
+		{
+			desc:  "not yet refilled",
+			ip:    "192.0.2.1",
+			after: 5 * time.Second,
+			want:  false,
+		},
+		{
+			desc:  "refilled one",
+			ip:    "192.0.2.1",
+			after: 10 * time.Second,
+			want:  true,
+		},
+		{
+			desc:  "only one refilled",
+			ip:    "192.0.2.1",
+			after: 10 * time.Second,
+			want:  false,
+		},
+	}
+	for _, v := range tests {
+		if got := l.allow(v.ip, start.Add(v.after)); got != v.want {
+			t.Errorf("Error on %s. Got %t, Want %t", v.desc, got, v.want)
+		}
+	}
+
+	// Only IPs back to a full bucket are forgotten.
+	l.cleanup(start.Add(20 * time.Second))
+	if _, ok := l.buckets["192.0.2.1"]; !ok {
+		t.Errorf("Wanted 192.0.2.1 kept with an empty bucket")
+	}
+	if _, ok := l.buckets["192.0.2.2"]; ok {
+		t.Errorf("Wanted 192.0.2.2 forgotten with a full bucket")
+	}
+	l.cleanup(start.Add(time.Minute))
+	if len(l.buckets) != 0 {
+		t.Errorf("Wanted all IPs forgotten, still have %d", len(l.buckets))
+	}
+
+	// Cleaning stops with the server.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		l.clean(ctx, time.Millisecond)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("clean kept running after the context was done")
+	}
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// rtrClient is a minimal router side of the protocol, for testing the cache
+// over a real connection.
+type rtrClient struct {
+	conn    net.Conn
+	version uint8
+}
+
+// rtrResponse is what a router got in reply to a query.
+type rtrResponse struct {
+	session   uint16
+	serial    uint32
+	announced []roa
+	withdrawn []roa
+}
+
+func dialRTR(t *testing.T, addr string, version uint8) *rtrClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &rtrClient{conn: conn, version: version}
+}
+
+func (r *rtrClient) resetQuery() error {
+	pdu := []byte{r.version, resetQuery, 0, 0, 0, 0, 0, 8}
+	_, err := r.conn.Write(pdu)
+	return err
+}
+
+func (r *rtrClient) serialQuery(session uint16, serial uint32) error {
+	pdu := make([]byte, 12)
+	pdu[0], pdu[1] = r.version, serialQuery
+	binary.BigEndian.PutUint16(pdu[2:], session)
+	binary.BigEndian.PutUint32(pdu[4:], 12)
+	binary.BigEndian.PutUint32(pdu[8:], serial)
+	_, err := r.conn.Write(pdu)
+	return err
+}
+
+// readNotify reads a Serial Notify, returning its serial.
+func (r *rtrClient) readNotify() (uint32, error) {
+	pdu, err := getPDU(r.conn)
+	if err != nil {
+		return 0, err
+	}
+	if pdu[1] != serialNotify {
+		return 0, fmt.Errorf("got PDU type %d, wanted a Serial Notify", pdu[1])
+	}
+	return binary.BigEndian.Uint32(pdu[8:]), nil
+}
+
+// readResponse reads a Cache Response, then the prefixes up to End of Data.
+func (r *rtrClient) readResponse() (rtrResponse, error) {
+	var resp rtrResponse
+	pdu, err := getPDU(r.conn)
+	if err != nil {
+		return resp, err
+	}
+	if pdu[1] != cacheResponse {
+		return resp, fmt.Errorf("got PDU type %d, wanted a Cache Response", pdu[1])
+	}
+	resp.session = binary.BigEndian.Uint16(pdu[2:])
+
+	for {
+		pdu, err := getPDU(r.conn)
+		if err != nil {
+			return resp, err
+		}
+		if pdu[0] != r.version {
+			return resp, fmt.Errorf("got version %d, wanted %d", pdu[0], r.version)
+		}
+		switch pdu[1] {
+		case ipv4Prefix, ipv6Prefix:
+			v, announce, err := decodePrefix(pdu)
+			if err != nil {
+				return resp, err
+			}
+			if announce {
+				resp.announced = append(resp.announced, v)
+			} else {
+				resp.withdrawn = append(resp.withdrawn, v)
+			}
+		case endOfData:
+			resp.serial = binary.BigEndian.Uint32(pdu[8:])
+			return resp, nil
+		default:
+			return resp, fmt.Errorf("unexpected PDU type %d", pdu[1])
+		}
+	}
+}
+
+// decodePrefix decodes an IPv4 or IPv6 prefix PDU, returning whether it's an announcement.
+func decodePrefix(pdu []byte) (roa, bool, error) {
+	var ip netaddr.IP
+	var asn uint32
+	switch {
+	case pdu[1] == ipv4Prefix && len(pdu) == 20:
+		ip = netaddr.IPFrom4(*(*[4]byte)(pdu[12:16]))
+		asn = binary.BigEndian.Uint32(pdu[16:])
+	case pdu[1] == ipv6Prefix && len(pdu) == 32:
+		ip = netaddr.IPFrom16(*(*[16]byte)(pdu[12:28]))
+		asn = binary.BigEndian.Uint32(pdu[28:])
+	default:
+		return roa{}, false, fmt.Errorf("prefix PDU type %d has length %d", pdu[1], len(pdu))
+	}
+	return roa{
+		Prefix:  netaddr.IPPrefixFrom(ip, pdu[9]),
+		MaxMask: pdu[10],
+		ASN:     asn,
+	}, pdu[8]&announce != 0, nil
+}
+
+func TestRTRSession(t *testing.T) {
+	a := roa{Prefix: netaddr.MustParseIPPrefix("192.0.2.0/24"), MaxMask: 24, ASN: 64496}
+	b := roa{Prefix: netaddr.MustParseIPPrefix("2001:db8::/32"), MaxMask: 48, ASN: 64497}
+	c := roa{Prefix: netaddr.MustParseIPPrefix("198.51.100.0/22"), MaxMask: 24, ASN: 64498}
+
+	s := &CacheServer{
+		mutex:     &sync.RWMutex{},
+		session:   7,
+		serial:    1,
+		roas:      []roa{a, b},
+		depth:     defaultHistory,
+		timers:    intervals{refresh: 3600, retry: 600, expire: 7200},
+		network:   "tcp",
+		responses: &responseCounts{},
+	}
+	s.listen("127.0.0.1", 0)
+	go s.start()
+	defer s.shutdown()
+	defer s.close()
+
+	router := dialRTR(t, s.listeners[0].Addr().String(), version1)
+	defer router.conn.Close()
+
+	// A full sync gets everything at the current serial.
+	if err := router.resetQuery(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := router.readResponse()
+	if err != nil {
+		t.Fatalf("Unable to read the full table: %v", err)
+	}
+	if got.session != 7 || got.serial != 1 || !sameROAs(got.announced, []roa{a, b}) || len(got.withdrawn) != 0 {
+		t.Errorf("Got full table %+v, Want session 7, serial 1, and %v announced", got, []roa{a, b})
+	}
+
+	// An update is notified, and the router gets only the diff.
+	s.apply(rpkiData{roas: []roa{a, c}}, time.Now())
+	s.sendNotifies(false)
+	notified, err := router.readNotify()
+	if err != nil {
+		t.Fatalf("Unable to read the notify: %v", err)
+	}
+	if notified != 2 {
+		t.Errorf("Got notify for serial %d, Want 2", notified)
+	}
+	if err := router.serialQuery(got.session, got.serial); err != nil {
+		t.Fatal(err)
+	}
+	got, err = router.readResponse()
+	if err != nil {
+		t.Fatalf("Unable to read the diff: %v", err)
+	}
+	if got.serial != 2 || !sameROAs(got.announced, []roa{c}) || !sameROAs(got.withdrawn, []roa{b}) {
+		t.Errorf("Got diff %+v, Want serial 2 with %v announced and %v withdrawn", got, c, b)
+	}
+
+	// Once up to date, a serial query gets an empty response.
+	if err := router.serialQuery(got.session, got.serial); err != nil {
+		t.Fatal(err)
+	}
+	got, err = router.readResponse()
+	if err != nil {
+		t.Fatalf("Unable to read the empty diff: %v", err)
+	}
+	if got.serial != 2 || len(got.announced) != 0 || len(got.withdrawn) != 0 {
+		t.Errorf("Got %+v, Want an empty diff at serial 2", got)
+	}
+
+	// A serial from another session needs a Cache Reset.
+	if err := router.serialQuery(got.session+1, got.serial); err != nil {
+		t.Fatal(err)
+	}
+	if pdu, err := getPDU(router.conn); err != nil || pdu[1] != cacheReset {
+		t.Fatalf("Got %v, %v, Want a Cache Reset", pdu, err)
+	}
+
+	// Each response has been counted by type.
+	for response, want := range map[int]uint64{fullResponse: 1, incrementalResponse: 2, cacheResetResponse: 1} {
+		if got := s.responses.get(response); got != want {
+			t.Errorf("Got %d %s responses, Want %d", got, responseTypes[response], want)
+		}
+	}
+}
+
+// TestOriginChange moves a prefix to another ASN, one update at a time, and
+// checks a router applying the diffs ends up with only the latest origin. A
+// router still holding an old one would keep seeing it as valid.
+func TestOriginChange(t *testing.T) {
+	a := roa{Prefix: netaddr.MustParseIPPrefix("192.0.2.0/24"), MaxMask: 24, ASN: 64496}
+	b := roa{Prefix: netaddr.MustParseIPPrefix("2001:db8::/32"), MaxMask: 48, ASN: 64497}
+
+	s := &CacheServer{
+		mutex:   &sync.RWMutex{},
+		session: 7,
+		serial:  1,
+		roas:    []roa{a, b},
+		depth:   defaultHistory,
+		timers:  intervals{refresh: 3600, retry: 600, expire: 7200},
+		network: "tcp",
+	}
+	s.listen("127.0.0.1", 0)
+	go s.start()
+	defer s.shutdown()
+	defer s.close()
+
+	router := dialRTR(t, s.listeners[0].Addr().String(), version1)
+	defer router.conn.Close()
+	if err := router.resetQuery(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := router.readResponse()
+	if err != nil {
+		t.Fatalf("Unable to read the full table: %v", err)
+	}
+	table := roasToMap(got.announced)
+
+	tests := []struct {
+		desc string
+		// asns are the origins of a after each update, all fetched before the
+		// router next queries.
+		asns []uint32
+	}{
+		{
+			desc: "one update",
+			asns: []uint32{64498},
+		},
+		{
+			desc: "several updates between queries",
+			asns: []uint32{64499, 64500, 64501},
+		},
+		{
+			desc: "back to the origin the router has",
+			asns: []uint32{64502, 64501},
+		},
+	}
+	for _, v := range tests {
+		moved := a
+		for _, asn := range v.asns {
+			moved.ASN = asn
+			s.apply(rpkiData{roas: []roa{moved, b}}, time.Now())
+		}
+		if err := router.serialQuery(got.session, got.serial); err != nil {
+			t.Fatal(err)
+		}
+		if got, err = router.readResponse(); err != nil {
+			t.Fatalf("Error on %s. Unable to read the diff: %v", v.desc, err)
+		}
+		for _, r := range got.withdrawn {
+			if _, ok := table[r.key()]; !ok {
+				t.Errorf("Error on %s. Got %v withdrawn, which the router doesn't have", v.desc, r)
+			}
+			delete(table, r.key())
+		}
+		for _, r := range got.announced {
+			table[r.key()] = r
+		}
+		var have []roa
+		for _, r := range table {
+			have = append(have, r)
+		}
+		if want := []roa{moved, b}; !sameROAs(have, want) {
+			t.Errorf("Error on %s. Router has %v, Want %v", v.desc, have, want)
+		}
+	}
+}
+
+// TestNotifyDuringResponse keeps notifying a router while it's sent a full
+// table many batches long. A notify in the middle of a batch would break up a
+// PDU, so the router would read garbage.
+func TestNotifyDuringResponse(t *testing.T) {
+	roas := make([]roa, 100000)
+	for i := range roas {
+		roas[i] = roa{
+			Prefix:  netaddr.IPPrefixFrom(netaddr.IPFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), 0}), 24),
+			MaxMask: 24,
+			ASN:     uint32(i),
+		}
+	}
+	s := &CacheServer{
+		mutex:   &sync.RWMutex{},
+		session: 7,
+		serial:  1,
+		roas:    roas,
+		depth:   defaultHistory,
+		timers:  intervals{refresh: 3600, retry: 600, expire: 7200},
+		network: "tcp",
+	}
+	s.listen("127.0.0.1", 0)
+	go s.start()
+	defer s.shutdown()
+	defer s.close()
+
+	router := dialRTR(t, s.listeners[0].Addr().String(), version1)
+	defer router.conn.Close()
+	// A first response negotiates the version, so the router is notified.
+	if err := router.resetQuery(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := router.readResponse(); err != nil {
+		t.Fatalf("Unable to read the full table: %v", err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+				s.sendNotifies(true)
+			}
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		if err := router.resetQuery(); err != nil {
+			t.Fatal(err)
+		}
+		// Notifies can come before or after the response, but not within it.
+		var pdu []byte
+		var err error
+		for {
+			if pdu, err = getPDU(router.conn); err != nil || pdu[1] != serialNotify {
+				break
+			}
+		}
+		if err != nil || pdu[1] != cacheResponse {
+			t.Fatalf("Got %v, %v, Want a Cache Response", pdu, err)
+		}
+		var prefixes int
+		for {
+			pdu, err := getPDU(router.conn)
+			if err != nil {
+				t.Fatalf("Unable to read the full table after %d prefixes: %v", prefixes, err)
+			}
+			if pdu[1] == endOfData {
+				break
+			}
+			if pdu[1] != ipv4Prefix {
+				t.Fatalf("Got PDU type %d after %d prefixes, Want only prefixes", pdu[1], prefixes)
+			}
+			prefixes++
+		}
+		if prefixes != len(roas) {
+			t.Errorf("Got %d prefixes, Want %d", prefixes, len(roas))
+		}
+	}
+}
+
+// TestNotifyChurn notifies while routers connect and disconnect, which needs
+// -race to catch the client list being changed under the notifies.
+func TestNotifyChurn(t *testing.T) {
+	a := roa{Prefix: netaddr.MustParseIPPrefix("192.0.2.0/24"), MaxMask: 24, ASN: 64496}
+	b := roa{Prefix: netaddr.MustParseIPPrefix("2001:db8::/32"), MaxMask: 48, ASN: 64497}
+
+	s := &CacheServer{
+		mutex:   &sync.RWMutex{},
+		session: 7,
+		serial:  1,
+		roas:    []roa{a},
+		depth:   defaultHistory,
+		timers:  intervals{refresh: 3600, retry: 600, expire: 7200},
+		network: "tcp",
+	}
+	s.listen("127.0.0.1", 0)
+	go s.start()
+	defer s.shutdown()
+	defer s.close()
+	addr := s.listeners[0].Addr().String()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				router := dialRTR(t, addr, version1)
+				// Notifies may arrive before the response, so read anything up to End of Data.
+				if router.resetQuery() == nil {
+					for {
+						pdu, err := getPDU(router.conn)
+						if err != nil || pdu[1] == endOfData {
+							break
+						}
+					}
+				}
+				router.conn.Close()
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	// Keep updating until every router has been and gone.
+	var updates uint32
+	for {
+		select {
+		case <-done:
+			s.mutex.RLock()
+			serial := s.serial
+			s.mutex.RUnlock()
+			if serial != updates+1 {
+				t.Errorf("Got serial %d after %d updates, Want %d", serial, updates, updates+1)
+			}
+			return
+		default:
+		}
+		data := rpkiData{roas: []roa{a}}
+		if updates%2 == 0 {
+			data.roas = append(data.roas, b)
+		}
+		s.apply(data, time.Now())
+		s.sendNotifies(updates%5 == 0)
+		updates++
+	}
+}
+
+// TestEmptyTable checks routers get a well formed response from an empty table
+// at serial 0, as served with -empty.
+func TestEmptyTable(t *testing.T) {
+	s := &CacheServer{
+		mutex:   &sync.RWMutex{},
+		session: 7,
+		depth:   defaultHistory,
+		timers:  intervals{refresh: 3600, retry: 600, expire: 7200},
+		network: "tcp",
+	}
+	s.listen("127.0.0.1", 0)
+	go s.start()
+	defer s.shutdown()
+	defer s.close()
+
+	router := dialRTR(t, s.listeners[0].Addr().String(), version1)
+	defer router.conn.Close()
+
+	if err := router.resetQuery(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := router.readResponse()
+	if err != nil {
+		t.Fatalf("Unable to read the full table: %v", err)
+	}
+	if got.session != 7 || got.serial != 0 || len(got.announced) != 0 || len(got.withdrawn) != 0 {
+		t.Errorf("Got full table %+v, Want an empty table at serial 0", got)
+	}
+
+	if err := router.serialQuery(7, 0); err != nil {
+		t.Fatal(err)
+	}
+	got, err = router.readResponse()
+	if err != nil {
+		t.Fatalf("Unable to read the diff: %v", err)
+	}
+	if got.serial != 0 || len(got.announced) != 0 || len(got.withdrawn) != 0 {
+		t.Errorf("Got %+v, Want an empty diff at serial 0", got)
+	}
+}
@@ -1,34 +1,66 @@
 // This app implements RFC8210.
 // The Resource Public Key Infrastructure (RPKI) to Router Protocol.
-// Version 1
+// Version 1, as well as version 0 from RFC6810 and version 2 with ASPA from
+// draft-ietf-sidrops-8210bis.
 
 package main
 
 import (
-	"flag"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"net"
 	"os"
-	"path"
+	"os/signal"
+	"reflect"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"gopkg.in/ini.v1"
 	"inet.af/netaddr"
 )
 
 const (
+	// unixPrefix on a bind address listens on a Unix socket at the path following it.
+	unixPrefix = "unix:"
+
 	// refreshROA is the amount of seconds to wait until a new json is pulled.
 	refreshROA = 6 * time.Minute
 
+	// refreshMargin is how long after the upstream data stops being valid an
+	// adaptive refresh fetches, giving the validator time to publish.
+	refreshMargin = 30 * time.Second
+
+	// shutdownGrace is how long to wait for client sessions to finish on shutdown.
+	shutdownGrace = 5 * time.Second
+
+	// writeBatch is how many bytes of a response are buffered before being
+	// written to the router.
+	writeBatch = 64 << 10
+
+	// Temporary accept errors are retried after minAcceptDelay, doubling each
+	// time up to maxAcceptDelay, as net/http does.
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+
 	// Intervals are the default intervals in seconds if no specific value is configured
+	// with refresh, retry, and expire in the config.
 	DefaultRefreshInterval = uint32(3600) // 1 - 86400
 	DefaultRetryInterval   = uint32(600)  // 1 - 7200
 	DefaultExpireInterval  = uint32(7200) // 600 - 172800
+
+	// Default caps on the prefix length of ROAs to serve, which keep every ROA.
+	// maxminmaskv4 and maxminmaskv6 can be lowered to drop ROAs more specific
+	// than the DFZ accepts.
+	maxMinMaskv4 = uint8(32)
+	maxMinMaskv6 = uint8(128)
 )
 
 // Converted ROA struct with all the details.
@@ -36,19 +68,144 @@ type roa struct {
 	Prefix  netaddr.IPPrefix
 	MaxMask uint8
 	ASN     uint32
+	RIR     rir
+}
+
+// bgpsecKey is a BGPsec router key. The public key is kept as a string so
+// keys can be compared and used in maps.
+type bgpsecKey struct {
+	SKI    [20]byte
+	ASN    uint32
+	PubKey string
+}
+
+// aspa is an ASPA (Autonomous System Provider Authorization), the set of
+// providers of a customer AS. Providers are sorted with no duplicates, so
+// two ASPAs can be compared with equal.
+type aspa struct {
+	Customer  uint32
+	Providers []uint32
+}
+
+// rir is the trust anchor a ROA was published under.
+type rir uint8
+
+const (
+	unknownRIR rir = iota
+	afrinic
+	apnic
+	arin
+	lacnic
+	ripe
+)
+
+var rirNames = map[rir]string{
+	unknownRIR: "unknown",
+	afrinic:    "afrinic",
+	apnic:      "apnic",
+	arin:       "arin",
+	lacnic:     "lacnic",
+	ripe:       "ripe",
+}
+
+// String returns the RIR's name, or unknown for anything not in rirNames.
+func (r rir) String() string {
+	if name, ok := rirNames[r]; ok {
+		return name
+	}
+	return rirNames[unknownRIR]
 }
 
 // CacheServer is our RPKI cache server.
+// roas has the IPv4 ROAs first, then the IPv6 ones, and roasV4 and roasV6 are
+// each family's part of it, so neither needs the family checked for each ROA.
 type CacheServer struct {
-	listener net.Listener
-	clients  []*client
-	roas     []roa
-	mutex    *sync.RWMutex
-	serial   uint32
-	session  uint16
-	diff     serialDiff
-	updates  checkErrorUpdate
-	urls     []string
+	listeners []net.Listener
+	clients   []*client
+	roas      []roa
+	roasV4    []roa
+	roasV6    []roa
+	index     *roaIndex
+	keys      []bgpsecKey
+	aspas     []aspa
+	mutex     *sync.RWMutex
+	serial    uint32
+	session   uint16
+	diff      serialDiff
+	history   []serialDiff
+	depth     int
+	updates   checkErrorUpdate
+	urls      []string
+	fallbacks []string
+	slurm     string
+	timers    intervals
+	counters  counters
+	sessions  sync.WaitGroup
+	state     string
+	allowed   []netaddr.IPPrefix
+	filter    roaFilter
+	maxShrink int
+	// maxDiff is the most ROA changes in an update before routers are sent a
+	// Cache Reset instead. Zero is unlimited.
+	maxDiff int
+
+	// fullSyncs has how long each full table took to send to a client.
+	fullSyncs *histogram
+	// responses counts the responses to client queries, by type.
+	responses *responseCounts
+	// snapshot is where the ROAs are saved after each update. Empty disables it.
+	snapshot string
+	// timerOverrides replace timers for clients from their prefixes.
+	timerOverrides []timerOverride
+	// statusInterval is how often status is logged, separate from refreshROA.
+	statusInterval time.Duration
+	// readTimeout drops clients which have sent nothing for this long.
+	readTimeout time.Duration
+	// maxSession closes sessions this long after they connected. Zero never does.
+	maxSession time.Duration
+	// tcpKeepalive is the TCP keepalive period. Zero is Go's default, and
+	// negative disables them.
+	tcpKeepalive time.Duration
+	// staleAfter is how old the last successful fetch can be while still healthy.
+	staleAfter time.Duration
+	// maxClients caps the number of sessions. Zero is unlimited.
+	maxClients int
+	// config is what the server was started with, updated by reloads.
+	config config
+	// notifyInterval is the least time between Serial Notifies to all clients.
+	notifyInterval time.Duration
+	notifier       notifier
+	// md5Key is the TCP-MD5 key routers need to connect. Empty disables it.
+	md5Key string
+	// adaptiveRefresh schedules fetches from the upstream valid time.
+	adaptiveRefresh bool
+	// firstRefresh is the wait for the first fetch after startup, if sooner
+	// than the usual one. Zero waits as usual.
+	firstRefresh time.Duration
+	// network is what TCP listeners use, tcp, tcp4, or tcp6.
+	network string
+	// proxyProtocol takes the router's address from a PROXY header on TCP
+	// connections, sent by a load balancer in front.
+	proxyProtocol bool
+	// limiter drops connections from IPs connecting too often. Nil is unlimited.
+	limiter *rateLimiter
+	// etags caches what was last read from each location, by ETag.
+	etags *etagCache
+	// refreshNow wakes the update goroutine to fetch straight away. Nil when
+	// there are no updates.
+	refreshNow chan struct{}
+	// views serve subsets of the ROAs on ports of their own, and are updated
+	// along with these. view is what a view serves, and is unset otherwise.
+	views []*CacheServer
+	view  roaView
+	// ctx is cancelled on shutdown to stop the background goroutines, which
+	// workers waits for.
+	ctx     context.Context
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+	// closing is set under the lock on shutdown, after which no clients are
+	// accepted, so sessions isn't added to while it's waited on.
+	closing bool
 }
 
 // checkErrorUpdate will let us know timings of ROA updates.
@@ -56,6 +213,28 @@ type checkErrorUpdate struct {
 	lastCheck  time.Time
 	lastError  time.Time
 	lastUpdate time.Time
+
+	// lastErrorMsg is why the last failed update failed.
+	lastErrorMsg string
+
+	// lastSuccess is the last fetch which worked, whether or not anything changed.
+	lastSuccess time.Time
+
+	// generated and valid are from the metadata of the last successful fetch.
+	generated time.Time
+	valid     time.Time
+
+	// fetchBytes and fetchTime are the size of the json in the last successful
+	// fetch, and how long fetching and parsing it took.
+	fetchBytes int
+	fetchTime  time.Duration
+
+	// unchanged is how many successful updates in a row have changed nothing,
+	// including those where no location was modified. Zero if the last did.
+	unchanged int
+	// changed is whether the last successful update changed anything. False
+	// until there's been one.
+	changed bool
 }
 
 // serialDiff will have a list of add and deletes of ROAs to get from
@@ -65,8 +244,18 @@ type serialDiff struct {
 	newSerial uint32
 	delRoa    []roa
 	addRoa    []roa
+	delKey    []bgpsecKey
+	addKey    []bgpsecKey
+	// An ASPA replaces any earlier one for the customer, so a changed ASPA
+	// is in addASPA, with the ASPA it replaces in delASPA.
+	delASPA []aspa
+	addASPA []aspa
 	// There may be no actual diffs between now and last
 	diff bool
+	// resetRequired is set when a router can't be brought up to date with a
+	// diff, such as after a session change or a gap in the history, so it
+	// needs a Cache Reset instead.
+	resetRequired bool
 }
 
 func main() {
@@ -78,133 +267,467 @@ func main() {
 
 // run will do the initial set up. Returns error to main.
 func run() error {
-	// load in config
-	exe, err := os.Executable()
+	// load in config, with flags taking precedence
+	cfg, err := loadConfig(os.Args[1:])
 	if err != nil {
 		return err
 	}
-	path := fmt.Sprintf("%s/config.ini", path.Dir(exe))
-	cf, err := ini.Load(path)
-	if err != nil {
-		log.Fatalf("failed to read config file: %v\n", err)
+	if cfg.showVersion {
+		fmt.Println(getVersion())
+		return nil
 	}
-	logf := cf.Section("rpkirtr").Key("log").String()
-	port, err := cf.Section("rpkirtr").Key("port").Int64()
-	if err != nil {
-		return fmt.Errorf("port set needs to be a number: %v", err)
+	httpClient.Timeout = cfg.fetchTimeout
+	jsonFields = cfg.fields
+	instanceName = cfg.instance
+	if cfg.check {
+		return check(cfg, os.Stdout)
 	}
 
-	// grab URLs
-	jsons := flag.String("urls", "", "json locations of VRPs")
-	flag.Parse()
-	urls := strings.Split(*jsons, ",")
-
 	// set up logging
-	f, err := os.OpenFile(logf, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	f, err := openLog(cfg.log, cfg.logMaxSize)
 	if err != nil {
-		return fmt.Errorf("failed to open logfile: %w", err)
+		return err
 	}
 	defer f.Close()
 
-	// Enable line numbers in logging
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	log.SetOutput(f)
+	setLogging(f, cfg.logFormat, cfg.logLevel)
+	log.Printf("Starting %s\n", getVersion())
 
 	// random seed used for session ID
 	rand.Seed(time.Now().UTC().UnixNano())
+	session := uint16(rand.Intn(65535))
+	var serial uint32
 
-	// We need our initial set of ROAs.
-	roas, err := readROAs(urls)
-	init := time.Now() // Use this value to save time of first roa update.
-	if err != nil {
-		return fmt.Errorf("unable to download ROAs, aborting: %w", err)
+	// Reuse the previous session if we have one, so routers don't need to flush.
+	// An empty table always starts at serial 0, and isn't saved as the state.
+	if cfg.state != "" && !cfg.empty {
+		st, err := readState(cfg.state)
+		if err != nil {
+			log.Printf("Unable to load state, starting a new session: %v\n", err)
+		} else {
+			// ROAs may have changed while we were down, so routers will
+			// need a reset. This is still cheaper than a new session.
+			session = st.Session
+			serial = st.Serial + 1
+			log.Printf("Loaded session %d and serial %d from %s\n", st.Session, st.Serial, cfg.state)
+		}
+	}
+
+	// We need our initial set of ROAs, unless serving a fixed empty table.
+	etags := newETagCache()
+	var data rpkiData
+	var updates checkErrorUpdate
+	if cfg.empty {
+		log.Println("Serving an empty table at serial 0, without fetching any ROAs")
+	} else if data, updates, err = initialROAs(cfg, etags); err != nil {
+		return err
 	}
-	log.Println("Initial roa set downloaded")
 
 	// Set up our server with it's initial data.
+	roas, roasV4, roasV6 := splitFamilies(data.roas)
 	rpki := CacheServer{
 		mutex:   &sync.RWMutex{},
-		session: uint16(rand.Intn(65535)),
-		roas:    roas,
-		updates: checkErrorUpdate{
-			lastCheck: init,
+		session: session,
+		serial:  serial,
+		diff: serialDiff{
+			oldSerial: serial,
+			newSerial: serial,
 		},
-		urls: urls,
+		roas:            roas,
+		roasV4:          roasV4,
+		roasV6:          roasV6,
+		index:           newROAIndex(roas),
+		keys:            data.keys,
+		aspas:           data.aspas,
+		updates:         updates,
+		urls:            cfg.urls,
+		fallbacks:       cfg.fallbacks,
+		slurm:           cfg.slurm,
+		timers:          cfg.timers,
+		timerOverrides:  cfg.timerOverrides,
+		fullSyncs:       newHistogram(syncBuckets),
+		responses:       &responseCounts{},
+		state:           cfg.state,
+		snapshot:        cfg.snapshot,
+		allowed:         cfg.allowed,
+		depth:           cfg.depth,
+		filter:          cfg.filter,
+		maxShrink:       cfg.maxShrink,
+		maxDiff:         cfg.maxDiff,
+		readTimeout:     cfg.readTimeout,
+		maxSession:      cfg.maxSession,
+		tcpKeepalive:    cfg.tcpKeepalive,
+		staleAfter:      cfg.staleAfter,
+		maxClients:      cfg.maxClients,
+		md5Key:          cfg.md5Key,
+		adaptiveRefresh: cfg.adaptiveRefresh,
+		firstRefresh:    cfg.firstRefresh,
+		network:         cfg.network,
+		proxyProtocol:   cfg.proxyProtocol,
+		etags:           etags,
+		config:          cfg,
+		notifyInterval:  cfg.notifyInterval,
+		statusInterval:  cfg.statusInterval,
+	}
+	if cfg.connectRate > 0 {
+		rpki.limiter = newRateLimiter(cfg.connectRate, cfg.connectBurst)
+	}
+	for _, v := range cfg.views {
+		rpki.views = append(rpki.views, rpki.newView(v))
+	}
+	if !cfg.empty {
+		rpki.saveState()
+	}
+	if !updates.lastSuccess.IsZero() {
+		rpki.saveSnapshot(data)
 	}
+	rpki.ctx, rpki.cancel = context.WithCancel(context.Background())
 
 	ch := make(chan bool)
-	go rpki.status(ch)
+	rpki.background(func(ctx context.Context) { rpki.status(ctx, ch) })
 	// keep ROAs updated.
-	go rpki.updateROAs(ch)
+	if !cfg.empty {
+		rpki.refreshNow = make(chan struct{}, 1)
+		rpki.background(func(ctx context.Context) { rpki.updateROAs(ctx, ch) })
+	}
+
+	// Routers can be nudged to poll, even when nothing has changed.
+	if cfg.keepalive {
+		rpki.background(rpki.keepalive)
+	}
+	if rpki.limiter != nil {
+		rpki.background(func(ctx context.Context) { rpki.limiter.clean(ctx, limiterCleanup) })
+	}
+
+	// Metrics are only served if an admin port is configured.
+	if cfg.admin != 0 {
+		go rpki.serveAdmin(serviceAddr(cfg.bind, cfg.admin), cfg.pprof)
+	}
+	if cfg.grpc != 0 {
+		go rpki.serveGRPC(serviceAddr(cfg.bind, cfg.grpc))
+	}
 
 	// I'm listening!
-	rpki.listen(port)
-	defer rpki.close()
+	rpki.listen(cfg.bind, cfg.port)
+	for _, v := range rpki.views {
+		log.Printf("Serving view %s with %d ROAs\n", v.view.name, len(v.roas))
+		v.listen(cfg.bind, v.view.port)
+	}
+	if cfg.tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.tlsCert, cfg.tlsKey)
+		if err != nil {
+			return fmt.Errorf("unable to load TLS certificate: %w", err)
+		}
+		rpki.listenTLS(cfg.bind, cfg.tlsPort, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		})
+	}
+
+	// Re-read the config on SIGHUP, keeping the listeners and sessions.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			cfg, err := loadConfig(os.Args[1:])
+			if err != nil {
+				logWith(levelError, logFields{"error": err.Error()}, "Unable to reload config, keeping the current one: %v", err)
+				continue
+			}
+			rpki.reload(cfg)
+		}
+	}()
+
+	// Fetch straight away on SIGUSR1, such as after changing the SLURM file.
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	go func() {
+		for range usr1 {
+			log.Println("Received SIGUSR1, refreshing ROAs now")
+			if !rpki.refresh() {
+				log.Println("Not refreshing, as ROAs aren't being fetched")
+			}
+		}
+	}()
+
+	// Stop accepting new clients on SIGINT or SIGTERM.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		log.Printf("Received %v, shutting down\n", <-sigs)
+		rpki.close()
+	}()
+
 	rpki.start()
+	rpki.shutdown()
 
 	return nil
 }
 
+// newView returns a server for a view, starting with its part of the ROAs. It
+// has the same session and serial, and both are bumped together on each update.
+// Its listeners and clients are its own, while the settings for them are
+// copied from s.
+func (s *CacheServer) newView(v roaView) *CacheServer {
+	roas, roasV4, roasV6 := splitFamilies(v.filter(s.roas))
+	return &CacheServer{
+		mutex:   &sync.RWMutex{},
+		session: s.session,
+		serial:  s.serial,
+		diff: serialDiff{
+			oldSerial: s.serial,
+			newSerial: s.serial,
+		},
+		roas:           roas,
+		roasV4:         roasV4,
+		roasV6:         roasV6,
+		index:          newROAIndex(roas),
+		keys:           s.keys,
+		aspas:          s.aspas,
+		updates:        s.updates,
+		timers:         s.timers,
+		timerOverrides: s.timerOverrides,
+		fullSyncs:      newHistogram(syncBuckets),
+		responses:      &responseCounts{},
+		allowed:        s.allowed,
+		depth:          s.depth,
+		maxDiff:        s.maxDiff,
+		readTimeout:    s.readTimeout,
+		maxSession:     s.maxSession,
+		tcpKeepalive:   s.tcpKeepalive,
+		staleAfter:     s.staleAfter,
+		maxClients:     s.maxClients,
+		md5Key:         s.md5Key,
+		network:        s.network,
+		proxyProtocol:  s.proxyProtocol,
+		limiter:        s.limiter,
+		config:         s.config,
+		notifyInterval: s.notifyInterval,
+		view:           v,
+	}
+}
+
+// initialROAs fetches the ROAs to start serving. If none can be fetched, the
+// snapshot is loaded instead, if there is one.
+func initialROAs(cfg config, etags *etagCache) (rpkiData, checkErrorUpdate, error) {
+	start := time.Now()
+	data, err := readROAsWithFallback(cfg.urls, cfg.fallbacks, cfg.filter, cfg.slurm, etags)
+	init := time.Now() // Use this value to save time of first roa update.
+	if err == nil {
+		log.Println("Initial roa set downloaded")
+		return data, checkErrorUpdate{
+			lastCheck:   init,
+			lastSuccess: init,
+			generated:   data.generated,
+			valid:       data.valid,
+			fetchBytes:  data.size,
+			fetchTime:   init.Sub(start),
+		}, nil
+	}
+	if cfg.snapshot == "" {
+		return data, checkErrorUpdate{}, fmt.Errorf("unable to download ROAs, aborting: %w", err)
+	}
+
+	// Serve the last known good ROAs until a fetch works. The last success
+	// is left unset, so the health check fails and the update retries soon.
+	data, saved, serr := readSnapshot(cfg.snapshot)
+	if serr != nil {
+		return data, checkErrorUpdate{}, fmt.Errorf("unable to download ROAs, or load the snapshot (%v), aborting: %w", serr, err)
+	}
+	log.Printf("Unable to download ROAs, serving %d ROAs from the snapshot saved at %s: %v\n",
+		len(data.roas), saved.Format("2006-01-02 15:04:05"), err)
+	return data, checkErrorUpdate{
+		lastCheck:    init,
+		lastError:    init,
+		lastErrorMsg: err.Error(),
+	}, nil
+}
+
+// check loads everything the server would start with, and prints what was
+// found. Logs go to stderr as usual. An error means the server would not work.
+func check(cfg config, w io.Writer) error {
+	if cfg.tlsCert != "" {
+		if _, err := tls.LoadX509KeyPair(cfg.tlsCert, cfg.tlsKey); err != nil {
+			return fmt.Errorf("unable to load TLS certificate: %w", err)
+		}
+	}
+	data, err := readROAsWithFallback(cfg.urls, cfg.fallbacks, cfg.filter, cfg.slurm, nil)
+	if err != nil {
+		return fmt.Errorf("unable to read ROAs: %w", err)
+	}
+	if len(data.roas) == 0 {
+		return errors.New("no ROAs found")
+	}
+
+	_, v4, v6 := splitFamilies(data.roas)
+	fmt.Fprintf(w, "%d ROAs, %d IPv4 and %d IPv6\n", len(data.roas), len(v4), len(v6))
+	fmt.Fprintf(w, "%d router keys\n", len(data.keys))
+	fmt.Fprintf(w, "%d ASPAs\n", len(data.aspas))
+	if !data.generated.IsZero() {
+		fmt.Fprintf(w, "generated at %s\n", data.generated.Format("2006-01-02 15:04:05"))
+	}
+	if !data.valid.IsZero() {
+		fmt.Fprintf(w, "valid until %s\n", data.valid.Format("2006-01-02 15:04:05"))
+		if data.valid.Before(time.Now()) {
+			fmt.Fprintf(w, "warning: the ROAs have expired\n")
+		}
+	}
+	return nil
+}
+
 // Start listening
-// TODO(only on IPv4?)
-func (s *CacheServer) listen(port int64) {
-	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+// An empty bind address listens on all interfaces, of the address families
+// the network allows. A bind address of unix:/path listens on a Unix socket
+// there instead, ignoring the port.
+func (s *CacheServer) listen(bind string, port int64) {
+	lc, network, addr := s.listenConfig(), s.network, listenAddr(bind, port)
+	if path, ok := unixPath(bind); ok {
+		lc, network, addr = &net.ListenConfig{}, "unix", path
+		removeStaleSocket(path)
+	}
+	l, err := lc.Listen(context.Background(), network, addr)
 	if err != nil {
 		log.Fatalf("Unable to start server: %v", err)
 	}
-	s.listener = l
-	log.Printf("Listening on port %d\n", port)
+	if s.proxyProtocol && network != "unix" {
+		l = proxyListener{l}
+	}
+	s.listeners = append(s.listeners, l)
+	log.Printf("Listening on %s\n", l.Addr())
+}
+
+// listenTLS starts listening for TLS connections, as per RFC8210 section 7.
+func (s *CacheServer) listenTLS(bind string, port int64, config *tls.Config) {
+	l, err := s.listenConfig().Listen(context.Background(), s.network, listenAddr(bind, port))
+	if err != nil {
+		log.Fatalf("Unable to start TLS server: %v", err)
+	}
+	// The PROXY header comes before the TLS handshake.
+	if s.proxyProtocol {
+		l = proxyListener{l}
+	}
+	l = tls.NewListener(l, config)
+	s.listeners = append(s.listeners, l)
+	log.Printf("Listening for TLS on %s\n", l.Addr())
+}
+
+// listenConfig sets the TCP-MD5 key on listeners if there is one. The key
+// covers the allowed prefixes, or everything if all are allowed.
+// Accepted connections get TCP keepalives every tcpKeepalive, so a router
+// which went away is noticed before the read timeout.
+func (s *CacheServer) listenConfig() *net.ListenConfig {
+	lc := &net.ListenConfig{KeepAlive: s.tcpKeepalive}
+	if s.md5Key == "" {
+		return lc
+	}
+	peers := s.allowed
+	if len(peers) == 0 {
+		peers = []netaddr.IPPrefix{
+			netaddr.MustParseIPPrefix("0.0.0.0/0"),
+			netaddr.MustParseIPPrefix("::/0"),
+		}
+	}
+	lc.Control = md5Control(s.md5Key, peers)
+	return lc
+}
+
+// unixPath returns the socket path if the bind address is unix:/path.
+func unixPath(bind string) (string, bool) {
+	if !strings.HasPrefix(bind, unixPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(bind, unixPrefix), true
+}
+
+// removeStaleSocket removes a socket left behind by a crash, which would
+// otherwise stop us listening. Closing the listener removes it normally.
+func removeStaleSocket(path string) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		log.Printf("Removing stale socket %s\n", path)
+		os.Remove(path)
+	}
+}
+
+// listenAddr combines the bind address and port, bracketing IPv6 addresses.
+func listenAddr(bind string, port int64) string {
+	return net.JoinHostPort(bind, strconv.FormatInt(port, 10))
+}
+
+// serviceAddr is where the admin and gRPC listeners go: the bind address, or
+// loopback if RTR is on a Unix socket, as routers are then only local.
+func serviceAddr(bind string, port int64) string {
+	if _, ok := unixPath(bind); ok {
+		bind = "localhost"
+	}
+	return listenAddr(bind, port)
 }
 
 // Log current ROA status
-func (s *CacheServer) status(ch chan bool) {
+// Status is logged every status interval, as well as after each ROA update.
+func (s *CacheServer) status(ctx context.Context, ch chan bool) {
+	ticker := time.NewTicker(s.statusInterval)
+	defer ticker.Stop()
 	for {
-		// Only excecute once a message ove rthe channel is received
-		<-ch
-		log.Println("received true over the channel")
+		select {
+		case <-ctx.Done():
+			return
+		case <-ch:
+			logWith(levelDebug, nil, "received true over the channel")
+		case <-ticker.C:
+		}
 
 		s.mutex.RLock()
 		// Count how many ROAs we have.
-		var v4, v6 int
-		for _, r := range s.roas {
-			if r.Prefix.IP().Is4() {
-				v4++
-			} else {
-				v6++
-			}
-		}
+		v4, v6 := len(s.roasV4), len(s.roasV6)
 
 		log.Println("*** Status ***")
 		log.Printf("I currently have %d clients connected\n", len(s.clients))
 		for i, v := range s.clients {
-			log.Printf("%d: %s\n", i+1, v.addr)
+			log.Printf("%d: %s\n", i+1, v.status())
 		}
 		log.Printf("Current serial number is %d\n", s.serial)
 		log.Printf("Last diff is %t\n", s.diff.diff)
+		log.Printf("Updates in a row without changes: %d\n", s.updates.unchanged)
 		log.Printf("Current size of diff is %d\n", len(s.diff.addRoa)+len(s.diff.delRoa))
+		if len(s.history) > 0 {
+			log.Printf("Diffs retained from serial %d\n", s.history[0].oldSerial)
+		}
 		if len(s.diff.addRoa) > 0 {
 			log.Printf("ROAs to be added:")
 			for _, v := range s.diff.addRoa {
-				log.Printf("%s Mask %d ASN %d", v.Prefix.IPNet().String(), v.Prefix.Bits(), v.ASN)
+				log.Printf("%s Mask %d ASN %d RIR %s", v.Prefix.IPNet().String(), v.Prefix.Bits(), v.ASN, v.RIR)
 			}
 		}
 		if len(s.diff.delRoa) > 0 {
 			log.Printf("ROAs to be deleted:")
 			for _, v := range s.diff.delRoa {
-				log.Printf("%s Mask %d ASN %d", v.Prefix.IPNet().String(), v.Prefix.Bits(), v.ASN)
+				log.Printf("%s Mask %d ASN %d RIR %s", v.Prefix.IPNet().String(), v.Prefix.Bits(), v.ASN, v.RIR)
 			}
 		}
 		log.Printf("There are %d ROAs\n", len(s.roas))
 		log.Printf("There are %d IPv4 ROAs and %d IPv6 ROAs\n", v4, v6)
+		log.Printf("There are %d router keys\n", len(s.keys))
+		log.Printf("There are %d ASPAs\n", len(s.aspas))
 		if !s.updates.lastCheck.IsZero() {
 			log.Printf("Last check was %v\n", s.updates.lastCheck.Format("2006-01-02 15:04:05"))
 		}
 		if !s.updates.lastError.IsZero() {
-			log.Printf("Last error checking update was %v\n", s.updates.lastError.Format("2006-01-02 15:04:05"))
+			log.Printf("Last error checking update was %v: %s\n", s.updates.lastError.Format("2006-01-02 15:04:05"), s.updates.lastErrorMsg)
 		}
+		var failed uint64
+		for _, n := range s.counters.errors {
+			failed += n
+		}
+		log.Printf("There have been %d failed updates\n", failed)
 		if !s.updates.lastUpdate.IsZero() {
 			log.Printf("Last ROA change was %v\n", s.updates.lastUpdate.Format("2006-01-02 15:04:05"))
 		}
+		if !s.updates.generated.IsZero() {
+			log.Printf("Upstream ROAs were generated at %v\n", s.updates.generated.Format("2006-01-02 15:04:05"))
+		}
+		if !s.updates.valid.IsZero() {
+			log.Printf("Upstream ROAs are valid until %v\n", s.updates.valid.Format("2006-01-02 15:04:05"))
+		}
 
 		var m runtime.MemStats
 		runtime.ReadMemStats(&m)
@@ -217,104 +740,610 @@ func (s *CacheServer) status(ch chan bool) {
 	}
 }
 
+// splitFamilies returns the ROAs with the IPv4 ones first, along with the
+// IPv4 and IPv6 parts of it. Each family keeps its order.
+func splitFamilies(roas []roa) (all, v4, v6 []roa) {
+	all = make([]roa, 0, len(roas))
+	for _, r := range roas {
+		if r.Prefix.IP().Is4() {
+			all = append(all, r)
+		}
+	}
+	n := len(all)
+	for _, r := range roas {
+		if !r.Prefix.IP().Is4() {
+			all = append(all, r)
+		}
+	}
+	return all, all[:n:n], all[n:]
+}
+
 func bToMb(b uint64) uint64 {
 	return b / 1024 / 1024
 }
 
-// close off the listener if existing
+// close off the listeners if existing
 func (s *CacheServer) close() {
-	s.listener.Close()
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	for _, v := range s.views {
+		v.close()
+	}
 }
 
-// start will start the listener as well as accept client and handle each.
+// shutdown stops the background goroutines and closes all client sessions.
+// Each session is given a moment to finish writing any in-flight PDUs before
+// the connection is closed.
+func (s *CacheServer) shutdown() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	for _, v := range s.views {
+		v.shutdown()
+	}
+
+	s.mutex.Lock()
+	s.closing = true
+	for _, c := range s.clients {
+		log.Printf("Closing session to %s\n", c.addr)
+		// Unblock the read so the session ends once it's done writing.
+		c.conn.SetReadDeadline(time.Now())
+	}
+	s.mutex.Unlock()
+
+	if waitFor(&s.sessions, shutdownGrace) {
+		log.Println("All sessions closed")
+	} else {
+		log.Println("Timed out waiting for sessions to finish, closing them")
+		s.mutex.RLock()
+		for _, c := range s.clients {
+			c.conn.Close()
+		}
+		s.mutex.RUnlock()
+	}
+
+	// An update in progress finishes its fetch first.
+	if waitFor(&s.workers, shutdownGrace) {
+		log.Println("All background goroutines stopped")
+	} else {
+		log.Println("Timed out waiting for background goroutines to stop")
+	}
+}
+
+// waitFor waits for wg, returning false if it takes longer than timeout.
+func waitFor(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// background runs f in a goroutine until the server shuts down, which
+// cancels its context and waits for it to return.
+func (s *CacheServer) background(f func(ctx context.Context)) {
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		f(s.ctx)
+	}()
+}
+
+// sleep waits for d, or until woken, returning false if ctx is done first.
+func sleep(ctx context.Context, d time.Duration, wake <-chan struct{}) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	case <-wake:
+		return true
+	}
+}
+
+// refresh has the update goroutine fetch now, rather than at the next
+// scheduled time. Returns false if nothing is being fetched, such as when
+// serving an empty table. A refresh already waiting to start covers this one.
+func (s *CacheServer) refresh() bool {
+	if s.refreshNow == nil {
+		return false
+	}
+	select {
+	case s.refreshNow <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// start will start the listeners as well as accept client and handle each.
+// Returns once all listeners are closed.
 func (s *CacheServer) start() {
+	var wg sync.WaitGroup
+	for _, srv := range append([]*CacheServer{s}, s.views...) {
+		for _, l := range srv.listeners {
+			wg.Add(1)
+			go func(srv *CacheServer, l net.Listener) {
+				defer wg.Done()
+				srv.serve(l)
+			}(srv, l)
+		}
+	}
+	wg.Wait()
+}
+
+// serve accepts clients on a single listener. Returns once the listener is
+// closed, or on an error which isn't temporary. Temporary errors, such as
+// running out of file descriptors, are retried with an increasing delay.
+func (s *CacheServer) serve(l net.Listener) {
+	var delay time.Duration
 	for {
-		conn, err := s.listener.Accept()
+		conn, err := l.Accept()
 		if err != nil {
-			log.Printf("%v\n", err)
+			if errors.Is(err, net.ErrClosed) {
+				log.Println("Listener closed, no longer accepting clients")
+				return
+			}
+			if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+				log.Printf("Unable to accept on %s, no longer accepting clients: %v\n", l.Addr(), err)
+				return
+			}
+			if delay == 0 {
+				delay = minAcceptDelay
+			} else if delay *= 2; delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			log.Printf("Accept error: %v; retrying in %v\n", err, delay)
+			time.Sleep(delay)
 			continue
 		}
+		delay = 0
 
-		client := s.accept(conn)
-		go s.handleClient(client)
+		// Waiting for a PROXY header mustn't hold up other connections.
+		if s.proxyProtocol && l.Addr().Network() != "unix" {
+			go s.admit(conn)
+			continue
+		}
+		s.admit(conn)
 	}
 }
 
-// accept adds a new client to the current list of clients being served.
-func (s *CacheServer) accept(conn net.Conn) *client {
-	log.Printf("Connection from %v, total clients: %d\n",
-		conn.RemoteAddr().String(), len(s.clients)+1)
+// admit adds a connection as a client and starts serving it, or closes it if
+// it's not accepted.
+func (s *CacheServer) admit(conn net.Conn) {
+	// The PROXY header can take up to proxyHeaderTimeout to arrive, so it's
+	// read before accept takes the lock.
+	if err := readProxy(conn); err != nil {
+		logWith(levelWarn, logFields{"client": conn.RemoteAddr().String()}, "Rejecting connection from %s: %v", conn.RemoteAddr().String(), err)
+		conn.Close()
+		return
+	}
+	c, err := s.accept(conn)
+	if err != nil {
+		// No report is sent: the router hasn't sent a PDU yet, so there's no
+		// version to answer at, and a v2 report would confuse a v0 or v1 router.
+		logWith(levelWarn, logFields{"client": conn.RemoteAddr().String()}, "Rejecting connection from %s: %v", conn.RemoteAddr().String(), err)
+		conn.Close()
+		return
+	}
+	go s.handleClient(c)
+}
 
+// accept adds a new client to the current list of clients being served, and
+// counts its session, which handleClient ends. Connections which are not
+// allowed return an error and are not added.
+func (s *CacheServer) accept(conn net.Conn) (*client, error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	if s.closing {
+		return nil, errors.New("shutting down")
+	}
+	log.Printf("Connection from %v, total clients: %d\n",
+		conn.RemoteAddr().String(), len(s.clients)+1)
 
-	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	addr := conn.RemoteAddr().String()
+	var clientIP netaddr.IP
+	if path, ok := unixAddr(conn); ok {
+		// File permissions on the socket decide who can connect, not the allowed list.
+		addr = unixPrefix + path
+	} else {
+		ip, _, _ := net.SplitHostPort(addr)
+		clientIP, _ = netaddr.ParseIP(ip)
+		if !s.isAllowed(ip) {
+			return nil, fmt.Errorf("%s is not in the allowed list", ip)
+		}
+		if s.limiter != nil && !s.limiter.allow(ip, time.Now()) {
+			return nil, fmt.Errorf("%s is connecting too often, limit is %d a minute", ip, s.config.connectRate)
+		}
+	}
+	if s.maxClients > 0 && len(s.clients) >= s.maxClients {
+		return nil, fmt.Errorf("too many clients, limit is %d", s.maxClients)
+	}
 
 	// Each client will have a pointer to a load of the server's data.
 	client := &client{
-		conn:   conn,
-		addr:   ip,
-		roas:   &s.roas,
-		serial: &s.serial,
-		mutex:  s.mutex,
-		diff:   &s.diff,
+		conn:    conn,
+		addr:    addr,
+		session: s.session,
+		roas:    &s.roas,
+		keys:    &s.keys,
+		aspas:   &s.aspas,
+		serial:  &s.serial,
+		mutex:   s.mutex,
+		history: &s.history,
+		timers:  &s.timers,
+		timeout: s.readTimeout,
+
+		overrides: &s.timerOverrides,
+		ip:        clientIP,
+		fullSyncs: s.fullSyncs,
+		responses: s.responses,
+	}
+
+	if s.maxSession > 0 {
+		client.ends = time.Now().Add(s.maxSession)
 	}
 
 	s.clients = append(s.clients, client)
+	s.sessions.Add(1)
+
+	return client, nil
+}
 
-	return client
+// unixAddr returns the socket path if the connection is over a Unix socket.
+// The client end has no address, so the listening path is used.
+func unixAddr(conn net.Conn) (string, bool) {
+	if conn.LocalAddr().Network() != "unix" {
+		return "", false
+	}
+	return conn.LocalAddr().String(), true
+}
+
+// isAllowed checks the address against the allowed prefixes.
+// An empty list allows everyone.
+func (s *CacheServer) isAllowed(addr string) bool {
+	if len(s.allowed) == 0 {
+		return true
+	}
+	ip, err := netaddr.ParseIP(addr)
+	if err != nil {
+		return false
+	}
+	for _, p := range s.allowed {
+		if p.Contains(ip.Unmap()) {
+			return true
+		}
+	}
+	return false
 }
 
 // remove removes a client from the current list of clients being served.
-func (s *CacheServer) remove(c *client) {
+// The reason is why the session ended, and only used for logging.
+func (s *CacheServer) remove(c *client, reason string) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	log.Printf("Removing client %s\n", c.conn.RemoteAddr().String())
+	logWith(levelInfo, logFields{"client": c.addr, "reason": reason}, "Removing client %s: %s", c.conn.RemoteAddr().String(), reason)
 
-	// remove the connection from client array
+	// remove the connection from client array. A new slice is made, as copies
+	// of the old one may still be being iterated without the lock.
 	for i, check := range s.clients {
 		if check == c {
-			s.clients = append(s.clients[:i], s.clients[i+1:]...)
+			s.clients = append(s.clients[:i:i], s.clients[i+1:]...)
+			break
+		}
+	}
+}
+
+// checkShrink returns an error if the new set of ROAs is empty, or is more
+// than maxShrink percent smaller than the old set. A download cut short can
+// still parse, so this also catches truncated sets. Both count as shrinking.
+func checkShrink(old, new, maxShrink int) error {
+	if new == 0 {
+		return &updateError{category: shrinkError, err: fmt.Errorf("refusing to replace %d ROAs with an empty set", old)}
+	}
+	if old > 0 && (old-new)*100 > old*maxShrink {
+		return &updateError{category: shrinkError, err: fmt.Errorf("refusing to shrink from %d to %d ROAs, which is more than %d%%", old, new, maxShrink)}
+	}
+	return nil
+}
+
+// reload applies the allowed prefixes, the cache urls, and intervals, including
+// any overridden for prefixes, from a new config. New urls are used from the
+// next update, which keeps the existing ROAs if they fail. Other
+// changes need a restart, so are only logged. Existing sessions are kept, even
+// if no longer allowed.
+func (s *CacheServer) reload(cfg config) {
+	s.mutex.Lock()
+	old := s.config
+	s.allowed = cfg.allowed
+	s.timers = cfg.timers
+	s.timerOverrides = cfg.timerOverrides
+	s.urls = cfg.urls
+	s.config.allowed = cfg.allowed
+	s.config.urls = cfg.urls
+	s.config.timers = cfg.timers
+	s.config.timerOverrides = cfg.timerOverrides
+	s.config.logLevel = cfg.logLevel
+	s.mutex.Unlock()
+	for _, v := range s.views {
+		v.mutex.Lock()
+		v.allowed = cfg.allowed
+		v.timers = cfg.timers
+		v.timerOverrides = cfg.timerOverrides
+		v.mutex.Unlock()
+	}
+
+	log.Printf("Reloaded config, %d allowed prefixes and intervals refresh %d, retry %d, expire %d, overridden for %d prefixes\n",
+		len(cfg.allowed), cfg.timers.refresh, cfg.timers.retry, cfg.timers.expire, len(cfg.timerOverrides))
+	if !reflect.DeepEqual(old.urls, cfg.urls) {
+		log.Printf("cacheurl changed to %s, used from the next update\n", strings.Join(cfg.urls, ","))
+	}
+	if old.logLevel != cfg.logLevel {
+		setLogLevel(cfg.logLevel)
+		log.Printf("loglevel changed to %s\n", cfg.logLevel)
+	}
+	for _, name := range restartNeeded(old, cfg) {
+		logWith(levelWarn, logFields{"setting": name}, "%s changed, but needs a restart to apply", name)
+	}
+}
+
+// keepalive sends a Serial Notify to every client each refresh interval.
+func (s *CacheServer) keepalive(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(s.timers.refresh) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.notifyAll(true)
+			for _, v := range s.views {
+				v.notifyAll(true)
+			}
 		}
 	}
 }
 
+// notifier keeps Serial Notifies to one per notify interval.
+// keepalive is set when a held back notify is for every client.
+type notifier struct {
+	mu        sync.Mutex
+	last      time.Time
+	pending   bool
+	keepalive bool
+}
+
+// notifyAll sends the current serial to every client which is behind, at most
+// once every notifyInterval. A notify any sooner is held back until the
+// interval is up, and then sends the serial as it is by then, so quick updates
+// get one notify. A keepalive notifies clients which are up to date as well.
+func (s *CacheServer) notifyAll(keepalive bool) {
+	s.notifier.mu.Lock()
+	s.notifier.keepalive = s.notifier.keepalive || keepalive
+	if s.notifier.pending {
+		s.notifier.mu.Unlock()
+		return
+	}
+	if wait := time.Until(s.notifier.last.Add(s.notifyInterval)); wait > 0 {
+		s.notifier.pending = true
+		s.notifier.mu.Unlock()
+		log.Printf("Holding back notify for %v\n", wait.Round(time.Millisecond))
+		time.AfterFunc(wait, func() {
+			s.notifier.mu.Lock()
+			s.notifier.pending = false
+			s.notifier.mu.Unlock()
+			s.notifyAll(false)
+		})
+		return
+	}
+	keepalive = s.notifier.keepalive
+	s.notifier.keepalive = false
+	s.notifier.last = time.Now()
+	s.notifier.mu.Unlock()
+	s.sendNotifies(keepalive)
+}
+
+// sendNotifies sends the current serial to every client which hasn't been
+// sent it, or every client for a keepalive. Clients are notified at once, so a
+// stuck router only delays its own notify, and its session is closed.
+// The clients are copied under the lock, as they can connect and disconnect
+// while notifies are sent. One removed since is sent a notify which fails.
+func (s *CacheServer) sendNotifies(keepalive bool) {
+	s.mutex.RLock()
+	serial, session := s.serial, s.session
+	var clients []*client
+	for _, c := range s.clients {
+		if keepalive || !c.sent || c.sentSerial != serial {
+			clients = append(clients, c)
+		}
+	}
+	s.mutex.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		logWith(levelDebug, logFields{"client": c.addr, "serial": serial}, "sending a notify to %s", c.addr)
+		wg.Add(1)
+		go func(c *client) {
+			defer wg.Done()
+			c.notifyOrClose(serial, session, false)
+		}(c)
+	}
+	wg.Wait()
+}
+
+// refreshWait is how long to wait before the next fetch. With adaptive
+// refresh, that's refreshMargin after the data is valid until. The fixed
+// refreshROA is used otherwise, or when valid is unknown or already past.
+func (s *CacheServer) refreshWait(valid, now time.Time) time.Duration {
+	if !s.adaptiveRefresh || valid.IsZero() || !valid.After(now) {
+		return refreshROA
+	}
+	return valid.Sub(now) + refreshMargin
+}
+
+// firstWait is how long to wait before the first fetch after startup. That's
+// the usual refresh, or the retry interval when started from a snapshot, unless
+// firstRefresh is sooner.
+func (s *CacheServer) firstWait(now time.Time) time.Duration {
+	wait := s.refreshWait(s.updates.valid, now)
+	if s.updates.lastSuccess.IsZero() {
+		// Started from a snapshot, so try for fresh ROAs sooner.
+		wait = time.Duration(s.timers.retry) * time.Second
+	}
+	// Corrections pushed upstream just after startup are picked up soon.
+	if s.firstRefresh > 0 && s.firstRefresh < wait {
+		wait = s.firstRefresh
+	}
+	return wait
+}
+
 // updateROAs will update the server struct with the current list of ROAs
-func (s *CacheServer) updateROAs(ch chan bool) {
+// After a failed update it will try again after the retry interval instead.
+// Fetching, parsing, and diffing are done without the lock, which is only held
+// to swap in the result. This goroutine is the only one changing the ROAs,
+// keys, ASPAs, and serial, so it can read them without the lock.
+func (s *CacheServer) updateROAs(ctx context.Context, ch chan bool) {
+	wait := s.firstWait(time.Now())
 	for {
-		time.Sleep(refreshROA)
-		s.mutex.Lock()
-		s.updates.lastCheck = time.Now()
+		if !sleep(ctx, wait, s.refreshNow) {
+			return
+		}
+		check := time.Now()
 
-		roas, err := readROAs(s.urls)
+		// The urls can be changed by a reload.
+		s.mutex.RLock()
+		urls := s.urls
+		s.mutex.RUnlock()
+		data, err := readROAsWithFallback(urls, s.fallbacks, s.filter, s.slurm, s.etags)
+		took := time.Since(check)
+		if err == nil {
+			// A validator hiccup could otherwise withdraw everything from every router.
+			err = checkShrink(len(s.roas), len(data.roas), s.maxShrink)
+		}
 		if err != nil {
-			log.Printf("Unable to update ROAs, so keeping existing ROAs for now: %v\n", err)
+			s.mutex.Lock()
+			logWith(levelError, logFields{"serial": s.serial, "error": err.Error()}, "Unable to update ROAs, so keeping existing ROAs for now: %v", err)
+			s.updates.lastCheck = check
 			s.updates.lastError = time.Now()
+			s.updates.lastErrorMsg = err.Error()
+			s.counters.failed(errorCategory(err))
+			wait = time.Duration(s.timers.retry) * time.Second
 			s.mutex.Unlock()
-			log.Println("will send true over the channel")
-			ch <- true
+			logWith(levelDebug, nil, "will send true over the channel")
+			select {
+			case ch <- true:
+			case <-ctx.Done():
+				return
+			}
 			continue
 		}
 
-		// Calculate diffs
-		s.diff = makeDiff(roas, s.roas, s.serial)
-		if s.diff.diff {
-			s.updates.lastUpdate = time.Now()
-		}
+		logWith(levelInfo, logFields{"bytes": data.size, "duration": took.Seconds()}, "Fetched %d bytes of json in %v", data.size, took.Round(time.Millisecond))
+		s.mutex.Lock()
+		s.updates.fetchBytes = data.size
+		s.updates.fetchTime = took
+		s.mutex.Unlock()
 
-		// Increment serial and replace
-		s.serial++
-		s.roas = roas
-		log.Printf("roas updated, serial is now %d\n", s.serial)
+		wait = s.refreshWait(data.valid, time.Now())
+		if data.notModified {
+			// Nothing to diff or tell the routers, so the serial stays the same.
+			log.Printf("ROAs not modified, keeping serial %d\n", s.serial)
+			s.mutex.Lock()
+			s.updates.lastCheck = check
+			s.updates.lastSuccess = check
+			s.updates.unchanged++
+			s.updates.changed = false
+			s.mutex.Unlock()
+			continue
+		}
+		if !data.generated.IsZero() {
+			logWith(levelInfo, logFields{"generated": data.generated.Unix()}, "Upstream ROAs were generated at %s", data.generated.Format("2006-01-02 15:04:05"))
+		}
+		if !data.valid.IsZero() {
+			logWith(levelInfo, logFields{"valid": data.valid.Unix()}, "Upstream ROAs are valid until %s", data.valid.Format("2006-01-02 15:04:05"))
+		}
 
-		s.mutex.Unlock()
-		log.Println("will send true over the channel")
-		ch <- true
+		s.apply(data, check)
+		for _, v := range s.views {
+			vd := data
+			vd.roas = v.view.filter(data.roas)
+			v.apply(vd, check)
+		}
+		s.saveSnapshot(data)
+		logWith(levelDebug, nil, "will send true over the channel")
+		select {
+		case ch <- true:
+		case <-ctx.Done():
+			return
+		}
 
 		// Notify all clients that the serial number has been updated.
-		for _, c := range s.clients {
-			log.Printf("sending a notify to %s\n", c.addr)
-			c.notify(s.serial, s.session)
+		s.notifyAll(false)
+		for _, v := range s.views {
+			v.notifyAll(false)
 		}
 	}
 }
+
+// apply diffs data against the current ROAs, router keys, and ASPAs, then
+// replaces them and bumps the serial. The diff is calculated without the lock,
+// which is why only the update goroutine may call it.
+func (s *CacheServer) apply(data rpkiData, check time.Time) {
+	// Calculate diffs, and keep them so clients can update from older serials.
+	diff := makeDiff(data.roas, s.roas, s.serial)
+	diff.addKey, diff.delKey = diffKeys(data.keys, s.keys)
+	diff.addASPA, diff.delASPA = diffASPAs(data.aspas, s.aspas)
+	diff.diff = diff.diff || len(diff.addKey) > 0 || len(diff.delKey) > 0 ||
+		len(diff.addASPA) > 0 || len(diff.delASPA) > 0
+	// A router on a constrained control plane copes better with a full table
+	// it can pace itself than with a huge diff.
+	if changes := len(diff.addRoa) + len(diff.delRoa); s.maxDiff > 0 && changes > s.maxDiff {
+		diff.resetRequired = true
+		logWith(levelWarn, logFields{"serial": diff.newSerial, "changes": changes},
+			"%d ROA changes is over maxdiffbeforereset of %d, so routers will be sent a Cache Reset", changes, s.maxDiff)
+	}
+	roas, roasV4, roasV6 := splitFamilies(data.roas)
+	index := newROAIndex(roas)
+
+	s.mutex.Lock()
+	s.updates.lastCheck = check
+	s.updates.lastSuccess = check
+	s.updates.generated = data.generated
+	s.updates.valid = data.valid
+	s.diff = diff
+	s.history = appendHistory(s.history, diff, s.depth)
+	if diff.diff {
+		s.updates.lastUpdate = time.Now()
+		s.updates.unchanged = 0
+	} else {
+		s.updates.unchanged++
+	}
+	s.updates.changed = diff.diff
+
+	s.counters.updates++
+	s.counters.added += uint64(len(diff.addRoa))
+	s.counters.deleted += uint64(len(diff.delRoa))
+
+	// Increment serial and replace
+	s.serial++
+	s.roas, s.roasV4, s.roasV6 = roas, roasV4, roasV6
+	s.index = index
+	s.keys = data.keys
+	s.aspas = data.aspas
+	if s.view.name != "" {
+		logWith(levelInfo, logFields{"serial": s.serial, "roas": len(s.roas), "view": s.view.name}, "roas for view %s updated, serial is now %d", s.view.name, s.serial)
+	} else {
+		logWith(levelInfo, logFields{"serial": s.serial, "roas": len(s.roas)}, "roas updated, serial is now %d", s.serial)
+	}
+	s.saveState()
+
+	s.mutex.Unlock()
+}
@@ -0,0 +1,1011 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func TestShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &CacheServer{
+		listeners: []net.Listener{l},
+		mutex:     &sync.RWMutex{},
+	}
+	stopped := make(chan struct{})
+	go func() {
+		s.start()
+		close(stopped)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Wait for the client to be registered.
+	for i := 0; i < 100; i++ {
+		s.mutex.RLock()
+		n := len(s.clients)
+		s.mutex.RUnlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s.close()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("start did not return after the listener was closed")
+	}
+	s.shutdown()
+
+	// The client should see its session closed.
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Wanted EOF on client connection, got %v", err)
+	}
+	if len(s.clients) != 0 {
+		t.Errorf("Wanted no clients after shutdown, got %d", len(s.clients))
+	}
+
+	// A connection still being admitted isn't accepted once shutting down.
+	late, lateRouter := net.Pipe()
+	defer late.Close()
+	defer lateRouter.Close()
+	if _, err := s.accept(late); err == nil {
+		t.Errorf("Wanted a client refused after shutdown")
+	}
+}
+
+func TestShutdownBackground(t *testing.T) {
+	s := &CacheServer{
+		mutex:          &sync.RWMutex{},
+		statusInterval: time.Hour,
+		timers:         intervals{refresh: 3600},
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	ch := make(chan bool)
+	s.background(func(ctx context.Context) { s.status(ctx, ch) })
+	s.background(func(ctx context.Context) { s.updateROAs(ctx, ch) })
+	s.background(s.keepalive)
+
+	start := time.Now()
+	s.shutdown()
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("Shutdown took %v, wanted the background goroutines to stop straight away", took)
+	}
+	if !waitFor(&s.workers, 100*time.Millisecond) {
+		t.Errorf("Background goroutines still running after shutdown")
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	s := &CacheServer{
+		mutex:      &sync.RWMutex{},
+		urls:       []string{"data/int.json"},
+		filter:     roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6},
+		maxShrink:  defaultMaxShrink,
+		depth:      defaultHistory,
+		timers:     intervals{refresh: 3600, retry: 600, expire: 7200},
+		etags:      newETagCache(),
+		refreshNow: make(chan struct{}, 1),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	defer s.shutdown()
+	ch := make(chan bool)
+	s.background(func(ctx context.Context) { s.updateROAs(ctx, ch) })
+
+	// The first fetch is otherwise the retry interval away. A second refresh
+	// while one is waiting is covered by the first.
+	if !s.refresh() || !s.refresh() {
+		t.Fatal("Refresh not taken with updates running")
+	}
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("No update after a refresh")
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.serial != 1 || len(s.roas) == 0 {
+		t.Errorf("Got serial %d with %d ROAs, Want serial 1 with the ROAs fetched", s.serial, len(s.roas))
+	}
+
+	if (&CacheServer{}).refresh() {
+		t.Error("Refresh taken without updates running")
+	}
+}
+
+func TestViews(t *testing.T) {
+	s := &CacheServer{
+		mutex:      &sync.RWMutex{},
+		urls:       []string{"data/int.json"},
+		filter:     roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6},
+		maxShrink:  defaultMaxShrink,
+		depth:      defaultHistory,
+		timers:     intervals{refresh: 3600, retry: 600, expire: 7200},
+		etags:      newETagCache(),
+		refreshNow: make(chan struct{}, 1),
+		network:    "tcp",
+	}
+	view := s.newView(roaView{name: "ripe", rirs: map[rir]bool{ripe: true}})
+	s.views = append(s.views, view)
+	view.listen("127.0.0.1", 0)
+	go s.start()
+	defer s.close()
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	defer s.shutdown()
+	ch := make(chan bool)
+	s.background(func(ctx context.Context) { s.updateROAs(ctx, ch) })
+
+	s.refresh()
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("No update after a refresh")
+	}
+	s.mutex.RLock()
+	var want []roa
+	for _, r := range s.roas {
+		if r.RIR == ripe {
+			// Routers aren't sent the RIR.
+			r.RIR = unknownRIR
+			want = append(want, r)
+		}
+	}
+	all := len(s.roas)
+	s.mutex.RUnlock()
+	if len(want) == 0 || len(want) == all {
+		t.Fatalf("Got %d RIPE ROAs out of %d, Want some but not all", len(want), all)
+	}
+
+	// The view is updated along with the full table, with only its ROAs.
+	// Version 0 isn't sent the router keys, which aren't filtered.
+	router := dialRTR(t, view.listeners[0].Addr().String(), version0)
+	defer router.conn.Close()
+	if err := router.resetQuery(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := router.readResponse()
+	if err != nil {
+		t.Fatalf("Unable to read the view's table: %v", err)
+	}
+	if got.serial != 1 || !sameROAs(got.announced, want) {
+		t.Errorf("Got serial %d with %d ROAs from the view, Want serial 1 with the %d RIPE ROAs", got.serial, len(got.announced), len(want))
+	}
+}
+
+// selfSignedCert returns a throwaway certificate for 127.0.0.1.
+func selfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+}
+
+func TestTLSListener(t *testing.T) {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{selfSignedCert(t)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &CacheServer{
+		listeners: []net.Listener{l},
+		mutex:     &sync.RWMutex{},
+		session:   123,
+	}
+	go s.start()
+	defer s.close()
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// A reset query should get a cache response for our session.
+	conn.Write([]byte{0x01, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x08})
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	pdu, err := getPDU(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0x01, cacheResponse, 0x00, 0x7b, 0x00, 0x00, 0x00, 0x08}
+	if !bytes.Equal(pdu, want) {
+		t.Errorf("Got %v, Want %v", pdu, want)
+	}
+}
+
+func TestIsAllowed(t *testing.T) {
+	tests := []struct {
+		desc    string
+		allowed []netaddr.IPPrefix
+		addr    string
+		want    bool
+	}{
+		{
+			desc: "empty list allows all",
+			addr: "192.0.2.1",
+			want: true,
+		},
+		{
+			desc:    "v4 in list",
+			allowed: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("192.0.2.0/24")},
+			addr:    "192.0.2.1",
+			want:    true,
+		},
+		{
+			desc:    "v4 not in list",
+			allowed: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("192.0.2.0/24")},
+			addr:    "198.51.100.1",
+		},
+		{
+			desc:    "v6 in list",
+			allowed: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("192.0.2.0/24"), netaddr.MustParseIPPrefix("2001:db8::/32")},
+			addr:    "2001:db8::1",
+			want:    true,
+		},
+		{
+			desc:    "v4 mapped v6",
+			allowed: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("192.0.2.0/24")},
+			addr:    "::ffff:192.0.2.1",
+			want:    true,
+		},
+		{
+			desc:    "garbage",
+			allowed: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("192.0.2.0/24")},
+			addr:    "router",
+		},
+	}
+	for _, v := range tests {
+		s := &CacheServer{allowed: v.allowed}
+		if got := s.isAllowed(v.addr); got != v.want {
+			t.Errorf("Error on %s. Got %t, Want %t\n", v.desc, got, v.want)
+		}
+	}
+}
+
+func TestCheckShrink(t *testing.T) {
+	tests := []struct {
+		desc      string
+		old       int
+		new       int
+		maxShrink int
+		wantErr   bool
+	}{
+		{
+			desc:      "growing",
+			old:       100,
+			new:       150,
+			maxShrink: 50,
+		},
+		{
+			desc:      "shrinking within threshold",
+			old:       100,
+			new:       50,
+			maxShrink: 50,
+		},
+		{
+			desc:      "shrinking beyond threshold",
+			old:       100,
+			new:       49,
+			maxShrink: 50,
+			wantErr:   true,
+		},
+		{
+			desc:      "empty set",
+			old:       100,
+			maxShrink: 100,
+			wantErr:   true,
+		},
+		{
+			desc:      "no shrinking allowed",
+			old:       100,
+			new:       99,
+			maxShrink: 0,
+			wantErr:   true,
+		},
+		{
+			desc:      "nothing before",
+			new:       1,
+			maxShrink: 0,
+		},
+	}
+	for _, v := range tests {
+		err := checkShrink(v.old, v.new, v.maxShrink)
+		if (err != nil) != v.wantErr {
+			t.Errorf("Error on %s. Got error %v, Want error %t\n", v.desc, err, v.wantErr)
+		}
+		if err != nil && errorCategory(err) != shrinkError {
+			t.Errorf("Error on %s. Got category %s, Want %s", v.desc, errorCategory(err), shrinkError)
+		}
+	}
+}
+
+func TestMaxDiff(t *testing.T) {
+	a := roa{Prefix: netaddr.MustParseIPPrefix("192.0.2.0/24"), MaxMask: 24, ASN: 64496}
+	b := roa{Prefix: netaddr.MustParseIPPrefix("198.51.100.0/24"), MaxMask: 24, ASN: 64497}
+	c := roa{Prefix: netaddr.MustParseIPPrefix("2001:db8::/32"), MaxMask: 48, ASN: 64498}
+	s := &CacheServer{
+		mutex:   &sync.RWMutex{},
+		session: 7,
+		serial:  1,
+		roas:    []roa{a},
+		depth:   defaultHistory,
+		maxDiff: 2,
+	}
+
+	// Adding one and deleting none is within the limit.
+	s.apply(rpkiData{roas: []roa{a, b}}, time.Now())
+	// Deleting two and adding one isn't.
+	s.apply(rpkiData{roas: []roa{c}}, time.Now())
+	s.apply(rpkiData{roas: []roa{c}}, time.Now())
+
+	for _, v := range []struct {
+		serial uint32
+		reset  bool
+	}{
+		{serial: 1, reset: true},
+		{serial: 2, reset: true},
+		{serial: 3},
+	} {
+		diff, why := diffForQuery(s.history, s.session, s.serial, serialQueryPDU{Session: 7, Serial: v.serial})
+		if diff.resetRequired != v.reset {
+			t.Errorf("Got reset required %t from serial %d because %q, Want %t", diff.resetRequired, v.serial, why, v.reset)
+		}
+	}
+}
+
+func TestUnchangedUpdates(t *testing.T) {
+	a := roa{Prefix: netaddr.MustParseIPPrefix("192.0.2.0/24"), MaxMask: 24, ASN: 64496}
+	b := roa{Prefix: netaddr.MustParseIPPrefix("198.51.100.0/24"), MaxMask: 24, ASN: 64497}
+	s := &CacheServer{
+		mutex: &sync.RWMutex{},
+		roas:  []roa{a},
+		depth: defaultHistory,
+	}
+	if s.updates.changed {
+		t.Error("Got the last update changed before any update, Want unchanged")
+	}
+	for i, v := range []struct {
+		roas    []roa
+		want    int
+		changed bool
+	}{
+		{roas: []roa{a}, want: 1},
+		{roas: []roa{a}, want: 2},
+		{roas: []roa{a, b}, want: 0, changed: true},
+		{roas: []roa{a, b}, want: 1},
+	} {
+		s.apply(rpkiData{roas: v.roas}, time.Now())
+		if s.updates.unchanged != v.want {
+			t.Errorf("Got %d unchanged updates after update %d, Want %d", s.updates.unchanged, i+1, v.want)
+		}
+		if s.updates.changed != v.changed {
+			t.Errorf("Got changed %t after update %d, Want %t", s.updates.changed, i+1, v.changed)
+		}
+	}
+}
+
+func TestNotifyAll(t *testing.T) {
+	s := &CacheServer{
+		mutex:   &sync.RWMutex{},
+		session: 1,
+		serial:  2,
+	}
+	server, router := net.Pipe()
+	defer router.Close()
+	quiet, quietRouter := net.Pipe()
+	defer quietRouter.Close()
+	s.clients = []*client{
+		{conn: server, mutex: s.mutex, version: version1, negotiated: true},
+		// Never sent a query, so doesn't get a notify.
+		{conn: quiet, mutex: s.mutex},
+	}
+
+	go s.notifyAll(false)
+
+	router.SetDeadline(time.Now().Add(time.Second))
+	got, err := getPDU(router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0x01, serialNotify, 0x00, 0x01, 0x00, 0x00, 0x00, 0x0c, 0x00, 0x00, 0x00, 0x02}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Got %v, Want %v", got, want)
+	}
+
+	quietRouter.SetDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := quietRouter.Read(make([]byte, 1)); err == nil {
+		t.Errorf("Wanted no notify for a client which hasn't negotiated a version")
+	}
+}
+
+func TestMaxClients(t *testing.T) {
+	s := &CacheServer{
+		mutex:      &sync.RWMutex{},
+		maxClients: 1,
+	}
+	first, firstRouter := net.Pipe()
+	defer first.Close()
+	defer firstRouter.Close()
+	if _, err := s.accept(first); err != nil {
+		t.Fatalf("First client should be accepted, got %v", err)
+	}
+
+	second, secondRouter := net.Pipe()
+	defer second.Close()
+	defer secondRouter.Close()
+	if _, err := s.accept(second); err == nil {
+		t.Fatalf("Wanted the second client to be refused")
+	}
+	if len(s.clients) != 1 {
+		t.Errorf("Wanted 1 client, got %d", len(s.clients))
+	}
+
+	// Unlimited by default.
+	s.maxClients = 0
+	if _, err := s.accept(second); err != nil {
+		t.Errorf("No limit should accept the second client, got %v", err)
+	}
+
+	// A refused router hasn't sent a PDU, so it's closed without a report.
+	s.maxClients = 1
+	third, thirdRouter := net.Pipe()
+	defer thirdRouter.Close()
+	go s.admit(third)
+	thirdRouter.SetDeadline(time.Now().Add(time.Second))
+	if n, err := thirdRouter.Read(make([]byte, 8)); err != io.EOF {
+		t.Errorf("Wanted the refused session closed with nothing sent, got %d bytes and %v", n, err)
+	}
+}
+
+func TestTCPKeepalive(t *testing.T) {
+	for _, period := range []time.Duration{0, 30 * time.Second, -1} {
+		s := &CacheServer{tcpKeepalive: period}
+		if got := s.listenConfig().KeepAlive; got != period {
+			t.Errorf("Got keepalive %v, Want %v", got, period)
+		}
+	}
+}
+
+func TestListenAddr(t *testing.T) {
+	tests := []struct {
+		bind string
+		port int64
+		want string
+	}{
+		{port: 8282, want: ":8282"},
+		{bind: "192.0.2.1", port: 8282, want: "192.0.2.1:8282"},
+		{bind: "2001:db8::1", port: 324, want: "[2001:db8::1]:324"},
+	}
+	for _, v := range tests {
+		if got := listenAddr(v.bind, v.port); got != v.want {
+			t.Errorf("Error on %q. Got %s, Want %s\n", v.bind, got, v.want)
+		}
+	}
+
+	// The admin and gRPC listeners follow bind, but not onto a Unix socket.
+	for bind, want := range map[string]string{
+		"":                           ":8283",
+		"192.0.2.1":                  "192.0.2.1:8283",
+		"unix:/run/rpkirtr/rtr.sock": "localhost:8283",
+	} {
+		if got := serviceAddr(bind, 8283); got != want {
+			t.Errorf("Error on %q. Got %s, Want %s\n", bind, got, want)
+		}
+	}
+
+	// Binds to only the given address.
+	s := &CacheServer{network: "tcp"}
+	s.listen("127.0.0.1", 0)
+	defer s.close()
+	if host, _, _ := net.SplitHostPort(s.listeners[0].Addr().String()); host != "127.0.0.1" {
+		t.Errorf("Wanted to listen on 127.0.0.1, got %s", s.listeners[0].Addr())
+	}
+}
+
+func TestReload(t *testing.T) {
+	old := config{
+		port:    8282,
+		urls:    []string{"a.json"},
+		timers:  intervals{refresh: 3600, retry: 600, expire: 7200},
+		allowed: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("192.0.2.0/24")},
+	}
+	s := &CacheServer{
+		mutex:   &sync.RWMutex{},
+		config:  old,
+		urls:    old.urls,
+		timers:  old.timers,
+		allowed: old.allowed,
+	}
+
+	new := config{
+		port:    8383,
+		urls:    []string{"b.json"},
+		timers:  intervals{refresh: 60, retry: 30, expire: 600},
+		allowed: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("198.51.100.0/24")},
+	}
+	s.reload(new)
+
+	if !reflect.DeepEqual(s.urls, new.urls) {
+		t.Errorf("Got urls %v, Want %v", s.urls, new.urls)
+	}
+
+	if s.timers != new.timers {
+		t.Errorf("Got timers %+v, Want %+v", s.timers, new.timers)
+	}
+	if !s.isAllowed("198.51.100.1") || s.isAllowed("192.0.2.1") {
+		t.Errorf("Got allowed %v, Want %v", s.allowed, new.allowed)
+	}
+	// The port needs a restart, so it should still be what was started with.
+	if s.config.port != old.port {
+		t.Errorf("Got port %d, Want %d", s.config.port, old.port)
+	}
+
+	// The log level applies straight away.
+	var buf bytes.Buffer
+	setLogging(&buf, textLogs, levelInfo)
+	defer setLogging(os.Stderr, textLogs, levelInfo)
+	new.logLevel = levelWarn
+	s.reload(new)
+	log.Printf("dropped")
+	logWith(levelWarn, nil, "kept")
+	if got := buf.String(); strings.Contains(got, "dropped") || !strings.Contains(got, "kept") {
+		t.Errorf("Wanted only warnings logged after reloading loglevel, got %q", got)
+	}
+	if s.config.logLevel != levelWarn {
+		t.Errorf("Got loglevel %s, Want %s", s.config.logLevel, levelWarn)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	empty := filepath.Join(t.TempDir(), "empty.json")
+	if err := os.WriteFile(empty, []byte(`{"roas": []}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	filter := roaFilter{v4: maxMinMaskv4, v6: maxMinMaskv6}
+
+	tests := []struct {
+		desc    string
+		cfg     config
+		want    []string
+		wantErr bool
+	}{
+		{
+			desc: "good json",
+			cfg:  config{urls: []string{"data/int.json"}, filter: filter},
+			want: []string{"ROAs, ", "1 router keys\n", "generated at 2021-10-21 23:33:14\n"},
+		},
+		{
+			desc:    "missing json",
+			cfg:     config{urls: []string{"data/missing.json"}, filter: filter},
+			wantErr: true,
+		},
+		{
+			desc:    "no ROAs",
+			cfg:     config{urls: []string{empty}, filter: filter},
+			wantErr: true,
+		},
+		{
+			desc:    "missing TLS certificate",
+			cfg:     config{urls: []string{"data/int.json"}, filter: filter, tlsCert: "missing.pem", tlsKey: "missing.pem"},
+			wantErr: true,
+		},
+	}
+	for _, v := range tests {
+		var buf bytes.Buffer
+		err := check(v.cfg, &buf)
+		if (err != nil) != v.wantErr {
+			t.Errorf("Error on %s. Got error %v, Want error %t", v.desc, err, v.wantErr)
+			continue
+		}
+		for _, want := range v.want {
+			if !strings.Contains(buf.String(), want) {
+				t.Errorf("Error on %s. Output missing %q. Got:\n%s", v.desc, want, buf.String())
+			}
+		}
+	}
+}
+
+func TestUnixListen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rpkirtr.sock")
+	s := &CacheServer{
+		mutex:   &sync.RWMutex{},
+		allowed: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("192.0.2.0/24")},
+	}
+
+	// A socket left behind should not stop us listening.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	s.listen(unixPrefix+path, 0)
+	router, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+	conn, err := s.listeners[0].Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The allowed list doesn't apply to Unix sockets.
+	c, err := s.accept(conn)
+	if err != nil {
+		t.Fatalf("Unable to accept client: %v", err)
+	}
+	if want := unixPrefix + path; c.addr != want {
+		t.Errorf("Got client address %s, Want %s", c.addr, want)
+	}
+
+	s.close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Wanted socket removed on close, got %v", err)
+	}
+}
+
+func TestRefreshWait(t *testing.T) {
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		desc     string
+		adaptive bool
+		valid    time.Time
+		want     time.Duration
+	}{
+		{
+			desc:  "fixed",
+			valid: now.Add(time.Hour),
+			want:  refreshROA,
+		},
+		{
+			desc:     "adaptive",
+			adaptive: true,
+			valid:    now.Add(time.Hour),
+			want:     time.Hour + refreshMargin,
+		},
+		{
+			desc:     "adaptive without valid",
+			adaptive: true,
+			want:     refreshROA,
+		},
+		{
+			desc:     "adaptive with valid in the past",
+			adaptive: true,
+			valid:    now.Add(-time.Minute),
+			want:     refreshROA,
+		},
+	}
+	for _, v := range tests {
+		s := &CacheServer{adaptiveRefresh: v.adaptive}
+		if got := s.refreshWait(v.valid, now); got != v.want {
+			t.Errorf("Error on %s. Got %v, Want %v", v.desc, got, v.want)
+		}
+	}
+}
+
+func TestFirstWait(t *testing.T) {
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		desc     string
+		first    time.Duration
+		snapshot bool
+		want     time.Duration
+	}{
+		{
+			desc: "usual refresh",
+			want: refreshROA,
+		},
+		{
+			desc:  "first refresh sooner",
+			first: time.Minute,
+			want:  time.Minute,
+		},
+		{
+			desc:  "first refresh later",
+			first: time.Hour,
+			want:  refreshROA,
+		},
+		{
+			desc:     "from a snapshot",
+			snapshot: true,
+			want:     10 * time.Minute,
+		},
+		{
+			desc:     "from a snapshot with first refresh sooner",
+			first:    time.Minute,
+			snapshot: true,
+			want:     time.Minute,
+		},
+	}
+	for _, v := range tests {
+		s := &CacheServer{
+			firstRefresh: v.first,
+			timers:       intervals{refresh: 3600, retry: 600, expire: 7200},
+		}
+		if !v.snapshot {
+			s.updates.lastSuccess = now
+		}
+		if got := s.firstWait(now); got != v.want {
+			t.Errorf("Error on %s. Got %v, Want %v", v.desc, got, v.want)
+		}
+	}
+}
+
+func TestNotifyBehind(t *testing.T) {
+	tests := []struct {
+		desc      string
+		sent      bool
+		serial    uint32
+		keepalive bool
+		want      bool
+	}{
+		{
+			desc: "never sent anything",
+			want: true,
+		},
+		{
+			desc:   "behind",
+			sent:   true,
+			serial: 1,
+			want:   true,
+		},
+		{
+			desc:   "up to date",
+			sent:   true,
+			serial: 2,
+		},
+		{
+			desc:      "up to date keepalive",
+			sent:      true,
+			serial:    2,
+			keepalive: true,
+			want:      true,
+		},
+	}
+	for _, v := range tests {
+		s := &CacheServer{mutex: &sync.RWMutex{}, session: 1, serial: 2}
+		server, router := net.Pipe()
+		s.clients = []*client{{conn: server, mutex: s.mutex, version: version1, negotiated: true, sent: v.sent, sentSerial: v.serial}}
+		go s.sendNotifies(v.keepalive)
+
+		router.SetDeadline(time.Now().Add(100 * time.Millisecond))
+		_, err := getPDU(router)
+		if got := err == nil; got != v.want {
+			t.Errorf("Error on %s. Got notified %t, Want %t: %v", v.desc, got, v.want, err)
+		}
+		router.Close()
+	}
+}
+
+func TestNotifyStuckClient(t *testing.T) {
+	old := writeTimeout
+	writeTimeout = 50 * time.Millisecond
+	defer func() { writeTimeout = old }()
+
+	s := &CacheServer{mutex: &sync.RWMutex{}, session: 1, serial: 2}
+	stuck, stuckRouter := net.Pipe()
+	defer stuckRouter.Close()
+	server, router := net.Pipe()
+	defer router.Close()
+	s.clients = []*client{
+		// Never reads, so the notify times out.
+		{conn: stuck, mutex: s.mutex, version: version1, negotiated: true},
+		{conn: server, mutex: s.mutex, version: version1, negotiated: true},
+	}
+	done := make(chan struct{})
+	go func() {
+		s.sendNotifies(false)
+		close(done)
+	}()
+
+	router.SetDeadline(time.Now().Add(time.Second))
+	if _, err := getPDU(router); err != nil {
+		t.Errorf("Wanted a notify despite the stuck client, got %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Notifying a router which isn't reading did not time out")
+	}
+	if _, err := stuck.Write([]byte{0}); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("Wanted the stuck session closed after the failed notify, got %v", err)
+	}
+}
+
+func TestNotifyInterval(t *testing.T) {
+	s := &CacheServer{
+		mutex:          &sync.RWMutex{},
+		session:        1,
+		serial:         2,
+		notifyInterval: 100 * time.Millisecond,
+	}
+	server, router := net.Pipe()
+	defer router.Close()
+	s.clients = []*client{{conn: server, mutex: s.mutex, version: version1, negotiated: true}}
+
+	setSerial := func(serial uint32) {
+		s.mutex.Lock()
+		s.serial = serial
+		s.mutex.Unlock()
+	}
+
+	// The first notify goes straight away. The next two are within the
+	// interval, so only one is sent once it's up, with the latest serial.
+	go func() {
+		s.notifyAll(false)
+		setSerial(3)
+		s.notifyAll(false)
+		setSerial(4)
+		s.notifyAll(false)
+	}()
+
+	router.SetDeadline(time.Now().Add(time.Second))
+	for _, serial := range []byte{2, 4} {
+		got, err := getPDU(router)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []byte{0x01, serialNotify, 0x00, 0x01, 0x00, 0x00, 0x00, 0x0c, 0x00, 0x00, 0x00, serial}
+		if !bytes.Equal(got, want) {
+			t.Errorf("Got %v, Want %v", got, want)
+		}
+	}
+
+	router.SetDeadline(time.Now().Add(200 * time.Millisecond))
+	if got, err := getPDU(router); err == nil {
+		t.Errorf("Wanted only two notifies, got another: %v", got)
+	}
+}
+
+// failingListener returns each of errs from Accept in turn.
+type failingListener struct {
+	net.Listener
+	errs  []error
+	calls int
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	err := l.errs[l.calls]
+	l.calls++
+	return nil, err
+}
+
+// temporaryError is a net.Error which can be retried.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+func TestServeAcceptErrors(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+
+	tests := []struct {
+		desc  string
+		errs  []error
+		calls int
+	}{
+		{
+			desc:  "closed",
+			errs:  []error{net.ErrClosed},
+			calls: 1,
+		},
+		{
+			desc:  "permanent",
+			errs:  []error{errors.New("broken"), net.ErrClosed},
+			calls: 1,
+		},
+		{
+			desc:  "temporary is retried",
+			errs:  []error{temporaryError{}, temporaryError{}, temporaryError{}, net.ErrClosed},
+			calls: 4,
+		},
+	}
+	for _, v := range tests {
+		s := &CacheServer{mutex: &sync.RWMutex{}}
+		l := &failingListener{Listener: tcp, errs: v.errs}
+		s.serve(l)
+		if l.calls != v.calls {
+			t.Errorf("Error on %s. Got %d calls to Accept, Want %d", v.desc, l.calls, v.calls)
+		}
+	}
+}
+
+func TestRIRString(t *testing.T) {
+	tests := []struct {
+		rir  rir
+		want string
+	}{
+		{rir: afrinic, want: "afrinic"},
+		{rir: apnic, want: "apnic"},
+		{rir: arin, want: "arin"},
+		{rir: lacnic, want: "lacnic"},
+		{rir: ripe, want: "ripe"},
+		{rir: unknownRIR, want: "unknown"},
+		{rir: rir(200), want: "unknown"},
+	}
+	for _, v := range tests {
+		if got := v.rir.String(); got != v.want {
+			t.Errorf("Got %q for RIR %d, Want %q", got, uint8(v.rir), v.want)
+		}
+	}
+}
+
+func TestSplitFamilies(t *testing.T) {
+	a := roa{Prefix: netaddr.MustParseIPPrefix("2001:db8::/32"), MaxMask: 48, ASN: 64496}
+	b := roa{Prefix: netaddr.MustParseIPPrefix("192.0.2.0/24"), MaxMask: 24, ASN: 64497}
+	c := roa{Prefix: netaddr.MustParseIPPrefix("2001:db8:1::/48"), MaxMask: 48, ASN: 64498}
+	d := roa{Prefix: netaddr.MustParseIPPrefix("198.51.100.0/24"), MaxMask: 24, ASN: 64499}
+
+	all, v4, v6 := splitFamilies([]roa{a, b, c, d})
+	tests := []struct {
+		desc string
+		got  []roa
+		want []roa
+	}{
+		{desc: "all", got: all, want: []roa{b, d, a, c}},
+		{desc: "IPv4", got: v4, want: []roa{b, d}},
+		{desc: "IPv6", got: v6, want: []roa{a, c}},
+	}
+	for _, v := range tests {
+		if !reflect.DeepEqual(v.got, v.want) {
+			t.Errorf("Error on %s. Got %v, Want %v", v.desc, v.got, v.want)
+		}
+	}
+	// Appending to the IPv4 part mustn't overwrite the IPv6 part.
+	_ = append(v4, b)
+	if all[2] != a {
+		t.Errorf("Got %v after appending to the IPv4 ROAs, Want %v", all[2], a)
+	}
+}
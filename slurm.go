@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"inet.af/netaddr"
+)
+
+// slurmFile is the json format of a SLURM file.
+// https://datatracker.ietf.org/doc/html/rfc8416
+type slurmFile struct {
+	SlurmVersion            int `json:"slurmVersion"`
+	ValidationOutputFilters struct {
+		PrefixFilters []slurmPrefix `json:"prefixFilters"`
+		BgpsecFilters []slurmBGPsec `json:"bgpsecFilters"`
+	} `json:"validationOutputFilters"`
+	LocallyAddedAssertions struct {
+		PrefixAssertions []slurmPrefix `json:"prefixAssertions"`
+		BgpsecAssertions []slurmBGPsec `json:"bgpsecAssertions"`
+	} `json:"locallyAddedAssertions"`
+}
+
+// slurmPrefix is both a prefix filter and a prefix assertion.
+type slurmPrefix struct {
+	Prefix          string  `json:"prefix"`
+	ASN             *uint32 `json:"asn"`
+	MaxPrefixLength *uint8  `json:"maxPrefixLength"`
+}
+
+// slurmBGPsec is both a BGPsec filter and a BGPsec assertion.
+// The SKI and public key are base64url encoded without padding.
+type slurmBGPsec struct {
+	ASN             *uint32 `json:"asn"`
+	SKI             string  `json:"SKI"`
+	RouterPublicKey string  `json:"routerPublicKey"`
+}
+
+// slurm holds the parsed local filters and assertions.
+type slurm struct {
+	prefixFilters []prefixFilter
+	keyFilters    []keyFilter
+	roas          []roa
+	keys          []bgpsecKey
+}
+
+// prefixFilter matches ROAs by prefix, ASN, or both.
+type prefixFilter struct {
+	prefix    netaddr.IPPrefix
+	hasPrefix bool
+	asn       uint32
+	hasASN    bool
+}
+
+// keyFilter matches router keys by SKI, ASN, or both.
+type keyFilter struct {
+	ski    [20]byte
+	hasSKI bool
+	asn    uint32
+	hasASN bool
+}
+
+// readSLURM loads and checks a SLURM file.
+func readSLURM(path string) (slurm, error) {
+	var sl slurm
+	f, err := os.ReadFile(path)
+	if err != nil {
+		return sl, fmt.Errorf("unable to read SLURM file: %w", err)
+	}
+	var sf slurmFile
+	if err := json.Unmarshal(f, &sf); err != nil {
+		return sl, fmt.Errorf("unable to unmarshal SLURM file %s: %w", path, err)
+	}
+	if sf.SlurmVersion != 1 {
+		return sl, fmt.Errorf("unsupported SLURM version %d in %s", sf.SlurmVersion, path)
+	}
+
+	for _, v := range sf.ValidationOutputFilters.PrefixFilters {
+		var pf prefixFilter
+		if v.Prefix != "" {
+			if pf.prefix, err = parseSLURMPrefix(v.Prefix); err != nil {
+				return sl, err
+			}
+			pf.hasPrefix = true
+		}
+		if v.ASN != nil {
+			pf.asn, pf.hasASN = *v.ASN, true
+		}
+		if !pf.hasPrefix && !pf.hasASN {
+			return sl, fmt.Errorf("SLURM prefix filter needs a prefix or asn")
+		}
+		sl.prefixFilters = append(sl.prefixFilters, pf)
+	}
+
+	for _, v := range sf.ValidationOutputFilters.BgpsecFilters {
+		var kf keyFilter
+		if v.SKI != "" {
+			if kf.ski, err = decodeSLURMSKI(v.SKI); err != nil {
+				return sl, err
+			}
+			kf.hasSKI = true
+		}
+		if v.ASN != nil {
+			kf.asn, kf.hasASN = *v.ASN, true
+		}
+		if !kf.hasSKI && !kf.hasASN {
+			return sl, fmt.Errorf("SLURM BGPsec filter needs a SKI or asn")
+		}
+		sl.keyFilters = append(sl.keyFilters, kf)
+	}
+
+	for _, v := range sf.LocallyAddedAssertions.PrefixAssertions {
+		prefix, err := parseSLURMPrefix(v.Prefix)
+		if err != nil {
+			return sl, err
+		}
+		if v.ASN == nil {
+			return sl, fmt.Errorf("SLURM prefix assertion for %s needs an asn", v.Prefix)
+		}
+		// Without a max length, only the prefix itself is valid.
+		r := roa{
+			Prefix:  prefix,
+			MaxMask: prefix.Bits(),
+			ASN:     *v.ASN,
+		}
+		if v.MaxPrefixLength != nil {
+			r.MaxMask = *v.MaxPrefixLength
+		}
+		if !r.isValid() {
+			return sl, fmt.Errorf("SLURM prefix assertion for %s has invalid maxPrefixLength %d", v.Prefix, r.MaxMask)
+		}
+		sl.roas = append(sl.roas, r)
+	}
+
+	for _, v := range sf.LocallyAddedAssertions.BgpsecAssertions {
+		if v.ASN == nil {
+			return sl, fmt.Errorf("SLURM BGPsec assertion for %s needs an asn", v.SKI)
+		}
+		ski, err := decodeSLURMSKI(v.SKI)
+		if err != nil {
+			return sl, err
+		}
+		pub, err := base64.RawURLEncoding.DecodeString(v.RouterPublicKey)
+		if err != nil || len(pub) == 0 {
+			return sl, fmt.Errorf("SLURM BGPsec assertion for %s has an invalid routerPublicKey", v.SKI)
+		}
+		sl.keys = append(sl.keys, bgpsecKey{
+			SKI:    ski,
+			ASN:    *v.ASN,
+			PubKey: string(pub),
+		})
+	}
+
+	return sl, nil
+}
+
+// parseSLURMPrefix parses a prefix, which can't have host bits set.
+func parseSLURMPrefix(p string) (netaddr.IPPrefix, error) {
+	prefix, err := netaddr.ParseIPPrefix(p)
+	if err != nil {
+		return prefix, fmt.Errorf("invalid SLURM prefix: %w", err)
+	}
+	if prefix != prefix.Masked() {
+		return prefix, fmt.Errorf("SLURM prefix %s has host bits set", p)
+	}
+	return prefix, nil
+}
+
+func decodeSLURMSKI(s string) ([20]byte, error) {
+	var ski [20]byte
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return ski, fmt.Errorf("invalid SLURM SKI %s: %w", s, err)
+	}
+	if len(b) != 20 {
+		return ski, fmt.Errorf("SLURM SKI %s is %d bytes, not 20", s, len(b))
+	}
+	copy(ski[:], b)
+	return ski, nil
+}
+
+// matches checks if a ROA is caught by the filter. A prefix filter catches
+// the prefix and anything more specific.
+func (f prefixFilter) matches(r roa) bool {
+	if f.hasPrefix && !(f.prefix.Contains(r.Prefix.IP()) && r.Prefix.Bits() >= f.prefix.Bits()) {
+		return false
+	}
+	if f.hasASN && f.asn != r.ASN {
+		return false
+	}
+	return true
+}
+
+func (f keyFilter) matches(k bgpsecKey) bool {
+	if f.hasSKI && f.ski != k.SKI {
+		return false
+	}
+	if f.hasASN && f.asn != k.ASN {
+		return false
+	}
+	return true
+}
+
+// apply removes anything caught by the filters, then adds the assertions.
+func (sl slurm) apply(data rpkiData) rpkiData {
+	roas := make([]roa, 0, len(data.roas)+len(sl.roas))
+	var dropped int
+	for _, r := range data.roas {
+		if sl.filtered(r) {
+			dropped++
+			continue
+		}
+		roas = append(roas, r)
+	}
+	roas = append(roas, sl.roas...)
+
+	keys := make([]bgpsecKey, 0, len(data.keys)+len(sl.keys))
+	for _, k := range data.keys {
+		if sl.filteredKey(k) {
+			dropped++
+			continue
+		}
+		keys = append(keys, k)
+	}
+	keys = append(keys, sl.keys...)
+
+	log.Printf("SLURM filtered %d entries and added %d ROAs and %d router keys\n", dropped, len(sl.roas), len(sl.keys))
+	data.roas = GetSetOfValidatedROAs(roas)
+	data.keys = uniqueRouterKeys(keys)
+	return data
+}
+
+func (sl slurm) filtered(r roa) bool {
+	for _, f := range sl.prefixFilters {
+		if f.matches(r) {
+			return true
+		}
+	}
+	return false
+}
+
+func (sl slurm) filteredKey(k bgpsecKey) bool {
+	for _, f := range sl.keyFilters {
+		if f.matches(k) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestReadSLURM(t *testing.T) {
+	sl, err := readSLURM("data/slurm.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sl.prefixFilters) != 3 || len(sl.keyFilters) != 1 || len(sl.roas) != 2 || len(sl.keys) != 1 {
+		t.Fatalf("Got %d prefix filters, %d key filters, %d ROAs, and %d keys. Want 3, 1, 2, and 1",
+			len(sl.prefixFilters), len(sl.keyFilters), len(sl.roas), len(sl.keys))
+	}
+
+	// No maxPrefixLength means only the prefix itself.
+	want := roa{Prefix: netaddr.MustParseIPPrefix("fd00::/8"), MaxMask: 8, ASN: 64513}
+	if sl.roas[1] != want {
+		t.Errorf("Got %+v, Want %+v", sl.roas[1], want)
+	}
+	if sl.keys[0].SKI[0] != 0x01 || sl.keys[0].SKI[19] != 0x14 || sl.keys[0].PubKey != "\xaa\xbb\xcc" {
+		t.Errorf("Router key not decoded correctly, got %+v", sl.keys[0])
+	}
+}
+
+func TestReadSLURMErrors(t *testing.T) {
+	tests := []struct {
+		desc  string
+		slurm string
+	}{
+		{
+			desc:  "wrong version",
+			slurm: `{"slurmVersion": 2}`,
+		},
+		{
+			desc:  "empty prefix filter",
+			slurm: `{"slurmVersion": 1, "validationOutputFilters": {"prefixFilters": [{"comment": "nothing"}]}}`,
+		},
+		{
+			desc:  "host bits set",
+			slurm: `{"slurmVersion": 1, "validationOutputFilters": {"prefixFilters": [{"prefix": "192.0.2.1/24"}]}}`,
+		},
+		{
+			desc:  "assertion without asn",
+			slurm: `{"slurmVersion": 1, "locallyAddedAssertions": {"prefixAssertions": [{"prefix": "192.0.2.0/24"}]}}`,
+		},
+		{
+			desc:  "assertion with bad max length",
+			slurm: `{"slurmVersion": 1, "locallyAddedAssertions": {"prefixAssertions": [{"prefix": "192.0.2.0/24", "asn": 1, "maxPrefixLength": 16}]}}`,
+		},
+		{
+			desc:  "short SKI",
+			slurm: `{"slurmVersion": 1, "validationOutputFilters": {"bgpsecFilters": [{"SKI": "AQID"}]}}`,
+		},
+		{
+			desc:  "not json",
+			slurm: `slurm`,
+		},
+	}
+	for _, v := range tests {
+		file := filepath.Join(t.TempDir(), "slurm.json")
+		if err := os.WriteFile(file, []byte(v.slurm), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readSLURM(file); err == nil {
+			t.Errorf("Error on %s. Wanted an error, but none received", v.desc)
+		}
+	}
+	if _, err := readSLURM("data/missing.json"); err == nil {
+		t.Errorf("Wanted an error reading a missing file, but none received")
+	}
+}
+
+func TestApplySLURM(t *testing.T) {
+	sl, err := readSLURM("data/slurm.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := rpkiData{
+		roas: []roa{
+			{Prefix: netaddr.MustParseIPPrefix("1.0.0.0/24"), MaxMask: 24, ASN: 13335},
+			// Covered by the 1.0.4.0/22 filter, as are more specifics.
+			{Prefix: netaddr.MustParseIPPrefix("1.0.4.0/22"), MaxMask: 22, ASN: 38803},
+			{Prefix: netaddr.MustParseIPPrefix("1.0.5.0/24"), MaxMask: 24, ASN: 38803},
+			// Less specific than the filter, so stays.
+			{Prefix: netaddr.MustParseIPPrefix("1.0.0.0/16"), MaxMask: 24, ASN: 38803},
+			// Caught by the ASN filter.
+			{Prefix: netaddr.MustParseIPPrefix("2c0f:ffe8::/32"), MaxMask: 32, ASN: 37443},
+			// Only caught when both the prefix and ASN match.
+			{Prefix: netaddr.MustParseIPPrefix("2001:678:cdc::/48"), MaxMask: 48, ASN: 210660},
+			{Prefix: netaddr.MustParseIPPrefix("2001:678:cdc::/48"), MaxMask: 48, ASN: 210661},
+			{Prefix: netaddr.MustParseIPPrefix("2001:679::/48"), MaxMask: 48, ASN: 210660},
+		},
+		keys: []bgpsecKey{
+			{SKI: [20]byte{9}, ASN: 64496, PubKey: "a"},
+			{SKI: [20]byte{8}, ASN: 64497, PubKey: "b"},
+		},
+	}
+
+	got := sl.apply(data)
+	want := []roa{
+		{Prefix: netaddr.MustParseIPPrefix("1.0.0.0/24"), MaxMask: 24, ASN: 13335},
+		{Prefix: netaddr.MustParseIPPrefix("1.0.0.0/16"), MaxMask: 24, ASN: 38803},
+		{Prefix: netaddr.MustParseIPPrefix("2001:678:cdc::/48"), MaxMask: 48, ASN: 210661},
+		{Prefix: netaddr.MustParseIPPrefix("2001:679::/48"), MaxMask: 48, ASN: 210660},
+		{Prefix: netaddr.MustParseIPPrefix("10.0.0.0/8"), MaxMask: 24, ASN: 64512},
+		{Prefix: netaddr.MustParseIPPrefix("fd00::/8"), MaxMask: 8, ASN: 64513},
+	}
+	if !sameROAs(got.roas, want) {
+		t.Errorf("Got %v, Want %v", got.roas, want)
+	}
+	if len(got.keys) != 2 || got.keys[0].ASN != 64497 || got.keys[1].ASN != 64512 {
+		t.Errorf("Got keys %+v, Wanted ASN 64497 kept and 64512 added", got.keys)
+	}
+}
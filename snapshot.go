@@ -0,0 +1,116 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshot is the last set of ROAs, router keys, and ASPAs fetched, saved so
+// they can be served if nothing can be fetched at startup.
+type snapshot struct {
+	Saved time.Time     `json:"saved"`
+	ROAs  []roa         `json:"roas"`
+	Keys  []snapshotKey `json:"keys"`
+	ASPAs []aspa        `json:"aspas"`
+}
+
+// snapshotKey is a router key as saved. The public key is binary, so it's
+// kept as bytes to be base64 encoded, rather than a string.
+type snapshotKey struct {
+	SKI    [20]byte `json:"ski"`
+	ASN    uint32   `json:"asn"`
+	PubKey []byte   `json:"pubkey"`
+}
+
+// readSnapshot loads the data saved by writeSnapshot, returning when it was saved.
+// Snapshots saved before they were compressed are read as well.
+func readSnapshot(file string) (rpkiData, time.Time, error) {
+	f, err := os.ReadFile(file)
+	if err != nil {
+		return rpkiData{}, time.Time{}, err
+	}
+	if f, err = gunzip(f, false); err != nil {
+		return rpkiData{}, time.Time{}, fmt.Errorf("unable to read snapshot %s: %w", file, err)
+	}
+	var snap snapshot
+	if err := json.Unmarshal(f, &snap); err != nil {
+		return rpkiData{}, time.Time{}, fmt.Errorf("unable to unmarshal snapshot: %w", err)
+	}
+	if len(snap.ROAs) == 0 {
+		return rpkiData{}, time.Time{}, fmt.Errorf("snapshot %s has no ROAs", file)
+	}
+	data := rpkiData{
+		roas:  snap.ROAs,
+		keys:  make([]bgpsecKey, 0, len(snap.Keys)),
+		aspas: snap.ASPAs,
+	}
+	for _, k := range snap.Keys {
+		data.keys = append(data.keys, bgpsecKey{SKI: k.SKI, ASN: k.ASN, PubKey: string(k.PubKey)})
+	}
+	return data, snap.Saved, nil
+}
+
+// writeSnapshot saves the data as gzipped json, as it's the size of the whole
+// table. It replaces the old snapshot whole, so a crash part way through
+// doesn't leave half a snapshot to start from.
+func writeSnapshot(file string, data rpkiData, saved time.Time) error {
+	snap := snapshot{
+		Saved: saved,
+		ROAs:  data.roas,
+		Keys:  make([]snapshotKey, 0, len(data.keys)),
+		ASPAs: data.aspas,
+	}
+	for _, k := range data.keys {
+		snap.Keys = append(snap.Keys, snapshotKey{SKI: k.SKI, ASN: k.ASN, PubKey: []byte(k.PubKey)})
+	}
+	f, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	return replaceFile(file, func(w io.Writer) error {
+		zw := gzip.NewWriter(w)
+		if _, err := zw.Write(f); err != nil {
+			return err
+		}
+		return zw.Close()
+	})
+}
+
+// replaceFile writes to a temporary file alongside file, syncs it, then renames
+// it over file, so file is always either the old or the new contents.
+func replaceFile(file string, write func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// saveSnapshot writes the data if a snapshot file is configured. The data is
+// never changed once fetched, so this doesn't need the mutex.
+func (s *CacheServer) saveSnapshot(data rpkiData) {
+	if s.snapshot == "" {
+		return
+	}
+	if err := writeSnapshot(s.snapshot, data, time.Now()); err != nil {
+		log.Printf("Unable to save snapshot to %s: %v\n", s.snapshot, err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func TestSnapshot(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "snapshot.json")
+	want := rpkiData{
+		roas: []roa{
+			{Prefix: netaddr.MustParseIPPrefix("192.0.2.0/24"), MaxMask: 24, ASN: 64496, RIR: ripe},
+			{Prefix: netaddr.MustParseIPPrefix("2001:db8::/32"), MaxMask: 48, ASN: 64497},
+		},
+		// Public keys are binary, which mustn't be mangled.
+		keys:  []bgpsecKey{{SKI: [20]byte{1, 2, 3}, ASN: 64496, PubKey: "\x30\x59\xff\x00"}},
+		aspas: []aspa{{Customer: 64496, Providers: []uint32{64497, 64498}}},
+	}
+	saved := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	if err := writeSnapshot(file, want, saved); err != nil {
+		t.Fatal(err)
+	}
+	got, when, err := readSnapshot(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) || !when.Equal(saved) {
+		t.Errorf("Got %+v saved at %v, Want %+v saved at %v", got, when, want, saved)
+	}
+
+	// Only the snapshot itself is left behind, compressed.
+	if entries, _ := os.ReadDir(filepath.Dir(file)); len(entries) != 1 {
+		t.Errorf("Got %d files after saving, Want only the snapshot", len(entries))
+	}
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(raw, []byte{0x1f, 0x8b}) {
+		t.Errorf("Got a snapshot starting %x, Want it gzipped", raw[:2])
+	}
+
+	// A snapshot saved before they were compressed can still be read.
+	plain, err := gunzip(raw, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := os.WriteFile(old, plain, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got, _, err := readSnapshot(old); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v, %v from an uncompressed snapshot, Want %+v", got, err, want)
+	}
+
+	// A snapshot cut short isn't used.
+	short := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := os.WriteFile(short, raw[:len(raw)/2], 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readSnapshot(short); err == nil {
+		t.Errorf("Wanted an error reading a truncated snapshot, but none received")
+	}
+
+	if _, _, err := readSnapshot(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Errorf("Wanted an error reading a missing snapshot, but none received")
+	}
+	if err := writeSnapshot(file, rpkiData{}, saved); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readSnapshot(file); err == nil {
+		t.Errorf("Wanted an error reading a snapshot without ROAs, but none received")
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// state is persisted across restarts so routers keep the same session.
+type state struct {
+	Session uint16 `json:"session"`
+	Serial  uint32 `json:"serial"`
+}
+
+// readState loads the previously saved session and serial.
+func readState(file string) (state, error) {
+	var st state
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return st, err
+	}
+	if err := json.Unmarshal(data, &st); err != nil {
+		return st, fmt.Errorf("unable to unmarshal state file: %w", err)
+	}
+	return st, nil
+}
+
+// writeState saves the current session and serial. The old state is replaced
+// whole, so a crash while saving can't leave a truncated file to start from.
+func writeState(file string, st state) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return replaceFile(file, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// saveState writes the current session and serial if a state file is configured.
+// Must be called with the mutex held, or before any clients are served.
+func (s *CacheServer) saveState() {
+	if s.state == "" {
+		return
+	}
+	st := state{
+		Session: s.session,
+		Serial:  s.serial,
+	}
+	if err := writeState(s.state, st); err != nil {
+		log.Printf("Unable to save state to %s: %v\n", s.state, err)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestState(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state.json")
+	want := state{
+		Session: 1234,
+		Serial:  5678,
+	}
+	if err := writeState(file, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readState(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("Got %+v, Want %+v\n", got, want)
+	}
+	// Replacing the state leaves no temporary files behind.
+	want.Serial++
+	if err := writeState(file, want); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := readState(file); got != want {
+		t.Errorf("Got %+v after replacing, Want %+v\n", got, want)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(file)); len(entries) != 1 {
+		t.Errorf("Wanted only the state file, got %d files", len(entries))
+	}
+	if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("Wanted the state file only readable by us, got %v", info.Mode())
+	}
+
+	if _, err := readState(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Errorf("Wanted an error reading a missing state file, but none received")
+	}
+
+	if err := os.WriteFile(file, []byte("{not json"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readState(file); err == nil {
+		t.Errorf("Wanted an error reading a corrupt state file, but none received")
+	}
+}
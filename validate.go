@@ -0,0 +1,123 @@
+package main
+
+import (
+	"inet.af/netaddr"
+)
+
+// validationState is the origin validation state of a route.
+// https://datatracker.ietf.org/doc/html/rfc6811#section-2
+type validationState uint8
+
+const (
+	notFound validationState = iota
+	valid
+	invalid
+)
+
+var stateNames = map[validationState]string{
+	notFound: "notfound",
+	valid:    "valid",
+	invalid:  "invalid",
+}
+
+func (v validationState) String() string {
+	return stateNames[v]
+}
+
+// roaIndex is a binary trie of ROAs per address family, so all the ROAs
+// covering a prefix can be found without going through every ROA.
+type roaIndex struct {
+	v4 *trieNode
+	v6 *trieNode
+}
+
+// trieNode holds the ROAs for the prefix made up of the bits on the way to it.
+type trieNode struct {
+	children [2]*trieNode
+	roas     []roa
+}
+
+// newROAIndex builds an index over the given ROAs.
+func newROAIndex(roas []roa) *roaIndex {
+	idx := &roaIndex{
+		v4: &trieNode{},
+		v6: &trieNode{},
+	}
+	for _, r := range roas {
+		node := idx.root(r.Prefix)
+		ip := ipBytes(r.Prefix.IP())
+		for i := 0; i < int(r.Prefix.Bits()); i++ {
+			b := bit(ip, i)
+			if node.children[b] == nil {
+				node.children[b] = &trieNode{}
+			}
+			node = node.children[b]
+		}
+		node.roas = append(node.roas, r)
+	}
+	return idx
+}
+
+func (idx *roaIndex) root(p netaddr.IPPrefix) *trieNode {
+	if p.IP().Is4() {
+		return idx.v4
+	}
+	return idx.v6
+}
+
+// covering returns all ROAs with a prefix covering the given prefix.
+func (idx *roaIndex) covering(p netaddr.IPPrefix) []roa {
+	var roas []roa
+	node := idx.root(p)
+	ip := ipBytes(p.IP())
+	for i := 0; node != nil; i++ {
+		roas = append(roas, node.roas...)
+		if i == int(p.Bits()) {
+			break
+		}
+		node = node.children[bit(ip, i)]
+	}
+	return roas
+}
+
+// validate returns the validation state of a route, along with the ROAs
+// covering it.
+func (idx *roaIndex) validate(p netaddr.IPPrefix, asn uint32) (validationState, []roa) {
+	p = p.Masked()
+	covering := idx.covering(p)
+	if len(covering) == 0 {
+		return notFound, nil
+	}
+	for _, r := range covering {
+		// AS0 ROAs never match a route.
+		if r.ASN != 0 && r.ASN == asn && p.Bits() <= r.MaxMask {
+			return valid, covering
+		}
+	}
+	return invalid, covering
+}
+
+// Validate returns the validation state of a route against the current ROAs.
+func (s *CacheServer) Validate(p netaddr.IPPrefix, asn uint32) (validationState, []roa) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.index == nil {
+		return notFound, nil
+	}
+	return s.index.validate(p, asn)
+}
+
+// ipBytes returns the address as 4 bytes for IPv4 and 16 bytes for IPv6.
+func ipBytes(ip netaddr.IP) []byte {
+	if ip.Is4() {
+		b := ip.As4()
+		return b[:]
+	}
+	b := ip.As16()
+	return b[:]
+}
+
+// bit returns the i-th most significant bit of b.
+func bit(b []byte, i int) int {
+	return int(b[i/8]>>(7-i%8)) & 1
+}
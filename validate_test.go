@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestValidate(t *testing.T) {
+	roas := []roa{
+		{Prefix: netaddr.MustParseIPPrefix("192.0.2.0/24"), MaxMask: 24, ASN: 64496},
+		{Prefix: netaddr.MustParseIPPrefix("198.51.100.0/22"), MaxMask: 24, ASN: 64497},
+		{Prefix: netaddr.MustParseIPPrefix("203.0.113.0/24"), MaxMask: 24, ASN: 0},
+		{Prefix: netaddr.MustParseIPPrefix("2001:db8::/32"), MaxMask: 48, ASN: 64498},
+		{Prefix: netaddr.MustParseIPPrefix("2001:db8::/48"), MaxMask: 48, ASN: 64499},
+	}
+	idx := newROAIndex(roas)
+
+	tests := []struct {
+		desc     string
+		prefix   string
+		asn      uint32
+		want     validationState
+		covering int
+	}{
+		{
+			desc:     "exact match",
+			prefix:   "192.0.2.0/24",
+			asn:      64496,
+			want:     valid,
+			covering: 1,
+		},
+		{
+			desc:     "wrong origin",
+			prefix:   "192.0.2.0/24",
+			asn:      64500,
+			want:     invalid,
+			covering: 1,
+		},
+		{
+			desc:     "more specific within maxLength",
+			prefix:   "198.51.101.0/24",
+			asn:      64497,
+			want:     valid,
+			covering: 1,
+		},
+		{
+			desc:     "more specific than maxLength",
+			prefix:   "192.0.2.0/25",
+			asn:      64496,
+			want:     invalid,
+			covering: 1,
+		},
+		{
+			desc:   "less specific is not covered",
+			prefix: "192.0.0.0/16",
+			asn:    64496,
+			want:   notFound,
+		},
+		{
+			desc:   "no ROA",
+			prefix: "10.0.0.0/8",
+			asn:    64496,
+			want:   notFound,
+		},
+		{
+			desc:     "AS0 never matches",
+			prefix:   "203.0.113.0/24",
+			asn:      0,
+			want:     invalid,
+			covering: 1,
+		},
+		{
+			desc:     "either of two covering ROAs",
+			prefix:   "2001:db8::/48",
+			asn:      64498,
+			want:     valid,
+			covering: 2,
+		},
+		{
+			desc:     "v6 outside the more specific",
+			prefix:   "2001:db8:1::/48",
+			asn:      64499,
+			want:     invalid,
+			covering: 1,
+		},
+		{
+			desc:     "host bits set",
+			prefix:   "192.0.2.1/24",
+			asn:      64496,
+			want:     valid,
+			covering: 1,
+		},
+	}
+	for _, v := range tests {
+		got, covering := idx.validate(netaddr.MustParseIPPrefix(v.prefix), v.asn)
+		if got != v.want {
+			t.Errorf("Error on %s. Got %s, Want %s\n", v.desc, got, v.want)
+		}
+		if len(covering) != v.covering {
+			t.Errorf("Error on %s. Got %d covering ROAs, Want %d\n", v.desc, len(covering), v.covering)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// buildVersion and buildCommit can be set when building, with
+// -ldflags "-X main.buildVersion=v1.2.3 -X main.buildCommit=abc123".
+// Anything not set is taken from the build info Go embeds.
+var (
+	buildVersion string
+	buildCommit  string
+)
+
+// versionInfo identifies the running build.
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	GoVersion string `json:"goversion"`
+}
+
+func (v versionInfo) String() string {
+	return fmt.Sprintf("rpkirtr %s (commit %s, %s)", v.Version, v.Commit, v.GoVersion)
+}
+
+// getVersion returns the version and commit set when building, falling back
+// to the module version and VCS revision, or unknown without either.
+func getVersion() versionInfo {
+	v := versionInfo{
+		Version:   buildVersion,
+		Commit:    buildCommit,
+		GoVersion: runtime.Version(),
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v.Version == "" {
+			v.Version = info.Main.Version
+		}
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" && v.Commit == "" {
+				v.Commit = s.Value
+			}
+		}
+	}
+	if v.Version == "" {
+		v.Version = "unknown"
+	}
+	if v.Commit == "" {
+		v.Commit = "unknown"
+	}
+	return v
+}